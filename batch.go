@@ -0,0 +1,460 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lexoprom/fb2md-cli/fb2md"
+)
+
+// isBatchInput reports whether arg, given after the first input, is
+// another input rather than the output path: a directory, a glob pattern,
+// or a book whose extension is not the one the output gets.
+func isBatchInput(arg string, opts Options) bool {
+	if arg == fb2md.StdoutPath {
+		return false
+	}
+	info, err := os.Stat(arg)
+	if err == nil && info.IsDir() {
+		return true
+	}
+	if err != nil && isGlob(arg) {
+		return true
+	}
+	ext := strings.ToLower(filepath.Ext(arg))
+	return supportedExts[ext] && ext != opts.OutputExt()
+}
+
+// runBatch converts inputs into outputDir as one batch, writes the
+// manifest, index and report and prints the summary.
+func runBatch(inputs []string, outputDir, manifestPath, reportPath, conflictMode string, opts Options) {
+	if outputDir == "" {
+		outputDir = "."
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		fatalf(exitOutputError, "error: cannot create output directory: %v", err)
+	}
+	opts.outputs = newOutputSet(conflictMode)
+	opts.outputs.skipExisting = opts.SkipExisting
+	opts.outputs.newerOnly = opts.NewerOnly
+	// --diff writes no outputs, so there is nothing to resume.
+	if !opts.Diff {
+		resume, done, err := openResume(outputDir, opts.Resume)
+		if err != nil {
+			fatalf(exitStatus(err), "error: %v", err)
+		}
+		opts.resume = resume
+		opts.outputs.resumed = done
+	}
+	if manifestPath != "" || reportPath != "" || opts.Index {
+		opts.manifest = newManifest(manifestPath)
+	}
+	opts.progress = newProgress(opts)
+	started := time.Now()
+	n, err := convertBatch(inputs, outputDir, opts)
+	opts.progress.close()
+	// A batch stopped by --on-conflict error can be resumed.
+	opts.resume.close(err == nil)
+	// The manifest, index and report are written even for a batch that stopped
+	// early.
+	if merr := opts.manifest.write(); merr != nil {
+		log.Printf("warning: %v", merr)
+	}
+	if opts.Index && !opts.Diff {
+		if ierr := writeIndex(outputDir, opts.manifest); ierr != nil {
+			log.Printf("warning: %v", ierr)
+		}
+	}
+	if reportPath != "" {
+		if rerr := writeReport(reportPath, opts.manifest, opts.outputs, started, err); rerr != nil {
+			log.Printf("warning: %v", rerr)
+		}
+	}
+	if err != nil {
+		if n > 0 {
+			fatalf(exitSomeFailed, "error: %v", err)
+		}
+		fatalf(exitAllFailed, "error: %v", err)
+	}
+	summary := os.Stdout
+	if opts.Diff {
+		summary = os.Stderr
+	}
+	failed := len(opts.outputs.failures)
+	if isTerminal(summary) && jsonLog == nil {
+		printSummaryTable(summary, n, opts.outputs, time.Since(started))
+	} else {
+		line := fmt.Sprintf("converted %d file(s)", n)
+		if c := opts.outputs.collisions; c > 0 {
+			line += fmt.Sprintf(", %d output name collision(s) (%s)", c, opts.outputs.mode)
+		}
+		if u := opts.outputs.upToDate; u > 0 {
+			line += fmt.Sprintf(", %d up to date", u)
+		}
+		if failed > 0 {
+			line += fmt.Sprintf(", %d failed", failed)
+		}
+		fmt.Fprintln(summary, line)
+	}
+	fb2md.LogEvent(logger, "batch_done", "converted", n, "up_to_date", opts.outputs.upToDate, "failed", failed, "collisions", opts.outputs.collisions)
+	if opts.stats != nil {
+		fmt.Fprintf(summary, "total: %s\n", opts.stats.total)
+	}
+	switch {
+	case failed > 0 && n == 0:
+		os.Exit(exitAllFailed)
+	case failed > 0:
+		os.Exit(exitSomeFailed)
+	}
+}
+
+// printSummaryTable prints the summary of a batch on a terminal as a table
+// of the books by outcome, followed by the failed books and why.
+func printSummaryTable(w *os.File, converted int, outputs *outputSet, elapsed time.Duration) {
+	row := func(color, label string, count int, note string) {
+		fmt.Fprintf(w, "  %s %6d%s\n", colorize(w, color, fmt.Sprintf("%-12s", label)), count, note)
+	}
+	fmt.Fprintln(w)
+	row(ansiGreen, "converted", converted, "")
+	if u := outputs.upToDate; u > 0 {
+		row(ansiYellow, "up to date", u, "")
+	}
+	if c := outputs.collisions; c > 0 {
+		row(ansiYellow, "collisions", c, " ("+outputs.mode+")")
+	}
+	if f := len(outputs.failures); f > 0 {
+		row(ansiRed, "failed", f, "")
+	}
+	fmt.Fprintf(w, "  %-12s %6s\n", "time", elapsed.Round(time.Millisecond))
+	if len(outputs.failures) > 0 {
+		fmt.Fprintln(w, "\nfailed:")
+		for _, f := range outputs.failures {
+			fmt.Fprintf(w, "  %s\n", colorize(w, ansiRed, f))
+		}
+	}
+}
+
+// convertBatch converts the books of every input into outputDir as one
+// batch: directories, zip and tar archives of books, glob patterns and
+// single books. It returns the number of books converted.
+func convertBatch(inputs []string, outputDir string, opts Options) (int, error) {
+	if opts.progress != nil {
+		opts.progress.setTotal(batchTotal(inputs, opts))
+	}
+	var count int
+	for _, input := range inputs {
+		n, err := convertBatchInput(input, outputDir, opts)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+func convertBatchInput(input, outputDir string, opts Options) (int, error) {
+	if input == "-" || isURL(input) {
+		return 0, fmt.Errorf("%s: stdin and URLs cannot be converted together with other inputs", input)
+	}
+	info, err := os.Stat(input)
+	if err != nil && isGlob(input) {
+		root, matches, err := expandGlob(input)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", input, err)
+		}
+		if len(matches) == 0 {
+			log.Printf("warning: %s: no books match", input)
+		}
+		var count int
+		for _, match := range matches {
+			if !isBook(match) {
+				continue
+			}
+			rel, err := filepath.Rel(root, match)
+			if err != nil {
+				rel = filepath.Base(match)
+			}
+			if excluded(rel, opts.Exclude) {
+				fb2md.LogInfo(logger, "skipped %s: matches --exclude", match)
+				continue
+			}
+			ok, err := convertBatchFile(match, batchOutput(rel, outputDir, opts), opts)
+			if err != nil {
+				return count, err
+			}
+			if ok {
+				count++
+			}
+		}
+		return count, nil
+	}
+
+	switch {
+	case err != nil:
+		// Reported as a failed book.
+	case info.IsDir():
+		return convertDirectory(input, outputDir, opts)
+	case isTarArchive(input):
+		return convertTarArchive(input, outputDir, opts)
+	case pathFormat(input) == "fb2.zip":
+		if library, err := isZipLibrary(input); err == nil && library {
+			return convertZipArchive(input, outputDir, opts)
+		}
+	}
+	ok, err := convertBatchFile(input, batchOutput(filepath.Base(input), outputDir, opts), opts)
+	if ok {
+		return 1, err
+	}
+	return 0, err
+}
+
+// batchOutput returns the output path in outputDir of the book at rel, a
+// path relative to the directory or pattern it was found by.
+func batchOutput(rel, outputDir string, opts Options) string {
+	safeName := strings.ReplaceAll(trimBookExt(rel), string(filepath.Separator), "_")
+	return filepath.Join(outputDir, opts.OutputName(safeName))
+}
+
+// convertBatchFile converts one book of a batch to outPath, recording it
+// in the manifest and progress. A failed book is reported and the batch
+// goes on; err is only returned when --on-conflict error stops it.
+func convertBatchFile(path, outPath string, opts Options) (ok bool, err error) {
+	started := beginBook(path, opts)
+	outPath, err = convertFile(path, outPath, opts)
+	finishBook(path, outPath, started, err, opts)
+	if opts.outputs.stops(err) {
+		return false, fmt.Errorf("%s: %w", path, err)
+	}
+	if err != nil {
+		reportFailed(path, err, opts)
+		return false, nil
+	}
+	reportConverted(path, outPath, opts)
+	return true, nil
+}
+
+// beginBook marks the start of converting the book read from source for
+// the manifest, the progress bar and the JSON log, and returns the time.
+func beginBook(source string, opts Options) time.Time {
+	opts.manifest.begin(source)
+	opts.progress.begin(source)
+	fb2md.LogEvent(logger, "file_started", "source", source)
+	return time.Now()
+}
+
+// finishBook marks the end of converting the book read from source,
+// started at started, to output, with err if it failed.
+func finishBook(source, output string, started time.Time, err error, opts Options) {
+	opts.manifest.finish(output, err)
+	opts.resume.finish(source, err)
+	opts.progress.finish(err)
+	args := []any{"source", source, "status", bookStatus(err), "seconds", roundSeconds(time.Since(started))}
+	if err == nil || errors.Is(err, errUpToDate) {
+		args = append(args, "output", output)
+	} else {
+		args = append(args, "error", err.Error())
+	}
+	fb2md.LogEvent(logger, "file_done", args...)
+}
+
+// detach reads an archive entry into memory under --timeout-per-file: a
+// conversion given up on may still be reading its input, which must then
+// not be the archive the batch reads the next book from.
+func detach(r io.Reader, opts Options) (io.Reader, error) {
+	if opts.TimeoutPerFile <= 0 {
+		return r, nil
+	}
+	data, err := io.ReadAll(r)
+	return bytes.NewReader(data), err
+}
+
+// reportFailed logs why the book read from source was not converted, and
+// counts it as failed unless --on-conflict skipped it; an up-to-date output
+// is only mentioned with --verbose.
+func reportFailed(source string, err error, opts Options) {
+	msg := fmt.Sprintf("%s: %v", source, err)
+	switch {
+	case errors.Is(err, errUpToDate):
+		fb2md.LogInfo(logger, "%s", colorize(os.Stderr, ansiYellow, "skipped "+msg))
+	case errors.Is(err, errOutputConflict):
+		log.Printf("warning: %s", colorize(os.Stderr, ansiYellow, msg))
+	default:
+		if opts.outputs != nil {
+			opts.outputs.failures = append(opts.outputs.failures, msg)
+		}
+		log.Printf("warning: %s", colorize(os.Stderr, ansiRed, msg))
+	}
+}
+
+// batchTotal counts the books of a batch for the progress bar, or returns
+// 0 when a tar stream makes the number unknown.
+func batchTotal(inputs []string, opts Options) int {
+	total := 0
+	for _, input := range inputs {
+		info, err := os.Stat(input)
+		switch {
+		case err != nil && isGlob(input):
+			root, matches, _ := expandGlob(input)
+			for _, match := range matches {
+				if isBook(match) && !globExcluded(root, match, opts) {
+					total++
+				}
+			}
+		case err != nil:
+		case info.IsDir():
+			total += countBooks(input, opts)
+		case isTarArchive(input):
+			return 0
+		case pathFormat(input) == "fb2.zip":
+			if library, _ := isZipLibrary(input); !library {
+				total++
+			} else if reader, err := zip.OpenReader(input); err == nil {
+				for _, f := range zipBookEntries(&reader.Reader) {
+					if !excluded(f.Name, opts.Exclude) {
+						total++
+					}
+				}
+				reader.Close()
+			}
+		default:
+			total++
+		}
+	}
+	return total
+}
+
+// globExcluded reports whether match, found by a glob pattern under root,
+// is left out by --exclude.
+func globExcluded(root, match string, opts Options) bool {
+	rel, err := filepath.Rel(root, match)
+	if err != nil {
+		rel = filepath.Base(match)
+	}
+	return excluded(rel, opts.Exclude)
+}
+
+// countBooks returns the number of books convertDirectory finds under dir.
+func countBooks(dir string, opts Options) int {
+	n := 0
+	walkBooks(dir, opts, false, func(path, rel string) error {
+		n++
+		return nil
+	})
+	return n
+}
+
+// walkBooks calls fn for every book under dir, with its path relative to
+// dir, leaving out directories deeper than --max-depth and what --exclude
+// or --skip-hidden leave out. With --follow-symlinks it walks the
+// directories symlinks point to as well, each real directory once, so that
+// a link cycle or a mirror does not convert the same books again. With
+// report set the skipped files and directories are logged with --verbose
+// and a directory that cannot be read stops the walk.
+func walkBooks(dir string, opts Options, report bool, fn func(path, rel string) error) error {
+	skipped := func(format string, args ...any) {
+		if report {
+			fb2md.LogInfo(logger, format, args...)
+		}
+	}
+	walked := make(map[string]bool)
+	firstVisit := func(path string) bool {
+		real, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return true
+		}
+		if abs, err := filepath.Abs(real); err == nil {
+			real = abs
+		}
+		if walked[real] {
+			return false
+		}
+		walked[real] = true
+		return true
+	}
+	if opts.FollowSymlinks {
+		firstVisit(dir)
+	}
+
+	// walk walks root, a directory found as prefix below dir.
+	var walk func(root, prefix string) error
+	walk = func(root, prefix string) error {
+		return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if report {
+					return err
+				}
+				return nil
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				rel = filepath.Base(path)
+			}
+			rel = filepath.Join(prefix, rel)
+			isDir, link := d.IsDir(), false
+			if d.Type()&fs.ModeSymlink != 0 && opts.FollowSymlinks {
+				if info, err := os.Stat(path); err == nil && info.IsDir() {
+					isDir, link = true, true
+				}
+			}
+			if path == root && isDir {
+				return nil
+			}
+			// SkipDir on a symlink would skip the rest of its directory.
+			skipDir := fs.SkipDir
+			if link {
+				skipDir = nil
+			}
+			if opts.SkipHidden && strings.HasPrefix(d.Name(), ".") {
+				skipped("skipped %s: hidden", path)
+				if isDir {
+					return skipDir
+				}
+				return nil
+			}
+			if isDir {
+				if tooDeep(dir, filepath.Join(dir, rel), opts.MaxDepth) {
+					skipped("skipped %s: deeper than --max-depth %d", path, opts.MaxDepth)
+					return skipDir
+				}
+				if excludedEntry(strings.Split(filepath.ToSlash(rel), "/"), true, opts.Exclude) {
+					skipped("skipped %s: matches --exclude", path)
+					return skipDir
+				}
+				if opts.FollowSymlinks && !firstVisit(path) {
+					skipped("skipped %s: a directory already walked", path)
+					return skipDir
+				}
+				if link {
+					// The trailing separator has WalkDir follow the link.
+					return walk(path+string(filepath.Separator), rel)
+				}
+				return nil
+			}
+			if !isBook(path) {
+				skipped("skipped %s: not a supported book format", path)
+				return nil
+			}
+			if excludedEntry(strings.Split(filepath.ToSlash(rel), "/"), false, opts.Exclude) {
+				skipped("skipped %s: matches --exclude", path)
+				return nil
+			}
+			return fn(path, rel)
+		})
+	}
+	// A directory given as a symlink is walked whatever --follow-symlinks
+	// says, as the user named it.
+	root := dir
+	if info, err := os.Lstat(dir); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		root += string(filepath.Separator)
+	}
+	return walk(root, "")
+}
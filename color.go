@@ -0,0 +1,24 @@
+package main
+
+import "os"
+
+// ANSI escape codes of the colored status output.
+const (
+	ansiGreen  = "\033[32m"
+	ansiYellow = "\033[33m"
+	ansiRed    = "\033[31m"
+	ansiReset  = "\033[0m"
+)
+
+// noColor is set by --no-color or the NO_COLOR environment variable.
+var noColor bool
+
+// colorize returns s in color for writing to f when f is a terminal, and
+// as is otherwise: converted books are shown green, skipped ones yellow and
+// failed ones red.
+func colorize(f *os.File, color, s string) string {
+	if noColor || jsonLog != nil || !isTerminal(f) {
+		return s
+	}
+	return color + s + ansiReset
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// envPrefix starts the environment variables that give the flags their
+// defaults: FB2MD_OUTPUT_DIR for --output-dir, FB2MD_DIALECT for --dialect.
+const envPrefix = "FB2MD_"
+
+// envName returns the environment variable of the flag name.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// envFlag reports whether the flag f is set from the environment; the
+// one-letter shorthands and --version are not.
+func envFlag(f *flag.Flag) bool {
+	return len(f.Name) > 1 && f.Name != "version"
+}
+
+// applyEnv sets the flags of fs from their environment variables. It runs
+// before the command line is parsed, so a flag given there still wins.
+func applyEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || !envFlag(f) {
+			return
+		}
+		name := envName(f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if serr := fs.Set(f.Name, value); serr != nil {
+			err = fmt.Errorf("%s=%q: %w", name, value, serr)
+		}
+	})
+	return err
+}
+
+// warnUnknownEnv warns of the FB2MD_ variables that name no flag of fs, a
+// misspelling that would otherwise go unnoticed.
+func warnUnknownEnv(fs *flag.FlagSet) {
+	known := map[string]bool{}
+	fs.VisitAll(func(f *flag.Flag) {
+		if envFlag(f) {
+			known[envName(f.Name)] = true
+		}
+	})
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, envPrefix) && !known[name] {
+			log.Printf("warning: %s names no flag; ignored", name)
+		}
+	}
+}
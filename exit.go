@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/lexoprom/fb2md-cli/fb2md"
+)
+
+// Exit statuses of a conversion, so that scripts can tell failures apart;
+// "fb2md validate" has its own, see runValidate.
+const (
+	// exitUsage is for bad flags or arguments.
+	exitUsage = 1
+	// exitSomeFailed is for a batch that converted some books but failed
+	// others, or stopped early.
+	exitSomeFailed = 2
+	// exitAllFailed is for a book that could not be converted, or a batch
+	// that converted none of its books.
+	exitAllFailed = 3
+	// exitUnsupportedFormat is for a book in a format fb2md does not read.
+	exitUnsupportedFormat = 4
+	// exitOutputError is for output that could not be written.
+	exitOutputError = 5
+	// exitDRMProtected is for a DRM-protected book fb2md cannot read.
+	exitDRMProtected = 6
+)
+
+// exitStatus returns the exit status of a conversion that failed with err.
+func exitStatus(err error) int {
+	var outErr *fb2md.OutputError
+	switch {
+	case errors.Is(err, fb2md.ErrUnsupportedFormat):
+		return exitUnsupportedFormat
+	case errors.Is(err, fb2md.ErrDRMProtected):
+		return exitDRMProtected
+	case errors.As(err, &outErr):
+		return exitOutputError
+	default:
+		return exitAllFailed
+	}
+}
+
+// limitFlags names the flag that sets each limit a conversion can fail on.
+var limitFlags = []struct {
+	err  error
+	flag string
+}{
+	{fb2md.ErrTooLarge, "--max-file-size"},
+	{fb2md.ErrTimedOut, "--timeout-per-file"},
+	{fb2md.ErrArchiveTooLarge, "--zip-max-size"},
+	{fb2md.ErrTooManyEntries, "--zip-max-entries"},
+}
+
+// flagError adds to err the flag that sets the limit it ran into, if any.
+func flagError(err error) error {
+	for _, limit := range limitFlags {
+		if errors.Is(err, limit.err) {
+			return fmt.Errorf("%w (%s)", err, limit.flag)
+		}
+	}
+	return err
+}
+
+// fatalf logs a message like log.Fatalf and exits with status.
+func fatalf(status int, format string, args ...any) {
+	log.Printf(format, args...)
+	os.Exit(status)
+}
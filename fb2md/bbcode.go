@@ -0,0 +1,359 @@
+package fb2md
+
+import (
+	"fmt"
+	"strings"
+)
+
+// bbcodeRenderer writes a Book as BBCode for forum posts. Footnotes are
+// collected at the end of each post in spoiler tags.
+type bbcodeRenderer struct {
+	ctx           *renderContext
+	book          *Book
+	out           *strings.Builder
+	sectionLevel  int
+	footnoteNum   map[string]int
+	footnoteOrder []string
+	// pending holds the notes referenced since the last flush.
+	pending []string
+}
+
+func (r *bbcodeRenderer) init(book *Book) {
+	r.book = book
+	r.out = &strings.Builder{}
+	r.footnoteNum = make(map[string]int)
+}
+
+func (r *bbcodeRenderer) render(book *Book) []byte {
+	r.init(book)
+	if book.Meta != nil {
+		r.writeMetadata(book.Meta)
+	}
+	r.writeBlocks(book.Body)
+	r.writeFootnotes()
+	return []byte(r.out.String())
+}
+
+// renderSplit writes the metadata as the first post and each chapter as a
+// post of its own, so long books fit forum post limits.
+func (r *bbcodeRenderer) renderSplit(book *Book) [][]byte {
+	r.init(book)
+	var posts [][]byte
+	if book.Meta != nil {
+		r.writeMetadata(book.Meta)
+	}
+	posts = append(posts, []byte(r.out.String()))
+
+	title := ""
+	if book.Meta != nil {
+		title = strings.TrimSpace(book.Meta.Title)
+	}
+	for _, page := range splitPages(book.Body, title) {
+		r.out = &strings.Builder{}
+		r.writeBlocks(page.blocks)
+		r.writeFootnotes()
+		if strings.TrimSpace(r.out.String()) != "" {
+			posts = append(posts, []byte(r.out.String()))
+		}
+	}
+	return posts
+}
+
+func (r *bbcodeRenderer) writeMetadata(meta *Metadata) {
+	if title := strings.TrimSpace(meta.Title); title != "" {
+		r.out.WriteString(fmt.Sprintf("[size=150][b]%s[/b][/size]\n\n", title))
+	}
+	if len(meta.Authors) > 0 {
+		r.out.WriteString(fmt.Sprintf("[b]Authors:[/b] %s\n", strings.Join(meta.AuthorNames(), ", ")))
+	}
+	if len(meta.Genres) > 0 {
+		r.out.WriteString(fmt.Sprintf("[b]Genres:[/b] %s\n", strings.Join(meta.Genres, ", ")))
+	}
+	for _, seq := range meta.Sequences {
+		r.out.WriteString("[b]Series:[/b] " + seq.label() + "\n")
+	}
+	if meta.Date != "" {
+		r.out.WriteString(fmt.Sprintf("[b]Date:[/b] %s\n", meta.Date))
+	}
+	if len(meta.Annotation) > 0 {
+		r.out.WriteString("\n[quote]")
+		r.out.WriteString(strings.TrimSpace(r.blockString(meta.Annotation)))
+		r.out.WriteString("[/quote]\n")
+	}
+	r.out.WriteString("\n[hr]\n\n")
+}
+
+// writeFootnotes writes the notes referenced since the last call, each in
+// a spoiler tag labelled with its number.
+func (r *bbcodeRenderer) writeFootnotes() {
+	// Notes may reference further notes, which are appended as found.
+	for i := 0; i < len(r.pending); i++ {
+		id := r.pending[i]
+		note, ok := r.book.Footnotes[id]
+		if !ok {
+			continue
+		}
+		if i == 0 {
+			r.out.WriteString("\n")
+		}
+		r.out.WriteString(fmt.Sprintf("[spoiler=%d]", r.footnoteNum[id]))
+		r.writeInlines(note.Content)
+		r.out.WriteString("[/spoiler]\n")
+	}
+	r.pending = nil
+}
+
+func (r *bbcodeRenderer) writeBlocks(blocks []Block) {
+	for _, b := range blocks {
+		if r.ctx.opts.guard.err() != nil {
+			return
+		}
+		r.writeBlock(b)
+	}
+}
+
+// blockString renders blocks to a string instead of the output.
+func (r *bbcodeRenderer) blockString(blocks []Block) string {
+	old := r.out
+	r.out = &strings.Builder{}
+	r.writeBlocks(blocks)
+	text := r.out.String()
+	r.out = old
+	return text
+}
+
+func (r *bbcodeRenderer) writeBlock(b Block) {
+	switch n := b.(type) {
+	case *Section:
+		r.sectionLevel++
+		if n.Title != "" {
+			if r.sectionLevel == 1 {
+				r.out.WriteString(fmt.Sprintf("[size=150][b]%s[/b][/size]\n\n", n.Title))
+			} else {
+				r.out.WriteString(fmt.Sprintf("[b]%s[/b]\n\n", n.Title))
+			}
+		}
+		for _, epigraph := range n.Epigraphs {
+			r.writeBlock(epigraph)
+		}
+		r.writeBlocks(n.Annotation)
+		r.writeBlocks(n.Blocks)
+		r.sectionLevel--
+	case *Heading:
+		if n.Level <= 2 {
+			r.out.WriteString(fmt.Sprintf("[size=150][b]%s[/b][/size]\n\n", n.Text))
+		} else {
+			r.out.WriteString(fmt.Sprintf("[b]%s[/b]\n\n", n.Text))
+		}
+	case *BodyTitle:
+		r.out.WriteString(fmt.Sprintf("[size=150][b]%s[/b][/size]\n\n", n.Text))
+	case *Chapter:
+		if text := strings.TrimSpace(r.blockString(n.Blocks)); text != "" {
+			r.out.WriteString(text)
+			r.out.WriteString("\n\n")
+		}
+	case *Paragraph:
+		r.writeInlines(n.Inlines)
+		r.out.WriteString("\n\n")
+	case *Subtitle:
+		r.out.WriteString("[b]")
+		r.writeInlines(n.Inlines)
+		r.out.WriteString("[/b]\n\n")
+	case *Plain:
+		r.writeInlines(n.Inlines)
+	case *TextAuthor:
+		r.out.WriteString("[i]— ")
+		r.writeInlines(n.Inlines)
+		r.out.WriteString("[/i]\n")
+	case *EmptyLine:
+		r.out.WriteString("\n")
+	case *HorizontalRule:
+		r.out.WriteString("[hr]\n\n")
+	case *CodeBlock:
+		r.out.WriteString("[code]" + n.Text + "[/code]\n\n")
+	case *Image:
+		r.writeImage(n)
+		r.out.WriteString("\n\n")
+	case *Epigraph:
+		r.writeQuote(n.Blocks)
+	case *Cite:
+		r.writeQuote(n.Blocks)
+	case *Quote:
+		var lines []string
+		for _, line := range n.Lines {
+			lines = append(lines, strings.TrimSpace(r.inlineString(line)))
+		}
+		r.out.WriteString("[quote]" + strings.Join(lines, "\n") + "[/quote]\n\n")
+	case *Poem:
+		r.writePoem(n)
+	case *Stanza:
+		r.writeStanza(n)
+	case *List:
+		if n.Ordered {
+			r.out.WriteString("[list=1]\n")
+		} else {
+			r.out.WriteString("[list]\n")
+		}
+		for _, item := range n.Items {
+			r.out.WriteString("[*]")
+			r.writeInlines(item)
+			r.out.WriteString("\n")
+		}
+		r.out.WriteString("[/list]\n\n")
+	case *Table:
+		r.writeTable(n)
+	}
+}
+
+func (r *bbcodeRenderer) writeQuote(blocks []Block) {
+	r.out.WriteString("[quote]")
+	r.out.WriteString(strings.TrimSpace(r.blockString(blocks)))
+	r.out.WriteString("[/quote]\n\n")
+}
+
+func (r *bbcodeRenderer) writePoem(poem *Poem) {
+	if poem.Title != "" {
+		r.out.WriteString(fmt.Sprintf("[b]%s[/b]\n\n", poem.Title))
+	}
+	for _, epigraph := range poem.Epigraphs {
+		r.writeBlock(epigraph)
+	}
+	r.writeBlocks(poem.Blocks)
+	for _, author := range poem.Authors {
+		r.out.WriteString("[i]— ")
+		r.writeInlines(author)
+		r.out.WriteString("[/i]\n")
+	}
+	if poem.Date != "" {
+		r.out.WriteString(fmt.Sprintf("[i]%s[/i]\n", poem.Date))
+	}
+	r.out.WriteString("\n")
+}
+
+func (r *bbcodeRenderer) writeStanza(stanza *Stanza) {
+	if stanza.Title != "" {
+		r.out.WriteString(fmt.Sprintf("[b]%s[/b]\n", stanza.Title))
+	}
+	if stanza.Subtitle != nil {
+		r.out.WriteString("[b]")
+		r.writeInlines(stanza.Subtitle)
+		r.out.WriteString("[/b]\n")
+	}
+	for _, line := range stanza.Lines {
+		r.writeInlines(line)
+		r.out.WriteString("\n")
+	}
+	r.out.WriteString("\n")
+}
+
+func (r *bbcodeRenderer) writeTable(table *Table) {
+	if table.Columns == 0 {
+		return
+	}
+	r.out.WriteString("[table]\n")
+	for _, row := range table.Rows {
+		r.out.WriteString("[tr]")
+		for _, cell := range row {
+			tag := "td"
+			if cell.Header {
+				tag = "th"
+			}
+			r.out.WriteString("[" + tag + "]")
+			r.writeInlines(cell.Inlines)
+			r.out.WriteString("[/" + tag + "]")
+		}
+		r.out.WriteString("[/tr]\n")
+	}
+	r.out.WriteString("[/table]\n\n")
+}
+
+func (r *bbcodeRenderer) writeInlines(inlines []Inline) {
+	for _, in := range inlines {
+		switch n := in.(type) {
+		case *Text:
+			r.out.WriteString(n.Value)
+		case *Emphasis:
+			r.writeWrapped("i", n.Children)
+		case *Strong:
+			r.writeWrapped("b", n.Children)
+		case *Strikethrough:
+			r.writeWrapped("s", n.Children)
+		case *Code:
+			r.writeWrapped("code", n.Children)
+		case *Superscript, *Subscript, *Span:
+			r.out.WriteString(plainText([]Inline{n}))
+		case *Link:
+			text := strings.TrimSpace(r.inlineString(n.Children))
+			if !strings.Contains(n.Href, "://") && !strings.HasPrefix(n.Href, "mailto:") {
+				// Anchors and relative links do not survive into forum posts.
+				r.out.WriteString(text)
+				continue
+			}
+			r.out.WriteString(fmt.Sprintf("[url=%s]%s[/url]", n.Href, text))
+		case *NoteRef:
+			num, seen := r.footnoteNum[n.ID]
+			if !seen {
+				r.footnoteOrder = append(r.footnoteOrder, n.ID)
+				num = len(r.footnoteOrder)
+				r.footnoteNum[n.ID] = num
+			}
+			if !containsString(r.pending, n.ID) {
+				r.pending = append(r.pending, n.ID)
+			}
+			r.out.WriteString(fmt.Sprintf("[sup]%d[/sup]", num))
+		case *LineBreak:
+			r.out.WriteString("\n")
+		case *Image:
+			r.writeImage(n)
+		}
+	}
+}
+
+func (r *bbcodeRenderer) writeWrapped(tag string, inlines []Inline) {
+	r.out.WriteString("[" + tag + "]")
+	r.writeInlines(inlines)
+	r.out.WriteString("[/" + tag + "]")
+}
+
+// inlineString renders inlines to a string instead of the output.
+func (r *bbcodeRenderer) inlineString(inlines []Inline) string {
+	old := r.out
+	r.out = &strings.Builder{}
+	r.writeInlines(inlines)
+	text := r.out.String()
+	r.out = old
+	return text
+}
+
+func (r *bbcodeRenderer) writeImage(img *Image) {
+	if img.Media != "" {
+		src := img.Href
+		if img.ID != "" {
+			src, _ = r.ctx.imageLink(img.ID)
+		}
+		if src == "" {
+			r.out.WriteString("[" + img.mediaLabel() + "]")
+		} else {
+			r.out.WriteString(fmt.Sprintf("[url=%s]%s[/url]", src, img.mediaLabel()))
+		}
+		return
+	}
+	if img.ID == "" {
+		r.out.WriteString(fmt.Sprintf("[img]%s[/img]", img.Href))
+		return
+	}
+	if link, ok := r.ctx.imageLink(img.ID); ok {
+		r.out.WriteString(fmt.Sprintf("[img]%s[/img]", link))
+	} else {
+		r.out.WriteString("[" + img.placeholder() + "]")
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
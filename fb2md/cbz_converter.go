@@ -0,0 +1,283 @@
+package fb2md
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+var cbzImageExts = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+	".bmp":  true,
+	".avif": true,
+}
+
+// CbzConverter extracts the pages of a comic book archive and writes a
+// document referencing them in reading order.
+type CbzConverter struct{}
+
+func NewCbzConverter() *CbzConverter {
+	return &CbzConverter{}
+}
+
+// Convert converts a comic archive read from r and writes it to w, as
+// ConvertStream does.
+func (z *CbzConverter) Convert(r io.Reader, w io.Writer, opts Options) error {
+	opts.out = w
+	return z.ConvertReader(r, "", opts)
+}
+
+// ConvertReader converts a comic archive read from r.
+func (z *CbzConverter) ConvertReader(r io.Reader, outputFile string, opts Options) error {
+	reader, err := openZipReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to open CBZ: %w", err)
+	}
+	return z.convertZip(reader, outputFile, opts)
+}
+
+// cbzPages returns the page images of a comic archive in reading order,
+// and its ComicInfo.xml if it has one.
+func cbzPages(reader *zip.Reader) (pages []*zip.File, comicInfo *zip.File, err error) {
+	for _, f := range reader.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if strings.EqualFold(path.Base(f.Name), "ComicInfo.xml") {
+			comicInfo = f
+			continue
+		}
+		if cbzImageExts[strings.ToLower(path.Ext(f.Name))] {
+			pages = append(pages, f)
+		}
+	}
+	if len(pages) == 0 {
+		return nil, nil, fmt.Errorf("no page images found in CBZ")
+	}
+	sort.SliceStable(pages, func(i, j int) bool {
+		return naturalLess(pages[i].Name, pages[j].Name)
+	})
+	return pages, comicInfo, nil
+}
+
+func (z *CbzConverter) convertZip(reader *zip.Reader, outputFile string, opts Options) error {
+	imagesDir := opts.ImagesDir
+	pages, comicInfo, err := cbzPages(reader)
+	if err != nil {
+		return err
+	}
+
+	if imagesDir != "" && opts.Images == nil && !opts.Diff {
+		if err := os.MkdirAll(imagesDir, 0755); err != nil {
+			return &OutputError{fmt.Errorf("failed to create images directory: %w", err)}
+		}
+	}
+
+	book := &Book{}
+	if comicInfo != nil {
+		data, err := readZipFile(comicInfo)
+		if err != nil {
+			LogWarning(opts.Logger, "failed to read ComicInfo.xml: %v", err)
+		} else {
+			book.FrontMatter = comicInfoFrontMatter(data, len(pages), opts.Logger)
+		}
+	}
+
+	used := make(map[string]bool)
+	for i, page := range pages {
+		filename := uniqueFilename(page.Name, used)
+		imagePath := filepath.Join(imagesDir, filename)
+
+		if !opts.Diff {
+			data, err := readZipFile(page)
+			if err != nil {
+				LogWarning(opts.Logger, "failed to read page %s: %v", page.Name, err)
+				continue
+			}
+			if data, err = shrinkImage(data, opts); err != nil {
+				LogWarning(opts.Logger, "failed to resize page %s: %v", page.Name, err)
+				continue
+			}
+			err = opts.guard.run(func() error { return opts.imageFS().WriteFile(filename, data) })
+			switch {
+			case errors.Is(err, ErrTimedOut):
+				return err
+			case err != nil:
+				return &OutputError{fmt.Errorf("failed to write page %s: %w", page.Name, err)}
+			}
+			LogEvent(opts.Logger, "image_written", "path", imagePath, "bytes", len(data))
+		}
+
+		book.Body = append(book.Body, &Image{
+			Href: relativeMarkdownPath(outputFile, imagePath),
+			Alt:  fmt.Sprintf("Page %d", i+1),
+		})
+	}
+
+	// Pages are already written; there are no embedded binaries to extract.
+	opts.ExtractImages = false
+	return writeBook(book, outputFile, opts)
+}
+
+// uniqueFilename derives a safe file name from an archive entry name that
+// does not clash with names already in used.
+func uniqueFilename(name string, used map[string]bool) string {
+	ext := strings.ToLower(path.Ext(name))
+	base := sanitizeFilename(strings.TrimSuffix(path.Base(name), path.Ext(name)))
+	if base == "" {
+		base = "page"
+	}
+
+	filename := base + ext
+	for n := 2; used[filename]; n++ {
+		filename = fmt.Sprintf("%s_%d%s", base, n, ext)
+	}
+	used[filename] = true
+	return filename
+}
+
+// comicInfoFields maps ComicInfo.xml elements to front matter keys, in output order.
+var comicInfoFields = []struct{ elem, key string }{
+	{"Title", "title"},
+	{"Series", "series"},
+	{"Number", "number"},
+	{"Volume", "volume"},
+	{"Writer", "writer"},
+	{"Penciller", "penciller"},
+	{"Inker", "inker"},
+	{"Colorist", "colorist"},
+	{"Letterer", "letterer"},
+	{"CoverArtist", "cover_artist"},
+	{"Editor", "editor"},
+	{"Publisher", "publisher"},
+	{"Imprint", "imprint"},
+	{"Genre", "genre"},
+	{"Tags", "tags"},
+	{"LanguageISO", "language"},
+	{"AgeRating", "age_rating"},
+	{"Web", "web"},
+	{"Summary", "summary"},
+}
+
+// comicInfoFrontMatter returns ComicInfo.xml metadata as front matter fields.
+func comicInfoFrontMatter(data []byte, pageCount int, logger *slog.Logger) []MetaField {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		LogWarning(logger, "failed to parse ComicInfo.xml: %v", err)
+		return nil
+	}
+	info := doc.SelectElement("ComicInfo")
+	if info == nil {
+		return nil
+	}
+
+	var fields []MetaField
+	for _, field := range comicInfoFields {
+		elem := info.SelectElement(field.elem)
+		if elem == nil || strings.TrimSpace(elem.Text()) == "" {
+			continue
+		}
+		fields = append(fields, MetaField{Key: field.key, Value: strings.TrimSpace(elem.Text())})
+	}
+
+	var date []string
+	for _, part := range []string{"Year", "Month", "Day"} {
+		elem := info.SelectElement(part)
+		if elem == nil {
+			break
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(elem.Text()))
+		if err != nil || n <= 0 {
+			break
+		}
+		if part == "Year" {
+			date = append(date, fmt.Sprintf("%04d", n))
+		} else {
+			date = append(date, fmt.Sprintf("%02d", n))
+		}
+	}
+	if len(date) > 0 {
+		fields = append(fields, MetaField{Key: "date", Value: strings.Join(date, "-")})
+	}
+
+	return append(fields, MetaField{Key: "pages", Value: pageCount})
+}
+
+// yamlQuote returns s as a double-quoted YAML scalar.
+func yamlQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// naturalLess compares strings treating runs of digits as numbers, so that
+// page2.jpg sorts before page10.jpg.
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		da, db := leadingDigits(a), leadingDigits(b)
+		if da != "" && db != "" {
+			na := strings.TrimLeft(da, "0")
+			nb := strings.TrimLeft(db, "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			a, b = a[len(da):], b[len(db):]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func leadingDigits(s string) string {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i]
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
@@ -0,0 +1,115 @@
+package fb2md
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// charsetCandidates are the encodings detectCharset chooses between: the
+// Cyrillic code pages FB2 files come in, the Western one, and the Japanese
+// and Chinese ones of translated books.
+var charsetCandidates = []string{"windows-1251", "koi8-r", "ibm866", "x-mac-cyrillic", "iso-8859-5", "windows-1252", "shift_jis", "euc-jp", "gb18030", "big5"}
+
+// charsetPunctuation are the non-ASCII symbols common in book text; other
+// symbols and controls are signs of a wrong guess.
+const charsetPunctuation = "«»„“”‘’‚—–…№°§©® •·"
+
+// charsetCommonHan are the most frequent Chinese characters, simplified and
+// traditional. The Chinese encodings all decode to Han characters; the
+// right one gives common ones.
+const charsetCommonHan = "的一是不了人我在有他这這中大来來上国國个個到说說们們为為子和你地出道也时時年得就那要下以生会會自着著去之过過家学學对對可她里裡后後小么麼心多天而能好都然没沒日于於起还還发發成事只作当當想看文无無开開手十用主行方又如前所本见見经經头頭面公同三已老从從动動两兩长長"
+
+// detectCharset guesses the encoding of text that is not valid UTF-8
+// from how the words read in each candidate: words in one script, lower
+// case after a capital, and few stray symbols. ok is false when no
+// candidate reads as text, or the best one is not clearly ahead.
+func detectCharset(data []byte) (name string, ok bool) {
+	best, second := -1<<31, -1<<31
+	for _, candidate := range charsetCandidates {
+		e, err := LookupEncoding(candidate)
+		if err != nil {
+			continue
+		}
+		decoded, err := e.NewDecoder().Bytes(data)
+		if err != nil {
+			continue
+		}
+		switch score := charsetScore(string(decoded)); {
+		case score > best:
+			name, best, second = candidate, score, best
+		case score > second:
+			second = score
+		}
+	}
+	return name, best > 0 && best-second >= max(best/10, 2)
+}
+
+// charsetScore rates how much text decoded from non-ASCII bytes looks like
+// words. ASCII is the same in every candidate and is left out.
+func charsetScore(text string) int {
+	score := 0
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool { return !unicode.IsLetter(r) }) {
+		score += wordScore(word)
+	}
+	for _, r := range text {
+		switch {
+		case r >= 0xFF66 && r <= 0xFF9F:
+			// Half-width katakana, rare in books, is what KOI8-R text
+			// comes out as in Shift_JIS.
+			score -= 3
+		case r >= utf8.RuneSelf && !unicode.IsLetter(r) && !unicode.IsSpace(r) && !strings.ContainsRune(charsetPunctuation, r) && !isCJKPunctuation(r):
+			score -= 3
+		}
+	}
+	return score
+}
+
+// isCJKPunctuation reports whether r is one of the ideographic and
+// full-width symbols of Chinese and Japanese text.
+func isCJKPunctuation(r rune) bool {
+	return r >= 0x3000 && r <= 0x303F || r == 0x30FB || r >= 0xFF01 && r <= 0xFF65
+}
+
+// wordScore rates a word with non-ASCII letters: a word in one script,
+// capitalized only at the start, counts for its non-ASCII letters; a word
+// mixing scripts or cases counts against. Latin words are expected to be
+// mostly ASCII. Chinese and Japanese scripts, which mix in one word, count
+// as one; kana and common Han characters count twice.
+func wordScore(word string) int {
+	var letters, nonASCII, common, cyrillic, latin, upper, innerUpper int
+	for i, r := range word {
+		letters++
+		if r >= utf8.RuneSelf {
+			nonASCII++
+		}
+		if unicode.Is(unicode.Hiragana, r) || strings.ContainsRune(charsetCommonHan, r) {
+			common++
+		}
+		switch {
+		case unicode.Is(unicode.Cyrillic, r):
+			cyrillic++
+		case unicode.Is(unicode.Latin, r):
+			latin++
+		}
+		if unicode.IsUpper(r) {
+			upper++
+			if i > 0 {
+				innerUpper++
+			}
+		}
+	}
+	if nonASCII == 0 || upper == letters && letters > 1 {
+		// Capitals say little: a lower-case KOI8-R word read as
+		// windows-1251 comes out in capitals.
+		return 0
+	}
+	switch {
+	case cyrillic > 0 && cyrillic != letters,
+		latin > 0 && latin != letters,
+		innerUpper > 0,
+		latin == letters && nonASCII*2 > letters:
+		return -nonASCII
+	}
+	return nonASCII + common
+}
@@ -0,0 +1,168 @@
+package fb2md
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrUnsupportedFormat is returned for a book in a format fb2md does not
+// read.
+var ErrUnsupportedFormat = errors.New("unsupported format")
+
+// OutputError is an error writing the output of a conversion, as opposed
+// to reading the book.
+type OutputError struct {
+	Err error
+}
+
+func (e *OutputError) Error() string { return e.Err.Error() }
+func (e *OutputError) Unwrap() error { return e.Err }
+
+// formatsByExt maps input file extensions to format names accepted by --format.
+var formatsByExt = map[string]string{
+	".fb2":  "fb2",
+	".zip":  "fb2.zip",
+	".fb3":  "fb3",
+	".epub": "epub",
+	".txt":  "txt",
+	".tei":  "tei",
+	".xml":  "tei",
+	".cbz":  "cbz",
+}
+
+// FormatFromExt returns the format of the book at input as its extension
+// tells it, e.g. "fb2.zip" for book.zip.
+func FormatFromExt(input string) string {
+	ext := strings.ToLower(filepath.Ext(input))
+	if format, ok := formatsByExt[ext]; ok {
+		return format
+	}
+	return strings.TrimPrefix(ext, ".")
+}
+
+// Convert converts a book in the given format read from r and writes it
+// to output, or to stdout when output is StdoutPath. The format is one
+// Readable accepts; SniffFormat and FormatFromExt tell it.
+func Convert(r io.Reader, format, output string, opts Options) error {
+	if opts.guard == nil && (opts.MaxFileSize > 0 || opts.TimeoutPerFile > 0) {
+		return convertGuarded(r, format, output, opts)
+	}
+	if opts.out == nil {
+		if err := prepareOutput(output, &opts); err != nil {
+			return err
+		}
+	}
+
+	opts.started = time.Now()
+	defer LogTiming(opts.Logger, "converted "+format+" to "+output, opts.started)
+	switch format {
+	case "fb2":
+		converter := NewConverter()
+		return converter.ConvertReader(r, output, opts)
+	case "fb2.zip", "zip":
+		data, err := readZippedFB2(r)
+		if err != nil {
+			return err
+		}
+		converter := NewConverter()
+		return converter.ConvertData(data, output, opts)
+	case "fb3":
+		converter := NewFb3Converter()
+		return converter.ConvertReader(r, output, opts)
+	case "epub":
+		converter := NewEpubConverter()
+		return converter.ConvertReader(r, output, opts)
+	case "txt":
+		converter := NewTxtConverter()
+		return converter.ConvertReader(r, output, opts)
+	case "tei":
+		converter := NewTeiConverter()
+		return converter.ConvertReader(r, output, opts)
+	case "mobi":
+		return errMOBI
+	case "cbz":
+		// Comic pages are always extracted; they are the content.
+		if opts.ImagesDir == "" && opts.out == nil {
+			opts.ImagesDir = strings.TrimSuffix(output, filepath.Ext(output)) + "_images"
+		}
+		converter := NewCbzConverter()
+		return converter.ConvertReader(r, output, opts)
+	default:
+		return fmt.Errorf("%w: %s", ErrUnsupportedFormat, format)
+	}
+}
+
+// ConvertStream converts a book in the given format read from r and
+// writes it to w, without touching the file system unless opts.Images is
+// left unset: the images it extracts then go to files in opts.ImagesDir.
+// Links to images are relative to ImagesDir, bare names when it is empty.
+// Chapters split with SplitChapters are joined, as on stdout.
+func ConvertStream(r io.Reader, w io.Writer, format string, opts Options) error {
+	opts.out = w
+	return Convert(r, format, "", opts)
+}
+
+// Read reads a book in the given format from r into the document tree
+// without rendering it, for a program to look into or change before
+// Write. output is where the book is meant to go: the pages of a comic,
+// which are its content, are extracted next to it unless opts.Diff is set.
+func Read(r io.Reader, format, output string, opts Options) (*Book, error) {
+	var book *Book
+	opts.collect = func(read *Book) { book = read }
+	if err := Convert(r, format, output, opts); err != nil {
+		return nil, err
+	}
+	if book == nil {
+		return nil, fmt.Errorf("no book was read")
+	}
+	return book, nil
+}
+
+// Write renders book, as Read returns it, and writes it to output as
+// Convert does. book is left as it is, so that it can be written again,
+// e.g. in another format.
+func Write(book *Book, output string, opts Options) error {
+	if err := prepareOutput(output, &opts); err != nil {
+		return err
+	}
+	return writeBook(book.clone(), output, opts)
+}
+
+// Render renders book, as Read returns it, and writes it to w as
+// ConvertStream does.
+func Render(book *Book, w io.Writer, opts Options) error {
+	opts.out = w
+	return writeBook(book.clone(), "", opts)
+}
+
+// prepareOutput checks that the directory of output exists and settles
+// where images go, by the dialect or else next to output.
+func prepareOutput(output string, opts *Options) error {
+	if err := dialectImages(output, opts); err != nil {
+		return err
+	}
+
+	outDir := filepath.Dir(output)
+	if outDir != "." && !opts.Diff {
+		info, err := os.Stat(outDir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return &OutputError{fmt.Errorf("output directory does not exist: %s", outDir)}
+			}
+			return &OutputError{fmt.Errorf("cannot access output directory %s: %w", outDir, err)}
+		}
+		if !info.IsDir() {
+			return &OutputError{fmt.Errorf("output directory is not a directory: %s", outDir)}
+		}
+	}
+
+	if opts.ExtractImages && opts.ImagesDir == "" {
+		opts.ImagesDir = strings.TrimSuffix(output, filepath.Ext(output)) + "_images"
+	}
+	return nil
+}
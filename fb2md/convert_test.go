@@ -0,0 +1,191 @@
+package fb2md_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/lexoprom/fb2md-cli/fb2md"
+)
+
+// pixel is a 1x1 PNG.
+const pixel = "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg=="
+
+const testFB2 = `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+<description><title-info><book-title>Stream Test</book-title></title-info></description>
+<body>
+<section><title><p>One</p></title><p>First<a l:href="#n1" type="note">1</a>.</p><image l:href="#pic.png"/></section>
+<section><title><p>Two</p></title><p>Second.</p></section>
+</body>
+<body name="notes"><section id="n1"><title><p>1</p></title><p>A note.</p></section></body>
+<binary id="pic.png" content-type="image/png">` + pixel + `</binary>
+</FictionBook>`
+
+// testEPUB builds an EPUB of one chapter showing an image.
+func testEPUB(t *testing.T) []byte {
+	t.Helper()
+	png, err := base64.StdEncoding.DecodeString(pixel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"mimetype", []byte("application/epub+zip")},
+		{"META-INF/container.xml", []byte(`<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+<rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`)},
+		{"OEBPS/content.opf", []byte(`<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+<metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:title>Stream EPUB</dc:title><dc:identifier id="id">x</dc:identifier></metadata>
+<manifest>
+<item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+<item id="img" href="images/dot.png" media-type="image/png"/>
+</manifest>
+<spine><itemref idref="ch1"/></spine>
+</package>`)},
+		{"OEBPS/ch1.xhtml", []byte(`<?xml version="1.0" encoding="utf-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Chapter</title></head>
+<body><h1>Chapter</h1><p>Some text.</p><img src="images/dot.png" alt="A dot"/></body></html>`)},
+		{"OEBPS/images/dot.png", png},
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestConvertStreamFB2(t *testing.T) {
+	images := fb2md.MemFS{}
+	var out bytes.Buffer
+	opts := fb2md.Options{ExtractImages: true, ImagesDir: "img", Images: images}
+	if err := fb2md.ConvertStream(strings.NewReader(testFB2), &out, "fb2", opts); err != nil {
+		t.Fatal(err)
+	}
+	md := out.String()
+	for _, want := range []string{"# Stream Test", "## One", "First[^n1].", "[^n1]: A note.", "](img/pic.png)"} {
+		if !strings.Contains(md, want) {
+			t.Errorf("output lacks %q:\n%s", want, md)
+		}
+	}
+	if len(images) != 1 || images["pic.png"] == nil {
+		t.Errorf("images = %v, want pic.png", keys(images))
+	}
+}
+
+func TestConvertStreamEPUB(t *testing.T) {
+	images := fb2md.MemFS{}
+	var out bytes.Buffer
+	opts := fb2md.Options{ExtractImages: true, Images: images}
+	if err := fb2md.ConvertStream(bytes.NewReader(testEPUB(t)), &out, "epub", opts); err != nil {
+		t.Fatal(err)
+	}
+	md := out.String()
+	for _, want := range []string{"# Stream EPUB", "Some text.", "![A dot]("} {
+		if !strings.Contains(md, want) {
+			t.Errorf("output lacks %q:\n%s", want, md)
+		}
+	}
+	if len(images) != 1 {
+		t.Fatalf("images = %v, want one", keys(images))
+	}
+	for name := range images {
+		if !strings.Contains(md, "]("+name+")") {
+			t.Errorf("output does not link %s:\n%s", name, md)
+		}
+	}
+}
+
+func TestConvertStreamSplitChaptersJoined(t *testing.T) {
+	var out bytes.Buffer
+	opts := fb2md.Options{SplitChapters: true, Images: fb2md.MemFS{}}
+	if err := fb2md.ConvertStream(strings.NewReader(testFB2), &out, "fb2", opts); err != nil {
+		t.Fatal(err)
+	}
+	md := out.String()
+	one, two := strings.Index(md, "## One"), strings.Index(md, "## Two")
+	if one < 0 || two < one {
+		t.Errorf("output does not hold both chapters in order:\n%s", md)
+	}
+}
+
+func TestEPUBRoundTrip(t *testing.T) {
+	var epub bytes.Buffer
+	if err := fb2md.ConvertStream(strings.NewReader(testFB2), &epub, "fb2", fb2md.Options{To: "epub"}); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := fb2md.ConvertStream(&epub, &out, "epub", fb2md.Options{Images: fb2md.MemFS{}}); err != nil {
+		t.Fatal(err)
+	}
+	md := out.String()
+	for _, heading := range []string{"One", "Two"} {
+		if n := strings.Count(md, heading); n != 1 {
+			t.Errorf("%q appears %d times, want once:\n%s", heading, n, md)
+		}
+	}
+	if !strings.Contains(md, "\n\nSecond.\n") {
+		t.Errorf("output does not keep the paragraphs of a section apart:\n%s", md)
+	}
+}
+
+func TestConverterReused(t *testing.T) {
+	const plain = `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+<description><title-info><book-title>Plain</book-title></title-info></description>
+<body><section><p>A dangling<a l:href="#n1" type="note">1</a> note.</p></section></body>
+</FictionBook>`
+	c := fb2md.NewConverter()
+	if err := c.Convert(strings.NewReader(testFB2), &bytes.Buffer{}, fb2md.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := c.Convert(strings.NewReader(plain), &out, fb2md.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "A note.") {
+		t.Errorf("the notes of the first book leaked into the second:\n%s", out.String())
+	}
+}
+
+func TestRenderTwice(t *testing.T) {
+	book, err := fb2md.Read(strings.NewReader(testFB2), "fb2", fb2md.StdoutPath, fb2md.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := fb2md.Options{NumberHeadings: true}
+	var first, second bytes.Buffer
+	if err := fb2md.Render(book, &first, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := fb2md.Render(book, &second, opts); err != nil {
+		t.Fatal(err)
+	}
+	if first.String() != second.String() {
+		t.Errorf("second rendering differs:\n%s\nfirst:\n%s", second.String(), first.String())
+	}
+}
+
+func keys(m fb2md.MemFS) []string {
+	var names []string
+	for name := range m {
+		names = append(names, name)
+	}
+	return names
+}
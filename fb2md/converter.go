@@ -0,0 +1,895 @@
+package fb2md
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+// Converter reads FictionBook documents into a Book.
+type Converter struct {
+	doc       *etree.Document
+	opts      Options
+	footnotes map[string]*Footnote
+}
+
+// relativeMarkdownPath returns targetPath as a slash-separated link relative
+// to the directory of outputFile.
+func relativeMarkdownPath(outputFile, targetPath string) string {
+	if targetPath == "" {
+		return ""
+	}
+	if outputFile == "" {
+		return filepath.ToSlash(targetPath)
+	}
+
+	outputDir, err := filepath.Abs(filepath.Dir(outputFile))
+	if err != nil {
+		return filepath.ToSlash(targetPath)
+	}
+	targetAbs, err := filepath.Abs(targetPath)
+	if err != nil {
+		return filepath.ToSlash(targetPath)
+	}
+
+	rel, err := filepath.Rel(outputDir, targetAbs)
+	if err != nil {
+		return filepath.ToSlash(targetPath)
+	}
+	return filepath.ToSlash(rel)
+}
+
+func stripBase64Whitespace(s string) string {
+	if s == "" {
+		return ""
+	}
+
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case ' ', '\n', '\r', '\t':
+			continue
+		default:
+			out = append(out, s[i])
+		}
+	}
+	return string(out)
+}
+
+func sanitizeFilename(name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return ""
+	}
+
+	// Normalize separators and strip any path components.
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = path.Base(name)
+
+	var b strings.Builder
+	b.Grow(len(name))
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z':
+			b.WriteRune(r)
+		case r >= 'A' && r <= 'Z':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == '.' || r == '_' || r == '-':
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+
+	out := strings.Trim(b.String(), "._-")
+	if out == "" || out == "." || out == ".." {
+		return ""
+	}
+	return out
+}
+
+func NewConverter() *Converter {
+	return &Converter{}
+}
+
+// Convert converts an FB2 document read from r and writes it to w, as
+// ConvertStream does.
+func (c *Converter) Convert(r io.Reader, w io.Writer, opts Options) error {
+	opts.out = w
+	return c.ConvertReader(r, "", opts)
+}
+
+// ConvertReader converts an FB2 document read from r.
+func (c *Converter) ConvertReader(r io.Reader, outputFile string, opts Options) error {
+	// Books in a known encoding are decoded as they are parsed; --lenient
+	// needs the text to repair it.
+	if !opts.Lenient {
+		decoded, ok, err := decodeStream(r, opts)
+		if err != nil {
+			return fmt.Errorf("failed to read FB2 file: %w", err)
+		}
+		if ok {
+			doc, err := readXMLStream(decoded)
+			if err != nil {
+				return fmt.Errorf("failed to parse FB2 file: %w (--lenient may recover it)", err)
+			}
+			return c.ConvertDocument(doc, outputFile, opts)
+		}
+		r = decoded
+	}
+
+	// Read everything as bytes for encoding detection
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read FB2 file: %w", err)
+	}
+
+	return c.ConvertData(data, outputFile, opts)
+}
+
+// ConvertData converts raw FB2 bytes (in any supported encoding).
+func (c *Converter) ConvertData(data []byte, outputFile string, opts Options) error {
+	// Detect and convert encoding to UTF-8
+	data, err := detectAndConvertEncoding(data, opts)
+	if err != nil {
+		return fmt.Errorf("encoding conversion failed: %w", err)
+	}
+
+	// Parse FB2 XML
+	doc, recovered, err := parseFB2(data, opts.Lenient, opts.guard)
+	if recovered != "" {
+		LogWarning(opts.Logger, "%s", recovered)
+	}
+	if err != nil {
+		if !opts.Lenient {
+			return fmt.Errorf("failed to parse FB2 file: %w (--lenient may recover it)", err)
+		}
+		return fmt.Errorf("failed to parse FB2 file: %w", err)
+	}
+
+	return c.ConvertDocument(doc, outputFile, opts)
+}
+
+// ConvertDocument renders an already parsed FictionBook document. Readers for
+// other formats build a FictionBook tree and hand it over here.
+func (c *Converter) ConvertDocument(doc *etree.Document, outputFile string, opts Options) error {
+	book, err := c.BuildBook(doc, opts)
+	if err != nil {
+		return err
+	}
+	return writeBook(book, outputFile, opts)
+}
+
+// BuildBook reads a parsed FictionBook document into a Book.
+func (c *Converter) BuildBook(doc *etree.Document, opts Options) (*Book, error) {
+	c.opts = opts
+	c.doc = doc
+	c.footnotes = make(map[string]*Footnote)
+
+	// Find root element
+	root := doc.SelectElement("FictionBook")
+	if root == nil {
+		return nil, fmt.Errorf("invalid FB2 file: FictionBook element not found")
+	}
+
+	book := &Book{Footnotes: c.footnotes}
+
+	// First pass: collect footnotes from notes bodies
+	notesBodies := c.opts.NotesBodies
+	if notesBodies == nil {
+		notesBodies = defaultNotesBodies
+	}
+	var textBodies []*etree.Element
+	for _, body := range root.SelectElements("body") {
+		if !isNotesBody(body, notesBodies) {
+			if includeBody(body, c.opts.IncludeBodies) {
+				textBodies = append(textBodies, body)
+			} else {
+				LogInfo(c.opts.Logger, "left out body %q (--include-bodies)", body.SelectAttrValue("name", ""))
+			}
+			continue
+		}
+		if c.collectFootnotes(body) == 0 && body.FindElement(".//p") != nil && includeBody(body, c.opts.IncludeBodies) {
+			// Kept as text rather than lost, e.g. an afterword named "comments".
+			LogWarning(c.opts.Logger, "body %q has no notes with ids; converting it as text", body.SelectAttrValue("name", ""))
+			textBodies = append(textBodies, body)
+		}
+	}
+
+	// Description (metadata)
+	if desc := root.SelectElement("description"); desc != nil {
+		book.Meta = c.buildMetadata(desc)
+	}
+
+	for _, body := range textBodies {
+		if err := opts.guard.err(); err != nil {
+			return nil, err
+		}
+		book.Body = append(book.Body, c.buildBody(body)...)
+	}
+
+	for _, binary := range root.SelectElements("binary") {
+		book.Binaries = append(book.Binaries, Binary{
+			ID:          binary.SelectAttrValue("id", ""),
+			ContentType: binary.SelectAttrValue("content-type", "image/jpeg"),
+			Data:        binary.Text(),
+		})
+	}
+
+	return book, nil
+}
+
+// defaultNotesBodies are the body names whose sections are footnotes
+// unless --notes-bodies says otherwise.
+var defaultNotesBodies = []string{"notes", "footnotes", "comments"}
+
+// isNotesBody reports whether body is named one of names.
+func isNotesBody(body *etree.Element, names []string) bool {
+	name := body.SelectAttrValue("name", "")
+	return name != "" && containsFold(names, name)
+}
+
+// includeBody reports whether body is one of the bodies --include-bodies
+// selects: "main" is the unnamed body, and nil selects every body.
+func includeBody(body *etree.Element, names []string) bool {
+	if names == nil {
+		return true
+	}
+	name := body.SelectAttrValue("name", "")
+	if name == "" {
+		name = "main"
+	}
+	return containsFold(names, name)
+}
+
+// containsFold reports whether list holds s, ignoring case.
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// collectFootnotes extracts footnote text from notes body sections and
+// returns the number of notes found. It recurses into nested sections
+// since notes can be wrapped in a container section.
+func (c *Converter) collectFootnotes(elem *etree.Element) int {
+	var n int
+	for _, section := range elem.SelectElements("section") {
+		id := section.SelectAttrValue("id", "")
+		if id == "" {
+			// Container section without ID — recurse into it
+			n += c.collectFootnotes(section)
+			continue
+		}
+		var content []Inline
+		for _, child := range section.ChildElements() {
+			var part []Inline
+			switch child.Tag {
+			case "title":
+				// Skip title in footnotes — it's usually just the number
+			case "p":
+				part = c.buildInlines(child)
+			case "section":
+				// Nested sections inside a note — recurse
+				n += c.collectFootnotes(child)
+			default:
+				if text := extractAllText(child); text != "" {
+					part = []Inline{&Text{Value: text}}
+				}
+			}
+			if len(part) == 0 {
+				continue
+			}
+			if len(content) > 0 {
+				content = append(content, &Text{Value: " "})
+			}
+			content = append(content, part...)
+		}
+		if len(content) > 0 {
+			c.footnotes[id] = &Footnote{ID: id, Content: content}
+			n++
+		}
+	}
+	return n
+}
+
+func (c *Converter) buildMetadata(desc *etree.Element) *Metadata {
+	titleInfo := desc.SelectElement("title-info")
+	if titleInfo == nil {
+		return nil
+	}
+
+	meta := c.buildTitleInfo(titleInfo)
+	if srcInfo := desc.SelectElement("src-title-info"); srcInfo != nil {
+		meta.Source = c.buildTitleInfo(srcInfo)
+	}
+
+	if docInfo := desc.SelectElement("document-info"); docInfo != nil {
+		doc := &DocumentInfo{
+			ProgramUsed: childText(docInfo, "program-used"),
+			SrcOCR:      childText(docInfo, "src-ocr"),
+			ID:          childText(docInfo, "id"),
+			Version:     childText(docInfo, "version"),
+		}
+		for _, author := range docInfo.SelectElements("author") {
+			if person := buildPerson(author); person.Name() != "" {
+				doc.Authors = append(doc.Authors, person)
+			}
+		}
+		if date := docInfo.SelectElement("date"); date != nil {
+			doc.Date = strings.TrimSpace(date.Text())
+			doc.DateValue = date.SelectAttrValue("value", "")
+		}
+		for _, url := range docInfo.SelectElements("src-url") {
+			if text := strings.TrimSpace(url.Text()); text != "" {
+				doc.SrcURLs = append(doc.SrcURLs, text)
+			}
+		}
+		for _, publisher := range docInfo.SelectElements("publisher") {
+			if name := buildPerson(publisher).Name(); name != "" {
+				doc.Publishers = append(doc.Publishers, name)
+			} else if text := strings.TrimSpace(publisher.Text()); text != "" {
+				doc.Publishers = append(doc.Publishers, text)
+			}
+		}
+		if history := docInfo.SelectElement("history"); history != nil {
+			doc.History = c.buildBlockContent(history)
+		}
+		meta.Document = doc
+		meta.Identifier = doc.ID
+	}
+
+	for _, info := range desc.SelectElements("custom-info") {
+		if value := strings.TrimSpace(info.Text()); value != "" {
+			meta.CustomInfo = append(meta.CustomInfo, CustomInfo{
+				Type:  strings.TrimSpace(info.SelectAttrValue("info-type", "")),
+				Value: value,
+			})
+		}
+	}
+
+	if pubInfo := desc.SelectElement("publish-info"); pubInfo != nil {
+		meta.Publish = &PublishInfo{
+			BookName:  childText(pubInfo, "book-name"),
+			Publisher: childText(pubInfo, "publisher"),
+			City:      childText(pubInfo, "city"),
+			Year:      childText(pubInfo, "year"),
+			ISBN:      childText(pubInfo, "isbn"),
+			Sequences: buildSequences(pubInfo),
+		}
+	}
+
+	return meta
+}
+
+// buildTitleInfo reads a title-info or src-title-info element.
+func (c *Converter) buildTitleInfo(titleInfo *etree.Element) *Metadata {
+	meta := &Metadata{}
+	if title := titleInfo.SelectElement("book-title"); title != nil {
+		meta.Title = title.Text()
+	}
+
+	for _, author := range titleInfo.SelectElements("author") {
+		if person := buildPerson(author); person.Name() != "" {
+			meta.Authors = append(meta.Authors, person)
+		}
+	}
+
+	for _, translator := range titleInfo.SelectElements("translator") {
+		if person := buildPerson(translator); person.Name() != "" {
+			meta.Translators = append(meta.Translators, person)
+		}
+	}
+
+	for _, genre := range titleInfo.SelectElements("genre") {
+		if text := genre.Text(); text != "" {
+			meta.Genres = append(meta.Genres, text)
+		}
+	}
+
+	meta.Sequences = buildSequences(titleInfo)
+	meta.Keywords = childText(titleInfo, "keywords")
+	meta.SrcLang = childText(titleInfo, "src-lang")
+
+	if annotation := titleInfo.SelectElement("annotation"); annotation != nil {
+		meta.Annotation = c.buildBlockContent(annotation)
+	}
+
+	if date := titleInfo.SelectElement("date"); date != nil {
+		meta.Date = date.Text()
+		meta.DateValue = date.SelectAttrValue("value", "")
+	}
+
+	if lang := titleInfo.SelectElement("lang"); lang != nil {
+		meta.Lang = strings.TrimSpace(lang.Text())
+	}
+
+	if image := titleInfo.FindElement("./coverpage/image"); image != nil {
+		href := image.SelectAttrValue("l:href", "")
+		if href == "" {
+			href = image.SelectAttrValue("href", "")
+		}
+		meta.Cover = strings.TrimPrefix(href, "#")
+	}
+
+	return meta
+}
+
+// buildSequences reads the <sequence> children of elem, with the
+// sequences nested in them.
+func buildSequences(elem *etree.Element) []Sequence {
+	var sequences []Sequence
+	for _, seq := range elem.SelectElements("sequence") {
+		if name := seq.SelectAttrValue("name", ""); name != "" {
+			sequences = append(sequences, Sequence{
+				Name:   name,
+				Number: seq.SelectAttrValue("number", ""),
+				Sub:    buildSequences(seq),
+			})
+		}
+	}
+	return sequences
+}
+
+// childText returns the trimmed text of the named child, or "".
+func childText(elem *etree.Element, tag string) string {
+	if child := elem.SelectElement(tag); child != nil {
+		return strings.TrimSpace(child.Text())
+	}
+	return ""
+}
+
+func buildPerson(elem *etree.Element) Person {
+	var p Person
+	if e := elem.SelectElement("first-name"); e != nil {
+		p.FirstName = strings.TrimSpace(e.Text())
+	}
+	if e := elem.SelectElement("middle-name"); e != nil {
+		p.MiddleName = strings.TrimSpace(e.Text())
+	}
+	if e := elem.SelectElement("last-name"); e != nil {
+		p.LastName = strings.TrimSpace(e.Text())
+	}
+	if e := elem.SelectElement("nickname"); e != nil {
+		p.Nickname = strings.TrimSpace(e.Text())
+	}
+	return p
+}
+
+func (c *Converter) buildBody(body *etree.Element) []Block {
+	var blocks []Block
+	for _, child := range body.ChildElements() {
+		switch child.Tag {
+		case "title":
+			blocks = append(blocks, &BodyTitle{Text: extractAllText(child)})
+		case "epigraph":
+			blocks = append(blocks, c.buildEpigraph(child))
+		case "section":
+			blocks = append(blocks, c.buildSection(child))
+		case "p":
+			blocks = appendBlock(blocks, c.buildTextBlock(child))
+		case "subtitle":
+			blocks = append(blocks, &Subtitle{Inlines: c.buildInlines(child)})
+		case "empty-line":
+			blocks = append(blocks, &EmptyLine{})
+		case "image":
+			blocks = append(blocks, c.buildImage(child))
+		case "poem":
+			blocks = append(blocks, c.buildPoem(child))
+		case "cite":
+			blocks = append(blocks, c.buildCite(child))
+		case "table":
+			blocks = append(blocks, c.buildTable(child))
+		default:
+			blocks = append(blocks, c.buildBlockContent(child)...)
+		}
+	}
+	return blocks
+}
+
+func (c *Converter) buildSection(elem *etree.Element) *Section {
+	section := &Section{ID: elem.SelectAttrValue("id", "")}
+
+	if title := elem.SelectElement("title"); title != nil {
+		section.Title = extractAllText(title)
+	}
+
+	for _, epigraph := range elem.SelectElements("epigraph") {
+		section.Epigraphs = append(section.Epigraphs, c.buildEpigraph(epigraph))
+	}
+
+	if annotation := elem.SelectElement("annotation"); annotation != nil {
+		section.Annotation = c.buildBlockContent(annotation)
+	}
+
+	for _, child := range elem.ChildElements() {
+		switch child.Tag {
+		case "title", "epigraph", "annotation":
+			// Already handled above
+		case "section":
+			section.Blocks = append(section.Blocks, c.buildSection(child))
+		case "p":
+			section.Blocks = appendBlock(section.Blocks, c.buildTextBlock(child))
+		case "subtitle":
+			section.Blocks = append(section.Blocks, &Subtitle{Inlines: c.buildInlines(child)})
+		case "empty-line":
+			section.Blocks = append(section.Blocks, &EmptyLine{})
+		case "image":
+			section.Blocks = append(section.Blocks, c.buildImage(child))
+		case "poem":
+			section.Blocks = append(section.Blocks, c.buildPoem(child))
+		case "cite":
+			section.Blocks = append(section.Blocks, c.buildCite(child))
+		case "table":
+			section.Blocks = append(section.Blocks, c.buildTable(child))
+		default:
+			section.Blocks = append(section.Blocks, c.buildBlockContent(child)...)
+		}
+	}
+
+	return section
+}
+
+func (c *Converter) buildEpigraph(elem *etree.Element) *Epigraph {
+	epigraph := &Epigraph{}
+	for _, child := range elem.ChildElements() {
+		switch child.Tag {
+		case "p":
+			epigraph.Blocks = append(epigraph.Blocks, c.buildParagraph(child))
+		case "poem":
+			epigraph.Blocks = append(epigraph.Blocks, c.buildPoem(child))
+		case "cite":
+			epigraph.Blocks = append(epigraph.Blocks, c.buildCite(child))
+		case "text-author":
+			epigraph.Blocks = append(epigraph.Blocks, &TextAuthor{Inlines: c.buildInlines(child)})
+		case "empty-line":
+			epigraph.Blocks = append(epigraph.Blocks, &EmptyLine{})
+		}
+	}
+	return epigraph
+}
+
+// buildPoem handles <poem> elements with stanzas and verses.
+func (c *Converter) buildPoem(elem *etree.Element) *Poem {
+	poem := &Poem{}
+	if title := elem.SelectElement("title"); title != nil {
+		poem.Title = extractAllText(title)
+	}
+
+	for _, epigraph := range elem.SelectElements("epigraph") {
+		poem.Epigraphs = append(poem.Epigraphs, c.buildEpigraph(epigraph))
+	}
+
+	for _, child := range elem.ChildElements() {
+		switch child.Tag {
+		case "stanza":
+			poem.Blocks = append(poem.Blocks, c.buildStanza(child))
+		case "subtitle":
+			poem.Blocks = append(poem.Blocks, &Subtitle{Inlines: c.buildInlines(child)})
+		}
+	}
+
+	for _, author := range elem.SelectElements("text-author") {
+		poem.Authors = append(poem.Authors, c.buildInlines(author))
+	}
+
+	if date := elem.SelectElement("date"); date != nil {
+		poem.Date = date.Text()
+	}
+
+	return poem
+}
+
+// buildStanza handles <stanza> elements with verse lines.
+func (c *Converter) buildStanza(elem *etree.Element) *Stanza {
+	stanza := &Stanza{}
+	if title := elem.SelectElement("title"); title != nil {
+		stanza.Title = extractAllText(title)
+	}
+	if subtitle := elem.SelectElement("subtitle"); subtitle != nil {
+		stanza.Subtitle = append([]Inline{}, c.buildInlines(subtitle)...)
+	}
+	for _, v := range elem.SelectElements("v") {
+		stanza.Lines = append(stanza.Lines, c.buildInlines(v))
+	}
+	return stanza
+}
+
+// buildCite handles <cite> elements.
+func (c *Converter) buildCite(elem *etree.Element) *Cite {
+	cite := &Cite{}
+	for _, child := range elem.ChildElements() {
+		switch child.Tag {
+		case "p":
+			cite.Blocks = append(cite.Blocks, c.buildParagraph(child))
+		case "poem":
+			cite.Blocks = append(cite.Blocks, c.buildPoem(child))
+		case "subtitle":
+			cite.Blocks = append(cite.Blocks, &Subtitle{Inlines: c.buildInlines(child)})
+		case "empty-line":
+			cite.Blocks = append(cite.Blocks, &EmptyLine{})
+		case "table":
+			cite.Blocks = append(cite.Blocks, c.buildTable(child))
+		case "text-author":
+			cite.Blocks = append(cite.Blocks, &TextAuthor{Inlines: c.buildInlines(child)})
+		}
+	}
+	return cite
+}
+
+// buildTable handles <table> elements. A table without rows has no columns.
+func (c *Converter) buildTable(elem *etree.Element) *Table {
+	table := &Table{}
+	rows := elem.SelectElements("tr")
+	if len(rows) == 0 {
+		return table
+	}
+
+	// Determine column count from first row
+	firstRow := rows[0]
+	cells := firstRow.SelectElements("th")
+	if len(cells) == 0 {
+		cells = firstRow.SelectElements("td")
+	}
+	// Also check mixed th/td
+	if len(cells) == 0 {
+		cells = firstRow.ChildElements()
+	}
+	table.Columns = len(cells)
+
+	// First row is a header when it has <th> elements
+	table.Header = len(firstRow.SelectElements("th")) > 0
+
+	for _, row := range rows {
+		var cells []TableCell
+		for _, cell := range row.ChildElements() {
+			if cell.Tag == "th" || cell.Tag == "td" {
+				cells = append(cells, TableCell{
+					Header:  cell.Tag == "th",
+					Align:   cellAlign(cell),
+					Inlines: c.buildInlines(cell),
+				})
+			}
+		}
+		table.Rows = append(table.Rows, cells)
+	}
+
+	return table
+}
+
+// cellAlign returns the horizontal alignment of a table cell, or "" when it
+// has none or an unknown one.
+func cellAlign(cell *etree.Element) string {
+	switch align := strings.ToLower(strings.TrimSpace(cell.SelectAttrValue("align", ""))); align {
+	case "left", "center", "right":
+		return align
+	}
+	return ""
+}
+
+// buildBlockContent handles a generic container with block-level children.
+func (c *Converter) buildBlockContent(elem *etree.Element) []Block {
+	var blocks []Block
+	for _, child := range elem.ChildElements() {
+		switch child.Tag {
+		case "p":
+			blocks = appendBlock(blocks, c.buildTextBlock(child))
+		case "empty-line":
+			blocks = append(blocks, &EmptyLine{})
+		case "section":
+			blocks = append(blocks, c.buildSection(child))
+		case "subtitle":
+			blocks = append(blocks, &Subtitle{Inlines: c.buildInlines(child)})
+		case "epigraph":
+			blocks = append(blocks, c.buildEpigraph(child))
+		case "image":
+			blocks = append(blocks, c.buildImage(child))
+		case "poem":
+			blocks = append(blocks, c.buildPoem(child))
+		case "cite":
+			blocks = append(blocks, c.buildCite(child))
+		case "table":
+			blocks = append(blocks, c.buildTable(child))
+		default:
+			blocks = append(blocks, &Plain{Inlines: c.buildInlines(child)})
+		}
+	}
+	return blocks
+}
+
+func (c *Converter) buildInlines(elem *etree.Element) []Inline {
+	var inlines []Inline
+
+	// Direct text content of this element
+	if text := elem.Text(); text != "" {
+		inlines = append(inlines, &Text{Value: text})
+	}
+
+	for _, child := range elem.ChildElements() {
+		var in Inline
+		switch child.Tag {
+		case "emphasis":
+			in = &Emphasis{Children: c.buildInlines(child)}
+		case "strong":
+			in = &Strong{Children: c.buildInlines(child)}
+		case "strikethrough":
+			in = &Strikethrough{Children: c.buildInlines(child)}
+		case "code":
+			in = &Code{Children: c.buildInlines(child)}
+		case "sup":
+			in = &Superscript{Children: c.buildInlines(child)}
+		case "sub":
+			in = &Subscript{Children: c.buildInlines(child)}
+		case "a":
+			in = c.buildLink(child)
+		case "image":
+			in = c.buildImage(child)
+		case "empty-line":
+			in = &Text{Value: "\n"}
+		case "style":
+			in = &Span{
+				Class:    child.SelectAttrValue("name", ""),
+				Children: c.buildInlines(child),
+			}
+		default:
+			in = &Span{Children: c.buildInlines(child)}
+		}
+		inlines = append(inlines, withLang(in, child))
+
+		// Tail text after element
+		if tail := child.Tail(); tail != "" {
+			inlines = append(inlines, &Text{Value: tail})
+		}
+	}
+
+	return inlines
+}
+
+func (c *Converter) buildLink(link *etree.Element) Inline {
+	href := link.SelectAttrValue("l:href", "")
+	if href == "" {
+		href = link.SelectAttrValue("href", "")
+	}
+
+	// Footnote references
+	if link.SelectAttrValue("type", "") == "note" && strings.HasPrefix(href, "#") {
+		noteID := strings.TrimPrefix(href, "#")
+		if _, exists := c.footnotes[noteID]; exists {
+			return &NoteRef{ID: noteID}
+		}
+	}
+
+	children := c.buildInlines(link)
+	if strings.TrimSpace(plainText(children)) == "" {
+		children = []Inline{&Text{Value: "Link"}}
+	}
+	return &Link{Href: href, Children: children}
+}
+
+// extractAllText recursively extracts all text from an element and its children.
+func extractAllText(elem *etree.Element) string {
+	var text strings.Builder
+
+	if elem.Text() != "" {
+		text.WriteString(elem.Text())
+	}
+
+	for _, child := range elem.ChildElements() {
+		text.WriteString(extractAllText(child))
+		if child.Tail() != "" {
+			text.WriteString(child.Tail())
+		}
+	}
+
+	return strings.TrimSpace(text.String())
+}
+
+func (c *Converter) buildParagraph(p *etree.Element) *Paragraph {
+	inlines := c.buildInlines(p)
+	if lang := xmlLang(p); lang != "" && len(inlines) > 0 {
+		inlines = []Inline{&Span{Lang: lang, Children: inlines}}
+	}
+	return &Paragraph{ID: p.SelectAttrValue("id", ""), Inlines: inlines}
+}
+
+// xmlLang returns the xml:lang of elem, or "".
+func xmlLang(elem *etree.Element) string {
+	return strings.TrimSpace(elem.SelectAttrValue("xml:lang", ""))
+}
+
+// withLang marks in as written in the language elem declares: a span takes
+// the language itself, other inlines are wrapped in one.
+func withLang(in Inline, elem *etree.Element) Inline {
+	lang := xmlLang(elem)
+	if lang == "" {
+		return in
+	}
+	if span, ok := in.(*Span); ok {
+		span.Lang = lang
+		return span
+	}
+	return &Span{Lang: lang, Children: []Inline{in}}
+}
+
+// buildTextBlock builds a paragraph, or a code block when the paragraph
+// holds nothing but code.
+func (c *Converter) buildTextBlock(p *etree.Element) Block {
+	para := c.buildParagraph(p)
+	var code *Code
+	for _, in := range para.Inlines {
+		switch n := in.(type) {
+		case *Text:
+			if strings.TrimSpace(n.Value) == "" {
+				continue
+			}
+		case *Code:
+			if code == nil {
+				code = n
+				continue
+			}
+		}
+		return para
+	}
+	if code == nil {
+		return para
+	}
+	text := strings.Trim(plainText(code.Children), "\r\n")
+	if strings.TrimSpace(text) == "" {
+		return para
+	}
+	return &CodeBlock{Text: strings.ReplaceAll(text, "\r\n", "\n")}
+}
+
+// appendBlock appends b to blocks, joining a code block to the one before
+// it. Books often give each line of a listing its own paragraph, with
+// empty-line elements for the blank lines.
+func appendBlock(blocks []Block, b Block) []Block {
+	code, ok := b.(*CodeBlock)
+	if !ok {
+		return append(blocks, b)
+	}
+	sep := "\n"
+	n := len(blocks)
+	if n >= 2 {
+		if _, empty := blocks[n-1].(*EmptyLine); empty {
+			if _, prev := blocks[n-2].(*CodeBlock); prev {
+				blocks = blocks[:n-1]
+				n--
+				sep = "\n\n"
+			}
+		}
+	}
+	if n > 0 {
+		if prev, ok := blocks[n-1].(*CodeBlock); ok {
+			prev.Text += sep + code.Text
+			return blocks
+		}
+	}
+	return append(blocks, code)
+}
+
+func (c *Converter) buildImage(img *etree.Element) *Image {
+	href := img.SelectAttrValue("l:href", "")
+	if href == "" {
+		href = img.SelectAttrValue("href", "")
+	}
+
+	alt := strings.TrimSpace(img.SelectAttrValue("alt", ""))
+	title := strings.TrimSpace(img.SelectAttrValue("title", ""))
+	if strings.HasPrefix(href, "#") {
+		return &Image{ID: strings.TrimPrefix(href, "#"), Alt: alt, Title: title}
+	}
+	if alt == "" {
+		alt = "Image"
+	}
+	return &Image{Href: href, Alt: alt, Title: title}
+}
@@ -0,0 +1,93 @@
+package fb2md
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// yearFirstRe matches 2001-02-03, 2001.2.3, 2001/02 and the date part
+	// of a timestamp such as 2001-02-03T10:00:00Z.
+	yearFirstRe = regexp.MustCompile(`^(\d{4})(?:[-./](\d{1,2})(?:[-./](\d{1,2}))?)?(?:[T ]\d{1,2}:\d{2}.*)?$`)
+	// dayFirstRe matches 03.02.2001 and 3/2/2001, day first as written in
+	// Russian and most European books.
+	dayFirstRe = regexp.MustCompile(`^(\d{1,2})[./](\d{1,2})[./](\d{4})$`)
+	// wordDateRe matches dates with the month spelled out: "3 Feb 2001",
+	// "3 февраля 2001 г.", "February 2001", "Feb 3, 2001".
+	wordDateRe = regexp.MustCompile(`^(?:(\d{1,2})\.?\s+)?(\pL+)\.?\s+(?:(\d{1,2}),?\s+)?(\d{4})(?:\s*(?:г|года?)\.?)?$`)
+	leadYearRe = regexp.MustCompile(`^(\d{4})(?:\s*(?:г|года?)\.?)?(?:[\s,;]|$)`)
+	// monthPrefix is searched in order, so "мар" (март) is found before
+	// "ма" (май, мая).
+	monthPrefix = []struct {
+		prefix string
+		month  int
+	}{
+		{"jan", 1}, {"feb", 2}, {"mar", 3}, {"apr", 4}, {"may", 5}, {"jun", 6},
+		{"jul", 7}, {"aug", 8}, {"sep", 9}, {"oct", 10}, {"nov", 11}, {"dec", 12},
+		{"янв", 1}, {"фев", 2}, {"мар", 3}, {"апр", 4}, {"ма", 5}, {"июн", 6},
+		{"июл", 7}, {"авг", 8}, {"сен", 9}, {"окт", 10}, {"ноя", 11}, {"дек", 12},
+	}
+)
+
+// normalizeDate returns date as ISO 8601 YYYY, YYYY-MM or YYYY-MM-DD, or ""
+// when it cannot be read. Besides ISO dates it reads dotted and slashed
+// dates, day first when the year comes last, dates with English or Russian
+// month names, and a year followed by other text ("1999, Moscow").
+func normalizeDate(date string) string {
+	date = strings.TrimSpace(date)
+	if m := yearFirstRe.FindStringSubmatch(date); m != nil {
+		return isoDateParts(m[1], m[2], m[3])
+	}
+	if m := dayFirstRe.FindStringSubmatch(date); m != nil {
+		return isoDateParts(m[3], m[2], m[1])
+	}
+	if m := wordDateRe.FindStringSubmatch(date); m != nil {
+		if month := monthNumber(m[2]); month > 0 {
+			day := m[1]
+			if day == "" {
+				day = m[3]
+			}
+			return isoDateParts(m[4], strconv.Itoa(month), day)
+		}
+	}
+	if m := leadYearRe.FindStringSubmatch(date); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// isoDateParts joins year, month and day, the latter two possibly empty,
+// into an ISO date, or returns "" when they do not make a calendar date.
+func isoDateParts(year, month, day string) string {
+	if month == "" {
+		return year
+	}
+	m, _ := strconv.Atoi(month)
+	if m < 1 || m > 12 {
+		return ""
+	}
+	if day == "" {
+		return fmt.Sprintf("%s-%02d", year, m)
+	}
+	d, _ := strconv.Atoi(day)
+	date := fmt.Sprintf("%s-%02d-%02d", year, m, d)
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		return ""
+	}
+	return date
+}
+
+// monthNumber returns the month an English or Russian month name or
+// abbreviation stands for, or 0.
+func monthNumber(name string) int {
+	name = strings.ToLower(name)
+	for _, p := range monthPrefix {
+		if strings.HasPrefix(name, p.prefix) {
+			return p.month
+		}
+	}
+	return 0
+}
@@ -0,0 +1,311 @@
+package fb2md
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// dialect describes how a Markdown flavor differs from the default output.
+type dialect struct {
+	// frontMatter, when set, writes the book metadata as front matter
+	// fields instead of a header block.
+	frontMatter func(meta *Metadata, ctx *renderContext) []MetaField
+	// escape post-processes the rendered body.
+	escape func(body string) string
+	// extractImages always extracts images; bundle and siteAssets choose
+	// where they go.
+	extractImages bool
+	// bundle writes the book as a directory with index.md and its images.
+	bundle bool
+	// siteAssets puts images under assets/ at the site root and links them
+	// by absolute path.
+	siteAssets bool
+	// wikiImages embeds extracted images as ![[path]].
+	wikiImages bool
+	// fencedDivs writes epigraphs and cites as ::: divs instead of quotes.
+	fencedDivs bool
+	// spanAttrs writes named styles as [text]{.style}.
+	spanAttrs bool
+	// headerIDs appends {#id} to section headings that have an id.
+	headerIDs bool
+	// inlineNotes writes footnotes in place as ^[text].
+	inlineNotes bool
+	// parts writes top-level sections that hold sections as Markua parts
+	// and makes chapters level-1 headings.
+	parts bool
+	// asides writes epigraphs as Markua {aside} blocks.
+	asides bool
+	// imageAttrs writes a Markua {alt: ...} attribute list above block images.
+	imageAttrs bool
+	// attrLists writes section and paragraph ids as Markua {id: ...}
+	// attribute lines.
+	attrLists bool
+	// figures writes captioned block images with the caption as link text.
+	figures bool
+	// matterMarkers puts the metadata in {frontmatter} and the body in
+	// {mainmatter}.
+	matterMarkers bool
+
+	// The fields below turn off syntax outside the CommonMark core, which
+	// then falls back to raw HTML.
+
+	// noTables writes tables as HTML tables.
+	noTables bool
+	// noFootnotes writes note references as superscript links and the notes
+	// as a numbered list.
+	noFootnotes bool
+	// noStrikethrough writes strikethrough as <del>.
+	noStrikethrough bool
+}
+
+// dialects lists the accepted --dialect values. The empty name is the
+// default output.
+var dialects = map[string]dialect{
+	"":    {},
+	"gfm": {},
+	"hugo": {
+		frontMatter:   hugoFrontMatter,
+		escape:        escapeHugoShortcodes,
+		extractImages: true,
+		bundle:        true,
+	},
+	"jekyll": {
+		frontMatter:   jekyllFrontMatter,
+		extractImages: true,
+		siteAssets:    true,
+	},
+	"obsidian": {
+		frontMatter:   obsidianFrontMatter,
+		extractImages: true,
+		wikiImages:    true,
+	},
+	"pandoc": {
+		frontMatter: pandocFrontMatter,
+		fencedDivs:  true,
+		spanAttrs:   true,
+		headerIDs:   true,
+		inlineNotes: true,
+		figures:     true,
+	},
+	"markua": {
+		parts:         true,
+		asides:        true,
+		imageAttrs:    true,
+		attrLists:     true,
+		figures:       true,
+		matterMarkers: true,
+	},
+	"commonmark": {
+		noTables:        true,
+		noFootnotes:     true,
+		noStrikethrough: true,
+	},
+}
+
+// dialectImages points image extraction where the dialect's site generator
+// expects the images and turns extraction on.
+func dialectImages(output string, opts *Options) error {
+	d := dialects[opts.Dialect]
+	if output == StdoutPath || !d.extractImages || opts.InlineImages {
+		return nil
+	}
+	opts.ExtractImages = true
+	if opts.ImagesDir != "" || !d.bundle && !d.siteAssets {
+		return nil
+	}
+
+	if d.bundle {
+		bundle := filepath.Dir(output)
+		if !opts.Diff {
+			if err := os.Mkdir(bundle, 0755); err != nil && !os.IsExist(err) && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to create bundle directory: %w", err)
+			}
+		}
+		opts.ImagesDir = bundle
+		return nil
+	}
+
+	// Posts usually live in _posts/; assets/ sits next to it.
+	root := filepath.Dir(output)
+	if filepath.Base(root) == "_posts" {
+		root = filepath.Dir(root)
+	}
+	name := strings.TrimSuffix(filepath.Base(output), filepath.Ext(output))
+	opts.ImagesDir = filepath.Join(root, "assets", "img", name)
+	opts.ImagesURL = strings.TrimSuffix(opts.ImageLinkBase, "/") + "/assets/img/" + name
+	return nil
+}
+
+// hugoFrontMatter maps the metadata to Hugo page parameters, with the series
+// and genres as taxonomy terms.
+func hugoFrontMatter(meta *Metadata, ctx *renderContext) []MetaField {
+	var fields []MetaField
+	if title := strings.TrimSpace(meta.Title); title != "" {
+		fields = append(fields, MetaField{Key: "title", Value: title})
+	}
+	if date := meta.ISODate(); date != "" {
+		fields = append(fields, MetaField{Key: "date", Value: date})
+	}
+	if text := meta.dateText(); text != "" {
+		fields = append(fields, MetaField{Key: "date_text", Value: text})
+	}
+	if len(meta.Authors) > 0 {
+		fields = append(fields, MetaField{Key: "authors", Value: meta.AuthorNames()})
+	}
+	if len(meta.Sequences) > 0 {
+		var series []string
+		for _, seq := range meta.Sequences {
+			series = append(series, seq.Name)
+		}
+		fields = append(fields, MetaField{Key: "series", Value: series})
+		fields = append(fields, seriesIndexFields(meta.Sequences)...)
+	}
+	if tags := meta.tags(ctx.opts); len(tags) > 0 {
+		fields = append(fields, MetaField{Key: "tags", Value: tags})
+	}
+	if len(meta.Annotation) > 0 {
+		fields = append(fields, MetaField{Key: "summary", Value: meta.annotationText()})
+	}
+	if link, ok := ctx.imageLink(meta.Cover); ok && meta.Cover != "" {
+		fields = append(fields, MetaField{Key: "images", Value: []string{link}})
+	}
+	return fields
+}
+
+// jekyllFrontMatter maps the metadata to Jekyll post variables, with the
+// genres as categories.
+func jekyllFrontMatter(meta *Metadata, ctx *renderContext) []MetaField {
+	fields := []MetaField{{Key: "layout", Value: "post"}}
+	title := strings.TrimSpace(meta.Title)
+	if title != "" {
+		fields = append(fields, MetaField{Key: "title", Value: title})
+	}
+	// Jekyll only accepts full dates.
+	if date := meta.ISODate(); len(date) == len("2006-01-02") {
+		fields = append(fields, MetaField{Key: "date", Value: date})
+	}
+	if text := meta.dateText(); text != "" {
+		fields = append(fields, MetaField{Key: "date_text", Value: text})
+	}
+	if len(meta.Authors) > 0 {
+		fields = append(fields, MetaField{Key: "author", Value: strings.Join(meta.AuthorNames(), ", ")})
+	}
+	if len(meta.Genres) > 0 {
+		fields = append(fields, MetaField{Key: "categories", Value: meta.Genres})
+	}
+	if keywords := meta.keywordList(); len(keywords) > 0 && ctx.opts.ExtraMetadata {
+		fields = append(fields, MetaField{Key: "tags", Value: keywords})
+	}
+	if len(meta.Sequences) > 0 {
+		fields = append(fields, MetaField{Key: "series", Value: meta.Sequences[0].Name})
+		fields = append(fields, seriesIndexFields(meta.Sequences)...)
+	}
+	if len(meta.Annotation) > 0 {
+		fields = append(fields, MetaField{Key: "description", Value: meta.annotationText()})
+	}
+	if link, ok := ctx.imageLink(meta.Cover); ok && meta.Cover != "" {
+		fields = append(fields, MetaField{Key: "image", Value: link})
+	}
+	if slug := slugify(title); slug != "" {
+		fields = append(fields, MetaField{Key: "slug", Value: slug})
+	}
+	if ctx.opts.Permalink != "" {
+		fields = append(fields, MetaField{Key: "permalink", Value: ctx.opts.Permalink})
+	}
+	return fields
+}
+
+// obsidianFrontMatter maps the metadata to Obsidian note properties. Tags
+// cannot contain spaces, and the cover is a link so it resolves in the vault.
+func obsidianFrontMatter(meta *Metadata, ctx *renderContext) []MetaField {
+	var fields []MetaField
+	if title := strings.TrimSpace(meta.Title); title != "" {
+		fields = append(fields, MetaField{Key: "title", Value: title})
+	}
+	if len(meta.Authors) > 0 {
+		fields = append(fields, MetaField{Key: "authors", Value: meta.AuthorNames()})
+	}
+	if len(meta.Sequences) > 0 {
+		fields = append(fields, MetaField{Key: "series", Value: meta.Sequences[0].Name})
+		fields = append(fields, seriesIndexFields(meta.Sequences)...)
+	}
+	if date := meta.ISODate(); date != "" {
+		fields = append(fields, MetaField{Key: "date", Value: date})
+	}
+	if text := meta.dateText(); text != "" {
+		fields = append(fields, MetaField{Key: "date_text", Value: text})
+	}
+	if meta.Lang != "" {
+		fields = append(fields, MetaField{Key: "lang", Value: meta.Lang})
+	}
+	if names := meta.tags(ctx.opts); len(names) > 0 {
+		tags := make([]string, len(names))
+		for i, name := range names {
+			tags[i] = strings.Join(strings.Fields(name), "-")
+		}
+		fields = append(fields, MetaField{Key: "tags", Value: tags})
+	}
+	if len(meta.Annotation) > 0 {
+		fields = append(fields, MetaField{Key: "description", Value: meta.annotationText()})
+	}
+	if link, ok := ctx.imageLink(meta.Cover); ok && meta.Cover != "" {
+		fields = append(fields, MetaField{Key: "cover", Value: "[[" + link + "]]"})
+	}
+	return fields
+}
+
+// pandocFrontMatter maps the metadata to the variables Pandoc's templates
+// and writers understand.
+func pandocFrontMatter(meta *Metadata, ctx *renderContext) []MetaField {
+	var fields []MetaField
+	if title := strings.TrimSpace(meta.Title); title != "" {
+		fields = append(fields, MetaField{Key: "title", Value: title})
+	}
+	if len(meta.Authors) > 0 {
+		fields = append(fields, MetaField{Key: "author", Value: meta.AuthorNames()})
+	}
+	// The ISO date when there is one, so that documents sort by it.
+	if date := meta.ISODate(); date != "" {
+		fields = append(fields, MetaField{Key: "date", Value: date})
+	} else if date := strings.TrimSpace(meta.Date); date != "" {
+		fields = append(fields, MetaField{Key: "date", Value: date})
+	}
+	if text := meta.dateText(); text != "" && meta.ISODate() != "" {
+		fields = append(fields, MetaField{Key: "date_text", Value: text})
+	}
+	if meta.Lang != "" {
+		fields = append(fields, MetaField{Key: "lang", Value: meta.Lang})
+	}
+	if len(meta.Sequences) > 0 {
+		fields = append(fields, MetaField{Key: "series", Value: meta.Sequences[0].Name})
+		fields = append(fields, seriesIndexFields(meta.Sequences)...)
+	}
+	if keywords := meta.tags(ctx.opts); len(keywords) > 0 {
+		fields = append(fields, MetaField{Key: "keywords", Value: keywords})
+	}
+	if len(meta.Annotation) > 0 {
+		fields = append(fields, MetaField{Key: "abstract", Value: meta.annotationText()})
+	}
+	if link, ok := ctx.imageLink(meta.Cover); ok && meta.Cover != "" {
+		fields = append(fields, MetaField{Key: "cover-image", Value: link})
+	}
+	return fields
+}
+
+// slugify lowercases s and joins its runs of letters and digits with hyphens.
+func slugify(s string) string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(words, "-")
+}
+
+// escapeHugoShortcodes keeps "{{<" and "{{%" in the text from being parsed
+// as shortcode calls.
+func escapeHugoShortcodes(body string) string {
+	body = strings.ReplaceAll(body, "{{<", "&#123;&#123;<")
+	return strings.ReplaceAll(body, "{{%", "&#123;&#123;%")
+}
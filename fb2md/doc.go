@@ -0,0 +1,27 @@
+// Package fb2md converts FictionBook (FB2, FB3), EPUB, TEI, plain text and
+// CBZ books to Markdown, HTML, JSON, EPUB, BBCode or Pandoc JSON. It is the
+// conversion the fb2md command runs, for Go programs to call directly.
+//
+// Convert reads a book and writes it in one step:
+//
+//	f, err := os.Open("book.fb2")
+//	if err != nil {
+//		return err
+//	}
+//	defer f.Close()
+//	err = fb2md.Convert(f, "fb2", "book.md", fb2md.Options{ExtractImages: true})
+//
+// The format of a book is one Readable accepts; SniffFormat tells it from
+// the content and FormatFromExt from the file name. Read and Write split
+// the conversion in two, so that the document tree, a Book, can be looked
+// into or changed before it is rendered.
+//
+// ConvertStream and Render write to an io.Writer instead of a file, and
+// the images they extract to the ImageFS in Options.Images, such as a
+// MemFS, so that a book can be converted in memory, e.g. by an HTTP
+// handler.
+//
+// Errors writing the output are *OutputError; a book in a format the
+// package does not read fails with ErrUnsupportedFormat. Warnings, details
+// and events go to Options.Logger, and nowhere when it is nil.
+package fb2md
@@ -0,0 +1,877 @@
+package fb2md
+
+import (
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var isoDateRe = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2})?)?$`)
+
+// Book is the format-independent form of a converted book. Input readers
+// build a Book and renderers turn it into the requested output format.
+type Book struct {
+	// Meta is nil when the source carries no bibliographic description.
+	Meta *Metadata
+	// FrontMatter holds extra key/value metadata written as a header block.
+	FrontMatter []MetaField
+	Body        []Block
+	// Footnotes are keyed by the id that NoteRef inlines point to.
+	Footnotes map[string]*Footnote
+	Binaries  []Binary
+}
+
+// clone returns a deep copy of b, for rendering to number, normalize and
+// trim without changing the book the caller holds.
+func (b *Book) clone() *Book {
+	return deepCopy(reflect.ValueOf(b)).Interface().(*Book)
+}
+
+// deepCopy copies v and everything it points to; the document tree has
+// no cycles.
+func deepCopy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(deepCopy(v.Elem()))
+		return c
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(deepCopy(v.Elem()))
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := range v.Len() {
+			c.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for iter := v.MapRange(); iter.Next(); {
+			c.SetMapIndex(iter.Key(), deepCopy(iter.Value()))
+		}
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		for i := range v.NumField() {
+			c.Field(i).Set(deepCopy(v.Field(i)))
+		}
+		return c
+	default:
+		return v
+	}
+}
+
+// Metadata is the bibliographic description of a book.
+type Metadata struct {
+	Title      string
+	Authors    []Person
+	Genres     []string
+	Sequences  []Sequence
+	Annotation []Block
+	Date       string
+	// DateValue is the machine-readable form of Date, when the source has one.
+	DateValue string
+	Lang      string
+	// Cover is the id of the cover image binary.
+	Cover string
+	// Identifier uniquely identifies the book, e.g. the FB2 document id.
+	Identifier string
+
+	Translators []Person
+	Keywords    string
+	SrcLang     string
+	// Document describes the electronic edition; nil when the source has
+	// no such description.
+	Document *DocumentInfo
+	// Publish describes the printed edition the text was taken from.
+	Publish *PublishInfo
+	// CustomInfo holds the FB2 custom-info entries, where tools such as
+	// calibre and fb2edit keep data the schema has no place for.
+	CustomInfo []CustomInfo
+	// Source describes the original book of a translation, from the FB2
+	// src-title-info; nil for books that are not translations.
+	Source *Metadata
+}
+
+// DocumentInfo is the FB2 document-info: who made the file and from what.
+type DocumentInfo struct {
+	Authors     []Person
+	ProgramUsed string
+	Date        string
+	DateValue   string
+	SrcURLs     []string
+	SrcOCR      string
+	ID          string
+	Version     string
+	// History lists the changes made to the file, one block per change.
+	History    []Block
+	Publishers []string
+}
+
+// CustomInfo is a free-form description entry; Type names what it holds.
+type CustomInfo struct {
+	Type  string
+	Value string
+}
+
+// PublishInfo is the FB2 publish-info of the paper book.
+type PublishInfo struct {
+	BookName  string
+	Publisher string
+	City      string
+	Year      string
+	ISBN      string
+	Sequences []Sequence
+}
+
+// ISODate returns the publication date as YYYY, YYYY-MM or YYYY-MM-DD,
+// preferring the machine-readable value to the display text, or "" when
+// neither can be read as a date.
+func (m *Metadata) ISODate() string {
+	for _, date := range []string{m.DateValue, m.Date} {
+		if iso := normalizeDate(date); iso != "" {
+			return iso
+		}
+	}
+	return ""
+}
+
+// dateText returns the date as the book displays it, when that says more
+// than the ISO date: "3 Feb 2001" for 2001-02-03, but "" for "2001".
+func (m *Metadata) dateText() string {
+	text := strings.Join(strings.Fields(m.Date), " ")
+	if text == m.ISODate() {
+		return ""
+	}
+	return text
+}
+
+// AuthorNames returns the full names of the authors.
+func (m *Metadata) AuthorNames() []string {
+	names := make([]string, len(m.Authors))
+	for i, author := range m.Authors {
+		names[i] = author.Name()
+	}
+	return names
+}
+
+// keywordList returns the keywords split at commas and semicolons.
+func (m *Metadata) keywordList() []string {
+	var keywords []string
+	for _, kw := range strings.FieldsFunc(m.Keywords, func(r rune) bool { return r == ',' || r == ';' }) {
+		if kw = strings.TrimSpace(kw); kw != "" && !containsString(keywords, kw) {
+			keywords = append(keywords, kw)
+		}
+	}
+	return keywords
+}
+
+// tags returns the genres followed by the keywords when --extra-metadata
+// asks for them.
+func (m *Metadata) tags(opts Options) []string {
+	tags := m.Genres
+	if opts.ExtraMetadata {
+		for _, kw := range m.keywordList() {
+			if !containsString(tags, kw) {
+				tags = append(tags[:len(tags):len(tags)], kw)
+			}
+		}
+	}
+	return tags
+}
+
+// annotationText returns the annotation as plain text, one line per block.
+func (m *Metadata) annotationText() string {
+	return blocksText(m.Annotation)
+}
+
+// blocksText returns blocks as plain text, one line per non-empty block.
+func blocksText(blocks []Block) string {
+	var text []string
+	for _, b := range blocks {
+		if t := strings.TrimSpace(blockText(b)); t != "" {
+			text = append(text, t)
+		}
+	}
+	return strings.Join(text, "\n")
+}
+
+// Person is an author or translator.
+type Person struct {
+	FirstName  string
+	MiddleName string
+	LastName   string
+	Nickname   string
+}
+
+// Name returns the full name, falling back to the nickname.
+func (p Person) Name() string {
+	var parts []string
+	for _, part := range []string{p.FirstName, p.MiddleName, p.LastName} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return p.Nickname
+	}
+	return strings.Join(parts, " ")
+}
+
+// Sequence is a series the book belongs to.
+type Sequence struct {
+	Name   string
+	Number string
+	// Sub holds the series nested in this one, such as a cycle within a
+	// larger saga.
+	Sub []Sequence
+}
+
+// label returns the series as "Name, #3", followed by its sub-series:
+// "Saga, #3 / Cycle, #2".
+func (s Sequence) label() string {
+	label := s.Name
+	if s.Number != "" {
+		label += ", #" + s.Number
+	}
+	for _, sub := range s.Sub {
+		label += " / " + sub.label()
+	}
+	return label
+}
+
+// seriesIndexFields returns the structured front matter fields of the first
+// series beyond its name: series_index, then subseries and subseries_index
+// for the first series nested in it. Whole numbers are written as numbers.
+func seriesIndexFields(sequences []Sequence) []MetaField {
+	var fields []MetaField
+	add := func(key string, seq Sequence) {
+		if key != "series" {
+			fields = append(fields, MetaField{Key: key, Value: seq.Name})
+		}
+		if seq.Number == "" {
+			return
+		}
+		var index any = seq.Number
+		if n, err := strconv.Atoi(seq.Number); err == nil {
+			index = n
+		}
+		fields = append(fields, MetaField{Key: key + "_index", Value: index})
+	}
+	if len(sequences) == 0 {
+		return nil
+	}
+	add("series", sequences[0])
+	if sub := sequences[0].Sub; len(sub) > 0 {
+		add("subseries", sub[0])
+	}
+	return fields
+}
+
+// MetaField is a front matter entry. Value is a string, an int or a
+// []string.
+type MetaField struct {
+	Key   string
+	Value any
+}
+
+// Footnote is the text of a note referenced from the body.
+type Footnote struct {
+	ID      string
+	Content []Inline
+}
+
+// Binary is an embedded file, usually an image, stored base64-encoded.
+type Binary struct {
+	ID          string
+	ContentType string
+	Data        string
+}
+
+// Block is a block-level node of the document.
+type Block interface {
+	block()
+}
+
+// Section is a titled, nestable division of the text. Its heading level is
+// given by its nesting depth.
+type Section struct {
+	ID         string
+	Title      string
+	Epigraphs  []*Epigraph
+	Annotation []Block
+	Blocks     []Block
+}
+
+// Heading is a heading with an explicit level, as found in (X)HTML sources.
+type Heading struct {
+	Level int
+	Text  string
+}
+
+// BodyTitle is the title of a book body, shown above its sections.
+type BodyTitle struct {
+	Text string
+}
+
+// Chapter groups the blocks of one source document, such as an EPUB spine item.
+type Chapter struct {
+	Blocks []Block
+}
+
+type Paragraph struct {
+	// ID is the anchor the source gives the paragraph, if any.
+	ID      string
+	Inlines []Inline
+}
+
+type Subtitle struct {
+	Inlines []Inline
+}
+
+// Plain is inline content outside of any paragraph.
+type Plain struct {
+	Inlines []Inline
+}
+
+type EmptyLine struct{}
+
+type HorizontalRule struct{}
+
+// CodeBlock is preformatted text, such as a program listing, whose spaces
+// and line breaks are kept as they are.
+type CodeBlock struct {
+	Text string
+}
+
+// Image is a picture, either an embedded binary (ID) or an external file (Href).
+type Image struct {
+	ID   string
+	Href string
+	Alt  string
+	// Title is the caption of the image, when the source gives one.
+	Title string
+	// Media is "audio" or "video" for a media file, "interactive" for
+	// scripted content, which text outputs show as a placeholder such as
+	// [audio: file.mp3]. It is empty for pictures.
+	Media string
+}
+
+// mediaLabel returns the placeholder text of a media file: its kind and
+// file name, or for interactive content the name Alt holds.
+func (img *Image) mediaLabel() string {
+	name := img.ID
+	switch {
+	case name == "" && img.Href != "":
+		name = path.Base(img.Href)
+	case name == "":
+		name = img.Alt
+	}
+	if name == "" || name == "." || name == "/" {
+		return img.Media
+	}
+	return img.Media + ": " + name
+}
+
+// altText returns the text describing the image: its alt text, else its
+// caption, else the binary id.
+func (img *Image) altText() string {
+	switch {
+	case img.Alt != "":
+		return img.Alt
+	case img.Title != "":
+		return img.Title
+	}
+	return img.ID
+}
+
+// placeholder returns the text shown for an image that is neither
+// extracted nor embedded: "Image: " and its alt text, followed by its
+// caption when that says something else.
+func (img *Image) placeholder() string {
+	text := "Image: " + img.altText()
+	if img.Title != "" && img.Title != img.altText() {
+		text += " — " + img.Title
+	}
+	return text
+}
+
+// Epigraph holds Paragraph, Poem, Cite, TextAuthor and EmptyLine blocks.
+type Epigraph struct {
+	Blocks []Block
+}
+
+// Cite is a quotation made of Paragraph, Poem, Subtitle, EmptyLine, Table
+// and TextAuthor blocks.
+type Cite struct {
+	Blocks []Block
+}
+
+// Quote is a block quotation of plain lines.
+type Quote struct {
+	Lines [][]Inline
+}
+
+type TextAuthor struct {
+	Inlines []Inline
+}
+
+// Poem holds Stanza and Subtitle blocks.
+type Poem struct {
+	Title     string
+	Epigraphs []*Epigraph
+	Blocks    []Block
+	Authors   [][]Inline
+	Date      string
+}
+
+type Stanza struct {
+	Title string
+	// Subtitle is nil when the stanza has none.
+	Subtitle []Inline
+	Lines    [][]Inline
+}
+
+type List struct {
+	Ordered bool
+	Items   [][]Inline
+}
+
+type Table struct {
+	// Columns is the number of columns in the first row.
+	Columns int
+	// Header reports whether the first row is a header row.
+	Header bool
+	Rows   [][]TableCell
+}
+
+type TableCell struct {
+	Header bool
+	// Align is "left", "center", "right" or empty for the default.
+	Align   string
+	Inlines []Inline
+}
+
+// columnAlign returns the alignment of column i: that of its header cell,
+// else of the first cell in the column that has one.
+func (t *Table) columnAlign(i int) string {
+	for _, row := range t.Rows {
+		if i < len(row) && row[i].Align != "" {
+			return row[i].Align
+		}
+	}
+	return ""
+}
+
+func (*Section) block()        {}
+func (*Heading) block()        {}
+func (*BodyTitle) block()      {}
+func (*Chapter) block()        {}
+func (*Paragraph) block()      {}
+func (*Subtitle) block()       {}
+func (*Plain) block()          {}
+func (*EmptyLine) block()      {}
+func (*HorizontalRule) block() {}
+func (*CodeBlock) block()      {}
+func (*Image) block()          {}
+func (*Epigraph) block()       {}
+func (*Cite) block()           {}
+func (*Quote) block()          {}
+func (*TextAuthor) block()     {}
+func (*Poem) block()           {}
+func (*Stanza) block()         {}
+func (*List) block()           {}
+func (*Table) block()          {}
+
+// Inline is a node of running text.
+type Inline interface {
+	inline()
+}
+
+type Text struct {
+	Value string
+}
+
+type Emphasis struct {
+	Children []Inline
+}
+
+type Strong struct {
+	Children []Inline
+}
+
+type Strikethrough struct {
+	Children []Inline
+}
+
+type Code struct {
+	Children []Inline
+}
+
+type Superscript struct {
+	Children []Inline
+}
+
+type Subscript struct {
+	Children []Inline
+}
+
+// Span is text with no presentational meaning of its own, such as an FB2
+// named style.
+type Span struct {
+	Class string
+	// Lang is the language of the text, from xml:lang, when it differs
+	// from the book's.
+	Lang     string
+	Children []Inline
+}
+
+type Link struct {
+	Href     string
+	Children []Inline
+}
+
+// NoteRef is a reference to Book.Footnotes[ID].
+type NoteRef struct {
+	ID string
+}
+
+// LineBreak is a hard line break.
+type LineBreak struct{}
+
+func (*Text) inline()          {}
+func (*Emphasis) inline()      {}
+func (*Strong) inline()        {}
+func (*Strikethrough) inline() {}
+func (*Code) inline()          {}
+func (*Superscript) inline()   {}
+func (*Subscript) inline()     {}
+func (*Span) inline()          {}
+func (*Link) inline()          {}
+func (*NoteRef) inline()       {}
+func (*LineBreak) inline()     {}
+func (*Image) inline()         {}
+
+// plainText returns the text of inlines without any markup.
+func plainText(inlines []Inline) string {
+	var b strings.Builder
+	writePlainText(&b, inlines)
+	return b.String()
+}
+
+func writePlainText(b *strings.Builder, inlines []Inline) {
+	for _, in := range inlines {
+		switch n := in.(type) {
+		case *Text:
+			b.WriteString(n.Value)
+		case *Emphasis:
+			writePlainText(b, n.Children)
+		case *Strong:
+			writePlainText(b, n.Children)
+		case *Strikethrough:
+			writePlainText(b, n.Children)
+		case *Code:
+			writePlainText(b, n.Children)
+		case *Superscript:
+			writePlainText(b, n.Children)
+		case *Subscript:
+			writePlainText(b, n.Children)
+		case *Span:
+			writePlainText(b, n.Children)
+		case *Link:
+			writePlainText(b, n.Children)
+		case *LineBreak:
+			b.WriteString("\n")
+		}
+	}
+}
+
+// blockText returns the plain text of a block of running text, or "" for
+// structural blocks.
+func blockText(b Block) string {
+	switch n := b.(type) {
+	case *Paragraph:
+		return plainText(n.Inlines)
+	case *Subtitle:
+		return plainText(n.Inlines)
+	case *Plain:
+		return plainText(n.Inlines)
+	case *TextAuthor:
+		return plainText(n.Inlines)
+	case *Heading:
+		return n.Text
+	case *BodyTitle:
+		return n.Text
+	case *CodeBlock:
+		return n.Text
+	case *Quote:
+		lines := make([]string, len(n.Lines))
+		for i, line := range n.Lines {
+			lines[i] = plainText(line)
+		}
+		return strings.Join(lines, "\n")
+	case *List:
+		items := make([]string, len(n.Items))
+		for i, item := range n.Items {
+			items[i] = plainText(item)
+		}
+		return strings.Join(items, "\n")
+	}
+	return ""
+}
+
+// dropEpigraphs removes the epigraphs from blocks and from the sections and
+// poems in them.
+func dropEpigraphs(blocks []Block) []Block {
+	kept := blocks[:0]
+	for _, b := range blocks {
+		switch n := b.(type) {
+		case *Epigraph:
+			continue
+		case *Section:
+			n.Epigraphs = nil
+			n.Blocks = dropEpigraphs(n.Blocks)
+		case *Chapter:
+			n.Blocks = dropEpigraphs(n.Blocks)
+		case *Cite:
+			n.Blocks = dropEpigraphs(n.Blocks)
+		case *Poem:
+			n.Epigraphs = nil
+		}
+		kept = append(kept, b)
+	}
+	return kept
+}
+
+// placeCover puts the cover image at the start of the body, for --cover
+// image.
+func placeCover(book *Book) {
+	if book.Meta == nil || book.Meta.Cover == "" {
+		return
+	}
+	book.Body = append([]Block{&Image{ID: book.Meta.Cover, Alt: "Cover"}}, book.Body...)
+}
+
+// numberHeadings prefixes the titles of sections and headings with their
+// hierarchical number: 1, 1.1, 1.2, 2, ... Untitled sections are not
+// numbered and do not add a level. A heading above the first one's level
+// continues the top-level count.
+func numberHeadings(blocks []Block) {
+	var levels, counts []int
+	top := 0
+	next := func(level int) string {
+		for len(levels) > 0 && levels[len(levels)-1] > level {
+			levels, counts = levels[:len(levels)-1], counts[:len(counts)-1]
+		}
+		switch {
+		case len(levels) > 0 && levels[len(levels)-1] == level:
+			counts[len(counts)-1]++
+		case len(levels) == 0:
+			levels, counts = []int{level}, []int{top + 1}
+		default:
+			levels, counts = append(levels, level), append(counts, 1)
+		}
+		if len(counts) == 1 {
+			top = counts[0]
+		}
+		parts := make([]string, len(counts))
+		for i, n := range counts {
+			parts[i] = strconv.Itoa(n)
+		}
+		return strings.Join(parts, ".")
+	}
+
+	var walk func(blocks []Block, depth int)
+	walk = func(blocks []Block, depth int) {
+		for _, b := range blocks {
+			switch n := b.(type) {
+			case *Section:
+				if n.Title == "" {
+					walk(n.Blocks, depth)
+					continue
+				}
+				n.Title = next(depth+1) + " " + n.Title
+				walk(n.Blocks, depth+1)
+			case *Chapter:
+				walk(n.Blocks, depth)
+			case *Heading:
+				if n.Text != "" {
+					n.Text = next(n.Level) + " " + n.Text
+				}
+			}
+		}
+	}
+	walk(blocks, 0)
+}
+
+// WalkBlocks calls fn for each block and every block nested in it, and
+// for each inline they contain, depth first.
+func WalkBlocks(blocks []Block, fn func(node any)) {
+	for _, b := range blocks {
+		fn(b)
+		switch n := b.(type) {
+		case *Section:
+			for _, epigraph := range n.Epigraphs {
+				WalkBlocks([]Block{epigraph}, fn)
+			}
+			WalkBlocks(n.Annotation, fn)
+			WalkBlocks(n.Blocks, fn)
+		case *Chapter:
+			WalkBlocks(n.Blocks, fn)
+		case *Paragraph:
+			WalkInlines(n.Inlines, fn)
+		case *Subtitle:
+			WalkInlines(n.Inlines, fn)
+		case *Plain:
+			WalkInlines(n.Inlines, fn)
+		case *TextAuthor:
+			WalkInlines(n.Inlines, fn)
+		case *Epigraph:
+			WalkBlocks(n.Blocks, fn)
+		case *Cite:
+			WalkBlocks(n.Blocks, fn)
+		case *Quote:
+			for _, line := range n.Lines {
+				WalkInlines(line, fn)
+			}
+		case *Poem:
+			for _, epigraph := range n.Epigraphs {
+				WalkBlocks([]Block{epigraph}, fn)
+			}
+			WalkBlocks(n.Blocks, fn)
+			for _, author := range n.Authors {
+				WalkInlines(author, fn)
+			}
+		case *Stanza:
+			WalkInlines(n.Subtitle, fn)
+			for _, line := range n.Lines {
+				WalkInlines(line, fn)
+			}
+		case *List:
+			for _, item := range n.Items {
+				WalkInlines(item, fn)
+			}
+		case *Table:
+			for _, row := range n.Rows {
+				for _, cell := range row {
+					WalkInlines(cell.Inlines, fn)
+				}
+			}
+		}
+	}
+}
+
+// WalkInlines calls fn for each inline and every inline nested in it.
+func WalkInlines(inlines []Inline, fn func(node any)) {
+	for _, in := range inlines {
+		fn(in)
+		switch n := in.(type) {
+		case *Emphasis:
+			WalkInlines(n.Children, fn)
+		case *Strong:
+			WalkInlines(n.Children, fn)
+		case *Strikethrough:
+			WalkInlines(n.Children, fn)
+		case *Code:
+			WalkInlines(n.Children, fn)
+		case *Superscript:
+			WalkInlines(n.Children, fn)
+		case *Subscript:
+			WalkInlines(n.Children, fn)
+		case *Span:
+			WalkInlines(n.Children, fn)
+		case *Link:
+			WalkInlines(n.Children, fn)
+		}
+	}
+}
+
+// referencedImages returns the ids of the binaries the book shows: its
+// images, in the body, notes and annotation, and its cover.
+func referencedImages(book *Book) map[string]bool {
+	ids := make(map[string]bool)
+	collect := func(node any) {
+		if img, ok := node.(*Image); ok && img.ID != "" {
+			ids[img.ID] = true
+		}
+	}
+	if meta := book.Meta; meta != nil {
+		if meta.Cover != "" {
+			ids[meta.Cover] = true
+		}
+		WalkBlocks(meta.Annotation, collect)
+	}
+	WalkBlocks(book.Body, collect)
+	for _, note := range book.Footnotes {
+		WalkInlines(note.Content, collect)
+	}
+	return ids
+}
+
+// renumberFootnotes gives the notes the ids 1, 2, 3, ... in the order they
+// are first referenced, counting notes referenced from other notes after
+// the note that refers to them. Notes nothing refers to are numbered last,
+// in the order of their old ids.
+func renumberFootnotes(book *Book) {
+	if len(book.Footnotes) == 0 {
+		return
+	}
+	newID := make(map[string]string)
+	var refs []*NoteRef
+	var order []string
+	collect := func(node any) {
+		if ref, ok := node.(*NoteRef); ok {
+			refs = append(refs, ref)
+			if _, seen := newID[ref.ID]; !seen {
+				newID[ref.ID] = strconv.Itoa(len(newID) + 1)
+				order = append(order, ref.ID)
+			}
+		}
+	}
+	if book.Meta != nil {
+		WalkBlocks(book.Meta.Annotation, collect)
+	}
+	WalkBlocks(book.Body, collect)
+	// Notes may reference further notes, which are appended as found.
+	for i := 0; i < len(order); i++ {
+		if note, ok := book.Footnotes[order[i]]; ok {
+			WalkInlines(note.Content, collect)
+		}
+	}
+	var unreferenced []string
+	for id := range book.Footnotes {
+		if _, seen := newID[id]; !seen {
+			unreferenced = append(unreferenced, id)
+		}
+	}
+	sort.Strings(unreferenced)
+	for _, id := range unreferenced {
+		newID[id] = strconv.Itoa(len(newID) + 1)
+	}
+
+	for _, ref := range refs {
+		ref.ID = newID[ref.ID]
+	}
+	notes := make(map[string]*Footnote, len(book.Footnotes))
+	for id, note := range book.Footnotes {
+		note.ID = newID[id]
+		notes[note.ID] = note
+	}
+	book.Footnotes = notes
+}
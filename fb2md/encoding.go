@@ -0,0 +1,369 @@
+package fb2md
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/beevik/etree"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+var xmlEncodingRe = regexp.MustCompile(`(?i)<\?xml[^?]*encoding=["']([^"']+)["']`)
+
+// detectAndConvertEncoding reads raw bytes, detects encoding from XML declaration,
+// and converts to UTF-8 if necessary. Returns UTF-8 bytes with encoding declaration
+// removed or replaced. When the declaration is missing or wrong the encoding
+// is guessed, falling back to opts.AssumeEncoding when the guess is unsure;
+// a warning tells which encoding was used. opts.Encoding, when set, is used
+// whatever the file declares.
+func detectAndConvertEncoding(data []byte, opts Options) ([]byte, error) {
+	data, note, err := convertEncoding(data, opts)
+	if note != "" {
+		LogWarning(opts.Logger, "%s", note)
+	}
+	return data, err
+}
+
+// convertEncoding is detectAndConvertEncoding returning the warning, for
+// callers that only peek at the book.
+func convertEncoding(data []byte, opts Options) ([]byte, string, error) {
+	if opts.Encoding != "" {
+		decoded, err := forceEncoding(data, opts.Encoding)
+		return decoded, "", err
+	}
+	assume := opts.AssumeEncoding
+	if decoded, ok, err := decodeUnicodeBOM(data); ok {
+		return decoded, "", err
+	}
+
+	enc := ""
+	if match := xmlEncodingRe.FindSubmatch(data); match != nil {
+		enc = strings.ToLower(string(match[1]))
+	}
+
+	switch enc {
+	case "", "utf-8", "utf8", "utf-16", "utf-16le", "utf-16be", "unicode":
+		// A UTF-16 declaration without a byte order mark or the zero bytes
+		// of UTF-16 is wrong: the file was re-saved in an 8-bit encoding.
+		if utf8.Valid(data) {
+			return fixXMLDeclarationEncoding(data), "", nil
+		}
+		if repaired, note, ok := repairUTF8(data, assume); ok {
+			return fixXMLDeclarationEncoding(repaired), note, nil
+		}
+		return guessEncoding(data, enc, assume)
+	}
+
+	e, err := LookupEncoding(enc)
+	if err != nil {
+		return guessEncoding(data, enc, assume)
+	}
+	if !isASCII(data) && utf8.Valid(data) {
+		// Converted to UTF-8 without updating the declaration.
+		return fixXMLDeclarationEncoding(data), fmt.Sprintf("the text is UTF-8, not %s as declared", enc), nil
+	}
+	decoded, err := e.NewDecoder().Bytes(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode %s: %w", enc, err)
+	}
+	if score := charsetScore(string(decoded)); score < 0 {
+		// The declaration reads as garbage: try the encoding the text
+		// reads best in.
+		if name, ok := detectCharset(data); ok {
+			if guessed, err := decodeAs(data, name); err == nil && charsetScore(string(guessed)) > score {
+				return fixXMLDeclarationEncoding(guessed), fmt.Sprintf("the text reads as %s, not %s as declared", name, enc), nil
+			}
+		}
+	}
+	return fixXMLDeclarationEncoding(decoded), "", nil
+}
+
+// guessEncoding decodes text whose declared encoding, enc, is missing,
+// unsupported or not what the bytes are, in the encoding detectCharset
+// guesses, or assume when it is unsure.
+func guessEncoding(data []byte, enc, assume string) ([]byte, string, error) {
+	name, ok := detectCharset(data)
+	how := "guessed"
+	switch {
+	case !ok && assume != "":
+		name, how = assume, "assumed"
+	case name == "":
+		return nil, "", fmt.Errorf("cannot tell the encoding of the text; set it with --assume-encoding")
+	case !ok:
+		how = "guessed, unsure; set --assume-encoding if the text is garbled"
+	}
+	decoded, err := decodeAs(data, name)
+	if err != nil {
+		return nil, "", err
+	}
+	problem := "no encoding is declared and the text is not UTF-8"
+	if enc != "" {
+		problem = fmt.Sprintf("the text is not %s as declared", enc)
+	}
+	return fixXMLDeclarationEncoding(decoded), fmt.Sprintf("%s; reading it as %s (%s)", problem, name, how), nil
+}
+
+// encodingSniffSize is how much of a book decodeStream reads ahead to check
+// its declared encoding.
+const encodingSniffSize = 64 << 10
+
+// decodeStream returns r decoded to UTF-8 as it is read, so that a large
+// book is not held in memory twice while it is transcoded. That is done
+// when opts.Encoding is set, or when the book declares an encoding other
+// than UTF-8 or UTF-16 and its start reads as text in it. ok is false when
+// the whole book is needed to tell its encoding, and the returned reader
+// then yields r as it is, for detectAndConvertEncoding.
+func decodeStream(r io.Reader, opts Options) (decoded io.Reader, ok bool, err error) {
+	br := bufio.NewReaderSize(r, encodingSniffSize)
+	head, err := br.Peek(encodingSniffSize)
+	if err != nil && err != io.EOF {
+		return nil, false, err
+	}
+
+	name := opts.Encoding
+	if name == "" {
+		if _, bom, _ := decodeUnicodeBOM(head); bom {
+			return br, false, nil
+		}
+		match := xmlEncodingRe.FindSubmatch(head)
+		if match == nil {
+			return br, false, nil
+		}
+		name = strings.ToLower(string(match[1]))
+		switch name {
+		case "utf-8", "utf8", "utf-16", "utf-16le", "utf-16be", "unicode":
+			return br, false, nil
+		}
+		e, err := LookupEncoding(name)
+		if err != nil || !isASCII(head) && validUTF8Prefix(head) {
+			return br, false, nil
+		}
+		if text, err := e.NewDecoder().Bytes(head); err != nil || charsetScore(string(text)) < 0 {
+			return br, false, nil
+		}
+	}
+
+	e, err := LookupEncoding(name)
+	if err != nil {
+		return nil, false, err
+	}
+	if e == encoding.Encoding(unicode.UTF8) {
+		if bytes.HasPrefix(head, []byte{0xEF, 0xBB, 0xBF}) {
+			br.Discard(3)
+		}
+		return br, true, nil
+	}
+	return transform.NewReader(br, e.NewDecoder()), true, nil
+}
+
+// validUTF8Prefix reports whether data is valid UTF-8 but for a character
+// cut off at its end.
+func validUTF8Prefix(data []byte) bool {
+	for cut := 0; cut < utf8.UTFMax && cut <= len(data); cut++ {
+		if utf8.Valid(data[:len(data)-cut]) {
+			return true
+		}
+	}
+	return false
+}
+
+// readXMLStream parses an XML document from text decodeStream has already
+// decoded, whatever encoding its declaration names.
+func readXMLStream(r io.Reader) (*etree.Document, error) {
+	doc := etree.NewDocument()
+	doc.ReadSettings.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	if _, err := doc.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// repairUTF8 reads text that is mostly UTF-8 but has stray bytes of an
+// 8-bit encoding, as files edited in two programs do: the runs of invalid
+// bytes are decoded in the encoding detectCharset guesses for them, or
+// assume when it is unsure, and replaced with U+FFFD when neither names
+// one. ok is false when the text is not mostly UTF-8.
+func repairUTF8(data []byte, assume string) (repaired []byte, note string, ok bool) {
+	var runs [][2]int
+	multibyte, invalid := 0, 0
+	for i := 0; i < len(data); {
+		r, size := utf8.DecodeRune(data[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			if n := len(runs); n > 0 && runs[n-1][1] == i {
+				runs[n-1][1]++
+			} else {
+				runs = append(runs, [2]int{i, i + 1})
+			}
+			invalid++
+		case size > 1:
+			multibyte++
+		}
+		i += size
+	}
+	if multibyte <= invalid {
+		return nil, "", false
+	}
+
+	var stray []byte
+	for _, run := range runs {
+		stray = append(append(stray, data[run[0]:run[1]]...), ' ')
+	}
+	name, sure := detectCharset(stray)
+	how := "guessed"
+	switch {
+	case !sure && assume != "":
+		name, how = assume, "assumed"
+	case !sure:
+		how = "guessed, unsure; set --assume-encoding if the text is garbled"
+	}
+	var e encoding.Encoding
+	if name != "" {
+		e, _ = LookupEncoding(name)
+	}
+
+	var out bytes.Buffer
+	last := 0
+	for _, run := range runs {
+		out.Write(data[last:run[0]])
+		var decoded []byte
+		if e != nil {
+			decoded, _ = e.NewDecoder().Bytes(data[run[0]:run[1]])
+		}
+		if decoded == nil {
+			decoded = bytes.Repeat([]byte(string(utf8.RuneError)), run[1]-run[0])
+		}
+		out.Write(decoded)
+		last = run[1]
+	}
+	out.Write(data[last:])
+
+	if e == nil {
+		return out.Bytes(), fmt.Sprintf("the text is not valid UTF-8; replaced %d stray byte(s) in %d place(s) with U+FFFD", invalid, len(runs)), true
+	}
+	return out.Bytes(), fmt.Sprintf("the text is not valid UTF-8; read %d stray byte(s) in %d place(s) as %s (%s)", invalid, len(runs), name, how), true
+}
+
+// forceEncoding decodes data from the named encoding, ignoring the XML
+// declaration. A UTF-8 byte order mark is dropped; UTF-16 follows its own.
+func forceEncoding(data []byte, name string) ([]byte, error) {
+	e, err := LookupEncoding(name)
+	if err != nil {
+		return nil, err
+	}
+	if e == encoding.Encoding(unicode.UTF8) {
+		return fixXMLDeclarationEncoding(bytes.TrimPrefix(data, []byte{0xEF, 0xBB, 0xBF})), nil
+	}
+	decoded, err := decodeAs(data, name)
+	if err != nil {
+		return nil, err
+	}
+	return fixXMLDeclarationEncoding(decoded), nil
+}
+
+// decodeAs decodes data from the named encoding.
+func decodeAs(data []byte, name string) ([]byte, error) {
+	e, err := LookupEncoding(name)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := e.NewDecoder().Bytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", name, err)
+	}
+	return decoded, nil
+}
+
+func isASCII(data []byte) bool {
+	for _, b := range data {
+		if b >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// encodingAliases maps encoding names found in FB2 files that no registry
+// knows to the IANA name.
+var encodingAliases = map[string]string{
+	"win-1251":     "windows-1251",
+	"koi8r":        "koi8-r",
+	"koi8u":        "koi8-u",
+	"dos-866":      "ibm866",
+	"mac-cyrillic": "x-mac-cyrillic",
+	"maccyrillic":  "x-mac-cyrillic",
+	"cp932":        "shift_jis",
+	"euc-cn":       "gbk",
+	"cp950":        "big5",
+	"x-big5":       "big5",
+}
+
+// LookupEncoding returns the encoding with the given name: an IANA charset
+// name or alias such as windows-1250, iso-8859-5 or cp866, else a label of
+// the WHATWG Encoding Standard, which adds the cp125x names and
+// x-mac-cyrillic.
+func LookupEncoding(name string) (encoding.Encoding, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if alias, ok := encodingAliases[name]; ok {
+		name = alias
+	}
+	if e, err := ianaindex.IANA.Encoding(name); err == nil && e != nil {
+		return e, nil
+	}
+	if e, err := htmlindex.Get(name); err == nil && e != nil {
+		return e, nil
+	}
+	return nil, fmt.Errorf("unsupported encoding: %s", name)
+}
+
+// decodeUnicodeBOM recognizes UTF-8 and UTF-16 text by its byte order mark,
+// or UTF-16 without one by the zero bytes around the "<?" that starts an XML
+// declaration, and returns it as UTF-8 without the mark, with the
+// declaration saying utf-8. ok is false for other data.
+func decodeUnicodeBOM(data []byte) (decoded []byte, ok bool, err error) {
+	var enc encoding.Encoding
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return fixXMLDeclarationEncoding(data[3:]), true, nil
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}),
+		bytes.HasPrefix(data, []byte{'<', 0, '?', 0}):
+		enc = unicode.UTF16(unicode.LittleEndian, unicode.UseBOM)
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}),
+		bytes.HasPrefix(data, []byte{0, '<', 0, '?'}):
+		enc = unicode.UTF16(unicode.BigEndian, unicode.UseBOM)
+	default:
+		return nil, false, nil
+	}
+	// UseBOM follows and drops the mark when present, and keeps to the
+	// given byte order otherwise.
+	decoded, err = enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to decode utf-16: %w", err)
+	}
+	return fixXMLDeclarationEncoding(decoded), true, nil
+}
+
+// fixXMLDeclarationEncoding replaces the encoding in XML declaration with utf-8
+// so the XML parser doesn't complain.
+func fixXMLDeclarationEncoding(data []byte) []byte {
+	if !xmlEncodingRe.Match(data) {
+		return data
+	}
+	return xmlEncodingRe.ReplaceAll(data, bytes.Replace(
+		xmlEncodingRe.Find(data),
+		xmlEncodingRe.FindSubmatch(data)[1],
+		[]byte("utf-8"),
+		1,
+	))
+}
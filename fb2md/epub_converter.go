@@ -0,0 +1,627 @@
+package fb2md
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"unicode"
+
+	"github.com/beevik/etree"
+)
+
+type EpubConverter struct {
+	files map[string]*zip.File
+	opts  Options
+	// toc holds the table of contents entries of each spine document.
+	toc map[string][]tocEntry
+	// tocLevel is the heading level of the last TOC entry converted.
+	tocLevel int
+	// binaries holds the images the book refers to by id; imageIDs maps
+	// the paths of the image files among them to their ids.
+	binaries []Binary
+	imageIDs map[string]string
+	// svgCount numbers the drawings extracted from <svg> elements.
+	svgCount int
+	// mediaTypes holds the media types of the manifest items by path.
+	mediaTypes map[string]string
+	// pages holds the page list entries pointing into each spine document.
+	pages map[string][]tocEntry
+	// coverPage is the spine document the OPF guide or the landmarks name
+	// as the cover.
+	coverPage string
+	// docDir is the directory of the document being converted, which
+	// its links are relative to.
+	docDir string
+	// css holds the emphasis the book's stylesheets give classes; styles
+	// adds the <style> elements of the document being converted.
+	css    cssStyles
+	styles cssStyles
+}
+
+func NewEpubConverter() *EpubConverter {
+	return &EpubConverter{
+		files:    make(map[string]*zip.File),
+		imageIDs: make(map[string]string),
+	}
+}
+
+// Convert converts an EPUB read from r and writes it to w, as
+// ConvertStream does.
+func (e *EpubConverter) Convert(r io.Reader, w io.Writer, opts Options) error {
+	opts.out = w
+	return e.ConvertReader(r, "", opts)
+}
+
+// ConvertReader converts an EPUB read from r.
+func (e *EpubConverter) ConvertReader(r io.Reader, outputFile string, opts Options) error {
+	reader, err := openZipReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to open EPUB: %w", err)
+	}
+	return e.convertZip(reader, outputFile, opts)
+}
+
+func (e *EpubConverter) convertZip(reader *zip.Reader, outputFile string, opts Options) error {
+	e.opts = opts
+	if err := checkZipArchive(reader, opts); err != nil {
+		return fmt.Errorf("unsafe EPUB: %w", err)
+	}
+	e.files = make(map[string]*zip.File)
+	for _, f := range reader.File {
+		e.files[f.Name] = f
+	}
+
+	if err := e.checkDRM(); err != nil {
+		return err
+	}
+
+	rootFile, err := e.findRootFile()
+	if err != nil {
+		return err
+	}
+
+	spineDocs, err := e.getSpineDocuments(rootFile)
+	if err != nil {
+		return err
+	}
+
+	nav := e.readNavigation(rootFile)
+	e.toc = make(map[string][]tocEntry)
+	for _, entry := range nav.toc {
+		e.toc[entry.Doc] = append(e.toc[entry.Doc], entry)
+	}
+	e.pages = make(map[string][]tocEntry)
+	for _, page := range nav.pages {
+		e.pages[page.Doc] = append(e.pages[page.Doc], page)
+	}
+	if e.coverPage == "" {
+		e.coverPage = nav.cover
+	}
+
+	e.binaries = nil
+	e.imageIDs = make(map[string]string)
+	e.svgCount = 0
+	e.mediaTypes = e.readMediaTypes(rootFile)
+	e.css = e.readStyles(rootFile)
+	book := &Book{Meta: e.readMetadata(rootFile)}
+	for _, docPath := range spineDocs {
+		if err := opts.guard.err(); err != nil {
+			return err
+		}
+		if strings.HasPrefix(e.mediaType(docPath), "image/") {
+			// An SVG content document is a page that is all drawing.
+			if id := e.embedImage(docPath); id != "" {
+				book.Body = append(book.Body, &Chapter{Blocks: []Block{&Image{ID: id}}})
+			}
+			continue
+		}
+		content, err := e.readFile(docPath)
+		if err != nil {
+			LogWarning(e.opts.Logger, "failed to read %s: %v", docPath, err)
+			continue
+		}
+
+		blocks := e.xhtmlToBlocks(content, docPath)
+		switch {
+		case len(blocks) == 0:
+		case e.isCoverPage(docPath, blocks, book.Meta):
+			LogInfo(e.opts.Logger, "left out the cover page %s; the cover is in the metadata", docPath)
+		default:
+			book.Body = append(book.Body, &Chapter{Blocks: blocks})
+		}
+	}
+
+	if opts.StripGutenberg {
+		var header gutenbergMeta
+		book.Body, header = stripGutenbergBlocks(book.Body)
+		// The header names the title and authors as the text has them.
+		if meta := header.metadata(); meta != nil && book.Meta == nil {
+			book.Meta = meta
+		} else if meta != nil {
+			if meta.Title != "" {
+				book.Meta.Title = meta.Title
+			}
+			if len(meta.Authors) > 0 {
+				book.Meta.Authors = meta.Authors
+			}
+		}
+	}
+	book.Binaries = e.binaries
+
+	return writeBook(book, outputFile, opts)
+}
+
+// findRootFile returns the package document of the book: the first
+// rootfile of container.xml that is an OPF package present in the archive.
+// Books with several renditions list the default one first.
+func (e *EpubConverter) findRootFile() (string, error) {
+	container, err := e.readFile("META-INF/container.xml")
+	if err != nil {
+		return "", fmt.Errorf("failed to read container.xml: %w", err)
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(container); err != nil {
+		return "", fmt.Errorf("failed to parse container.xml: %w", err)
+	}
+
+	rootFiles := doc.FindElements(".//rootfile")
+	if len(rootFiles) == 0 {
+		return "", fmt.Errorf("invalid EPUB: rootfile not found")
+	}
+
+	var missing []string
+	for _, rootFileElem := range rootFiles {
+		mediaType := rootFileElem.SelectAttrValue("media-type", "")
+		if mediaType != "" && mediaType != "application/oebps-package+xml" {
+			continue
+		}
+		rootPath := rootFileElem.SelectAttrValue("full-path", "")
+		if rootPath == "" {
+			continue
+		}
+		if _, ok := e.files[rootPath]; !ok {
+			missing = append(missing, rootPath)
+			continue
+		}
+		return rootPath, nil
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("invalid EPUB: rootfile %s not found", missing[0])
+	}
+	return "", fmt.Errorf("invalid EPUB: rootfile path missing")
+}
+
+// getSpineDocuments returns the content documents of the book in spine
+// order, those marked linear="no", such as notes, where the spine lists
+// them. The navigation document is left out when it is not linear, as is
+// an item listed twice; the cover page is found by e.isCoverPage later.
+func (e *EpubConverter) getSpineDocuments(rootFile string) ([]string, error) {
+	doc, err := e.readXML(rootFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read root file %s: %w", rootFile, err)
+	}
+
+	manifest := doc.FindElement(".//manifest")
+	spine := doc.FindElement(".//spine")
+	if manifest == nil || spine == nil {
+		return nil, fmt.Errorf("invalid EPUB: manifest or spine missing")
+	}
+
+	items := make(map[string]*etree.Element)
+	for _, item := range manifest.SelectElements("item") {
+		if id := item.SelectAttrValue("id", ""); id != "" && item.SelectAttrValue("href", "") != "" {
+			items[id] = item
+		}
+	}
+
+	baseDir := path.Dir(rootFile)
+	var docs []string
+	seen := make(map[string]bool)
+	for _, itemRef := range spine.SelectElements("itemref") {
+		idRef := itemRef.SelectAttrValue("idref", "")
+		item, ok := items[idRef]
+		if !ok {
+			if idRef != "" {
+				LogWarning(e.opts.Logger, "spine item %s is not in the manifest", idRef)
+			}
+			continue
+		}
+		href := resolveHref(baseDir, item.SelectAttrValue("href", ""))
+		if seen[href] {
+			LogInfo(e.opts.Logger, "spine item %s lists %s again; left out", idRef, href)
+			continue
+		}
+		seen[href] = true
+
+		if itemRef.SelectAttrValue("linear", "yes") == "no" && containsString(strings.Fields(item.SelectAttrValue("properties", "")), "nav") {
+			LogInfo(e.opts.Logger, "left out the navigation document %s", href)
+			continue
+		}
+		docs = append(docs, href)
+	}
+
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("no spine documents found in EPUB")
+	}
+
+	e.coverPage = ""
+	for _, ref := range doc.FindElements(".//guide/reference") {
+		if ref.SelectAttrValue("type", "") == "cover" {
+			href, _, _ := strings.Cut(ref.SelectAttrValue("href", ""), "#")
+			e.coverPage = resolveHref(baseDir, href)
+		}
+	}
+
+	return docs, nil
+}
+
+// isCoverPage reports whether the blocks of the spine document docPath are
+// only a cover wrapper: no text, and no image but the cover, or, for the
+// page the OPF guide calls the cover, no image but one. The cover itself is
+// kept in the metadata, and --cover image puts it back in the text.
+func (e *EpubConverter) isCoverPage(docPath string, blocks []Block, meta *Metadata) bool {
+	if strings.TrimSpace(blocksText(blocks)) != "" {
+		return false
+	}
+	var ids []string
+	WalkBlocks(blocks, func(node any) {
+		if img, ok := node.(*Image); ok {
+			ids = append(ids, img.ID)
+		}
+	})
+	if len(ids) == 0 {
+		return false
+	}
+	if docPath == e.coverPage && len(ids) == 1 {
+		return true
+	}
+	for _, id := range ids {
+		if meta == nil || id == "" || id != meta.Cover {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *EpubConverter) readFile(name string) ([]byte, error) {
+	file, ok := e.files[name]
+	if !ok {
+		return nil, fmt.Errorf("file %s not found in EPUB", name)
+	}
+
+	rc, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+
+	return data, nil
+}
+
+// xhtmlToBlocks converts the spine document at docPath.
+func (e *EpubConverter) xhtmlToBlocks(content []byte, docPath string) []Block {
+	// Replace incompatible entities
+	contentStr := string(content)
+	contentStr = strings.ReplaceAll(contentStr, "&nbsp;", "&#160;")
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(contentStr); err != nil {
+		LogWarning(e.opts.Logger, "failed to parse XHTML: %v", err)
+		return nil
+	}
+
+	body := doc.FindElement(".//body")
+	if body == nil {
+		// Try with namespace
+		body = doc.FindElement(".//{http://www.w3.org/1999/xhtml}body")
+	}
+	if body == nil {
+		return nil
+	}
+
+	e.styles = e.css.withDocument(doc)
+	e.docDir = path.Dir(docPath)
+	if e.opts.StripGutenberg {
+		removeGutenbergBoilerplate(body)
+	}
+	if len(e.toc) > 0 {
+		e.applyTOC(body, e.toc[docPath])
+	}
+
+	if scripts := len(body.FindElements(".//script")); scripts > 0 {
+		LogWarning(e.opts.Logger, "%s: left out %d script(s); interactive content is shown as placeholders", docPath, scripts)
+	}
+
+	anchors := pageAnchors(body, e.pages[docPath])
+	var blocks []Block
+	for _, child := range body.ChildElements() {
+		built := e.buildBlocks(child)
+		if len(built) > 0 {
+			if p, ok := built[0].(*Paragraph); ok && p.ID == "" {
+				p.ID = anchors[child]
+			}
+		}
+		blocks = append(blocks, built...)
+	}
+	return blocks
+}
+
+// buildBlocks converts elem, taking the blocks out of a section wrapper
+// (section, article or div) rather than running them into one paragraph.
+func (e *EpubConverter) buildBlocks(elem *etree.Element) []Block {
+	if tag := strings.ToLower(elem.Tag); tag == "script" || tag == "style" {
+		return nil
+	}
+	if !isContainerTag(elem.Tag) || !holdsBlocks(elem) {
+		return []Block{e.buildBlock(elem)}
+	}
+	var blocks []Block
+	for _, child := range elem.ChildElements() {
+		blocks = append(blocks, e.buildBlocks(child)...)
+	}
+	return blocks
+}
+
+// holdsBlocks reports whether elem holds block elements and no text of its
+// own, which would be lost were its children converted one by one.
+func holdsBlocks(elem *etree.Element) bool {
+	if strings.TrimSpace(elem.Text()) != "" {
+		return false
+	}
+	blocks := false
+	for _, child := range elem.ChildElements() {
+		if strings.TrimSpace(child.Tail()) != "" {
+			return false
+		}
+		switch tag := strings.ToLower(child.Tag); {
+		case isHeadingTag(tag), isContainerTag(tag):
+			blocks = true
+		case tag == "p", tag == "blockquote", tag == "ul", tag == "ol", tag == "figure", tag == "table", tag == "pre", tag == "hr":
+			blocks = true
+		}
+	}
+	return blocks
+}
+
+func (e *EpubConverter) buildBlock(elem *etree.Element) Block {
+	tag := strings.ToLower(elem.Tag)
+
+	switch tag {
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		return &Heading{Level: int(tag[1] - '0'), Text: e.extractText(elem)}
+	case "p", "div":
+		return &Paragraph{Inlines: styled(e.buildInlines(elem, '\n'), e.styles.elementStyle(elem))}
+	case "blockquote":
+		return e.buildQuote(elem)
+	case "ul":
+		return e.buildList(elem, false)
+	case "ol":
+		return e.buildList(elem, true)
+	case "img":
+		return e.image(elem)
+	case "svg":
+		return e.svgImage(elem)
+	case "audio", "video", "object", "embed", "iframe", "canvas":
+		if media := e.media(elem); media != nil {
+			return media
+		}
+		return &Paragraph{Inlines: e.buildInlines(elem, '\n')}
+	case "figure":
+		// A figure with one image or drawing and its caption becomes a
+		// captioned image.
+		imgs := elem.FindElements(".//img")
+		svgs := elem.FindElements(".//svg")
+		if len(imgs)+len(svgs) == 1 {
+			var img *Image
+			if len(imgs) == 1 {
+				img = e.image(imgs[0])
+			} else {
+				img = e.svgImage(svgs[0])
+			}
+			if caption := elem.FindElement(".//figcaption"); caption != nil {
+				img.Title = e.extractText(caption)
+			}
+			return img
+		}
+		return &Paragraph{Inlines: e.buildInlines(elem, '\n')}
+	case "br":
+		return &Plain{Inlines: []Inline{&LineBreak{}}}
+	case "hr":
+		return &HorizontalRule{}
+	default:
+		return &Paragraph{Inlines: e.buildInlines(elem, '\n')}
+	}
+}
+
+// buildQuote turns a blockquote into one line per child element.
+func (e *EpubConverter) buildQuote(elem *etree.Element) *Quote {
+	quote := &Quote{}
+	b := &inlineBuilder{}
+	b.text(normalizeInlineWhitespace(elem.Text(), false, true))
+
+	children := elem.ChildElements()
+	if strings.TrimSpace(plainText(b.inlines)) != "" && len(children) > 0 {
+		quote.Lines = append(quote.Lines, b.newLine())
+	}
+	for _, child := range children {
+		e.buildInlineContent(child, b)
+		b.text(normalizeInlineWhitespace(child.Tail(), true, true))
+		quote.Lines = append(quote.Lines, b.newLine())
+	}
+	if len(b.inlines) > 0 {
+		quote.Lines = append(quote.Lines, b.inlines)
+	}
+	return quote
+}
+
+func (e *EpubConverter) buildList(list *etree.Element, ordered bool) *List {
+	l := &List{Ordered: ordered}
+	for _, item := range list.SelectElements("li") {
+		l.Items = append(l.Items, e.buildInlines(item, ' '))
+	}
+	return l
+}
+
+// buildInlines returns the inline content of elem. last is the character
+// the content follows, which decides whether leading whitespace is kept.
+func (e *EpubConverter) buildInlines(elem *etree.Element, last byte) []Inline {
+	b := &inlineBuilder{last: last}
+	e.buildInlineContent(elem, b)
+	return b.inlines
+}
+
+func (e *EpubConverter) buildInlineContent(elem *etree.Element, b *inlineBuilder) {
+	b.text(normalizeInlineWhitespace(elem.Text(), false, true))
+
+	for _, child := range elem.ChildElements() {
+		switch strings.ToLower(child.Tag) {
+		case "em", "i":
+			b.add(&Emphasis{Children: e.buildNested(child, b, '*')}, '*')
+		case "strong", "b":
+			b.add(&Strong{Children: e.buildNested(child, b, '*')}, '*')
+		case "code":
+			b.add(&Code{Children: e.buildNested(child, b, '`')}, '`')
+		case "sup":
+			children := e.buildNested(child, b, b.last)
+			b.add(&Superscript{Children: children}, b.last)
+		case "sub":
+			children := e.buildNested(child, b, b.last)
+			b.add(&Subscript{Children: children}, b.last)
+		case "a":
+			href := child.SelectAttrValue("href", "")
+			linkText := e.extractText(child)
+			if linkText == "" {
+				linkText = href
+			}
+			b.add(&Link{Href: href, Children: []Inline{&Text{Value: linkText}}}, ')')
+		case "img":
+			b.add(e.image(child), ')')
+		case "svg":
+			b.add(e.svgImage(child), ')')
+		case "audio", "video", "object", "embed", "iframe", "canvas":
+			if media := e.media(child); media != nil {
+				b.add(media, ')')
+			} else {
+				e.buildInlineContent(child, b)
+			}
+		case "script", "style":
+		case "br":
+			b.add(&LineBreak{}, '\n')
+		default:
+			// Spans styled as italic or bold by CSS.
+			if style := e.styles.elementStyle(child); style.italic || style.bold {
+				for _, in := range styled(e.buildNested(child, b, '*'), style) {
+					b.add(in, '*')
+				}
+			} else {
+				e.buildInlineContent(child, b)
+			}
+		}
+
+		b.text(normalizeInlineWhitespace(child.Tail(), true, true))
+	}
+}
+
+// buildNested builds the children of a formatting element. open is the
+// character its markup starts with, which whitespace inside is collapsed against.
+func (e *EpubConverter) buildNested(elem *etree.Element, b *inlineBuilder, open byte) []Inline {
+	outer := b.inlines
+	b.inlines = nil
+	b.last = open
+	e.buildInlineContent(elem, b)
+	children := b.inlines
+	b.inlines = outer
+	return children
+}
+
+func (e *EpubConverter) extractText(elem *etree.Element) string {
+	var text strings.Builder
+
+	if elem.Text() != "" {
+		text.WriteString(elem.Text())
+	}
+
+	for _, child := range elem.ChildElements() {
+		text.WriteString(e.extractText(child))
+		if child.Tail() != "" {
+			text.WriteString(child.Tail())
+		}
+	}
+
+	return strings.TrimSpace(text.String())
+}
+
+func normalizeInlineWhitespace(s string, preserveLeading, preserveTrailing bool) string {
+	if s == "" {
+		return ""
+	}
+
+	hasLeading := preserveLeading && strings.TrimLeftFunc(s, unicode.IsSpace) != s
+	hasTrailing := preserveTrailing && strings.TrimRightFunc(s, unicode.IsSpace) != s
+
+	trimmed := strings.TrimSpace(s)
+	if trimmed == "" {
+		if hasLeading || hasTrailing {
+			return " "
+		}
+		return ""
+	}
+
+	collapsed := strings.Join(strings.Fields(trimmed), " ")
+	if hasLeading {
+		collapsed = " " + collapsed
+	}
+	if hasTrailing {
+		collapsed += " "
+	}
+	return collapsed
+}
+
+// inlineBuilder collects inline nodes, dropping whitespace that would
+// follow a space or line break, as it collapses in rendered HTML.
+type inlineBuilder struct {
+	inlines []Inline
+	// last is the last character of the content so far, 0 at the start.
+	last byte
+}
+
+func (b *inlineBuilder) add(in Inline, last byte) {
+	b.inlines = append(b.inlines, in)
+	b.last = last
+}
+
+func (b *inlineBuilder) text(s string) {
+	if s == "" {
+		return
+	}
+
+	if b.last == 0 {
+		if strings.TrimSpace(s) == "" {
+			return
+		}
+		s = strings.TrimLeft(s, " ")
+	} else if strings.HasPrefix(s, " ") && (b.last == ' ' || b.last == '\n') {
+		s = strings.TrimLeft(s, " ")
+		if s == "" {
+			return
+		}
+	}
+
+	b.add(&Text{Value: s}, s[len(s)-1])
+}
+
+// newLine returns the inlines collected so far and starts a new line.
+func (b *inlineBuilder) newLine() []Inline {
+	line := b.inlines
+	b.inlines = nil
+	b.last = '\n'
+	return line
+}
@@ -0,0 +1,161 @@
+package fb2md
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+var cssCommentRe = regexp.MustCompile(`(?s)/\*.*?\*/`)
+
+// textStyle is the emphasis CSS gives an element. The set flags tell a
+// declared "normal" apart from no declaration.
+type textStyle struct {
+	italic, bold       bool
+	setItalic, setBold bool
+}
+
+// merge applies the declarations of o over s.
+func (s *textStyle) merge(o textStyle) {
+	if o.setItalic {
+		s.italic, s.setItalic = o.italic, true
+	}
+	if o.setBold {
+		s.bold, s.setBold = o.bold, true
+	}
+}
+
+// cssStyles maps class names to the emphasis the stylesheets give them.
+type cssStyles map[string]textStyle
+
+// readStyles reads the stylesheets of the EPUB whose package document is
+// rootFile.
+func (e *EpubConverter) readStyles(rootFile string) cssStyles {
+	styles := make(cssStyles)
+	opf, err := e.readXML(rootFile)
+	if err != nil {
+		return styles
+	}
+	for _, item := range opf.FindElements(".//manifest/item") {
+		if item.SelectAttrValue("media-type", "") != "text/css" {
+			continue
+		}
+		if data, err := e.readFile(resolveHref(path.Dir(rootFile), item.SelectAttrValue("href", ""))); err == nil {
+			styles.parse(string(data))
+		}
+	}
+	return styles
+}
+
+// withDocument returns the styles with those of the <style> elements of
+// an XHTML document added.
+func (c cssStyles) withDocument(doc *etree.Document) cssStyles {
+	elems := doc.FindElements(".//style")
+	if len(elems) == 0 {
+		return c
+	}
+	styles := make(cssStyles, len(c))
+	for class, style := range c {
+		styles[class] = style
+	}
+	for _, elem := range elems {
+		styles.parse(elem.Text())
+	}
+	return styles
+}
+
+// parse adds the rules of a stylesheet whose selector ends in a single
+// class, such as ".italic", "span.it" or "p .em". Other selectors are
+// ignored, as are rules in at-rule blocks other than their own braces.
+func (c cssStyles) parse(css string) {
+	css = cssCommentRe.ReplaceAllString(css, "")
+	for _, rule := range strings.Split(css, "}") {
+		i := strings.LastIndex(rule, "{")
+		if i < 0 {
+			continue
+		}
+		style := parseDeclarations(rule[i+1:])
+		if !style.setItalic && !style.setBold {
+			continue
+		}
+		selectors := rule[:i]
+		if j := strings.LastIndexAny(selectors, "{;"); j >= 0 {
+			selectors = selectors[j+1:]
+		}
+		for _, selector := range strings.Split(selectors, ",") {
+			if class := selectorClass(selector); class != "" {
+				merged := c[class]
+				merged.merge(style)
+				c[class] = merged
+			}
+		}
+	}
+}
+
+// selectorClass returns the class the last compound of selector requires,
+// or "" unless it requires exactly one class and nothing else but a tag.
+func selectorClass(selector string) string {
+	parts := strings.FieldsFunc(selector, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\n' || r == '>' || r == '+' || r == '~'
+	})
+	if len(parts) == 0 {
+		return ""
+	}
+	last := parts[len(parts)-1]
+	if strings.ContainsAny(last, ":[#*") || strings.Count(last, ".") != 1 {
+		return ""
+	}
+	_, class, _ := strings.Cut(last, ".")
+	return class
+}
+
+// parseDeclarations reads the font-style and font-weight declarations of a
+// rule body or style attribute.
+func parseDeclarations(decls string) textStyle {
+	var style textStyle
+	for _, decl := range strings.Split(decls, ";") {
+		name, value, ok := strings.Cut(decl, ":")
+		if !ok {
+			continue
+		}
+		value = strings.ToLower(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "!important")))
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "font-style":
+			style.italic = value == "italic" || value == "oblique"
+			style.setItalic = true
+		case "font-weight":
+			weight, err := strconv.Atoi(value)
+			style.bold = value == "bold" || value == "bolder" || err == nil && weight >= 600
+			style.setBold = true
+		}
+	}
+	return style
+}
+
+// elementStyle returns the emphasis the classes and style attribute of
+// elem give it.
+func (c cssStyles) elementStyle(elem *etree.Element) textStyle {
+	var style textStyle
+	for _, class := range strings.Fields(elem.SelectAttrValue("class", "")) {
+		style.merge(c[class])
+	}
+	style.merge(parseDeclarations(elem.SelectAttrValue("style", "")))
+	return style
+}
+
+// styled wraps inlines in the emphasis style calls for.
+func styled(inlines []Inline, style textStyle) []Inline {
+	if len(inlines) == 0 {
+		return inlines
+	}
+	if style.italic {
+		inlines = []Inline{&Emphasis{Children: inlines}}
+	}
+	if style.bold {
+		inlines = []Inline{&Strong{Children: inlines}}
+	}
+	return inlines
+}
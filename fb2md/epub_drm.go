@@ -0,0 +1,62 @@
+package fb2md
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrDRMProtected is returned for an EPUB whose content is encrypted.
+var ErrDRMProtected = errors.New("file is DRM-protected")
+
+// fontObfuscation lists the encryption algorithms EPUB uses to obfuscate
+// embedded fonts, which leave the text readable.
+var fontObfuscation = []string{
+	"http://www.idpf.org/2008/embedding",
+	"http://ns.adobe.com/pdf/enc#RC",
+}
+
+// checkDRM returns an error wrapping ErrDRMProtected, naming the scheme
+// when it is known, if META-INF/encryption.xml encrypts anything other
+// than fonts. Without the key such books convert to garbage or nothing.
+func (e *EpubConverter) checkDRM() error {
+	if _, ok := e.files["META-INF/encryption.xml"]; !ok {
+		return nil
+	}
+	doc, err := e.readXML("META-INF/encryption.xml")
+	if err != nil {
+		return fmt.Errorf("%w: unreadable encryption.xml", ErrDRMProtected)
+	}
+	encrypted := 0
+	for _, data := range doc.FindElements(".//EncryptedData") {
+		method := data.FindElement(".//EncryptionMethod")
+		if method != nil && containsString(fontObfuscation, method.SelectAttrValue("Algorithm", "")) {
+			continue
+		}
+		encrypted++
+	}
+	if encrypted == 0 {
+		return nil
+	}
+	if scheme := e.drmScheme(); scheme != "" {
+		return fmt.Errorf("%w (%s): %d encrypted file(s)", ErrDRMProtected, scheme, encrypted)
+	}
+	return fmt.Errorf("%w: %d encrypted file(s)", ErrDRMProtected, encrypted)
+}
+
+// drmScheme names the DRM of an encrypted book from the license files it
+// carries, or returns "".
+func (e *EpubConverter) drmScheme() string {
+	switch {
+	case e.files["META-INF/license.lcpl"] != nil:
+		return "Readium LCP"
+	case e.files["META-INF/sinf.xml"] != nil:
+		return "Apple FairPlay"
+	case e.files["META-INF/rights.xml"] != nil:
+		if data, err := e.readFile("META-INF/rights.xml"); err == nil && strings.Contains(string(data), "adobe.com/adept") {
+			return "Adobe ADEPT"
+		}
+		return "Adobe or Barnes & Noble"
+	}
+	return ""
+}
@@ -0,0 +1,288 @@
+package fb2md
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+const svgMediaType = "image/svg+xml"
+
+// wellKnownNamespaces are declared on extracted SVG that uses their
+// prefixes without declaring them, as SVG inlined in XHTML may.
+var wellKnownNamespaces = map[string]string{
+	"svg":   "http://www.w3.org/2000/svg",
+	"xlink": "http://www.w3.org/1999/xlink",
+}
+
+// readMediaTypes returns the media type of each manifest item of the EPUB
+// whose package document is rootFile, by path.
+func (e *EpubConverter) readMediaTypes(rootFile string) map[string]string {
+	types := make(map[string]string)
+	opf, err := e.readXML(rootFile)
+	if err != nil {
+		return types
+	}
+	for _, item := range opf.FindElements(".//manifest/item") {
+		if href := item.SelectAttrValue("href", ""); href != "" {
+			types[resolveHref(path.Dir(rootFile), href)] = item.SelectAttrValue("media-type", "")
+		}
+	}
+	return types
+}
+
+// mediaType returns the media type of a file of the EPUB: the manifest's,
+// else the one its extension implies.
+func (e *EpubConverter) mediaType(name string) string {
+	if t := e.mediaTypes[name]; t != "" {
+		return t
+	}
+	t, _, _ := strings.Cut(mime.TypeByExtension(path.Ext(name)), ";")
+	return t
+}
+
+// embedImage adds the image file name of the EPUB to the book's binaries,
+// once however often it is used, and returns its id: the file name, with a
+// number added when another image has it. It returns "" when the file
+// cannot be read.
+func (e *EpubConverter) embedImage(name string) string {
+	if id, ok := e.imageIDs[name]; ok {
+		return id
+	}
+	data, err := e.readFile(name)
+	if err != nil {
+		return ""
+	}
+	id := e.addBinary(path.Base(name), e.mediaType(name), data)
+	e.imageIDs[name] = id
+	return id
+}
+
+// addBinary adds data to the book's binaries under an id made unique from
+// name, and returns the id.
+func (e *EpubConverter) addBinary(name, contentType string, data []byte) string {
+	taken := make(map[string]bool, len(e.binaries))
+	for _, bin := range e.binaries {
+		taken[bin.ID] = true
+	}
+	ext := path.Ext(name)
+	id := name
+	for n := 2; taken[id]; n++ {
+		id = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), n, ext)
+	}
+	e.binaries = append(e.binaries, Binary{
+		ID:          id,
+		ContentType: contentType,
+		Data:        base64.StdEncoding.EncodeToString(data),
+	})
+	return id
+}
+
+// image converts an <img>. Images in the book are embedded like FB2
+// binaries, so that they are extracted with -i; links out of the book and
+// data URIs are kept as they are.
+func (e *EpubConverter) image(elem *etree.Element) *Image {
+	img := &Image{
+		Alt:   strings.TrimSpace(elem.SelectAttrValue("alt", "")),
+		Title: strings.TrimSpace(elem.SelectAttrValue("title", "")),
+	}
+	src := elem.SelectAttrValue("src", "")
+	if id := e.embedHref(src); id != "" {
+		img.ID = id
+	} else {
+		img.Href = src
+	}
+	return img
+}
+
+// embedHref embeds the image a link from the current document points to
+// and returns its id, or "" for links out of the book.
+func (e *EpubConverter) embedHref(href string) string {
+	if href == "" || strings.Contains(href, ":") {
+		return ""
+	}
+	href, _, _ = strings.Cut(href, "#")
+	return e.embedImage(resolveHref(e.docDir, href))
+}
+
+// svgImage converts an <svg> element of an XHTML document. An <svg> that
+// only wraps an <image>, as cover pages do to scale it, is that image;
+// other drawings are extracted as .svg files of their own.
+func (e *EpubConverter) svgImage(elem *etree.Element) *Image {
+	img := &Image{}
+	if title := childByLocalName(elem, "title"); title != nil {
+		img.Alt = strings.TrimSpace(e.extractText(title))
+	}
+
+	var drawing []*etree.Element
+	for _, child := range elem.ChildElements() {
+		switch strings.ToLower(child.Tag) {
+		case "title", "desc", "metadata":
+		default:
+			drawing = append(drawing, child)
+		}
+	}
+	if len(drawing) == 1 && strings.ToLower(drawing[0].Tag) == "image" {
+		href := svgImageHref(drawing[0])
+		if id := e.embedHref(href); id != "" {
+			img.ID = id
+		} else {
+			img.Href = href
+		}
+		return img
+	}
+
+	data, err := e.standaloneSVG(elem)
+	if err != nil {
+		LogWarning(e.opts.Logger, "failed to extract SVG: %v", err)
+		return img
+	}
+	e.svgCount++
+	img.ID = e.addBinary(fmt.Sprintf("svg-%d.svg", e.svgCount), svgMediaType, data)
+	return img
+}
+
+// standaloneSVG serializes an <svg> element as an SVG file: namespaces it
+// inherits from the XHTML document are declared on it, and the images it
+// draws are embedded as data URIs, since their links would not resolve
+// from the images directory.
+func (e *EpubConverter) standaloneSVG(elem *etree.Element) ([]byte, error) {
+	root := elem.Copy()
+	if root.Space == "" && root.SelectAttr("xmlns") == nil {
+		root.CreateAttr("xmlns", wellKnownNamespaces["svg"])
+	}
+	for _, prefix := range usedPrefixes(root) {
+		if root.SelectAttr("xmlns:"+prefix) != nil {
+			continue
+		}
+		if uri := inheritedNamespace(elem, prefix); uri != "" {
+			root.CreateAttr("xmlns:"+prefix, uri)
+		}
+	}
+
+	for _, image := range root.FindElements(".//*") {
+		if strings.ToLower(image.Tag) != "image" {
+			continue
+		}
+		attr := image.SelectAttr("xlink:href")
+		if attr == nil {
+			attr = image.SelectAttr("href")
+		}
+		if attr == nil || attr.Value == "" || strings.Contains(attr.Value, ":") {
+			continue
+		}
+		name := resolveHref(e.docDir, attr.Value)
+		if data, err := e.readFile(name); err == nil {
+			attr.Value = "data:" + e.mediaType(name) + ";base64," + base64.StdEncoding.EncodeToString(data)
+		}
+	}
+
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	doc.SetRoot(root)
+	return doc.WriteToBytes()
+}
+
+// usedPrefixes returns the namespace prefixes of the tags and attributes
+// under and including elem.
+func usedPrefixes(elem *etree.Element) []string {
+	var prefixes []string
+	add := func(prefix string) {
+		if prefix != "" && prefix != "xmlns" && prefix != "xml" && !containsString(prefixes, prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	var walk func(el *etree.Element)
+	walk = func(el *etree.Element) {
+		add(el.Space)
+		for _, attr := range el.Attr {
+			add(attr.Space)
+		}
+		for _, child := range el.ChildElements() {
+			walk(child)
+		}
+	}
+	walk(elem)
+	return prefixes
+}
+
+// inheritedNamespace returns the namespace prefix stands for at elem: as
+// declared on it or its ancestors, else the usual one.
+func inheritedNamespace(elem *etree.Element, prefix string) string {
+	for el := elem; el != nil; el = el.Parent() {
+		if attr := el.SelectAttr("xmlns:" + prefix); attr != nil {
+			return attr.Value
+		}
+	}
+	return wellKnownNamespaces[prefix]
+}
+
+// svgImageHref returns the link of an SVG <image>, SVG 1.1 xlink:href or
+// SVG 2 href.
+func svgImageHref(image *etree.Element) string {
+	if href := image.SelectAttrValue("xlink:href", ""); href != "" {
+		return href
+	}
+	return image.SelectAttrValue("href", "")
+}
+
+func childByLocalName(elem *etree.Element, name string) *etree.Element {
+	for _, child := range elem.ChildElements() {
+		if strings.ToLower(child.Tag) == name {
+			return child
+		}
+	}
+	return nil
+}
+
+// media converts an <audio> or <video> element, or an <object>, <embed>,
+// <iframe> or <canvas> of interactive content, into a placeholder. Media
+// files in the book are embedded so that -i extracts them with the images.
+// It returns nil for an <object> or <iframe> with fallback content, which
+// is converted instead.
+func (e *EpubConverter) media(elem *etree.Element) *Image {
+	tag := strings.ToLower(elem.Tag)
+	src := elem.SelectAttrValue("src", elem.SelectAttrValue("data", ""))
+	if src == "" {
+		if source := elem.SelectElement("source"); source != nil {
+			src = source.SelectAttrValue("src", "")
+		}
+	}
+
+	kind := tag
+	if tag != "audio" && tag != "video" {
+		mediaType := elem.SelectAttrValue("type", "")
+		if mediaType == "" && src != "" && !strings.Contains(src, ":") {
+			mediaType = e.mediaType(resolveHref(e.docDir, src))
+		}
+		kind, _, _ = strings.Cut(mediaType, "/")
+		if kind != "audio" && kind != "video" {
+			kind = "interactive"
+			if strings.TrimSpace(e.extractText(elem)) != "" {
+				return nil
+			}
+		}
+	}
+
+	img := &Image{Media: kind, Title: strings.TrimSpace(elem.SelectAttrValue("title", ""))}
+	if kind == "interactive" {
+		// Scripted documents and widgets do not work outside the book;
+		// only a link out of it is kept.
+		if strings.Contains(src, "://") {
+			img.Href = src
+		} else if src != "" {
+			img.Alt = path.Base(src)
+		}
+		return img
+	}
+	if id := e.embedHref(src); id != "" {
+		img.ID = id
+	} else {
+		img.Href = src
+	}
+	return img
+}
@@ -0,0 +1,203 @@
+package fb2md
+
+import (
+	"html"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+var (
+	htmlTagRe   = regexp.MustCompile(`<[^>]*>`)
+	htmlBreakRe = regexp.MustCompile(`(?i)</p>|<br\s*/?>|</div>`)
+)
+
+// readMetadata reads the Dublin Core metadata of the OPF package document
+// at rootFile into the same description an FB2 book has: title, authors and
+// translators, language, identifier, publisher and ISBN, description,
+// subjects as genres, date, series and cover. It returns nil when the
+// package cannot be read.
+func (e *EpubConverter) readMetadata(rootFile string) *Metadata {
+	opf, err := e.readXML(rootFile)
+	if err != nil {
+		return nil
+	}
+	metadata := opf.FindElement(".//metadata")
+	if metadata == nil {
+		return nil
+	}
+
+	// EPUB 3 qualifies elements with <meta refines="#id" property="...">.
+	refines := make(map[string]map[string]string)
+	for _, m := range metadata.SelectElements("meta") {
+		id := strings.TrimPrefix(m.SelectAttrValue("refines", ""), "#")
+		property := m.SelectAttrValue("property", "")
+		if id == "" || property == "" {
+			continue
+		}
+		if refines[id] == nil {
+			refines[id] = make(map[string]string)
+		}
+		refines[id][property] = strings.TrimSpace(m.Text())
+	}
+	refined := func(elem *etree.Element, property string) string {
+		return refines[elem.SelectAttrValue("id", "")][property]
+	}
+
+	meta := &Metadata{}
+	for _, title := range metadata.SelectElements("title") {
+		if meta.Title == "" || refined(title, "title-type") == "main" {
+			meta.Title = strings.TrimSpace(title.Text())
+		}
+	}
+
+	for _, tag := range []string{"creator", "contributor"} {
+		for _, creator := range metadata.SelectElements(tag) {
+			name := strings.Join(strings.Fields(creator.Text()), " ")
+			if name == "" {
+				continue
+			}
+			role := creator.SelectAttrValue("opf:role", refined(creator, "role"))
+			switch {
+			case role == "trl":
+				meta.Translators = append(meta.Translators, personFromName(name))
+			case role == "aut" || role == "" && tag == "creator":
+				meta.Authors = append(meta.Authors, personFromName(name))
+			}
+		}
+	}
+
+	if lang := metadata.SelectElement("language"); lang != nil {
+		meta.Lang = strings.TrimSpace(lang.Text())
+	}
+
+	uniqueID := opf.Root().SelectAttrValue("unique-identifier", "")
+	for _, id := range metadata.SelectElements("identifier") {
+		value := strings.TrimSpace(id.Text())
+		if value == "" {
+			continue
+		}
+		if meta.Identifier == "" || id.SelectAttrValue("id", "") == uniqueID {
+			meta.Identifier = value
+		}
+		lower := strings.ToLower(value)
+		if strings.HasPrefix(lower, "urn:isbn:") || strings.EqualFold(id.SelectAttrValue("opf:scheme", ""), "isbn") {
+			meta.publishInfo().ISBN = value[strings.LastIndex(value, ":")+1:]
+		}
+	}
+	if publisher := metadata.SelectElement("publisher"); publisher != nil {
+		if name := strings.TrimSpace(publisher.Text()); name != "" {
+			meta.publishInfo().Publisher = name
+		}
+	}
+
+	if desc := metadata.SelectElement("description"); desc != nil {
+		meta.Annotation = descriptionBlocks(desc.Text())
+	}
+	for _, subject := range metadata.SelectElements("subject") {
+		if s := strings.TrimSpace(subject.Text()); s != "" && !containsString(meta.Genres, s) {
+			meta.Genres = append(meta.Genres, s)
+		}
+	}
+	if date := metadata.SelectElement("date"); date != nil {
+		meta.DateValue = strings.TrimSpace(date.Text())
+		meta.Date = meta.DateValue
+		if iso := normalizeDate(meta.DateValue); iso != "" {
+			meta.Date = iso
+		}
+	}
+
+	meta.Sequences = opfSeries(metadata, refines)
+	meta.Cover = e.readCover(opf, metadata, path.Dir(rootFile))
+	return meta
+}
+
+// publishInfo returns the printed edition description, creating it.
+func (m *Metadata) publishInfo() *PublishInfo {
+	if m.Publish == nil {
+		m.Publish = &PublishInfo{}
+	}
+	return m.Publish
+}
+
+// opfSeries reads the series of the book: EPUB 3 collections of type
+// series, or the calibre:series meta that EPUB 2 books carry.
+func opfSeries(metadata *etree.Element, refines map[string]map[string]string) []Sequence {
+	var sequences []Sequence
+	var calibre Sequence
+	for _, m := range metadata.SelectElements("meta") {
+		switch {
+		case m.SelectAttrValue("property", "") == "belongs-to-collection":
+			name := strings.TrimSpace(m.Text())
+			props := refines[m.SelectAttrValue("id", "")]
+			if name == "" || props["collection-type"] != "" && props["collection-type"] != "series" {
+				continue
+			}
+			sequences = append(sequences, Sequence{Name: name, Number: seriesNumber(props["group-position"])})
+		case m.SelectAttrValue("name", "") == "calibre:series":
+			calibre.Name = strings.TrimSpace(m.SelectAttrValue("content", ""))
+		case m.SelectAttrValue("name", "") == "calibre:series_index":
+			calibre.Number = seriesNumber(m.SelectAttrValue("content", ""))
+		}
+	}
+	if len(sequences) == 0 && calibre.Name != "" {
+		sequences = append(sequences, calibre)
+	}
+	return sequences
+}
+
+// seriesNumber drops the ".0" calibre writes after whole series indexes.
+func seriesNumber(s string) string {
+	s = strings.TrimSpace(s)
+	if f, err := strconv.ParseFloat(s, 64); err == nil && f == float64(int(f)) {
+		return strconv.Itoa(int(f))
+	}
+	return s
+}
+
+// descriptionBlocks turns a dc:description, plain text or escaped HTML as
+// calibre writes it, into annotation paragraphs.
+func descriptionBlocks(desc string) []Block {
+	desc = htmlBreakRe.ReplaceAllString(desc, "\n")
+	desc = html.UnescapeString(htmlTagRe.ReplaceAllString(desc, ""))
+	var blocks []Block
+	for _, line := range strings.Split(desc, "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			blocks = append(blocks, &Paragraph{Inlines: []Inline{&Text{Value: line}}})
+		}
+	}
+	return blocks
+}
+
+// readCover adds the cover image of the book, the manifest item with the
+// cover-image property or named by the EPUB 2 cover meta, as a binary and
+// returns its id, or "" when the book has none.
+func (e *EpubConverter) readCover(opf *etree.Document, metadata *etree.Element, baseDir string) string {
+	coverID := ""
+	for _, m := range metadata.SelectElements("meta") {
+		if m.SelectAttrValue("name", "") == "cover" {
+			coverID = m.SelectAttrValue("content", "")
+		}
+	}
+	manifest := opf.FindElement(".//manifest")
+	if manifest == nil {
+		return ""
+	}
+	for _, item := range manifest.SelectElements("item") {
+		isCover := containsString(strings.Fields(item.SelectAttrValue("properties", "")), "cover-image")
+		if !isCover && (coverID == "" || item.SelectAttrValue("id", "") != coverID) {
+			continue
+		}
+		mediaType := item.SelectAttrValue("media-type", "")
+		if !strings.HasPrefix(mediaType, "image/") {
+			continue
+		}
+		if id := e.embedImage(resolveHref(baseDir, item.SelectAttrValue("href", ""))); id != "" {
+			return id
+		}
+	}
+	return ""
+}
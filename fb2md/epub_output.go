@@ -0,0 +1,367 @@
+package fb2md
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var uuidRe = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// epubRenderer packs a Book into an EPUB 3 container: one XHTML page per
+// top-level section, a nav document, the embedded images and a cover page.
+type epubRenderer struct {
+	ctx *renderContext
+}
+
+// epubPage is one XHTML document of the spine.
+type epubPage struct {
+	file   string
+	title  string
+	blocks []Block
+}
+
+func (r *epubRenderer) render(book *Book) []byte {
+	meta := book.Meta
+	if meta == nil {
+		meta = &Metadata{}
+	}
+	lang := meta.Lang
+	if lang == "" {
+		lang = "und"
+	}
+	title := strings.TrimSpace(meta.Title)
+	if title == "" {
+		title = "Untitled"
+	}
+
+	imageFiles := binaryImageFilenames(book.Binaries)
+	pages := epubPages(book.Body, title)
+
+	// Sections get anchors so the table of contents can point into pages,
+	// and internal links can be redirected to the page holding their target.
+	sectionIDs := make(map[*Section]string)
+	pageOf := make(map[string]string)
+	for _, page := range pages {
+		assignSectionIDs(page.blocks, page.file, sectionIDs, pageOf)
+		WalkBlocks(page.blocks, func(node any) {
+			if p, ok := node.(*Paragraph); ok && p.ID != "" {
+				pageOf[p.ID] = page.file
+			}
+		})
+	}
+
+	pageRenderer := &htmlRenderer{
+		ctx:   r.ctx,
+		xhtml: true,
+		imageSrc: func(id string) (string, bool) {
+			if file, ok := imageFiles[id]; ok {
+				return "images/" + file, true
+			}
+			return "", false
+		},
+		linkHref: func(href string) string {
+			if file, ok := pageOf[strings.TrimPrefix(href, "#")]; ok && strings.HasPrefix(href, "#") {
+				return file + href
+			}
+			return href
+		},
+		sectionIDs: sectionIDs,
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	modified := epubModified(meta, r.ctx.opts)
+	mtime := zipTime(modified)
+	create := func(name string, method uint16) (io.Writer, error) {
+		return zw.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: mtime})
+	}
+
+	// The mimetype entry must come first and be stored uncompressed.
+	if w, err := create("mimetype", zip.Store); err == nil {
+		w.Write([]byte("application/epub+zip"))
+	}
+	addFile := func(name, content string) {
+		w, err := create(name, zip.Deflate)
+		if err != nil {
+			return
+		}
+		w.Write([]byte(content))
+	}
+
+	addFile("META-INF/container.xml", `<?xml version="1.0" encoding="utf-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`)
+	addFile("OEBPS/style.css", htmlStyle)
+
+	var spine []string
+	var manifest strings.Builder
+
+	coverFile := ""
+	if meta.Cover != "" {
+		coverFile = imageFiles[meta.Cover]
+	}
+	if coverFile != "" {
+		addFile("OEBPS/cover.xhtml", xhtmlPage(lang, title, fmt.Sprintf(
+			"<div class=\"image\"><img src=\"images/%s\" alt=\"%s\"/></div>\n",
+			html.EscapeString(coverFile), html.EscapeString(title))))
+		manifest.WriteString("    <item id=\"cover\" href=\"cover.xhtml\" media-type=\"application/xhtml+xml\"/>\n")
+		spine = append(spine, "cover")
+	}
+
+	if book.Meta != nil {
+		pageRenderer.init(book)
+		pageRenderer.writeMetadata(book.Meta)
+		addFile("OEBPS/title.xhtml", xhtmlPage(lang, title, pageRenderer.out.String()))
+		manifest.WriteString("    <item id=\"title\" href=\"title.xhtml\" media-type=\"application/xhtml+xml\"/>\n")
+		spine = append(spine, "title")
+	}
+
+	for i, page := range pages {
+		id := fmt.Sprintf("page-%d", i+1)
+		addFile("OEBPS/"+page.file, xhtmlPage(lang, page.title, pageRenderer.fragment(book, page.blocks)))
+		manifest.WriteString(fmt.Sprintf("    <item id=\"%s\" href=\"%s\" media-type=\"application/xhtml+xml\"/>\n", id, page.file))
+		spine = append(spine, id)
+	}
+
+	addFile("OEBPS/nav.xhtml", epubNav(lang, pages, sectionIDs))
+
+	// As when images are extracted, the binaries nothing shows are left
+	// out unless AllBinaries is set.
+	used := referencedImages(book)
+	for i, binary := range book.Binaries {
+		file, ok := imageFiles[binary.ID]
+		if !ok || !used[binary.ID] && !r.ctx.opts.AllBinaries {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(stripBase64Whitespace(strings.TrimSpace(binary.Data)))
+		if err != nil {
+			LogWarning(r.ctx.opts.Logger, "failed to decode image %s: %v", binary.ID, err)
+			continue
+		}
+		w, err := create("OEBPS/images/"+file, zip.Deflate)
+		if err != nil {
+			continue
+		}
+		w.Write(data)
+
+		properties := ""
+		if binary.ID == meta.Cover {
+			properties = " properties=\"cover-image\""
+		}
+		manifest.WriteString(fmt.Sprintf("    <item id=\"image-%d\" href=\"images/%s\" media-type=\"%s\"%s/>\n",
+			i+1, html.EscapeString(file), html.EscapeString(binary.ContentType), properties))
+	}
+
+	addFile("OEBPS/content.opf", epubPackage(book, meta, lang, title, manifest.String(), spine, modified))
+
+	zw.Close()
+	return buf.Bytes()
+}
+
+// epubPages gives each page of the body its own XHTML file.
+func epubPages(body []Block, bookTitle string) []epubPage {
+	var pages []epubPage
+	for i, page := range splitPages(body, bookTitle) {
+		pages = append(pages, epubPage{
+			file:   fmt.Sprintf("chapter-%d.xhtml", i+1),
+			title:  page.title,
+			blocks: page.blocks,
+		})
+	}
+	return pages
+}
+
+// assignSectionIDs records the page of every section id and makes up ids
+// for titled sections that lack one.
+func assignSectionIDs(blocks []Block, file string, ids map[*Section]string, pageOf map[string]string) {
+	for _, b := range blocks {
+		section, ok := b.(*Section)
+		if !ok {
+			continue
+		}
+		id := section.ID
+		if id == "" && section.Title != "" {
+			id = fmt.Sprintf("section-%d", len(ids)+1)
+			ids[section] = id
+		}
+		if id != "" {
+			pageOf[id] = file
+		}
+		assignSectionIDs(section.Blocks, file, ids, pageOf)
+	}
+}
+
+func xhtmlPage(lang, title, body string) string {
+	var b strings.Builder
+	b.WriteString("<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<!DOCTYPE html>\n")
+	b.WriteString(fmt.Sprintf("<html xmlns=\"http://www.w3.org/1999/xhtml\" xmlns:epub=\"http://www.idpf.org/2007/ops\" lang=\"%s\" xml:lang=\"%s\">\n",
+		html.EscapeString(lang), html.EscapeString(lang)))
+	b.WriteString("<head>\n<meta charset=\"utf-8\"/>\n")
+	b.WriteString(fmt.Sprintf("<title>%s</title>\n", html.EscapeString(title)))
+	b.WriteString("<link rel=\"stylesheet\" type=\"text/css\" href=\"style.css\"/>\n</head>\n<body>\n")
+	b.WriteString(body)
+	b.WriteString("</body>\n</html>\n")
+	return b.String()
+}
+
+func epubNav(lang string, pages []epubPage, sectionIDs map[*Section]string) string {
+	var b strings.Builder
+	b.WriteString("<nav epub:type=\"toc\" id=\"toc\">\n<h1>Contents</h1>\n<ol>\n")
+	for _, page := range pages {
+		b.WriteString(fmt.Sprintf("<li><a href=\"%s\">%s</a>", page.file, html.EscapeString(page.title)))
+		var children []Block
+		for _, blk := range page.blocks {
+			if section, ok := blk.(*Section); ok {
+				children = append(children, section.Blocks...)
+			}
+		}
+		writeNavSections(&b, children, page.file, sectionIDs)
+		b.WriteString("</li>\n")
+	}
+	b.WriteString("</ol>\n</nav>\n")
+	return xhtmlPage(lang, "Contents", b.String())
+}
+
+// writeNavSections writes a nested list entry for every titled section.
+func writeNavSections(b *strings.Builder, blocks []Block, file string, sectionIDs map[*Section]string) {
+	var entries strings.Builder
+	for _, blk := range blocks {
+		section, ok := blk.(*Section)
+		if !ok {
+			continue
+		}
+		id := section.ID
+		if id == "" {
+			id = sectionIDs[section]
+		}
+		if section.Title == "" || id == "" {
+			writeNavSections(&entries, section.Blocks, file, sectionIDs)
+			continue
+		}
+		entries.WriteString(fmt.Sprintf("<li><a href=\"%s#%s\">%s</a>", file, html.EscapeString(id), html.EscapeString(section.Title)))
+		writeNavSections(&entries, section.Blocks, file, sectionIDs)
+		entries.WriteString("</li>\n")
+	}
+	if entries.Len() > 0 {
+		b.WriteString("\n<ol>\n")
+		b.WriteString(entries.String())
+		b.WriteString("</ol>\n")
+	}
+}
+
+func epubPackage(book *Book, meta *Metadata, lang, title, manifest string, spine []string, modified string) string {
+	var b strings.Builder
+	b.WriteString("<?xml version=\"1.0\" encoding=\"utf-8\"?>\n")
+	b.WriteString(fmt.Sprintf("<package xmlns=\"http://www.idpf.org/2007/opf\" version=\"3.0\" unique-identifier=\"book-id\" xml:lang=\"%s\">\n", html.EscapeString(lang)))
+	b.WriteString("  <metadata xmlns:dc=\"http://purl.org/dc/elements/1.1/\">\n")
+	b.WriteString(fmt.Sprintf("    <dc:identifier id=\"book-id\">%s</dc:identifier>\n", html.EscapeString(epubIdentifier(meta, title))))
+	b.WriteString(fmt.Sprintf("    <dc:title>%s</dc:title>\n", html.EscapeString(title)))
+	b.WriteString(fmt.Sprintf("    <dc:language>%s</dc:language>\n", html.EscapeString(lang)))
+	for _, author := range meta.Authors {
+		b.WriteString(fmt.Sprintf("    <dc:creator>%s</dc:creator>\n", html.EscapeString(author.Name())))
+	}
+	for _, genre := range meta.Genres {
+		b.WriteString(fmt.Sprintf("    <dc:subject>%s</dc:subject>\n", html.EscapeString(genre)))
+	}
+	if len(meta.Annotation) > 0 {
+		b.WriteString(fmt.Sprintf("    <dc:description>%s</dc:description>\n", html.EscapeString(meta.annotationText())))
+	}
+	if date := meta.ISODate(); date != "" {
+		b.WriteString(fmt.Sprintf("    <dc:date>%s</dc:date>\n", date))
+	}
+	for i, seq := range meta.Sequences {
+		b.WriteString(fmt.Sprintf("    <meta property=\"belongs-to-collection\" id=\"series-%d\">%s</meta>\n", i+1, html.EscapeString(seq.Name)))
+		b.WriteString(fmt.Sprintf("    <meta refines=\"#series-%d\" property=\"collection-type\">series</meta>\n", i+1))
+		if seq.Number != "" {
+			b.WriteString(fmt.Sprintf("    <meta refines=\"#series-%d\" property=\"group-position\">%s</meta>\n", i+1, html.EscapeString(seq.Number)))
+		}
+	}
+	b.WriteString(fmt.Sprintf("    <meta property=\"dcterms:modified\">%s</meta>\n", modified))
+	b.WriteString("  </metadata>\n  <manifest>\n")
+	b.WriteString("    <item id=\"nav\" href=\"nav.xhtml\" media-type=\"application/xhtml+xml\" properties=\"nav\"/>\n")
+	b.WriteString("    <item id=\"css\" href=\"style.css\" media-type=\"text/css\"/>\n")
+	b.WriteString(manifest)
+	b.WriteString("  </manifest>\n  <spine>\n")
+	for _, id := range spine {
+		b.WriteString(fmt.Sprintf("    <itemref idref=\"%s\"/>\n", id))
+	}
+	b.WriteString("  </spine>\n</package>\n")
+	return b.String()
+}
+
+// epubModified returns the dcterms:modified date of the package. It is
+// SOURCE_DATE_EPOCH when that is set, the conversion time with
+// --deterministic=false, and otherwise the date of the book file or of the
+// book itself, so that the same input always gives the same EPUB.
+func epubModified(meta *Metadata, opts Options) string {
+	const layout = "2006-01-02T15:04:05Z"
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		return time.Unix(epoch, 0).UTC().Format(layout)
+	}
+	if opts.Timestamped {
+		return time.Now().UTC().Format(layout)
+	}
+	var dates []string
+	if doc := meta.Document; doc != nil {
+		dates = append(dates, normalizeDate(doc.DateValue), normalizeDate(doc.Date))
+	}
+	dates = append(dates, meta.ISODate())
+	for _, date := range dates {
+		if !isoDateRe.MatchString(date) {
+			continue
+		}
+		// Complete YYYY and YYYY-MM to the first day.
+		date += "-01-01"[len(date)-4:]
+		if t, err := time.Parse("2006-01-02", date); err == nil {
+			return t.Format(layout)
+		}
+	}
+	return time.Unix(0, 0).UTC().Format(layout)
+}
+
+// zipTime returns the time the entries of the EPUB are dated: modified,
+// as epubModified gives it, or 1980-01-01 for dates the zip format cannot
+// hold, those before it.
+func zipTime(modified string) time.Time {
+	dosEpoch := time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	t, err := time.Parse(time.RFC3339, modified)
+	if err != nil || t.Before(dosEpoch) {
+		return dosEpoch
+	}
+	return t
+}
+
+// epubIdentifier returns the book id as a URN, deriving a stable UUID from
+// the title and authors when the source has no id.
+func epubIdentifier(meta *Metadata, title string) string {
+	id := meta.Identifier
+	if uuidRe.MatchString(id) {
+		return "urn:uuid:" + strings.ToLower(id)
+	}
+	if id != "" {
+		return id
+	}
+
+	seed := title
+	for _, author := range meta.Authors {
+		seed += "\x00" + author.Name()
+	}
+	sum := sha1.Sum([]byte(seed))
+	sum[6] = (sum[6] & 0x0f) | 0x50 // version 5
+	sum[8] = (sum[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
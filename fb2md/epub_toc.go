@@ -0,0 +1,393 @@
+package fb2md
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+// tocEntry is an entry of the EPUB table of contents, page list or
+// landmarks: a titled position in a spine document.
+type tocEntry struct {
+	Doc      string
+	Fragment string
+	Title    string
+	// Depth is 1 for top-level entries, 2 for the entries under them, ...
+	Depth int
+	// Type is the epub:type of a landmark, such as "cover" or "bodymatter".
+	Type string
+}
+
+// navigation is what the navigation document and NCX of an EPUB tell
+// about its structure.
+type navigation struct {
+	toc []tocEntry
+	// pages are the print page numbers of the page list, as entry titles.
+	pages []tocEntry
+	// cover is the spine document the landmarks name as the cover.
+	cover string
+}
+
+// readNavigation reads the navigation of the EPUB whose package document
+// is rootFile from both the EPUB 3 navigation document and the EPUB 2 NCX,
+// taking the table of contents and page list from whichever is richer:
+// more entries, then deeper nesting. On a tie the navigation document wins.
+func (e *EpubConverter) readNavigation(rootFile string) navigation {
+	var nav navigation
+	opf, err := e.readXML(rootFile)
+	if err != nil {
+		return nav
+	}
+	manifest := opf.FindElement(".//manifest")
+	if manifest == nil {
+		return nav
+	}
+	baseDir := path.Dir(rootFile)
+
+	var navPath, ncxPath string
+	ncxID := ""
+	if spine := opf.FindElement(".//spine"); spine != nil {
+		ncxID = spine.SelectAttrValue("toc", "")
+	}
+	for _, item := range manifest.SelectElements("item") {
+		href := item.SelectAttrValue("href", "")
+		if href == "" {
+			continue
+		}
+		full := resolveHref(baseDir, href)
+		switch {
+		case containsString(strings.Fields(item.SelectAttrValue("properties", "")), "nav"):
+			navPath = full
+		case item.SelectAttrValue("id", "") == ncxID && ncxID != "",
+			item.SelectAttrValue("media-type", "") == "application/x-dtbncx+xml" && ncxPath == "":
+			ncxPath = full
+		}
+	}
+
+	if navPath != "" {
+		if doc, err := e.readXML(navPath); err == nil {
+			dir := path.Dir(navPath)
+			nav.toc = e.navTOC(doc, dir)
+			nav.pages = e.navList(navByType(doc, "page-list"), dir)
+			for _, landmark := range e.navList(navByType(doc, "landmarks"), dir) {
+				if landmark.Type == "cover" {
+					nav.cover = landmark.Doc
+				}
+			}
+		}
+	}
+	if ncxPath != "" {
+		if doc, err := e.readXML(ncxPath); err == nil {
+			dir := path.Dir(ncxPath)
+			if toc := e.ncxTOC(doc, dir); richerTOC(toc, nav.toc) {
+				nav.toc = toc
+			}
+			if pages := e.ncxPages(doc, dir); len(pages) > len(nav.pages) {
+				nav.pages = pages
+			}
+		}
+	}
+	return nav
+}
+
+// richerTOC reports whether table of contents a tells more than b: it has
+// more entries, or as many nested deeper.
+func richerTOC(a, b []tocEntry) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return tocDepth(a) > tocDepth(b)
+}
+
+func tocDepth(entries []tocEntry) int {
+	depth := 0
+	for _, entry := range entries {
+		depth = max(depth, entry.Depth)
+	}
+	return depth
+}
+
+// readXML reads and parses an XML file of the EPUB.
+func (e *EpubConverter) readXML(name string) (*etree.Document, error) {
+	data, err := e.readFile(name)
+	if err != nil {
+		return nil, err
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	return doc, nil
+}
+
+// navTOC reads the entries of the toc <nav> of an EPUB 3 navigation
+// document in dir, or of its first <nav> when none is marked as the toc.
+func (e *EpubConverter) navTOC(doc *etree.Document, dir string) []tocEntry {
+	toc := navByType(doc, "toc")
+	if toc == nil {
+		for _, nav := range doc.FindElements(".//nav") {
+			if nav.SelectAttrValue("epub:type", "") == "" {
+				toc = nav
+				break
+			}
+		}
+	}
+	return e.navList(toc, dir)
+}
+
+// navByType returns the <nav> of a navigation document with the given
+// epub:type, or nil.
+func navByType(doc *etree.Document, navType string) *etree.Element {
+	for _, nav := range doc.FindElements(".//nav") {
+		if containsString(strings.Fields(nav.SelectAttrValue("epub:type", "")), navType) {
+			return nav
+		}
+	}
+	return nil
+}
+
+// navList reads the nested <ol> list of links of a <nav> in dir.
+func (e *EpubConverter) navList(nav *etree.Element, dir string) []tocEntry {
+	if nav == nil {
+		return nil
+	}
+	var entries []tocEntry
+	var walk func(ol *etree.Element, depth int)
+	walk = func(ol *etree.Element, depth int) {
+		for _, li := range ol.SelectElements("li") {
+			// An entry without a link is a heading that only groups others.
+			if a := li.SelectElement("a"); a != nil {
+				if entry, ok := newTOCEntry(dir, a.SelectAttrValue("href", ""), e.extractText(a), depth); ok {
+					entry.Type = a.SelectAttrValue("epub:type", "")
+					entries = append(entries, entry)
+				}
+			}
+			for _, sub := range li.SelectElements("ol") {
+				walk(sub, depth+1)
+			}
+		}
+	}
+	for _, ol := range nav.SelectElements("ol") {
+		walk(ol, 1)
+	}
+	return entries
+}
+
+// ncxTOC reads the navMap of an EPUB 2 NCX file in dir.
+func (e *EpubConverter) ncxTOC(doc *etree.Document, dir string) []tocEntry {
+	navMap := doc.FindElement(".//navMap")
+	if navMap == nil {
+		return nil
+	}
+	var entries []tocEntry
+	var walk func(parent *etree.Element, depth int)
+	walk = func(parent *etree.Element, depth int) {
+		for _, point := range parent.SelectElements("navPoint") {
+			title := ""
+			if label := point.FindElement("./navLabel/text"); label != nil {
+				title = e.extractText(label)
+			}
+			if content := point.SelectElement("content"); content != nil {
+				if entry, ok := newTOCEntry(dir, content.SelectAttrValue("src", ""), title, depth); ok {
+					entries = append(entries, entry)
+				}
+			}
+			walk(point, depth+1)
+		}
+	}
+	walk(navMap, 1)
+	return entries
+}
+
+// ncxPages reads the pageList of an EPUB 2 NCX file in dir.
+func (e *EpubConverter) ncxPages(doc *etree.Document, dir string) []tocEntry {
+	var pages []tocEntry
+	for _, target := range doc.FindElements(".//pageList/pageTarget") {
+		label := target.SelectAttrValue("value", "")
+		if text := target.FindElement("./navLabel/text"); text != nil {
+			label = e.extractText(text)
+		}
+		if content := target.SelectElement("content"); content != nil {
+			if entry, ok := newTOCEntry(dir, content.SelectAttrValue("src", ""), label, 1); ok {
+				pages = append(pages, entry)
+			}
+		}
+	}
+	return pages
+}
+
+// newTOCEntry makes an entry for a link from a file in dir. Links out of
+// the book are left out.
+func newTOCEntry(dir, href, title string, depth int) (tocEntry, bool) {
+	if href == "" || strings.Contains(href, "://") {
+		return tocEntry{}, false
+	}
+	doc, fragment, _ := strings.Cut(href, "#")
+	return tocEntry{
+		Doc:      resolveHref(dir, doc),
+		Fragment: fragment,
+		Title:    strings.Join(strings.Fields(title), " "),
+		Depth:    depth,
+	}, true
+}
+
+// resolveHref returns the path in the EPUB of a (percent-encoded) link from
+// a file in dir.
+func resolveHref(dir, href string) string {
+	if unescaped, err := url.PathUnescape(href); err == nil {
+		href = unescaped
+	}
+	return path.Clean(path.Join(dir, href))
+}
+
+// applyTOC sets the levels of the headings of a spine document from the
+// table of contents entries pointing into it, so that the outline follows
+// the TOC rather than the heading tags the document happens to use. An
+// entry for the document itself sets the level of its opening heading; one
+// for an element id, that of the heading holding it, or of the first
+// heading of a section wrapper such as <section id>. Where there is no such
+// heading, one with the entry's title is inserted. Headings the TOC
+// does not list are kept below the last listed one.
+//
+// Levels are the entry depth plus one, leaving level 1 to the book title.
+func (e *EpubConverter) applyTOC(body *etree.Element, entries []tocEntry) {
+	listed := make(map[*etree.Element]bool)
+	for _, entry := range entries {
+		level := min(entry.Depth+1, 6)
+		target := body
+		if entry.Fragment != "" {
+			target = findByID(body, entry.Fragment)
+			if target == nil {
+				continue
+			}
+		}
+
+		top := topLevelChild(body, target)
+		if target == body {
+			// The document's own opening heading, when nothing but a
+			// heading or a wrapper comes first.
+			for _, child := range body.ChildElements() {
+				if isHeadingTag(child.Tag) || isContainerTag(child.Tag) {
+					top = child
+				}
+				break
+			}
+		} else if isContainerTag(target.Tag) {
+			top = target
+		}
+		heading := top
+		if top != nil && isContainerTag(top.Tag) {
+			heading = firstHeading(top)
+		}
+		switch {
+		case heading != nil && isHeadingTag(heading.Tag):
+			heading.Tag = fmt.Sprintf("h%d", level)
+			listed[heading] = true
+		case entry.Title != "":
+			heading := etree.NewElement(fmt.Sprintf("h%d", level))
+			heading.SetText(entry.Title)
+			if top == nil {
+				body.InsertChildAt(0, heading)
+			} else {
+				top.Parent().InsertChildAt(top.Index(), heading)
+			}
+			listed[heading] = true
+		}
+	}
+
+	// Headings inside wrappers count too: xhtmlToBlocks takes them out.
+	for _, child := range body.FindElements(".//*") {
+		if !isHeadingTag(child.Tag) {
+			continue
+		}
+		level := int(child.Tag[1] - '0')
+		if listed[child] {
+			e.tocLevel = level
+			continue
+		}
+		if e.tocLevel > 0 && level <= e.tocLevel {
+			child.Tag = fmt.Sprintf("h%d", min(e.tocLevel+1, 6))
+		}
+	}
+}
+
+// pageAnchors returns the anchors the page list entries pointing into a
+// spine document give its top-level elements: "page-12" for the page
+// labelled 12, on the paragraph holding the page break. A break marker
+// standing between paragraphs anchors the next one. The first page of a
+// paragraph wins.
+func pageAnchors(body *etree.Element, pages []tocEntry) map[*etree.Element]string {
+	anchors := make(map[*etree.Element]string)
+	for _, page := range pages {
+		label := strings.Join(strings.Fields(page.Title), "-")
+		if label == "" || page.Fragment == "" {
+			continue
+		}
+		top := topLevelChild(body, findByID(body, page.Fragment))
+		for top != nil && strings.TrimSpace(top.Text()) == "" && len(top.ChildElements()) == 0 {
+			top = nextSiblingElement(top)
+		}
+		if top != nil && anchors[top] == "" {
+			anchors[top] = "page-" + label
+		}
+	}
+	return anchors
+}
+
+// nextSiblingElement returns the element after elem, or nil.
+func nextSiblingElement(elem *etree.Element) *etree.Element {
+	siblings := elem.Parent().ChildElements()
+	for i, sibling := range siblings {
+		if sibling == elem && i+1 < len(siblings) {
+			return siblings[i+1]
+		}
+	}
+	return nil
+}
+
+// findByID returns the element under root with the given id, or nil.
+func findByID(root *etree.Element, id string) *etree.Element {
+	for _, elem := range root.FindElements(".//*") {
+		if elem.SelectAttrValue("id", "") == id {
+			return elem
+		}
+	}
+	return nil
+}
+
+// topLevelChild returns the child of body that is or contains elem, or nil
+// when elem is body itself.
+func topLevelChild(body, elem *etree.Element) *etree.Element {
+	for elem != nil && elem.Parent() != body {
+		elem = elem.Parent()
+	}
+	return elem
+}
+
+// firstHeading returns the first heading under elem, or nil.
+func firstHeading(elem *etree.Element) *etree.Element {
+	for _, child := range elem.FindElements(".//*") {
+		if isHeadingTag(child.Tag) {
+			return child
+		}
+	}
+	return nil
+}
+
+// isContainerTag reports whether tag is one of the elements documents wrap
+// their sections in.
+func isContainerTag(tag string) bool {
+	switch strings.ToLower(tag) {
+	case "section", "article", "div":
+		return true
+	}
+	return false
+}
+
+func isHeadingTag(tag string) bool {
+	tag = strings.ToLower(tag)
+	return len(tag) == 2 && tag[0] == 'h' && tag[1] >= '1' && tag[1] <= '6'
+}
@@ -0,0 +1,108 @@
+package fb2md
+
+import (
+	"fmt"
+	"strings"
+)
+
+// extendedMetadata returns the description that --metadata full adds to the
+// basic title, authors, genres, series and date: translators, the original
+// of a translation, the printed edition and the file's version and history.
+func extendedMetadata(meta *Metadata) []MetaField {
+	var fields []MetaField
+	addText := func(key, value string) {
+		if value = strings.Join(strings.Fields(value), " "); value != "" {
+			fields = append(fields, MetaField{Key: key, Value: value})
+		}
+	}
+	addNames := func(key string, people []Person) {
+		var names []string
+		for _, p := range people {
+			names = append(names, p.Name())
+		}
+		if len(names) > 0 {
+			fields = append(fields, MetaField{Key: key, Value: names})
+		}
+	}
+
+	addNames("translators", meta.Translators)
+	if src := meta.Source; src != nil {
+		addText("original_title", src.Title)
+		addNames("original_authors", src.Authors)
+		addText("original_date", src.Date)
+	}
+	if meta.SrcLang != "" {
+		addText("original_lang", meta.SrcLang)
+	} else if meta.Source != nil {
+		addText("original_lang", meta.Source.Lang)
+	}
+	if pub := meta.Publish; pub != nil {
+		addText("publish_title", pub.BookName)
+		addText("publisher", pub.Publisher)
+		addText("publish_city", pub.City)
+		addText("publish_year", pub.Year)
+		addText("isbn", pub.ISBN)
+	}
+	if doc := meta.Document; doc != nil {
+		addNames("document_authors", doc.Authors)
+		addText("document_date", doc.Date)
+		addText("document_version", doc.Version)
+		if history := blocksText(doc.History); history != "" {
+			fields = append(fields, MetaField{Key: "document_history", Value: history})
+		}
+	}
+	return fields
+}
+
+// metadataLabels names the extendedMetadata fields in the Markdown header.
+var metadataLabels = map[string]string{
+	"translators":      "Translators",
+	"original_title":   "Original title",
+	"original_authors": "Original authors",
+	"original_date":    "Original date",
+	"original_lang":    "Original language",
+	"publish_title":    "Printed as",
+	"publisher":        "Publisher",
+	"publish_city":     "City",
+	"publish_year":     "Year",
+	"isbn":             "ISBN",
+	"document_authors": "File by",
+	"document_date":    "File date",
+	"document_version": "File version",
+	"document_history": "File history",
+}
+
+// metaFieldText returns a field value as text, joining lists with sep.
+func metaFieldText(field MetaField, sep string) string {
+	if list, ok := field.Value.([]string); ok {
+		return strings.Join(list, sep)
+	}
+	return fmt.Sprint(field.Value)
+}
+
+// customInfoFields returns the custom-info entries as fields keyed by their
+// info-type, lowercased with runs of other characters turned into "_".
+// Entries of the same type become one list.
+func customInfoFields(meta *Metadata) []MetaField {
+	var fields []MetaField
+	index := make(map[string]int)
+	for _, info := range meta.CustomInfo {
+		key := strings.ReplaceAll(slugify(info.Type), "-", "_")
+		if key == "" {
+			key = "custom_info"
+		}
+		i, seen := index[key]
+		if !seen {
+			index[key] = len(fields)
+			fields = append(fields, MetaField{Key: key, Value: info.Value})
+			continue
+		}
+		switch v := fields[i].Value.(type) {
+		case string:
+			fields[i].Value = []string{v, info.Value}
+		case []string:
+			fields[i].Value = append(v, info.Value)
+		}
+	}
+	return fields
+}
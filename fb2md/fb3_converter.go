@@ -0,0 +1,467 @@
+package fb2md
+
+import (
+	"archive/zip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+const (
+	fb3BookRelType = "http://www.fictionbook.org/FictionBook3/relationships/Book"
+	fb3BodyRelType = "http://www.fictionbook.org/FictionBook3/relationships/body"
+)
+
+// Fb3Converter reads an FB3 container (an OPC zip with description.xml,
+// body.xml and an images folder) and renders it through the FB2 converter.
+type Fb3Converter struct {
+	files map[string]*zip.File
+	// Binary ids for images, keyed by archive path
+	binaryIDs map[string]string
+	binaries  []*etree.Element
+}
+
+func NewFb3Converter() *Fb3Converter {
+	return &Fb3Converter{}
+}
+
+// Convert converts an FB3 container read from r and writes it to w, as
+// ConvertStream does.
+func (f *Fb3Converter) Convert(r io.Reader, w io.Writer, opts Options) error {
+	opts.out = w
+	return f.ConvertReader(r, "", opts)
+}
+
+// ConvertReader converts an FB3 container read from r.
+func (f *Fb3Converter) ConvertReader(r io.Reader, outputFile string, opts Options) error {
+	reader, err := openZipReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to open FB3: %w", err)
+	}
+	return f.convertZip(reader, outputFile, opts)
+}
+
+func (f *Fb3Converter) convertZip(reader *zip.Reader, outputFile string, opts Options) error {
+	f.open(reader)
+	doc, err := f.buildFictionBook()
+	if err != nil {
+		return err
+	}
+
+	converter := NewConverter()
+	return converter.ConvertDocument(doc, outputFile, opts)
+}
+
+// open starts a conversion of the container in reader, forgetting the
+// files and images of any before.
+func (f *Fb3Converter) open(reader *zip.Reader) {
+	f.files = make(map[string]*zip.File)
+	f.binaryIDs = make(map[string]string)
+	f.binaries = nil
+	for _, zf := range reader.File {
+		f.files[zf.Name] = zf
+	}
+}
+
+// buildFictionBook assembles an FB2 document tree equivalent to the FB3 book.
+func (f *Fb3Converter) buildFictionBook() (*etree.Document, error) {
+	descPath, err := f.findRelTarget("", fb3BookRelType)
+	if err != nil {
+		return nil, err
+	}
+	descDoc, err := f.readXML(descPath)
+	if err != nil {
+		return nil, err
+	}
+
+	bodyPath, err := f.findRelTarget(descPath, fb3BodyRelType)
+	if err != nil {
+		// Most producers use the conventional name even without a relationship
+		bodyPath = path.Join(path.Dir(descPath), "body.xml")
+	}
+	bodyDoc, err := f.readXML(bodyPath)
+	if err != nil {
+		return nil, err
+	}
+	bodyRels := f.readRels(bodyPath)
+
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="utf-8"`)
+	root := doc.CreateElement("FictionBook")
+	root.CreateAttr("xmlns", "http://www.gribuser.ru/xml/fictionbook/2.0")
+	root.CreateAttr("xmlns:l", "http://www.w3.org/1999/xlink")
+
+	desc := root.CreateElement("description")
+	if descRoot := descDoc.Root(); descRoot != nil {
+		f.convertDescription(descRoot, desc.CreateElement("title-info"))
+	}
+
+	bookRoot := bodyDoc.Root()
+	if bookRoot == nil {
+		return nil, fmt.Errorf("invalid FB3: empty body")
+	}
+
+	body := root.CreateElement("body")
+	for _, child := range bookRoot.ChildElements() {
+		if child.Tag == "notes" {
+			f.convertNotes(child, root.CreateElement("body"), bodyPath, bodyRels)
+			continue
+		}
+		f.convertBlock(child, body, bodyPath, bodyRels)
+	}
+
+	for _, binary := range f.binaries {
+		root.AddChild(binary)
+	}
+
+	return doc, nil
+}
+
+func (f *Fb3Converter) convertDescription(src, titleInfo *etree.Element) {
+	if classification := src.SelectElement("fb3-classification"); classification != nil {
+		for _, subject := range classification.SelectElements("subject") {
+			titleInfo.CreateElement("genre").SetText(strings.TrimSpace(subject.Text()))
+		}
+	}
+
+	if relations := src.SelectElement("fb3-relations"); relations != nil {
+		for _, subject := range relations.SelectElements("subject") {
+			if subject.SelectAttrValue("link", "") != "author" {
+				continue
+			}
+			author := titleInfo.CreateElement("author")
+			found := false
+			for _, tag := range []string{"first-name", "middle-name", "last-name"} {
+				if part := subject.SelectElement(tag); part != nil && part.Text() != "" {
+					author.CreateElement(tag).SetText(part.Text())
+					found = true
+				}
+			}
+			if !found {
+				author.CreateElement("nickname").SetText(fb3MainTitle(subject))
+			}
+		}
+	}
+
+	if title := fb3MainTitle(src); title != "" {
+		titleInfo.CreateElement("book-title").SetText(title)
+	}
+
+	if annotation := src.SelectElement("annotation"); annotation != nil {
+		dst := titleInfo.CreateElement("annotation")
+		for _, child := range annotation.ChildElements() {
+			f.convertBlock(child, dst, "", nil)
+		}
+	}
+
+	if written := src.SelectElement("written"); written != nil {
+		if date := written.SelectElement("date"); date != nil {
+			dst := titleInfo.CreateElement("date")
+			dst.SetText(date.Text())
+			if value := date.SelectAttrValue("value", ""); value != "" {
+				dst.CreateAttr("value", value)
+			}
+		}
+	}
+
+	if lang := src.SelectElement("lang"); lang != nil {
+		titleInfo.CreateElement("lang").SetText(lang.Text())
+	}
+
+	for _, seq := range src.SelectElements("sequence") {
+		dst := titleInfo.CreateElement("sequence")
+		dst.CreateAttr("name", fb3MainTitle(seq))
+		if number := seq.SelectAttrValue("number", ""); number != "" {
+			dst.CreateAttr("number", number)
+		}
+	}
+}
+
+// fb3MainTitle returns the text of the <title><main> child used throughout
+// FB3 descriptions.
+func fb3MainTitle(elem *etree.Element) string {
+	title := elem.SelectElement("title")
+	if title == nil {
+		return ""
+	}
+	if main := title.SelectElement("main"); main != nil {
+		return strings.TrimSpace(main.Text())
+	}
+	return strings.TrimSpace(title.Text())
+}
+
+func (f *Fb3Converter) convertNotes(notes, body *etree.Element, basePath string, rels map[string]string) {
+	body.CreateAttr("name", "notes")
+	for _, child := range notes.ChildElements() {
+		switch child.Tag {
+		case "title":
+			f.convertBlock(child, body, basePath, rels)
+		case "notebody":
+			section := body.CreateElement("section")
+			if id := child.SelectAttrValue("id", ""); id != "" {
+				section.CreateAttr("id", id)
+			}
+			for _, cc := range child.ChildElements() {
+				f.convertBlock(cc, section, basePath, rels)
+			}
+		}
+	}
+}
+
+// convertBlock maps an FB3 block element onto its FB2 counterpart.
+func (f *Fb3Converter) convertBlock(src, parent *etree.Element, basePath string, rels map[string]string) {
+	switch src.Tag {
+	case "section", "title", "epigraph", "annotation":
+		dst := parent.CreateElement(src.Tag)
+		copyAttr(src, dst, "id")
+		for _, child := range src.ChildElements() {
+			f.convertBlock(child, dst, basePath, rels)
+		}
+	case "p", "subtitle", "text-author":
+		dst := parent.CreateElement(src.Tag)
+		copyAttr(src, dst, "id")
+		f.convertInline(src, dst, basePath, rels)
+	case "br":
+		parent.CreateElement("empty-line")
+	case "blockquote":
+		dst := parent.CreateElement("cite")
+		for _, child := range src.ChildElements() {
+			f.convertBlock(child, dst, basePath, rels)
+		}
+	case "poem":
+		dst := parent.CreateElement("poem")
+		for _, child := range src.ChildElements() {
+			if child.Tag == "stanza" {
+				stanza := dst.CreateElement("stanza")
+				for _, line := range child.ChildElements() {
+					if line.Tag == "p" || line.Tag == "v" {
+						f.convertInline(line, stanza.CreateElement("v"), basePath, rels)
+					}
+				}
+				continue
+			}
+			f.convertBlock(child, dst, basePath, rels)
+		}
+	case "ul", "ol":
+		for i, item := range src.SelectElements("li") {
+			dst := parent.CreateElement("p")
+			if src.Tag == "ol" {
+				dst.SetText(fmt.Sprintf("%d. ", i+1))
+			} else {
+				dst.SetText("- ")
+			}
+			f.convertInline(item, dst, basePath, rels)
+		}
+	case "pre":
+		dst := parent.CreateElement("p")
+		f.convertInline(src, dst.CreateElement("code"), basePath, rels)
+	case "table":
+		dst := parent.CreateElement("table")
+		for _, row := range src.SelectElements("tr") {
+			tr := dst.CreateElement("tr")
+			for _, cell := range row.ChildElements() {
+				if cell.Tag == "th" || cell.Tag == "td" {
+					td := tr.CreateElement(cell.Tag)
+					if align := cell.SelectAttrValue("align", ""); align != "" {
+						td.CreateAttr("align", align)
+					}
+					f.convertInline(cell, td, basePath, rels)
+				}
+			}
+		}
+	case "img":
+		f.convertImage(src, parent, basePath, rels)
+	case "clipped":
+		for _, child := range src.ChildElements() {
+			f.convertBlock(child, parent, basePath, rels)
+		}
+	default:
+		dst := parent.CreateElement("p")
+		f.convertInline(src, dst, basePath, rels)
+	}
+}
+
+// convertInline copies the text and inline markup of src into dst.
+func (f *Fb3Converter) convertInline(src, dst *etree.Element, basePath string, rels map[string]string) {
+	dst.SetText(dst.Text() + src.Text())
+	for _, child := range src.ChildElements() {
+		var out *etree.Element
+		switch child.Tag {
+		case "em", "underline":
+			out = dst.CreateElement("emphasis")
+			f.convertInline(child, out, basePath, rels)
+		case "strong", "strikethrough", "code", "sub", "sup":
+			out = dst.CreateElement(child.Tag)
+			f.convertInline(child, out, basePath, rels)
+		case "a":
+			out = dst.CreateElement("a")
+			out.CreateAttr("l:href", fb3Href(child))
+			f.convertInline(child, out, basePath, rels)
+		case "note":
+			out = dst.CreateElement("a")
+			href := fb3Href(child)
+			if !strings.HasPrefix(href, "#") {
+				href = "#" + href
+			}
+			out.CreateAttr("l:href", href)
+			out.CreateAttr("type", "note")
+			f.convertInline(child, out, basePath, rels)
+		case "img":
+			out = f.convertImage(child, dst, basePath, rels)
+		case "br":
+			out = dst.CreateElement("empty-line")
+		default:
+			out = dst.CreateElement("style")
+			f.convertInline(child, out, basePath, rels)
+		}
+		if out != nil {
+			out.SetTail(child.Tail())
+		}
+	}
+}
+
+// convertImage turns an FB3 <img src="rId"> into an FB2 <image> pointing at
+// a <binary> built from the referenced archive file.
+func (f *Fb3Converter) convertImage(src, parent *etree.Element, basePath string, rels map[string]string) *etree.Element {
+	ref := src.SelectAttrValue("src", "")
+	target, ok := rels[ref]
+	if !ok {
+		target = path.Join(path.Dir(basePath), ref)
+	}
+
+	id, err := f.addBinary(target)
+	if err != nil {
+		return nil
+	}
+
+	img := parent.CreateElement("image")
+	img.CreateAttr("l:href", "#"+id)
+	if alt := src.SelectAttrValue("alt", ""); alt != "" {
+		img.CreateAttr("alt", alt)
+	}
+	return img
+}
+
+func (f *Fb3Converter) addBinary(target string) (string, error) {
+	if id, ok := f.binaryIDs[target]; ok {
+		return id, nil
+	}
+
+	data, err := f.readFile(target)
+	if err != nil {
+		return "", err
+	}
+
+	id := path.Base(target)
+	contentType := mime.TypeByExtension(path.Ext(target))
+	if contentType == "" {
+		contentType = "image/jpeg"
+	}
+
+	binary := etree.NewElement("binary")
+	binary.CreateAttr("id", id)
+	binary.CreateAttr("content-type", contentType)
+	binary.SetText(base64.StdEncoding.EncodeToString(data))
+
+	f.binaries = append(f.binaries, binary)
+	f.binaryIDs[target] = id
+	return id, nil
+}
+
+func fb3Href(elem *etree.Element) string {
+	for _, key := range []string{"l:href", "xlink:href", "href"} {
+		if v := elem.SelectAttrValue(key, ""); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func copyAttr(src, dst *etree.Element, key string) {
+	if v := src.SelectAttrValue(key, ""); v != "" {
+		dst.CreateAttr(key, v)
+	}
+}
+
+// findRelTarget looks up the first relationship of the given type declared
+// for source (the package itself when source is empty).
+func (f *Fb3Converter) findRelTarget(source, relType string) (string, error) {
+	rels, err := f.readRelsDoc(source)
+	if err != nil {
+		return "", err
+	}
+	for _, rel := range rels.FindElements(".//Relationship") {
+		if !strings.EqualFold(rel.SelectAttrValue("Type", ""), relType) {
+			continue
+		}
+		return resolveRelTarget(source, rel.SelectAttrValue("Target", "")), nil
+	}
+	return "", fmt.Errorf("invalid FB3: relationship %s not found", path.Base(relType))
+}
+
+// readRels returns the relationship id -> archive path map for source.
+func (f *Fb3Converter) readRels(source string) map[string]string {
+	result := make(map[string]string)
+	rels, err := f.readRelsDoc(source)
+	if err != nil {
+		return result
+	}
+	for _, rel := range rels.FindElements(".//Relationship") {
+		id := rel.SelectAttrValue("Id", "")
+		if id != "" {
+			result[id] = resolveRelTarget(source, rel.SelectAttrValue("Target", ""))
+		}
+	}
+	return result
+}
+
+func (f *Fb3Converter) readRelsDoc(source string) (*etree.Document, error) {
+	relsPath := "_rels/.rels"
+	if source != "" {
+		relsPath = path.Join(path.Dir(source), "_rels", path.Base(source)+".rels")
+	}
+	return f.readXML(relsPath)
+}
+
+func resolveRelTarget(source, target string) string {
+	if strings.HasPrefix(target, "/") {
+		return strings.TrimPrefix(target, "/")
+	}
+	return path.Clean(path.Join(path.Dir(source), target))
+}
+
+func (f *Fb3Converter) readXML(name string) (*etree.Document, error) {
+	data, err := f.readFile(name)
+	if err != nil {
+		return nil, err
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	return doc, nil
+}
+
+func (f *Fb3Converter) readFile(name string) ([]byte, error) {
+	file, ok := f.files[name]
+	if !ok {
+		return nil, fmt.Errorf("file %s not found in FB3", name)
+	}
+
+	rc, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,161 @@
+package fb2md
+
+import "strings"
+
+// fb2Genres maps the standard FB2 genre codes to their English and Russian
+// names.
+var fb2Genres = map[string][2]string{
+	"sf_history":    {"Alternative History", "Альтернативная история"},
+	"sf_action":     {"Action Science Fiction", "Боевая фантастика"},
+	"sf_epic":       {"Epic Science Fiction", "Эпическая фантастика"},
+	"sf_heroic":     {"Heroic Fantasy", "Героическая фантастика"},
+	"sf_detective":  {"Detective Science Fiction", "Детективная фантастика"},
+	"sf_cyberpunk":  {"Cyberpunk", "Киберпанк"},
+	"sf_space":      {"Space Fiction", "Космическая фантастика"},
+	"sf_social":     {"Social Science Fiction", "Социально-психологическая фантастика"},
+	"sf_horror":     {"Horror and Mystic", "Ужасы и мистика"},
+	"sf_humor":      {"Humorous Science Fiction", "Юмористическая фантастика"},
+	"sf_fantasy":    {"Fantasy", "Фэнтези"},
+	"sf":            {"Science Fiction", "Научная фантастика"},
+	"det_classic":   {"Classic Detective", "Классический детектив"},
+	"det_police":    {"Police Procedural", "Полицейский детектив"},
+	"det_action":    {"Action", "Боевик"},
+	"det_irony":     {"Ironic Detective", "Иронический детектив"},
+	"det_history":   {"Historical Detective", "Исторический детектив"},
+	"det_espionage": {"Espionage", "Шпионский детектив"},
+	"det_crime":     {"Crime", "Криминальный детектив"},
+	"det_political": {"Political Detective", "Политический детектив"},
+	"det_maniac":    {"Maniacs", "Маньяки"},
+	"det_hard":      {"Hard-boiled", "Крутой детектив"},
+	"thriller":      {"Thriller", "Триллер"},
+	"detective":     {"Detective", "Детектив"},
+
+	"prose_classic":      {"Classic Prose", "Классическая проза"},
+	"prose_history":      {"Historical Prose", "Историческая проза"},
+	"prose_contemporary": {"Contemporary Prose", "Современная проза"},
+	"prose_counter":      {"Counterculture", "Контркультура"},
+	"prose_rus_classic":  {"Russian Classic Prose", "Русская классическая проза"},
+	"prose_su_classics":  {"Soviet Classic Prose", "Советская классическая проза"},
+
+	"love_contemporary": {"Contemporary Romance", "Современные любовные романы"},
+	"love_history":      {"Historical Romance", "Исторические любовные романы"},
+	"love_detective":    {"Romantic Suspense", "Остросюжетные любовные романы"},
+	"love_short":        {"Short Romance", "Короткие любовные романы"},
+	"love_erotica":      {"Erotica", "Эротика"},
+
+	"adv_western":  {"Western", "Вестерн"},
+	"adv_history":  {"Historical Adventure", "Исторические приключения"},
+	"adv_indian":   {"Indians", "Приключения про индейцев"},
+	"adv_maritime": {"Sea Adventures", "Морские приключения"},
+	"adv_geo":      {"Travel and Geography", "Путешествия и география"},
+	"adv_animal":   {"Nature and Animals", "Природа и животные"},
+	"adventure":    {"Adventure", "Приключения"},
+
+	"child_tale":      {"Fairy Tales", "Сказка"},
+	"child_verse":     {"Children's Verse", "Детские стихи"},
+	"child_prose":     {"Children's Prose", "Детская проза"},
+	"child_sf":        {"Children's Science Fiction", "Детская фантастика"},
+	"child_det":       {"Children's Action", "Детские остросюжетные"},
+	"child_adv":       {"Children's Adventure", "Детские приключения"},
+	"child_education": {"Children's Education", "Детская образовательная литература"},
+	"children":        {"Children's", "Детская литература"},
+
+	"poetry":     {"Poetry", "Поэзия"},
+	"dramaturgy": {"Drama", "Драматургия"},
+
+	"antique_ant":      {"Antique", "Античная литература"},
+	"antique_european": {"European Old Literature", "Европейская старинная литература"},
+	"antique_russian":  {"Old Russian Literature", "Древнерусская литература"},
+	"antique_east":     {"Old East Literature", "Древневосточная литература"},
+	"antique_myths":    {"Myths, Legends, Epos", "Мифы. Легенды. Эпос"},
+	"antique":          {"Other Antique", "Старинная литература"},
+
+	"sci_history":    {"History", "История"},
+	"sci_psychology": {"Psychology", "Психология"},
+	"sci_culture":    {"Cultural Studies", "Культурология"},
+	"sci_religion":   {"Religious Studies", "Религиоведение"},
+	"sci_philosophy": {"Philosophy", "Философия"},
+	"sci_politics":   {"Politics", "Политика"},
+	"sci_business":   {"Business", "Деловая литература"},
+	"sci_juris":      {"Jurisprudence", "Юриспруденция"},
+	"sci_linguistic": {"Linguistics", "Языкознание"},
+	"sci_medicine":   {"Medicine", "Медицина"},
+	"sci_phys":       {"Physics", "Физика"},
+	"sci_math":       {"Mathematics", "Математика"},
+	"sci_chem":       {"Chemistry", "Химия"},
+	"sci_biology":    {"Biology", "Биология"},
+	"sci_tech":       {"Technical", "Технические науки"},
+	"science":        {"Science", "Научная литература"},
+
+	"comp_www":         {"Internet", "Интернет"},
+	"comp_programming": {"Programming", "Программирование"},
+	"comp_hard":        {"Computer Hardware", "Компьютерное железо"},
+	"comp_soft":        {"Software", "Программы"},
+	"comp_db":          {"Databases", "Базы данных"},
+	"comp_osnet":       {"OS and Networking", "ОС и сети"},
+	"computers":        {"Computers", "Компьютерная литература"},
+
+	"ref_encyc": {"Encyclopedias", "Энциклопедии"},
+	"ref_dict":  {"Dictionaries", "Словари"},
+	"ref_ref":   {"Reference", "Справочники"},
+	"ref_guide": {"Guidebooks", "Руководства"},
+	"reference": {"Reference", "Справочная литература"},
+
+	"nonf_biography": {"Biography and Memoirs", "Биографии и мемуары"},
+	"nonf_publicism": {"Publicism", "Публицистика"},
+	"nonf_criticism": {"Criticism", "Критика"},
+	"design":         {"Art and Design", "Искусство и дизайн"},
+	"nonfiction":     {"Nonfiction", "Документальная литература"},
+
+	"religion_rel":       {"Religion", "Религия"},
+	"religion_esoterics": {"Esoterics", "Эзотерика"},
+	"religion_self":      {"Self-improvement", "Самосовершенствование"},
+	"religion":           {"Religious", "Религиозная литература"},
+
+	"humor_anecdote": {"Anecdotes", "Анекдоты"},
+	"humor_prose":    {"Humorous Prose", "Юмористическая проза"},
+	"humor_verse":    {"Humorous Verse", "Юмористические стихи"},
+	"humor":          {"Humor", "Юмор"},
+
+	"home_cooking":   {"Cooking", "Кулинария"},
+	"home_pets":      {"Pets", "Домашние животные"},
+	"home_crafts":    {"Hobbies and Crafts", "Хобби и ремесла"},
+	"home_entertain": {"Entertaining", "Развлечения"},
+	"home_health":    {"Health", "Здоровье"},
+	"home_garden":    {"Garden", "Сад и огород"},
+	"home_diy":       {"Do It Yourself", "Сделай сам"},
+	"home_sport":     {"Sports", "Спорт"},
+	"home_sex":       {"Erotica, Sex", "Эротика, секс"},
+	"home":           {"Home and Family", "Дом и семья"},
+}
+
+// genreName returns the name of an FB2 genre code in lang, "en" or "ru".
+// Unknown codes, and every code when lang is "raw", are returned as is.
+func genreName(code, lang string) string {
+	names, ok := fb2Genres[strings.ToLower(strings.TrimSpace(code))]
+	switch {
+	case !ok:
+		return code
+	case lang == "en":
+		return names[0]
+	case lang == "ru":
+		return names[1]
+	}
+	return code
+}
+
+// nameGenres replaces the genre codes of meta with their names in lang,
+// dropping the duplicates that codes sharing a name leave.
+func nameGenres(meta *Metadata, lang string) {
+	if meta == nil || lang == "" || lang == "raw" {
+		return
+	}
+	var genres []string
+	for _, code := range meta.Genres {
+		if name := genreName(code, lang); !containsString(genres, name) {
+			genres = append(genres, name)
+		}
+	}
+	meta.Genres = genres
+	nameGenres(meta.Source, lang)
+}
@@ -0,0 +1,131 @@
+package fb2md
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTooLarge is returned for a book larger than Options.MaxFileSize.
+var ErrTooLarge = errors.New("file is too large")
+
+// ErrTimedOut is returned for a book that took longer to convert than
+// Options.TimeoutPerFile.
+var ErrTimedOut = errors.New("conversion timed out")
+
+// CheckSize returns ErrTooLarge when a book of size bytes is over
+// opts.MaxFileSize, so that it is refused before it is read.
+func CheckSize(size int64, opts Options) error {
+	if opts.MaxFileSize > 0 && size > opts.MaxFileSize {
+		return fmt.Errorf("%w: %d bytes, over the limit of %s", ErrTooLarge, size, FormatByteSize(opts.MaxFileSize))
+	}
+	return nil
+}
+
+// guard lets a conversion TimeoutPerFile gives up on be abandoned:
+// from then on its reads fail, its parse and render loops stop at their
+// next check and it writes nothing, while the batch goes on to the next
+// book.
+type guard struct {
+	abandoned atomic.Bool
+	// mu is held while the conversion writes, so that abandoning it waits
+	// for a write in progress rather than for a read that may block.
+	mu sync.Mutex
+}
+
+// run calls fn unless the conversion was abandoned. Abandoning waits for
+// fn to return, so nothing fn touches is used by two books at once. A nil
+// guard always calls fn.
+func (g *guard) run(fn func() error) error {
+	if g == nil {
+		return fn()
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.abandoned.Load() {
+		return ErrTimedOut
+	}
+	return fn()
+}
+
+// err returns ErrTimedOut once the conversion was abandoned, for the loops
+// that parse and render a book to stop at. A nil guard never is.
+func (g *guard) err() error {
+	if g != nil && g.abandoned.Load() {
+		return ErrTimedOut
+	}
+	return nil
+}
+
+func (g *guard) abandon() {
+	g.abandoned.Store(true)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+}
+
+// reader returns r failing with ErrTimedOut once the conversion was
+// abandoned, for a parser reading from it to stop.
+func (g *guard) reader(r io.Reader) io.Reader {
+	if g == nil {
+		return r
+	}
+	return &guardedReader{r: r, g: g}
+}
+
+// guardedReader reads a book through its guard, failing once more than
+// limit bytes have been read when limit is set.
+type guardedReader struct {
+	r        io.Reader
+	g        *guard
+	limit    int64
+	read     int64
+	exceeded bool
+}
+
+func (r *guardedReader) Read(p []byte) (int, error) {
+	if err := r.g.err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	if r.limit > 0 && r.read > r.limit {
+		r.exceeded = true
+		return n, ErrTooLarge
+	}
+	return n, err
+}
+
+// convertGuarded converts the book read from r as Convert does,
+// failing with ErrTooLarge once more than MaxFileSize is read and with
+// ErrTimedOut when it takes longer than TimeoutPerFile.
+func convertGuarded(r io.Reader, format, output string, opts Options) error {
+	g := &guard{}
+	opts.guard = g
+	reader := &guardedReader{r: r, g: g, limit: opts.MaxFileSize}
+	convert := func() error {
+		err := Convert(reader, format, output, opts)
+		if reader.exceeded {
+			// The readers of some formats wrap the error beyond errors.Is.
+			return fmt.Errorf("%w: more than the limit of %s", ErrTooLarge, FormatByteSize(opts.MaxFileSize))
+		}
+		return err
+	}
+	if opts.TimeoutPerFile <= 0 {
+		return convert()
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- convert() }()
+	timer := time.NewTimer(opts.TimeoutPerFile)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		g.abandon()
+		return fmt.Errorf("%w after %s", ErrTimedOut, opts.TimeoutPerFile)
+	}
+}
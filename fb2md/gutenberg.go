@@ -0,0 +1,256 @@
+package fb2md
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+var (
+	gutenbergStartRe = regexp.MustCompile(`(?i)\*{3}\s*START OF (THE|THIS) PROJECT GUTENBERG`)
+	gutenbergEndRe   = regexp.MustCompile(`(?i)(\*{3}\s*END OF (THE|THIS) PROJECT GUTENBERG|^\W*End of (the )?Project Gutenberg)`)
+	gutenbergFieldRe = regexp.MustCompile(`^\W*(Title|Author|Translator|Editor|Language|Release Date)\W*:\s*(.+)$`)
+	transcriberRe    = regexp.MustCompile(`(?i)^\W*Transcriber[’']?s?\s+Notes?\b`)
+	nameSeparatorRe  = regexp.MustCompile(`\s*(,|;|\band\b)\s*`)
+)
+
+// gutenbergMeta is the bibliographic data found in a Project Gutenberg header.
+type gutenbergMeta struct {
+	title       string
+	authors     []string
+	translators []string
+	language    string
+	date        string
+}
+
+// stripGutenberg removes the license header and footer from a Project
+// Gutenberg text along with transcriber's notes, and returns the remaining
+// text and the metadata parsed from the header. Text without the START/END
+// markers is returned unchanged apart from transcriber's notes.
+func stripGutenberg(text string) (string, gutenbergMeta) {
+	var meta gutenbergMeta
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+
+	start, end := 0, len(lines)
+	for i, line := range lines {
+		if gutenbergStartRe.MatchString(line) {
+			start = i + 1
+			meta = parseGutenbergHeader(lines[:i])
+			break
+		}
+	}
+	for i := len(lines) - 1; i >= start; i-- {
+		if gutenbergEndRe.MatchString(lines[i]) {
+			end = i
+			break
+		}
+	}
+
+	return strings.Join(dropTranscriberNotes(lines[start:end]), "\n"), meta
+}
+
+func parseGutenbergHeader(lines []string) gutenbergMeta {
+	var meta gutenbergMeta
+	var last *string
+	for _, line := range lines {
+		m := gutenbergFieldRe.FindStringSubmatch(line)
+		if m == nil {
+			// Long titles wrap onto indented continuation lines
+			if last != nil && strings.HasPrefix(line, " ") && strings.TrimSpace(line) != "" {
+				*last += " " + strings.TrimSpace(line)
+				continue
+			}
+			last = nil
+			continue
+		}
+
+		value := strings.TrimSpace(m[2])
+		last = nil
+		switch strings.ToLower(m[1]) {
+		case "title":
+			meta.title = value
+			last = &meta.title
+		case "author":
+			meta.authors = append(meta.authors, splitNames(value)...)
+		case "translator":
+			meta.translators = append(meta.translators, splitNames(value)...)
+		case "language":
+			meta.language = value
+		case "release date":
+			// "June 1, 2004 [eBook #12345]"
+			if i := strings.Index(value, "["); i > 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+			meta.date = value
+		}
+	}
+	return meta
+}
+
+func splitNames(value string) []string {
+	var names []string
+	for _, part := range nameSeparatorRe.Split(value, -1) {
+		if part = strings.TrimSpace(part); part != "" {
+			names = append(names, part)
+		}
+	}
+	return names
+}
+
+// dropTranscriberNotes removes paragraphs that are transcriber's notes,
+// including bracketed notes spanning several paragraphs.
+func dropTranscriberNotes(lines []string) []string {
+	var out []string
+	inNote, bracketed := false, false
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if !inNote && transcriberRe.MatchString(trimmed) {
+			inNote = true
+			bracketed = strings.HasPrefix(strings.TrimLeft(trimmed, "*_ "), "[")
+		}
+		if !inNote {
+			out = append(out, line)
+			continue
+		}
+		if bracketed {
+			if strings.Contains(trimmed, "]") {
+				inNote = false
+			}
+			continue
+		}
+		if trimmed == "" {
+			inNote = false
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+// metadata returns the header data as book metadata, or nil when the
+// header names neither a title nor an author.
+func (m gutenbergMeta) metadata() *Metadata {
+	if m.title == "" && len(m.authors) == 0 {
+		return nil
+	}
+	meta := &Metadata{Title: m.title, Date: m.date, Lang: m.language}
+	for _, name := range m.authors {
+		meta.Authors = append(meta.Authors, personFromName(name))
+	}
+	return meta
+}
+
+// personFromName splits a full name into first and last name.
+func personFromName(name string) Person {
+	parts := strings.Fields(name)
+	switch len(parts) {
+	case 0:
+		return Person{}
+	case 1:
+		return Person{Nickname: parts[0]}
+	default:
+		return Person{
+			FirstName: strings.Join(parts[:len(parts)-1], " "),
+			LastName:  parts[len(parts)-1],
+		}
+	}
+}
+
+// stripGutenbergBlocks is stripGutenberg for books read from HTML: it drops
+// the blocks before the START marker and from the END marker on, and
+// transcriber's notes. Chapters left empty are removed.
+func stripGutenbergBlocks(blocks []Block) ([]Block, gutenbergMeta) {
+	var meta gutenbergMeta
+
+	// Work on a flat list of the blocks inside chapters
+	type leaf struct {
+		parent int
+		block  Block
+		text   string
+	}
+	var leaves []leaf
+	for i, b := range blocks {
+		children := []Block{b}
+		if ch, ok := b.(*Chapter); ok {
+			children = ch.Blocks
+		}
+		for _, child := range children {
+			leaves = append(leaves, leaf{parent: i, block: child, text: blockText(child)})
+		}
+	}
+
+	start, end := 0, len(leaves)
+	for i, l := range leaves {
+		if gutenbergStartRe.MatchString(l.text) {
+			start = i + 1
+			var header []string
+			for _, h := range leaves[:i] {
+				header = append(header, strings.Split(h.text, "\n")...)
+			}
+			meta = parseGutenbergHeader(header)
+			break
+		}
+	}
+	for i := len(leaves) - 1; i >= start; i-- {
+		if gutenbergEndRe.MatchString(leaves[i].text) {
+			end = i
+			break
+		}
+	}
+
+	kept := make(map[int][]Block)
+	inNote, bracketed := false, false
+	for _, l := range leaves[start:end] {
+		trimmed := strings.TrimSpace(l.text)
+		if !inNote && transcriberRe.MatchString(trimmed) {
+			inNote = true
+			bracketed = strings.HasPrefix(strings.TrimLeft(trimmed, "*_ "), "[")
+		}
+		if !inNote {
+			kept[l.parent] = append(kept[l.parent], l.block)
+			continue
+		}
+		if !bracketed || strings.Contains(trimmed, "]") {
+			inNote = false
+		}
+	}
+
+	var out []Block
+	for i, b := range blocks {
+		children, ok := kept[i]
+		if !ok {
+			continue
+		}
+		if _, isChapter := b.(*Chapter); isChapter {
+			out = append(out, &Chapter{Blocks: children})
+		} else {
+			out = append(out, b)
+		}
+	}
+	return out, meta
+}
+
+// removeGutenbergBoilerplate drops the license sections and transcriber's
+// notes that Gutenberg marks up with dedicated ids and classes in its HTML.
+func removeGutenbergBoilerplate(elem *etree.Element) {
+	for _, child := range elem.ChildElements() {
+		id := child.SelectAttrValue("id", "")
+		classes := strings.Fields(child.SelectAttrValue("class", ""))
+		if id == "pg-header" || id == "pg-footer" || hasAnyClass(classes, "pg-boilerplate", "transnote", "tnote") {
+			elem.RemoveChild(child)
+			continue
+		}
+		removeGutenbergBoilerplate(child)
+	}
+}
+
+func hasAnyClass(classes []string, names ...string) bool {
+	for _, class := range classes {
+		for _, name := range names {
+			if class == name {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package fb2md
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// headerData is what a --header-template sees: every metadata field, with
+// the annotation already rendered as Markdown.
+type headerData struct {
+	*Metadata
+	// Annotation is the annotation as Markdown, shadowing the block list.
+	Annotation string
+	// AuthorNames holds the display names of the authors.
+	AuthorNames []string
+}
+
+// headerFuncs are the helpers available to header templates.
+var headerFuncs = template.FuncMap{
+	"join": strings.Join,
+	"names": func(people []Person) []string {
+		names := make([]string, len(people))
+		for i, p := range people {
+			names[i] = p.Name()
+		}
+		return names
+	},
+}
+
+// LoadHeaderTemplate parses the template file at path for
+// Options.HeaderTemplate.
+func LoadHeaderTemplate(path string) (*template.Template, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header template: %w", err)
+	}
+	tmpl, err := template.New(filepath.Base(path)).Funcs(headerFuncs).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse header template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// writeTemplateHeader writes the metadata through the header template. It
+// reports false when the template fails, so the default header is used.
+func (r *markdownRenderer) writeTemplateHeader(meta *Metadata) bool {
+	old := r.out
+	r.out = &strings.Builder{}
+	r.writeBlocks(meta.Annotation)
+	data := headerData{
+		Metadata:    meta,
+		Annotation:  strings.TrimSpace(r.out.String()),
+		AuthorNames: meta.AuthorNames(),
+	}
+	r.out = old
+
+	var b strings.Builder
+	if err := r.ctx.opts.HeaderTemplate.Execute(&b, data); err != nil {
+		LogWarning(r.ctx.opts.Logger, "header template failed, using the default header: %v", err)
+		return false
+	}
+	if text := strings.TrimSpace(b.String()); text != "" {
+		r.out.WriteString(text)
+		r.out.WriteString("\n\n")
+	}
+	return true
+}
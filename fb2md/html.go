@@ -0,0 +1,499 @@
+package fb2md
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// htmlStyle is the stylesheet embedded in every HTML document.
+const htmlStyle = `body { max-width: 40em; margin: 2em auto; padding: 0 1em; font-family: Georgia, "Times New Roman", serif; line-height: 1.6; color: #222; background: #fff; }
+h1, h2, h3, h4, h5, h6 { font-family: "Helvetica Neue", Arial, sans-serif; line-height: 1.25; }
+img { max-width: 100%; height: auto; }
+.book-info { text-align: center; margin-bottom: 3em; }
+.annotation { text-align: left; }
+.image { text-align: center; margin: 1em 0; }
+figcaption { font-size: 0.9em; font-style: italic; }
+.subtitle { text-align: center; font-weight: bold; }
+.empty-line { height: 1em; }
+blockquote { margin: 1em 2em; }
+.epigraph { margin-left: 40%; font-style: italic; }
+.text-author { text-align: right; font-style: italic; }
+.poem { margin: 1em 2em; }
+.poem-title { font-weight: bold; }
+.stanza { margin: 0 0 1em; }
+table { border-collapse: collapse; margin: 1em 0; }
+th, td { border: 1px solid #ccc; padding: 0.25em 0.5em; }
+.footnotes { font-size: 0.9em; }
+`
+
+// htmlRenderer writes a Book as a standalone HTML page. Embedded images are
+// linked when extracted and inlined as data URIs otherwise.
+type htmlRenderer struct {
+	ctx           *renderContext
+	book          *Book
+	out           *strings.Builder
+	sectionLevel  int
+	binaries      map[string]Binary
+	footnoteNum   map[string]int
+	footnoteOrder []string
+
+	// The fields below are set when rendering EPUB pages.
+
+	// xhtml closes void elements for XML serialization.
+	xhtml bool
+	// imageSrc overrides where embedded images are linked from.
+	imageSrc func(id string) (string, bool)
+	// linkHref rewrites link targets.
+	linkHref func(href string) string
+	// sectionIDs gives anchors to sections that have none of their own.
+	sectionIDs map[*Section]string
+
+	// noteRef, when set, writes footnote references instead; Markdown uses it
+	// for tables written as HTML.
+	noteRef func(id string) string
+}
+
+func (r *htmlRenderer) init(book *Book) {
+	r.book = book
+	r.out = &strings.Builder{}
+	r.footnoteNum = make(map[string]int)
+	r.footnoteOrder = nil
+	r.binaries = make(map[string]Binary)
+	for _, b := range book.Binaries {
+		r.binaries[b.ID] = b
+	}
+}
+
+// fragment renders blocks followed by the footnotes they reference.
+func (r *htmlRenderer) fragment(book *Book, blocks []Block) string {
+	r.init(book)
+	r.writeBlocks(blocks)
+	r.writeFootnotes()
+	return r.out.String()
+}
+
+// end returns the closing of a void element.
+func (r *htmlRenderer) end() string {
+	if r.xhtml {
+		return "/>"
+	}
+	return ">"
+}
+
+func (r *htmlRenderer) render(book *Book) []byte {
+	r.init(book)
+	out := r.out
+
+	title, lang := "", ""
+	if book.Meta != nil {
+		title, lang = strings.TrimSpace(book.Meta.Title), book.Meta.Lang
+	}
+	for _, field := range book.FrontMatter {
+		if s, ok := field.Value.(string); ok && field.Key == "title" && title == "" {
+			title = s
+		}
+	}
+
+	out.WriteString("<!DOCTYPE html>\n")
+	if lang != "" {
+		out.WriteString(fmt.Sprintf("<html lang=\"%s\">\n", html.EscapeString(lang)))
+	} else {
+		out.WriteString("<html>\n")
+	}
+	out.WriteString("<head>\n<meta charset=\"utf-8\">\n")
+	out.WriteString("<meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">\n")
+	out.WriteString(fmt.Sprintf("<title>%s</title>\n", html.EscapeString(title)))
+	if book.Meta != nil {
+		for _, author := range book.Meta.Authors {
+			out.WriteString(fmt.Sprintf("<meta name=\"author\" content=\"%s\">\n", html.EscapeString(author.Name())))
+		}
+	}
+	for _, field := range book.FrontMatter {
+		out.WriteString(fmt.Sprintf("<meta name=\"%s\" content=\"%s\">\n",
+			html.EscapeString(field.Key), html.EscapeString(fmt.Sprint(field.Value))))
+	}
+	out.WriteString("<style>\n")
+	out.WriteString(htmlStyle)
+	out.WriteString("</style>\n</head>\n<body>\n")
+
+	if book.Meta != nil {
+		r.writeMetadata(book.Meta)
+	}
+	r.writeBlocks(book.Body)
+	r.writeFootnotes()
+
+	out.WriteString("</body>\n</html>\n")
+	return []byte(out.String())
+}
+
+func (r *htmlRenderer) writeMetadata(meta *Metadata) {
+	r.out.WriteString("<header class=\"book-info\">\n")
+	if title := strings.TrimSpace(meta.Title); title != "" {
+		r.out.WriteString(fmt.Sprintf("<h1>%s</h1>\n", html.EscapeString(title)))
+	}
+
+	if len(meta.Authors) > 0 {
+		names := make([]string, len(meta.Authors))
+		for i, author := range meta.Authors {
+			names[i] = html.EscapeString(author.Name())
+		}
+		r.out.WriteString(fmt.Sprintf("<p class=\"authors\">%s</p>\n", strings.Join(names, ", ")))
+	}
+
+	if len(meta.Genres) > 0 {
+		r.out.WriteString(fmt.Sprintf("<p class=\"genres\"><strong>Genres:</strong> %s</p>\n",
+			html.EscapeString(strings.Join(meta.Genres, ", "))))
+	}
+
+	for _, seq := range meta.Sequences {
+		r.out.WriteString(fmt.Sprintf("<p class=\"series\"><strong>Series:</strong> %s</p>\n", html.EscapeString(seq.label())))
+	}
+
+	if len(meta.Annotation) > 0 {
+		r.out.WriteString("<div class=\"annotation\">\n<h2>Annotation</h2>\n")
+		r.writeBlocks(meta.Annotation)
+		r.out.WriteString("</div>\n")
+	}
+
+	if meta.Date != "" {
+		r.out.WriteString(fmt.Sprintf("<p class=\"date\">%s</p>\n", html.EscapeString(meta.Date)))
+	}
+	r.out.WriteString("</header>\n")
+}
+
+// writeFootnotes appends referenced footnotes as a numbered list.
+func (r *htmlRenderer) writeFootnotes() {
+	if len(r.footnoteOrder) == 0 {
+		return
+	}
+	r.out.WriteString("<section class=\"footnotes\">\n<hr" + r.end() + "\n<ol>\n")
+	for i := 0; i < len(r.footnoteOrder); i++ {
+		id := r.footnoteOrder[i]
+		note, ok := r.book.Footnotes[id]
+		if !ok {
+			continue
+		}
+		r.out.WriteString(fmt.Sprintf("<li id=\"%s\">", html.EscapeString(id)))
+		r.writeInlines(note.Content)
+		r.out.WriteString(fmt.Sprintf(" <a href=\"#ref-%s\">↩</a></li>\n", html.EscapeString(id)))
+	}
+	r.out.WriteString("</ol>\n</section>\n")
+}
+
+func (r *htmlRenderer) writeBlocks(blocks []Block) {
+	for _, b := range blocks {
+		if r.ctx.opts.guard.err() != nil {
+			return
+		}
+		r.writeBlock(b)
+	}
+}
+
+func (r *htmlRenderer) writeBlock(b Block) {
+	switch n := b.(type) {
+	case *Section:
+		r.writeSection(n)
+	case *Heading:
+		r.out.WriteString(fmt.Sprintf("<h%d>%s</h%d>\n", n.Level, html.EscapeString(n.Text), n.Level))
+	case *BodyTitle:
+		r.out.WriteString(fmt.Sprintf("<h2>%s</h2>\n", html.EscapeString(n.Text)))
+	case *Chapter:
+		r.out.WriteString("<div class=\"chapter\">\n")
+		r.writeBlocks(n.Blocks)
+		r.out.WriteString("</div>\n")
+	case *Paragraph:
+		if n.ID != "" {
+			r.out.WriteString(fmt.Sprintf("<p id=\"%s\">", html.EscapeString(n.ID)))
+			r.writeInlines(n.Inlines)
+			r.out.WriteString("</p>\n")
+			return
+		}
+		r.writeElement("p", "", n.Inlines)
+	case *Subtitle:
+		r.writeElement("p", "subtitle", n.Inlines)
+	case *TextAuthor:
+		r.writeElement("p", "text-author", n.Inlines)
+	case *Plain:
+		r.writeInlines(n.Inlines)
+		r.out.WriteString("\n")
+	case *EmptyLine:
+		r.out.WriteString("<div class=\"empty-line\"></div>\n")
+	case *HorizontalRule:
+		r.out.WriteString("<hr" + r.end() + "\n")
+	case *CodeBlock:
+		r.out.WriteString("<pre><code>" + html.EscapeString(n.Text) + "</code></pre>\n")
+	case *Image:
+		if n.Title != "" {
+			r.out.WriteString("<figure class=\"image\">")
+			r.writeImage(n)
+			r.out.WriteString("<figcaption>" + html.EscapeString(n.Title) + "</figcaption></figure>\n")
+			return
+		}
+		r.out.WriteString("<div class=\"image\">")
+		r.writeImage(n)
+		r.out.WriteString("</div>\n")
+	case *Epigraph:
+		r.out.WriteString("<blockquote class=\"epigraph\">\n")
+		r.writeBlocks(n.Blocks)
+		r.out.WriteString("</blockquote>\n")
+	case *Cite:
+		r.out.WriteString("<blockquote class=\"cite\">\n")
+		r.writeBlocks(n.Blocks)
+		r.out.WriteString("</blockquote>\n")
+	case *Quote:
+		r.out.WriteString("<blockquote>\n")
+		for _, line := range n.Lines {
+			r.writeElement("p", "", line)
+		}
+		r.out.WriteString("</blockquote>\n")
+	case *Poem:
+		r.writePoem(n)
+	case *Stanza:
+		r.writeStanza(n)
+	case *List:
+		tag := "ul"
+		if n.Ordered {
+			tag = "ol"
+		}
+		r.out.WriteString("<" + tag + ">\n")
+		for _, item := range n.Items {
+			r.writeElement("li", "", item)
+		}
+		r.out.WriteString("</" + tag + ">\n")
+	case *Table:
+		r.writeTable(n)
+	}
+}
+
+func (r *htmlRenderer) writeSection(section *Section) {
+	r.sectionLevel++
+	defer func() { r.sectionLevel-- }()
+
+	id := section.ID
+	if id == "" {
+		id = r.sectionIDs[section]
+	}
+	if id != "" {
+		r.out.WriteString(fmt.Sprintf("<section id=\"%s\">\n", html.EscapeString(id)))
+	} else {
+		r.out.WriteString("<section>\n")
+	}
+
+	if section.Title != "" {
+		level := r.sectionLevel + 1
+		if level > 6 {
+			level = 6
+		}
+		r.out.WriteString(fmt.Sprintf("<h%d>%s</h%d>\n", level, html.EscapeString(section.Title), level))
+	}
+
+	for _, epigraph := range section.Epigraphs {
+		r.writeBlock(epigraph)
+	}
+	r.writeBlocks(section.Annotation)
+	r.writeBlocks(section.Blocks)
+
+	r.out.WriteString("</section>\n")
+}
+
+func (r *htmlRenderer) writePoem(poem *Poem) {
+	r.out.WriteString("<div class=\"poem\">\n")
+	if poem.Title != "" {
+		r.out.WriteString(fmt.Sprintf("<p class=\"poem-title\">%s</p>\n", html.EscapeString(poem.Title)))
+	}
+	for _, epigraph := range poem.Epigraphs {
+		r.writeBlock(epigraph)
+	}
+	r.writeBlocks(poem.Blocks)
+	for _, author := range poem.Authors {
+		r.writeElement("p", "text-author", author)
+	}
+	if poem.Date != "" {
+		r.out.WriteString(fmt.Sprintf("<p class=\"date\">%s</p>\n", html.EscapeString(poem.Date)))
+	}
+	r.out.WriteString("</div>\n")
+}
+
+func (r *htmlRenderer) writeStanza(stanza *Stanza) {
+	r.out.WriteString("<div class=\"stanza\">\n")
+	if stanza.Title != "" {
+		r.out.WriteString(fmt.Sprintf("<p class=\"poem-title\">%s</p>\n", html.EscapeString(stanza.Title)))
+	}
+	if stanza.Subtitle != nil {
+		r.writeElement("p", "subtitle", stanza.Subtitle)
+	}
+	r.out.WriteString("<p>")
+	for i, line := range stanza.Lines {
+		if i > 0 {
+			r.out.WriteString("<br" + r.end() + "\n")
+		}
+		r.writeInlines(line)
+	}
+	r.out.WriteString("</p>\n</div>\n")
+}
+
+func (r *htmlRenderer) writeTable(table *Table) {
+	if table.Columns == 0 {
+		return
+	}
+	r.out.WriteString("<table>\n")
+	for _, row := range table.Rows {
+		r.out.WriteString("<tr>")
+		for _, cell := range row {
+			tag := "td"
+			if cell.Header {
+				tag = "th"
+			}
+			if cell.Align != "" {
+				r.out.WriteString(fmt.Sprintf("<%s style=\"text-align: %s\">", tag, cell.Align))
+			} else {
+				r.out.WriteString("<" + tag + ">")
+			}
+			r.writeInlines(cell.Inlines)
+			r.out.WriteString("</" + tag + ">")
+		}
+		r.out.WriteString("</tr>\n")
+	}
+	r.out.WriteString("</table>\n")
+}
+
+// writeElement writes inlines wrapped in a block element with an optional class.
+func (r *htmlRenderer) writeElement(tag, class string, inlines []Inline) {
+	if class != "" {
+		r.out.WriteString(fmt.Sprintf("<%s class=\"%s\">", tag, class))
+	} else {
+		r.out.WriteString("<" + tag + ">")
+	}
+	r.writeInlines(inlines)
+	r.out.WriteString("</" + tag + ">\n")
+}
+
+func (r *htmlRenderer) writeInlines(inlines []Inline) {
+	for _, in := range inlines {
+		switch n := in.(type) {
+		case *Text:
+			r.out.WriteString(html.EscapeString(n.Value))
+		case *Emphasis:
+			r.writeWrapped("em", n.Children)
+		case *Strong:
+			r.writeWrapped("strong", n.Children)
+		case *Strikethrough:
+			r.writeWrapped("del", n.Children)
+		case *Code:
+			r.writeWrapped("code", n.Children)
+		case *Superscript:
+			r.writeWrapped("sup", n.Children)
+		case *Subscript:
+			r.writeWrapped("sub", n.Children)
+		case *Span:
+			if n.Class == "" && n.Lang == "" {
+				r.writeInlines(n.Children)
+				continue
+			}
+			r.out.WriteString("<span")
+			if n.Class != "" {
+				r.out.WriteString(fmt.Sprintf(" class=\"%s\"", html.EscapeString(n.Class)))
+			}
+			if n.Lang != "" {
+				r.out.WriteString(fmt.Sprintf(" lang=\"%s\"", html.EscapeString(n.Lang)))
+			}
+			r.out.WriteString(">")
+			r.writeInlines(n.Children)
+			r.out.WriteString("</span>")
+		case *Link:
+			href := n.Href
+			if r.linkHref != nil {
+				href = r.linkHref(href)
+			}
+			r.out.WriteString(fmt.Sprintf("<a href=\"%s\">", html.EscapeString(href)))
+			r.writeInlines(n.Children)
+			r.out.WriteString("</a>")
+		case *NoteRef:
+			if r.noteRef != nil {
+				r.out.WriteString(r.noteRef(n.ID))
+				continue
+			}
+			r.writeNoteRef(n.ID)
+		case *LineBreak:
+			r.out.WriteString("<br" + r.end() + "\n")
+		case *Image:
+			r.writeImage(n)
+		}
+	}
+}
+
+func (r *htmlRenderer) writeWrapped(tag string, inlines []Inline) {
+	r.out.WriteString("<" + tag + ">")
+	r.writeInlines(inlines)
+	r.out.WriteString("</" + tag + ">")
+}
+
+// writeNoteRef writes a numbered footnote reference. Only the first reference
+// to a note gets the anchor its back link points to.
+func (r *htmlRenderer) writeNoteRef(id string) {
+	num, seen := r.footnoteNum[id]
+	if !seen {
+		r.footnoteOrder = append(r.footnoteOrder, id)
+		num = len(r.footnoteOrder)
+		r.footnoteNum[id] = num
+		r.out.WriteString(fmt.Sprintf("<sup><a id=\"ref-%s\" href=\"#%s\">%d</a></sup>",
+			html.EscapeString(id), html.EscapeString(id), num))
+		return
+	}
+	r.out.WriteString(fmt.Sprintf("<sup><a href=\"#%s\">%d</a></sup>", html.EscapeString(id), num))
+}
+
+func (r *htmlRenderer) writeImage(img *Image) {
+	if img.ID == "" {
+		r.writeImg(img.Href, img)
+		return
+	}
+
+	imageSrc := r.ctx.imageLink
+	if r.imageSrc != nil {
+		imageSrc = r.imageSrc
+	}
+	src, ok := imageSrc(img.ID)
+	if !ok {
+		binary, found := r.binaries[img.ID]
+		if !found {
+			if img.Media != "" {
+				r.out.WriteString(html.EscapeString("[" + img.mediaLabel() + "]"))
+				return
+			}
+			r.out.WriteString(html.EscapeString("[" + img.placeholder() + "]"))
+			return
+		}
+		src = dataURI(binary)
+	}
+	r.writeImg(src, img)
+}
+
+// writeMedia writes an <audio> or <video> player for a media file, with
+// its placeholder text for readers that have none, or just the text for
+// interactive content.
+func (r *htmlRenderer) writeMedia(src string, img *Image) {
+	label := html.EscapeString("[" + img.mediaLabel() + "]")
+	if src == "" || img.Media != "audio" && img.Media != "video" {
+		r.out.WriteString(label)
+		return
+	}
+	title := ""
+	if img.Title != "" {
+		title = fmt.Sprintf(" title=\"%s\"", html.EscapeString(img.Title))
+	}
+	r.out.WriteString(fmt.Sprintf("<%s controls=\"controls\" src=\"%s\"%s>%s</%s>", img.Media, html.EscapeString(src), title, label, img.Media))
+}
+
+func (r *htmlRenderer) writeImg(src string, img *Image) {
+	if img.Media != "" {
+		r.writeMedia(src, img)
+		return
+	}
+	title := ""
+	if img.Title != "" {
+		title = fmt.Sprintf(" title=\"%s\"", html.EscapeString(img.Title))
+	}
+	r.out.WriteString(fmt.Sprintf("<img src=\"%s\" alt=\"%s\"%s%s", html.EscapeString(src), html.EscapeString(img.altText()), title, r.end()))
+}
@@ -0,0 +1,111 @@
+package fb2md
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+// defaultImageQuality is the JPEG quality used when images are resized
+// without an explicit --image-quality.
+const defaultImageQuality = 85
+
+// shrinkImage downscales an image whose longest edge exceeds
+// opts.ImageMaxSize and re-encodes JPEGs at opts.ImageQuality. The format
+// is kept, so file names and content types stay valid. Data that needs no
+// change, cannot be decoded or is an animated GIF is returned as is.
+func shrinkImage(data []byte, opts Options) ([]byte, error) {
+	if opts.ImageMaxSize <= 0 && opts.ImageQuality <= 0 {
+		return data, nil
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		// Formats without a decoder, such as WebP, are copied unchanged.
+		return data, nil
+	}
+	resize := opts.ImageMaxSize > 0 && max(cfg.Width, cfg.Height) > opts.ImageMaxSize
+	if !resize && (opts.ImageQuality <= 0 || format != "jpeg") {
+		return data, nil
+	}
+	if format == "gif" {
+		if g, err := gif.DecodeAll(bytes.NewReader(data)); err != nil || len(g.Image) > 1 {
+			return data, nil
+		}
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	if resize {
+		img = scaleDown(img, opts.ImageMaxSize)
+	}
+
+	var buf bytes.Buffer
+	switch format {
+	case "jpeg":
+		quality := opts.ImageQuality
+		if quality <= 0 {
+			quality = defaultImageQuality
+		}
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	case "png":
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode image: %w", err)
+	}
+	// Re-encoding alone must not make the file bigger.
+	if !resize && buf.Len() >= len(data) {
+		return data, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleDown resizes img so its longest edge is maxSize, averaging the
+// source pixels that fall into each target pixel.
+func scaleDown(img image.Image, maxSize int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := maxSize, maxSize
+	if w >= h {
+		dh = max(1, h*maxSize/w)
+	} else {
+		dw = max(1, w*maxSize/h)
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*h/dh, max((y+1)*h/dh, y*h/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*w/dw, max((x+1)*w/dw, x*w/dw+1)
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			p := dst.Pix[y*dst.Stride+x*4:]
+			for i := range sum {
+				p[i] = uint8(sum[i] / n)
+			}
+		}
+	}
+	return dst
+}
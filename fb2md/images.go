@@ -0,0 +1,126 @@
+package fb2md
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNoCover is returned by WriteCover for a book without a cover image.
+var ErrNoCover = errors.New("the book has no cover image")
+
+// WriteImages writes the images embedded in book to dir, named as Convert
+// names them, and returns the paths written. Images that fail are left
+// out with a warning to logger.
+func WriteImages(book *Book, dir string, logger *slog.Logger) ([]string, error) {
+	return writeBinaries(book.Binaries, binaryImageFilenames(book.Binaries), dir, logger)
+}
+
+// WriteCover writes the cover image of book to dir as name with the
+// extension of its type, e.g. name.jpg, and returns its path.
+func WriteCover(book *Book, dir, name string, logger *slog.Logger) (string, error) {
+	if book.Meta == nil || book.Meta.Cover == "" {
+		return "", ErrNoCover
+	}
+	for _, bin := range book.Binaries {
+		if bin.ID != book.Meta.Cover {
+			continue
+		}
+		paths, err := writeBinaries([]Binary{bin}, map[string]string{bin.ID: name + binaryExt(bin)}, dir, logger)
+		if err != nil {
+			return "", err
+		}
+		return paths[0], nil
+	}
+	return "", ErrNoCover
+}
+
+// writeBinaries writes binaries to dir under the names in files.
+func writeBinaries(binaries []Binary, files map[string]string, dir string, logger *slog.Logger) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, &OutputError{fmt.Errorf("failed to create images directory: %w", err)}
+	}
+	extractBinaryImages(binaries, Options{ImagesDir: dir, Logger: logger}, files)
+
+	var paths []string
+	for _, bin := range binaries {
+		if name := files[bin.ID]; name != "" {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+	}
+	return paths, nil
+}
+
+// WritePages writes the pages of the comic archive at archive to dir and
+// returns the paths written. With cover set only the first page is
+// written, as the cover, named cover with the extension of the page.
+func WritePages(archive, dir, cover string) ([]string, error) {
+	reader, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open CBZ: %w", err)
+	}
+	defer reader.Close()
+	pages, _, err := cbzPages(&reader.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if cover != "" {
+		pages = pages[:1]
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, &OutputError{fmt.Errorf("failed to create images directory: %w", err)}
+	}
+
+	var paths []string
+	used := make(map[string]bool)
+	for _, page := range pages {
+		name := uniqueFilename(page.Name, used)
+		if cover != "" {
+			name = cover + strings.ToLower(path.Ext(page.Name))
+		}
+		data, err := readZipFile(page)
+		if err != nil {
+			return paths, fmt.Errorf("failed to read page %s: %w", page.Name, err)
+		}
+		imagePath := filepath.Join(dir, name)
+		if err := os.WriteFile(imagePath, data, 0644); err != nil {
+			return paths, &OutputError{fmt.Errorf("failed to write page %s: %w", page.Name, err)}
+		}
+		paths = append(paths, imagePath)
+	}
+	return paths, nil
+}
+
+// ImageFS is where a conversion writes the images it extracts, the pages
+// of a comic and the images embedded in a book. Names are slash-separated
+// and relative to the images directory, as an fs.FS reads them back.
+type ImageFS interface {
+	WriteFile(name string, data []byte) error
+}
+
+// DirFS returns an ImageFS that writes images to the directory dir, which
+// must exist.
+func DirFS(dir string) ImageFS {
+	return dirFS(dir)
+}
+
+type dirFS string
+
+func (dir dirFS) WriteFile(name string, data []byte) error {
+	return os.WriteFile(filepath.Join(string(dir), filepath.FromSlash(name)), data, 0644)
+}
+
+// MemFS is an ImageFS that keeps the images in memory by name, for an HTTP
+// handler to serve them or a test to look at them.
+type MemFS map[string][]byte
+
+func (m MemFS) WriteFile(name string, data []byte) error {
+	m[name] = bytes.Clone(data)
+	return nil
+}
@@ -0,0 +1,288 @@
+package fb2md
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// jsonRenderer serializes a Book as a JSON document tree.
+type jsonRenderer struct {
+	ctx           *renderContext
+	footnoteSeen  map[string]bool
+	footnoteOrder []string
+}
+
+type jsonBook struct {
+	Metadata    *jsonMetadata  `json:"metadata,omitempty"`
+	FrontMatter []jsonField    `json:"front_matter,omitempty"`
+	Body        []jsonNode     `json:"body"`
+	Footnotes   []jsonFootnote `json:"footnotes,omitempty"`
+	Images      []jsonImage    `json:"images,omitempty"`
+}
+
+type jsonMetadata struct {
+	Title      string         `json:"title,omitempty"`
+	Authors    []jsonPerson   `json:"authors,omitempty"`
+	Genres     []string       `json:"genres,omitempty"`
+	Keywords   []string       `json:"keywords,omitempty"`
+	Sequences  []jsonSequence `json:"sequences,omitempty"`
+	Annotation []jsonNode     `json:"annotation,omitempty"`
+	Date       string         `json:"date,omitempty"`
+	Lang       string         `json:"lang,omitempty"`
+}
+
+type jsonPerson struct {
+	Name       string `json:"name"`
+	FirstName  string `json:"first_name,omitempty"`
+	MiddleName string `json:"middle_name,omitempty"`
+	LastName   string `json:"last_name,omitempty"`
+	Nickname   string `json:"nickname,omitempty"`
+}
+
+type jsonSequence struct {
+	Name   string         `json:"name"`
+	Number string         `json:"number,omitempty"`
+	Sub    []jsonSequence `json:"sub,omitempty"`
+}
+
+type jsonField struct {
+	Key   string `json:"key"`
+	Value any    `json:"value"`
+}
+
+type jsonFootnote struct {
+	ID      string     `json:"id"`
+	Content []jsonNode `json:"content"`
+}
+
+// jsonImage describes an embedded binary: the extracted file when images
+// are extracted, the base64 data otherwise.
+type jsonImage struct {
+	ID          string `json:"id"`
+	ContentType string `json:"content_type"`
+	File        string `json:"file,omitempty"`
+	Data        string `json:"data,omitempty"`
+}
+
+// jsonNode is any block or inline node; Type tells which fields are set.
+type jsonNode struct {
+	Type       string       `json:"type"`
+	ID         string       `json:"id,omitempty"`
+	Level      int          `json:"level,omitempty"`
+	Title      string       `json:"title,omitempty"`
+	Text       string       `json:"text,omitempty"`
+	Class      string       `json:"class,omitempty"`
+	Lang       string       `json:"lang,omitempty"`
+	Href       string       `json:"href,omitempty"`
+	Alt        string       `json:"alt,omitempty"`
+	Align      string       `json:"align,omitempty"`
+	Ordered    bool         `json:"ordered,omitempty"`
+	Header     bool         `json:"header,omitempty"`
+	Date       string       `json:"date,omitempty"`
+	Epigraphs  []jsonNode   `json:"epigraphs,omitempty"`
+	Annotation []jsonNode   `json:"annotation,omitempty"`
+	Subtitle   []jsonNode   `json:"subtitle,omitempty"`
+	Content    []jsonNode   `json:"content,omitempty"`
+	Lines      [][]jsonNode `json:"lines,omitempty"`
+	Items      [][]jsonNode `json:"items,omitempty"`
+	Rows       [][]jsonNode `json:"rows,omitempty"`
+	Authors    [][]jsonNode `json:"authors,omitempty"`
+}
+
+func (r *jsonRenderer) render(book *Book) []byte {
+	r.footnoteSeen = make(map[string]bool)
+
+	var out jsonBook
+	if meta := book.Meta; meta != nil {
+		m := &jsonMetadata{
+			Title:      strings.TrimSpace(meta.Title),
+			Genres:     meta.Genres,
+			Keywords:   meta.keywordList(),
+			Annotation: r.blocks(meta.Annotation),
+			Date:       meta.Date,
+			Lang:       meta.Lang,
+		}
+		m.Authors = jsonPersons(meta.Authors)
+		m.Sequences = jsonSequences(meta.Sequences)
+		out.Metadata = m
+	}
+
+	out.Body = r.blocks(book.Body)
+	if out.Body == nil {
+		out.Body = []jsonNode{}
+	}
+
+	for _, field := range book.FrontMatter {
+		out.FrontMatter = append(out.FrontMatter, jsonField{Key: field.Key, Value: field.Value})
+	}
+
+	// Referenced notes come first, in reading order, followed by the rest.
+	for i := 0; i < len(r.footnoteOrder); i++ {
+		note := book.Footnotes[r.footnoteOrder[i]]
+		out.Footnotes = append(out.Footnotes, jsonFootnote{ID: note.ID, Content: r.inlines(note.Content)})
+	}
+	var unreferenced []string
+	for id := range book.Footnotes {
+		if !r.footnoteSeen[id] {
+			unreferenced = append(unreferenced, id)
+		}
+	}
+	sort.Strings(unreferenced)
+	for _, id := range unreferenced {
+		note := book.Footnotes[id]
+		out.Footnotes = append(out.Footnotes, jsonFootnote{ID: note.ID, Content: r.inlines(note.Content)})
+	}
+
+	for _, binary := range book.Binaries {
+		if binary.ID == "" {
+			continue
+		}
+		img := jsonImage{ID: binary.ID, ContentType: binary.ContentType}
+		if link, ok := r.ctx.imageLink(binary.ID); ok {
+			img.File = link
+		} else {
+			img.Data = stripBase64Whitespace(strings.TrimSpace(binary.Data))
+		}
+		out.Images = append(out.Images, img)
+	}
+
+	data, _ := json.MarshalIndent(out, "", "  ")
+	return append(data, '\n')
+}
+
+func (r *jsonRenderer) blocks(blocks []Block) []jsonNode {
+	var nodes []jsonNode
+	for _, b := range blocks {
+		if r.ctx.opts.guard.err() != nil {
+			break
+		}
+		nodes = append(nodes, r.block(b))
+	}
+	return nodes
+}
+
+func (r *jsonRenderer) block(b Block) jsonNode {
+	switch n := b.(type) {
+	case *Section:
+		node := jsonNode{Type: "section", ID: n.ID, Title: n.Title}
+		for _, epigraph := range n.Epigraphs {
+			node.Epigraphs = append(node.Epigraphs, r.block(epigraph))
+		}
+		node.Annotation = r.blocks(n.Annotation)
+		node.Content = r.blocks(n.Blocks)
+		return node
+	case *Heading:
+		return jsonNode{Type: "heading", Level: n.Level, Text: n.Text}
+	case *BodyTitle:
+		return jsonNode{Type: "body_title", Text: n.Text}
+	case *Chapter:
+		return jsonNode{Type: "chapter", Content: r.blocks(n.Blocks)}
+	case *Paragraph:
+		return jsonNode{Type: "paragraph", ID: n.ID, Content: r.inlines(n.Inlines)}
+	case *Subtitle:
+		return jsonNode{Type: "subtitle", Content: r.inlines(n.Inlines)}
+	case *Plain:
+		return jsonNode{Type: "plain", Content: r.inlines(n.Inlines)}
+	case *TextAuthor:
+		return jsonNode{Type: "text_author", Content: r.inlines(n.Inlines)}
+	case *EmptyLine:
+		return jsonNode{Type: "empty_line"}
+	case *HorizontalRule:
+		return jsonNode{Type: "horizontal_rule"}
+	case *CodeBlock:
+		return jsonNode{Type: "code_block", Text: n.Text}
+	case *Image:
+		return imageNode(n)
+	case *Epigraph:
+		return jsonNode{Type: "epigraph", Content: r.blocks(n.Blocks)}
+	case *Cite:
+		return jsonNode{Type: "cite", Content: r.blocks(n.Blocks)}
+	case *Quote:
+		node := jsonNode{Type: "quote"}
+		for _, line := range n.Lines {
+			node.Lines = append(node.Lines, r.inlines(line))
+		}
+		return node
+	case *Poem:
+		node := jsonNode{Type: "poem", Title: n.Title, Date: n.Date}
+		for _, epigraph := range n.Epigraphs {
+			node.Epigraphs = append(node.Epigraphs, r.block(epigraph))
+		}
+		node.Content = r.blocks(n.Blocks)
+		for _, author := range n.Authors {
+			node.Authors = append(node.Authors, r.inlines(author))
+		}
+		return node
+	case *Stanza:
+		node := jsonNode{Type: "stanza", Title: n.Title, Subtitle: r.inlines(n.Subtitle)}
+		for _, line := range n.Lines {
+			node.Lines = append(node.Lines, r.inlines(line))
+		}
+		return node
+	case *List:
+		node := jsonNode{Type: "list", Ordered: n.Ordered}
+		for _, item := range n.Items {
+			node.Items = append(node.Items, r.inlines(item))
+		}
+		return node
+	case *Table:
+		node := jsonNode{Type: "table"}
+		for _, row := range n.Rows {
+			var cells []jsonNode
+			for _, cell := range row {
+				cells = append(cells, jsonNode{Type: "cell", Header: cell.Header, Align: cell.Align, Content: r.inlines(cell.Inlines)})
+			}
+			node.Rows = append(node.Rows, cells)
+		}
+		return node
+	}
+	return jsonNode{Type: "unknown"}
+}
+
+func (r *jsonRenderer) inlines(inlines []Inline) []jsonNode {
+	var nodes []jsonNode
+	for _, in := range inlines {
+		switch n := in.(type) {
+		case *Text:
+			nodes = append(nodes, jsonNode{Type: "text", Text: n.Value})
+		case *Emphasis:
+			nodes = append(nodes, jsonNode{Type: "emphasis", Content: r.inlines(n.Children)})
+		case *Strong:
+			nodes = append(nodes, jsonNode{Type: "strong", Content: r.inlines(n.Children)})
+		case *Strikethrough:
+			nodes = append(nodes, jsonNode{Type: "strikethrough", Content: r.inlines(n.Children)})
+		case *Code:
+			nodes = append(nodes, jsonNode{Type: "code", Content: r.inlines(n.Children)})
+		case *Superscript:
+			nodes = append(nodes, jsonNode{Type: "superscript", Content: r.inlines(n.Children)})
+		case *Subscript:
+			nodes = append(nodes, jsonNode{Type: "subscript", Content: r.inlines(n.Children)})
+		case *Span:
+			nodes = append(nodes, jsonNode{Type: "span", Class: n.Class, Lang: n.Lang, Content: r.inlines(n.Children)})
+		case *Link:
+			nodes = append(nodes, jsonNode{Type: "link", Href: n.Href, Content: r.inlines(n.Children)})
+		case *NoteRef:
+			if !r.footnoteSeen[n.ID] {
+				r.footnoteSeen[n.ID] = true
+				r.footnoteOrder = append(r.footnoteOrder, n.ID)
+			}
+			nodes = append(nodes, jsonNode{Type: "note_ref", ID: n.ID})
+		case *LineBreak:
+			nodes = append(nodes, jsonNode{Type: "line_break"})
+		case *Image:
+			nodes = append(nodes, imageNode(n))
+		}
+	}
+	return nodes
+}
+
+// imageNode is an image node, or an "audio", "video" or "interactive" one
+// for a media file.
+func imageNode(img *Image) jsonNode {
+	typ := "image"
+	if img.Media != "" {
+		typ = img.Media
+	}
+	return jsonNode{Type: typ, ID: img.ID, Href: img.Href, Alt: img.Alt, Title: img.Title}
+}
@@ -0,0 +1,52 @@
+package fb2md
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// LevelEvent is the level the events of a conversion are logged at, such
+// as an image written: between slog.LevelInfo and slog.LevelWarn, so that
+// a handler can take the events without the details logged at LevelInfo.
+const LevelEvent = slog.LevelInfo + 2
+
+// LogWarning logs a warning, such as an image that could not be decoded,
+// to l. The messages logged with these functions carry an "event"
+// attribute, "warning", "info" or "debug"; a nil l discards them.
+func LogWarning(l *slog.Logger, format string, args ...any) {
+	logf(l, slog.LevelWarn, "warning", format, args...)
+}
+
+// LogInfo logs a detail, such as a part of a book that was left out.
+func LogInfo(l *slog.Logger, format string, args ...any) {
+	logf(l, slog.LevelInfo, "info", format, args...)
+}
+
+// LogDebug logs a diagnostic.
+func LogDebug(l *slog.Logger, format string, args ...any) {
+	logf(l, slog.LevelDebug, "debug", format, args...)
+}
+
+// LogTiming logs at slog.LevelDebug how long step took since start; it is
+// meant to be deferred.
+func LogTiming(l *slog.Logger, step string, start time.Time) {
+	LogDebug(l, "%s in %v", step, time.Since(start).Round(time.Microsecond))
+}
+
+// LogEvent logs an event at LevelEvent, its name as the "event" attribute
+// and args as the attributes that follow it.
+func LogEvent(l *slog.Logger, event string, args ...any) {
+	if l != nil {
+		l.Log(context.Background(), LevelEvent, strings.ReplaceAll(event, "_", " "), append([]any{"event", event}, args...)...)
+	}
+}
+
+func logf(l *slog.Logger, level slog.Level, event, format string, args ...any) {
+	if l == nil || !l.Enabled(context.Background(), level) {
+		return
+	}
+	l.Log(context.Background(), level, fmt.Sprintf(format, args...), "event", event)
+}
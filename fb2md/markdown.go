@@ -0,0 +1,1242 @@
+package fb2md
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// markdownRenderer writes a Book as Markdown with footnotes collected at the end.
+type markdownRenderer struct {
+	ctx          *renderContext
+	dialect      dialect
+	book         *Book
+	out          *strings.Builder
+	sectionLevel int
+	// partLevel is 1 inside a Markua part, whose chapters are level 1.
+	partLevel     int
+	footnoteSeen  map[string]bool
+	footnoteOrder []string
+	// inlineNoteOpen guards against notes that reference themselves when
+	// footnotes are written in place.
+	inlineNoteOpen map[string]bool
+	// linkIDs holds the ids internal links may point to; anchors records
+	// where each ended up once written. slugCount dedupes heading slugs.
+	linkIDs   map[string]bool
+	anchors   map[string]anchorTarget
+	slugCount map[string]int
+	// page is the note being written in split mode.
+	page int
+}
+
+// anchorTarget is where an id of the source lives in the output: the note
+// of a split book and the fragment that reaches it there.
+type anchorTarget struct {
+	page     int
+	fragment string
+}
+
+func (r *markdownRenderer) init(book *Book) {
+	r.dialect = dialects[r.ctx.opts.Dialect]
+	r.dialect.noTables = r.dialect.noTables || r.ctx.opts.NoTables
+	r.dialect.noFootnotes = r.dialect.noFootnotes || r.ctx.opts.NoFootnoteSyntax
+	r.dialect.noStrikethrough = r.dialect.noStrikethrough || r.ctx.opts.NoStrikethrough
+	r.book = book
+	r.out = &strings.Builder{}
+	r.footnoteSeen = make(map[string]bool)
+	r.inlineNoteOpen = make(map[string]bool)
+	r.anchors = make(map[string]anchorTarget)
+	r.slugCount = make(map[string]int)
+	r.linkIDs = make(map[string]bool)
+	WalkBlocks(book.Body, func(node any) {
+		switch n := node.(type) {
+		case *Section:
+			r.linkIDs[n.ID] = n.ID != ""
+		case *Paragraph:
+			r.linkIDs[n.ID] = n.ID != ""
+		}
+	})
+}
+
+func (r *markdownRenderer) render(book *Book) []byte {
+	r.init(book)
+	r.writeFields(r.headerMeta(book), r.frontMatter(book))
+	header := r.out.Len()
+	r.writeHeader(book)
+	r.writeBlocks(book.Body)
+	r.writeFootnotes()
+	return r.finish(r.resolveLinks(r.escape(r.out.String(), header), nil))
+}
+
+// finish returns a rendered file, with runs of blank lines collapsed unless
+// --no-normalize is set.
+func (r *markdownRenderer) finish(text string) []byte {
+	if r.ctx.opts.NoNormalize {
+		return []byte(text)
+	}
+	return []byte(collapseBlankLines(text))
+}
+
+// renderSplit writes an index note with the book metadata and a table of
+// contents, then one note per chapter with front matter naming the book and
+// the chapter, and links to the previous, next and index notes.
+func (r *markdownRenderer) renderSplit(book *Book) [][]byte {
+	r.init(book)
+	bookTitle := ""
+	if book.Meta != nil {
+		bookTitle = strings.TrimSpace(book.Meta.Title)
+	}
+
+	type note struct {
+		title string
+		body  string
+		page  int
+	}
+	var notes []note
+	for i, page := range splitPages(book.Body, bookTitle) {
+		r.out = &strings.Builder{}
+		r.footnoteSeen = make(map[string]bool)
+		r.footnoteOrder = nil
+		r.slugCount = make(map[string]int)
+		r.page = i
+		r.writeBlocks(page.blocks)
+		r.writeFootnotes()
+		if body := strings.TrimSpace(r.out.String()); body != "" {
+			notes = append(notes, note{title: page.title, body: r.escape(body, 0), page: i})
+		}
+	}
+
+	index := filepath.Base(r.ctx.outputFile)
+	files := make([]string, len(notes))
+	pageFiles := make(map[int]string)
+	for i, n := range notes {
+		files[i] = filepath.Base(r.ctx.chapterFile(i + 1))
+		pageFiles[n.page] = files[i]
+	}
+
+	r.out = &strings.Builder{}
+	r.writeFields(r.headerMeta(book), r.frontMatter(book))
+	header := r.out.Len()
+	r.writeHeader(book)
+	r.out.WriteString("## Contents\n\n")
+	for i, n := range notes {
+		r.out.WriteString(fmt.Sprintf("%d. %s\n", i+1, r.noteLink(files[i], n.title)))
+	}
+	parts := [][]byte{r.finish(r.escape(r.out.String(), header))}
+
+	for i, n := range notes {
+		r.out = &strings.Builder{}
+		var fields []MetaField
+		if bookTitle != "" {
+			fields = append(fields, MetaField{Key: "book", Value: bookTitle})
+		}
+		if book.Meta != nil && len(book.Meta.Authors) > 0 {
+			fields = append(fields, MetaField{Key: "author", Value: book.Meta.AuthorNames()})
+		}
+		fields = append(fields,
+			MetaField{Key: "chapter", Value: i + 1},
+			MetaField{Key: "title", Value: n.title},
+			MetaField{Key: "parent", Value: r.noteRef(index)})
+		nav := []string{}
+		if i > 0 {
+			fields = append(fields, MetaField{Key: "prev", Value: r.noteRef(files[i-1])})
+			nav = append(nav, "← "+r.noteLink(files[i-1], notes[i-1].title))
+		}
+		nav = append(nav, "↑ "+r.noteLink(index, bookTitle))
+		if i < len(notes)-1 {
+			fields = append(fields, MetaField{Key: "next", Value: r.noteRef(files[i+1])})
+			nav = append(nav, r.noteLink(files[i+1], notes[i+1].title)+" →")
+		}
+
+		r.writeFields(nil, fields)
+		r.page = n.page
+		r.out.WriteString(r.resolveLinks(n.body, pageFiles))
+		r.out.WriteString("\n\n---\n\n")
+		r.out.WriteString(strings.Join(nav, " · "))
+		r.out.WriteString("\n")
+		parts = append(parts, r.finish(r.out.String()))
+	}
+	return parts
+}
+
+// noteLink links to another note of a split book.
+func (r *markdownRenderer) noteLink(file, title string) string {
+	if title == "" {
+		title = strings.TrimSuffix(file, filepath.Ext(file))
+	}
+	if r.dialect.wikiImages {
+		return "[[" + strings.TrimSuffix(file, filepath.Ext(file)) + "|" + title + "]]"
+	}
+	return "[" + title + "](" + file + ")"
+}
+
+// noteRef names another note of a split book in front matter.
+func (r *markdownRenderer) noteRef(file string) string {
+	if r.dialect.wikiImages {
+		return "[[" + strings.TrimSuffix(file, filepath.Ext(file)) + "]]"
+	}
+	return file
+}
+
+// frontMatter returns the front matter fields of the book, including the
+// metadata for dialects that keep it there.
+func (r *markdownRenderer) frontMatter(book *Book) []MetaField {
+	fields := book.FrontMatter
+	if meta := r.headerMeta(book); meta != nil && r.dialect.frontMatter != nil {
+		metaFields := r.dialect.frontMatter(meta, r.ctx)
+		if r.ctx.opts.MetadataLevel == "full" {
+			metaFields = append(metaFields, extendedMetadata(meta)...)
+		}
+		if r.ctx.opts.ExtraMetadata {
+			keys := make(map[string]bool)
+			for _, field := range metaFields {
+				keys[field.Key] = true
+			}
+			for _, field := range customInfoFields(meta) {
+				// Keep a custom "title" from replacing the real one.
+				if keys[field.Key] {
+					field.Key = "custom_" + field.Key
+				}
+				metaFields = append(metaFields, field)
+			}
+		}
+		if r.ctx.opts.Stats {
+			metaFields = append(metaFields, CollectStats(book).fields()...)
+		}
+		fields = append(metaFields, fields...)
+	} else if meta != nil && len(meta.Annotation) > 0 && r.ctx.opts.Annotation == "front-matter" && r.ctx.opts.MetadataFormat != "mmd" {
+		// Dialects without front matter still get one for the annotation.
+		fields = append([]MetaField{{Key: "description", Value: meta.annotationText()}}, fields...)
+	}
+	return fields
+}
+
+// headerMeta returns the metadata to write at the top of the book, or nil
+// when --metadata none leaves it out.
+func (r *markdownRenderer) headerMeta(book *Book) *Metadata {
+	if r.ctx.opts.MetadataLevel == "none" {
+		return nil
+	}
+	return book.Meta
+}
+
+// writeFields writes front matter, or a MultiMarkdown metadata block that
+// also carries meta when that format is selected.
+func (r *markdownRenderer) writeFields(meta *Metadata, fields []MetaField) {
+	if r.ctx.opts.MetadataFormat == "mmd" {
+		r.writeMMDMetadata(meta, fields)
+		return
+	}
+	r.writeFrontMatter(fields)
+}
+
+// writeHeader writes the metadata header block for dialects that keep the
+// metadata out of front matter, or the --header-template output.
+func (r *markdownRenderer) writeHeader(book *Book) {
+	meta := r.headerMeta(book)
+	custom := meta != nil && r.ctx.opts.HeaderTemplate != nil
+	if custom || meta != nil && r.dialect.frontMatter == nil && r.ctx.opts.MetadataFormat != "mmd" {
+		if r.dialect.matterMarkers {
+			r.out.WriteString("{frontmatter}\n\n")
+		}
+		if !custom || !r.writeTemplateHeader(meta) {
+			r.writeMetadata(meta)
+		}
+	}
+	if r.dialect.matterMarkers {
+		r.out.WriteString("{mainmatter}\n\n")
+	}
+}
+
+// escape applies the dialect's escaping to text after the first from bytes,
+// which hold the front matter.
+func (r *markdownRenderer) escape(text string, from int) string {
+	if r.dialect.escape == nil {
+		return text
+	}
+	return text[:from] + r.dialect.escape(text[from:])
+}
+
+func (r *markdownRenderer) writeFrontMatter(fields []MetaField) {
+	if len(fields) == 0 {
+		return
+	}
+	r.out.WriteString("---\n")
+	for _, field := range fields {
+		switch v := field.Value.(type) {
+		case int:
+			r.out.WriteString(fmt.Sprintf("%s: %d\n", field.Key, v))
+		case []string:
+			r.out.WriteString(field.Key + ":\n")
+			for _, item := range v {
+				r.out.WriteString("  - " + yamlQuote(item) + "\n")
+			}
+		default:
+			r.out.WriteString(fmt.Sprintf("%s: %s\n", field.Key, yamlQuote(fmt.Sprint(v))))
+		}
+	}
+	r.out.WriteString("---\n\n")
+}
+
+// writeMMDMetadata writes the metadata and front matter fields as a
+// MultiMarkdown metadata block, which must open the document.
+func (r *markdownRenderer) writeMMDMetadata(meta *Metadata, fields []MetaField) {
+	var lines []string
+	add := func(key, value string) {
+		if value = strings.Join(strings.Fields(value), " "); value != "" {
+			lines = append(lines, key+": "+value)
+		}
+	}
+	if meta != nil {
+		add("Title", meta.Title)
+		add("Author", strings.Join(meta.AuthorNames(), ", "))
+		add("Date", meta.Date)
+		add("Language", meta.Lang)
+		add("Keywords", strings.Join(meta.tags(r.ctx.opts), ", "))
+		for _, seq := range meta.Sequences {
+			add("Series", seq.label())
+		}
+		add("Abstract", meta.annotationText())
+		if r.ctx.opts.MetadataLevel == "full" {
+			for _, field := range extendedMetadata(meta) {
+				add(metadataLabels[field.Key], metaFieldText(field, ", "))
+			}
+		}
+		if r.ctx.opts.ExtraMetadata {
+			for _, field := range customInfoFields(meta) {
+				add(field.Key, metaFieldText(field, ", "))
+			}
+		}
+	}
+	for _, field := range fields {
+		switch v := field.Value.(type) {
+		case []string:
+			add(field.Key, strings.Join(v, ", "))
+		default:
+			add(field.Key, fmt.Sprint(v))
+		}
+	}
+	if len(lines) == 0 {
+		return
+	}
+	r.out.WriteString(strings.Join(lines, "\n"))
+	r.out.WriteString("\n\n")
+}
+
+func (r *markdownRenderer) writeMetadata(meta *Metadata) {
+	if meta.Title != "" {
+		r.headingFragment(meta.Title)
+		r.out.WriteString("# ")
+		r.out.WriteString(meta.Title)
+		r.out.WriteString("\n\n")
+	}
+
+	if len(meta.Authors) > 0 {
+		r.out.WriteString("**Authors:** ")
+		r.out.WriteString(strings.Join(meta.AuthorNames(), ", "))
+		r.out.WriteString("\n\n")
+	}
+
+	if len(meta.Genres) > 0 {
+		r.out.WriteString("**Genres:** ")
+		r.out.WriteString(strings.Join(meta.Genres, ", "))
+		r.out.WriteString("\n\n")
+	}
+
+	if keywords := meta.keywordList(); len(keywords) > 0 && r.ctx.opts.ExtraMetadata {
+		r.out.WriteString("**Keywords:** ")
+		r.out.WriteString(strings.Join(keywords, ", "))
+		r.out.WriteString("\n\n")
+	}
+
+	for _, seq := range meta.Sequences {
+		r.out.WriteString("**Series:** ")
+		r.out.WriteString(seq.label())
+		r.out.WriteString("\n\n")
+	}
+
+	if r.ctx.opts.MetadataLevel == "full" {
+		for _, field := range extendedMetadata(meta) {
+			r.out.WriteString("**" + metadataLabels[field.Key] + ":** ")
+			r.out.WriteString(strings.ReplaceAll(metaFieldText(field, ", "), "\n", "; "))
+			r.out.WriteString("\n\n")
+		}
+	}
+
+	if r.ctx.opts.ExtraMetadata {
+		for _, info := range meta.CustomInfo {
+			label := info.Type
+			if label == "" {
+				label = "Custom info"
+			}
+			r.out.WriteString("**" + label + ":** ")
+			r.out.WriteString(strings.Join(strings.Fields(info.Value), " "))
+			r.out.WriteString("\n\n")
+		}
+	}
+
+	if len(meta.Annotation) > 0 {
+		switch r.ctx.opts.Annotation {
+		case "front-matter":
+			// Written as the description field instead.
+		case "blockquote":
+			r.writeCite(&Cite{Blocks: meta.Annotation})
+		default:
+			r.headingFragment("Annotation")
+			r.out.WriteString("## Annotation\n\n")
+			r.writeBlocks(meta.Annotation)
+			r.out.WriteString("\n")
+		}
+	}
+
+	if meta.Date != "" {
+		r.out.WriteString("**Date:** ")
+		r.out.WriteString(meta.Date)
+		r.out.WriteString("\n\n")
+	}
+
+	r.out.WriteString("---\n\n")
+}
+
+// writeFootnotes appends referenced footnotes at the end of the document.
+// Notes referenced only from other notes are appended as they are found.
+func (r *markdownRenderer) writeFootnotes() {
+	if len(r.footnoteOrder) == 0 {
+		return
+	}
+	r.out.WriteString("\n---\n\n")
+	for i := 0; i < len(r.footnoteOrder); i++ {
+		id := r.footnoteOrder[i]
+		if note, ok := r.book.Footnotes[id]; ok {
+			text := r.inlineString(note.Content)
+			if r.dialect.noFootnotes {
+				r.out.WriteString(fmt.Sprintf("%d. <a id=\"fn-%s\"></a>%s [↩](#fnref-%s)\n\n",
+					i+1, html.EscapeString(id), text, id))
+				continue
+			}
+			r.out.WriteString(wrapText(text, r.ctx.opts.Wrap, fmt.Sprintf("[^%s]: ", id), "    "))
+			r.out.WriteString("\n\n")
+		}
+	}
+}
+
+func (r *markdownRenderer) writeBlocks(blocks []Block) {
+	for _, b := range blocks {
+		if r.ctx.opts.guard.err() != nil {
+			return
+		}
+		r.writeBlock(b)
+	}
+}
+
+func (r *markdownRenderer) writeBlock(b Block) {
+	switch n := b.(type) {
+	case *Section:
+		r.writeSection(n)
+	case *Heading:
+		r.headingFragment(n.Text)
+		r.out.WriteString(strings.Repeat("#", n.Level))
+		r.out.WriteString(" ")
+		r.out.WriteString(n.Text)
+		r.out.WriteString("\n\n")
+	case *BodyTitle:
+		r.headingFragment(n.Text)
+		r.out.WriteString("\n## ")
+		r.out.WriteString(n.Text)
+		r.out.WriteString("\n\n")
+	case *Chapter:
+		var buf strings.Builder
+		old := r.out
+		r.out = &buf
+		r.writeBlocks(n.Blocks)
+		r.out = old
+		if text := strings.TrimSpace(buf.String()); text != "" {
+			r.out.WriteString(text)
+			r.out.WriteString("\n\n\n")
+		}
+	case *Paragraph:
+		if n.ID != "" {
+			r.anchors[n.ID] = anchorTarget{r.page, n.ID}
+		}
+		if r.dialect.attrLists && n.ID != "" {
+			r.out.WriteString("{id: " + n.ID + "}\n")
+		}
+		r.writeProse(r.anchor(n.ID), "", n.Inlines)
+		r.out.WriteString("\n\n")
+	case *Subtitle:
+		r.out.WriteString("**")
+		r.writeInlines(n.Inlines)
+		r.out.WriteString("**\n\n")
+	case *Plain:
+		r.writeInlines(n.Inlines)
+	case *EmptyLine:
+		r.out.WriteString("\n")
+	case *HorizontalRule:
+		r.out.WriteString("\n---\n\n")
+	case *CodeBlock:
+		fence := codeFence(n.Text)
+		r.out.WriteString(fence + "\n" + n.Text + "\n" + fence + "\n\n")
+	case *Image:
+		if r.dialect.imageAttrs {
+			r.writeImageAttrs(n)
+		}
+		if r.dialect.figures {
+			r.writeFigure(n)
+		} else {
+			r.writeImage(n)
+		}
+		r.out.WriteString("\n\n")
+	case *Epigraph:
+		r.writeEpigraph(n)
+	case *Cite:
+		r.writeCite(n)
+	case *TextAuthor:
+		// Only reached inside fenced divs; quotes write authors themselves.
+		r.out.WriteString("— ")
+		r.writeInlines(n.Inlines)
+		r.out.WriteString("\n\n")
+	case *Quote:
+		r.writeQuote(n)
+	case *Poem:
+		r.writePoem(n)
+	case *List:
+		r.writeList(n)
+	case *Table:
+		r.writeTable(n)
+	}
+}
+
+func (r *markdownRenderer) writeSection(section *Section) {
+	r.sectionLevel++
+	defer func() { r.sectionLevel-- }()
+
+	if section.Title != "" {
+		level := r.sectionLevel + 1
+		attrs := ""
+		if section.ID != "" {
+			attrs = "id: " + section.ID
+		}
+		if r.dialect.parts {
+			level = r.sectionLevel - r.partLevel
+			if r.sectionLevel == 1 && isPart(section) {
+				attrs = strings.TrimSuffix("class: part, "+attrs, ", ")
+				level = 1
+				r.partLevel = 1
+				defer func() { r.partLevel = 0 }()
+			}
+		}
+		if level > 6 {
+			level = 6
+		}
+		fragment := r.headingFragment(section.Title)
+		if section.ID != "" {
+			if r.dialect.headerIDs || r.dialect.attrLists {
+				fragment = section.ID
+			}
+			r.anchors[section.ID] = anchorTarget{r.page, fragment}
+		}
+		if r.dialect.attrLists && attrs != "" {
+			r.out.WriteString("{" + attrs + "}\n")
+		} else if section.ID != "" && !r.dialect.headerIDs {
+			r.out.WriteString(r.anchor(section.ID) + "\n")
+		}
+		r.out.WriteString(strings.Repeat("#", level))
+		r.out.WriteString(" ")
+		r.out.WriteString(section.Title)
+		if r.dialect.headerIDs && section.ID != "" {
+			r.out.WriteString(" {#" + section.ID + "}")
+		}
+		r.out.WriteString("\n\n")
+	} else if section.ID != "" {
+		r.anchors[section.ID] = anchorTarget{r.page, section.ID}
+		if anchor := r.anchor(section.ID); anchor != "" {
+			r.out.WriteString(anchor + "\n\n")
+		}
+	}
+
+	for _, epigraph := range section.Epigraphs {
+		r.writeEpigraph(epigraph)
+	}
+	r.writeBlocks(section.Annotation)
+	r.writeBlocks(section.Blocks)
+}
+
+func (r *markdownRenderer) writeEpigraph(epigraph *Epigraph) {
+	switch {
+	case r.ctx.opts.EpigraphStyle == "html":
+		// The blank line after the tag lets Markdown inside the div render.
+		r.writeDiv("<div class=\"epigraph\" align=\"right\" style=\"font-style: italic\">\n", "</div>", epigraph.Blocks)
+		return
+	case r.ctx.opts.EpigraphStyle == "callout":
+		r.out.WriteString("> [!quote]\n")
+	case r.dialect.fencedDivs:
+		r.writeDiv("::: epigraph", ":::", epigraph.Blocks)
+		return
+	case r.dialect.asides:
+		r.writeDiv("{aside}", "{/aside}", epigraph.Blocks)
+		return
+	}
+	for _, b := range epigraph.Blocks {
+		switch n := b.(type) {
+		case *Paragraph:
+			r.writeProse("> "+r.anchor(n.ID), "> ", n.Inlines)
+			r.out.WriteString("\n")
+		case *Poem:
+			r.writeQuotedPoem(n)
+		case *Cite:
+			// Nested cite in epigraph — quoted along with the epigraph
+			for _, cb := range n.Blocks {
+				switch cn := cb.(type) {
+				case *Paragraph:
+					r.writeProse("> "+r.anchor(cn.ID), "> ", cn.Inlines)
+					r.out.WriteString("\n")
+				case *TextAuthor:
+					r.writeQuotedAuthor(cn)
+				case *EmptyLine:
+					r.out.WriteString(">\n")
+				}
+			}
+		case *TextAuthor:
+			r.writeQuotedAuthor(n)
+		case *EmptyLine:
+			r.out.WriteString(">\n")
+		}
+	}
+	r.out.WriteString("\n")
+}
+
+func (r *markdownRenderer) writeQuotedAuthor(author *TextAuthor) {
+	r.out.WriteString(">\n> — ")
+	r.writeInlines(author.Inlines)
+	r.out.WriteString("\n")
+}
+
+func (r *markdownRenderer) writePoem(poem *Poem) {
+	if poem.Title != "" {
+		r.out.WriteString("**")
+		r.out.WriteString(poem.Title)
+		r.out.WriteString("**\n\n")
+	}
+
+	for _, epigraph := range poem.Epigraphs {
+		r.writeEpigraph(epigraph)
+	}
+
+	switch r.ctx.opts.PoemStyle {
+	case "blockquote":
+		r.writeVerseQuote(poem.Blocks)
+	case "codeblock":
+		r.writeVerseCode(poem.Blocks)
+	default:
+		for _, b := range poem.Blocks {
+			switch n := b.(type) {
+			case *Stanza:
+				r.writeStanza(n)
+				r.out.WriteString("\n")
+			case *Subtitle:
+				r.writeBlock(n)
+			}
+		}
+	}
+
+	for _, author := range poem.Authors {
+		r.out.WriteString("*— ")
+		r.writeInlines(author)
+		r.out.WriteString("*\n\n")
+	}
+
+	if poem.Date != "" {
+		r.out.WriteString("*")
+		r.out.WriteString(poem.Date)
+		r.out.WriteString("*\n\n")
+	}
+}
+
+// writeQuotedPoem renders a poem inside a blockquote (epigraph, cite).
+func (r *markdownRenderer) writeQuotedPoem(poem *Poem) {
+	if poem.Title != "" {
+		r.out.WriteString("> **")
+		r.out.WriteString(poem.Title)
+		r.out.WriteString("**\n>\n")
+	}
+
+	for _, b := range poem.Blocks {
+		switch n := b.(type) {
+		case *Stanza:
+			for _, line := range n.Lines {
+				r.out.WriteString("> ")
+				r.writeInlines(line)
+				r.out.WriteString("\n")
+			}
+			r.out.WriteString(">\n")
+		case *Subtitle:
+			r.out.WriteString("> **")
+			r.writeInlines(n.Inlines)
+			r.out.WriteString("**\n")
+		}
+	}
+
+	for _, author := range poem.Authors {
+		r.out.WriteString("> *— ")
+		r.writeInlines(author)
+		r.out.WriteString("*\n")
+	}
+}
+
+// writeVerseQuote writes the stanzas of a poem as one blockquote. Lines end
+// in a backslash break, which editors do not strip like trailing spaces.
+func (r *markdownRenderer) writeVerseQuote(blocks []Block) {
+	first := true
+	para := func() {
+		if !first {
+			r.out.WriteString(">\n")
+		}
+		first = false
+	}
+	for _, b := range blocks {
+		switch n := b.(type) {
+		case *Stanza:
+			para()
+			if n.Title != "" {
+				r.out.WriteString("> **" + n.Title + "**\n>\n")
+			}
+			if n.Subtitle != nil {
+				r.out.WriteString("> **")
+				r.writeInlines(n.Subtitle)
+				r.out.WriteString("**\n>\n")
+			}
+			for i, line := range n.Lines {
+				r.out.WriteString("> ")
+				r.writeInlines(line)
+				if i < len(n.Lines)-1 {
+					r.out.WriteString("\\")
+				}
+				r.out.WriteString("\n")
+			}
+		case *Subtitle:
+			para()
+			r.out.WriteString("> **")
+			r.writeInlines(n.Inlines)
+			r.out.WriteString("**\n")
+		}
+	}
+	if !first {
+		r.out.WriteString("\n")
+	}
+}
+
+// writeVerseCode writes the stanzas of a poem as plain text in a fenced code
+// block, keeping the indentation of every line.
+func (r *markdownRenderer) writeVerseCode(blocks []Block) {
+	var parts []string
+	for _, b := range blocks {
+		switch n := b.(type) {
+		case *Stanza:
+			var lines []string
+			if n.Title != "" {
+				lines = append(lines, n.Title)
+			}
+			if n.Subtitle != nil {
+				lines = append(lines, plainText(n.Subtitle))
+			}
+			for _, line := range n.Lines {
+				lines = append(lines, strings.TrimRight(plainText(line), " \t"))
+			}
+			parts = append(parts, strings.Join(lines, "\n"))
+		case *Subtitle:
+			parts = append(parts, plainText(n.Inlines))
+		}
+	}
+	if len(parts) == 0 {
+		return
+	}
+	text := strings.Join(parts, "\n\n")
+	fence := codeFence(text)
+	r.out.WriteString(fence + "\n" + text + "\n" + fence + "\n\n")
+}
+
+func (r *markdownRenderer) writeStanza(stanza *Stanza) {
+	if stanza.Title != "" {
+		r.out.WriteString("**")
+		r.out.WriteString(stanza.Title)
+		r.out.WriteString("**\n")
+	}
+
+	if stanza.Subtitle != nil {
+		r.out.WriteString("**")
+		r.writeInlines(stanza.Subtitle)
+		r.out.WriteString("**\n")
+	}
+
+	// Verse lines — each on its own line with trailing double-space for MD line break
+	for i, line := range stanza.Lines {
+		r.writeInlines(line)
+		if i < len(stanza.Lines)-1 {
+			r.out.WriteString("  \n")
+		} else {
+			r.out.WriteString("\n")
+		}
+	}
+}
+
+func (r *markdownRenderer) writeCite(cite *Cite) {
+	if r.dialect.fencedDivs {
+		r.writeDiv("::: cite", ":::", cite.Blocks)
+		return
+	}
+	for _, b := range cite.Blocks {
+		switch n := b.(type) {
+		case *Paragraph:
+			r.writeProse("> "+r.anchor(n.ID), "> ", n.Inlines)
+			r.out.WriteString("\n>\n")
+		case *Poem:
+			r.writeQuotedPoem(n)
+		case *Subtitle:
+			r.out.WriteString("> **")
+			r.writeInlines(n.Inlines)
+			r.out.WriteString("**\n>\n")
+		case *EmptyLine:
+			r.out.WriteString(">\n")
+		case *Table:
+			// Tables inside quotes — not ideal but preserves content
+			r.writeTable(n)
+		case *TextAuthor:
+			r.writeQuotedAuthor(n)
+		}
+	}
+	r.out.WriteString("\n")
+}
+
+// writeDiv writes blocks between opening and closing fence lines, such as a
+// Pandoc fenced div or a Markua aside.
+func (r *markdownRenderer) writeDiv(open, close string, blocks []Block) {
+	r.out.WriteString(open + "\n")
+	r.writeBlocks(blocks)
+	r.out.WriteString(close + "\n\n")
+}
+
+// isPart reports whether a section holds nothing but sections.
+func isPart(section *Section) bool {
+	parts := 0
+	for _, b := range section.Blocks {
+		switch b.(type) {
+		case *Section:
+			parts++
+		case *EmptyLine:
+		default:
+			return false
+		}
+	}
+	return parts > 0
+}
+
+func (r *markdownRenderer) writeQuote(quote *Quote) {
+	for _, line := range quote.Lines {
+		for _, l := range strings.Split(r.inlineString(line), "\n") {
+			if l = strings.TrimSpace(l); l != "" {
+				r.out.WriteString("> ")
+				r.out.WriteString(l)
+				r.out.WriteString("\n")
+			}
+		}
+	}
+	r.out.WriteString("\n")
+}
+
+func (r *markdownRenderer) writeList(list *List) {
+	for i, item := range list.Items {
+		marker := "- "
+		if list.Ordered {
+			marker = fmt.Sprintf("%d. ", i+1)
+		}
+		r.writeProse(marker, strings.Repeat(" ", len(marker)), item)
+		r.out.WriteString("\n")
+	}
+	r.out.WriteString("\n")
+}
+
+func (r *markdownRenderer) writeTable(table *Table) {
+	if table.Columns == 0 {
+		return
+	}
+	if r.dialect.noTables {
+		r.writeHTMLTable(table)
+		return
+	}
+
+	rows := table.Rows
+	if table.Header {
+		r.writeTableRow(rows[0])
+		rows = rows[1:]
+	} else {
+		// No header — create empty header for valid MD table
+		r.out.WriteString("|")
+		for i := 0; i < table.Columns; i++ {
+			r.out.WriteString("  |")
+		}
+		r.out.WriteString("\n")
+	}
+
+	r.out.WriteString("|")
+	for i := 0; i < table.Columns; i++ {
+		switch table.columnAlign(i) {
+		case "left":
+			r.out.WriteString(" :--- |")
+		case "center":
+			r.out.WriteString(" :---: |")
+		case "right":
+			r.out.WriteString(" ---: |")
+		default:
+			r.out.WriteString(" --- |")
+		}
+	}
+	r.out.WriteString("\n")
+
+	for _, row := range rows {
+		r.writeTableRow(row)
+	}
+
+	r.out.WriteString("\n")
+}
+
+// writeHTMLTable writes a table as an HTML block. Markdown is not parsed
+// inside HTML blocks, so the cells are rendered as HTML too.
+func (r *markdownRenderer) writeHTMLTable(table *Table) {
+	cells := &htmlRenderer{ctx: r.ctx, noteRef: r.htmlNoteRef}
+	cells.init(&Book{})
+	cells.writeTable(table)
+	r.out.WriteString(cells.out.String())
+	r.out.WriteString("\n")
+}
+
+// writeTableRow writes a row of a pipe table. A cell must stay on one line
+// and its pipes, including those in links and image embeds, are escaped.
+func (r *markdownRenderer) writeTableRow(row []TableCell) {
+	r.out.WriteString("| ")
+	for _, cell := range row {
+		text := strings.TrimSpace(r.inlineString(cell.Inlines))
+		text = strings.ReplaceAll(text, "  \n", "<br>")
+		text = strings.Join(strings.Fields(strings.ReplaceAll(text, "\n", " ")), " ")
+		r.out.WriteString(strings.ReplaceAll(text, "|", "\\|"))
+		r.out.WriteString(" | ")
+	}
+	r.out.WriteString("\n")
+}
+
+func (r *markdownRenderer) writeInlines(inlines []Inline) {
+	for _, in := range inlines {
+		switch n := in.(type) {
+		case *Text:
+			r.out.WriteString(n.Value)
+		case *Emphasis:
+			r.writeWrapped("*", n.Children)
+		case *Strong:
+			r.writeWrapped("**", n.Children)
+		case *Strikethrough:
+			if r.dialect.noStrikethrough {
+				r.out.WriteString("<del>")
+				r.writeInlines(n.Children)
+				r.out.WriteString("</del>")
+				continue
+			}
+			r.writeWrapped("~~", n.Children)
+		case *Code:
+			r.writeWrapped("`", n.Children)
+		case *Superscript:
+			r.writeInlines(n.Children)
+		case *Subscript:
+			r.writeInlines(n.Children)
+		case *Span:
+			lang := ""
+			if r.ctx.opts.LangSpans {
+				lang = n.Lang
+			}
+			switch {
+			case r.dialect.spanAttrs && (n.Class != "" || lang != ""):
+				var attrs []string
+				if n.Class != "" {
+					attrs = append(attrs, "."+strings.Join(strings.Fields(n.Class), "-"))
+				}
+				if lang != "" {
+					attrs = append(attrs, "lang="+lang)
+				}
+				r.out.WriteString("[")
+				r.writeInlines(n.Children)
+				r.out.WriteString("]{" + strings.Join(attrs, " ") + "}")
+			case lang != "":
+				r.out.WriteString("<span lang=\"" + html.EscapeString(lang) + "\">")
+				r.writeInlines(n.Children)
+				r.out.WriteString("</span>")
+			default:
+				r.writeInlines(n.Children)
+			}
+		case *Link:
+			r.out.WriteString("[")
+			r.out.WriteString(strings.TrimSpace(plainText(n.Children)))
+			r.out.WriteString("](")
+			r.out.WriteString(r.linkHref(n.Href))
+			r.out.WriteString(")")
+		case *NoteRef:
+			if r.dialect.inlineNotes {
+				r.writeInlineNote(n.ID)
+				continue
+			}
+			if r.dialect.noFootnotes {
+				r.out.WriteString(r.htmlNoteRef(n.ID))
+				continue
+			}
+			r.out.WriteString("[^")
+			r.out.WriteString(n.ID)
+			r.out.WriteString("]")
+			if !r.footnoteSeen[n.ID] {
+				r.footnoteSeen[n.ID] = true
+				r.footnoteOrder = append(r.footnoteOrder, n.ID)
+			}
+		case *LineBreak:
+			r.out.WriteString("  \n")
+		case *Image:
+			r.writeImage(n)
+		}
+	}
+}
+
+// htmlNoteRef returns a numbered superscript link to a note. Only the first
+// reference to a note gets the anchor its back link points to.
+func (r *markdownRenderer) htmlNoteRef(id string) string {
+	anchor := ""
+	if !r.footnoteSeen[id] {
+		r.footnoteSeen[id] = true
+		r.footnoteOrder = append(r.footnoteOrder, id)
+		anchor = fmt.Sprintf(" id=\"fnref-%s\"", html.EscapeString(id))
+	}
+	num := 0
+	for i, seen := range r.footnoteOrder {
+		if seen == id {
+			num = i + 1
+			break
+		}
+	}
+	return fmt.Sprintf("<sup><a%s href=\"#fn-%s\">%d</a></sup>", anchor, html.EscapeString(id), num)
+}
+
+// writeInlineNote writes a footnote in place as ^[text], on one line.
+func (r *markdownRenderer) writeInlineNote(id string) {
+	note, ok := r.book.Footnotes[id]
+	if !ok || r.inlineNoteOpen[id] {
+		return
+	}
+	r.inlineNoteOpen[id] = true
+	text := strings.Join(strings.Fields(r.inlineString(note.Content)), " ")
+	delete(r.inlineNoteOpen, id)
+	r.out.WriteString("^[" + text + "]")
+}
+
+func (r *markdownRenderer) writeWrapped(marker string, inlines []Inline) {
+	r.out.WriteString(marker)
+	r.writeInlines(inlines)
+	r.out.WriteString(marker)
+}
+
+// headingFragment returns the fragment renderers generate for a heading:
+// the GitHub-style slug, numbered when it repeats, or for Obsidian the
+// heading text itself.
+func (r *markdownRenderer) headingFragment(text string) string {
+	text = strings.TrimSpace(text)
+	if r.dialect.wikiImages {
+		return url.PathEscape(text)
+	}
+	slug := headingSlug(text)
+	n := r.slugCount[slug]
+	r.slugCount[slug] = n + 1
+	if n > 0 {
+		slug = fmt.Sprintf("%s-%d", slug, n)
+	}
+	return slug
+}
+
+// headingSlug lowercases text, drops punctuation and turns spaces into
+// hyphens, as GitHub does for heading anchors.
+func headingSlug(text string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(text) {
+		switch {
+		case unicode.IsLetter(c) || unicode.IsDigit(c) || unicode.IsMark(c) || c == '_' || c == '-':
+			b.WriteRune(c)
+		case c == ' ':
+			b.WriteRune('-')
+		}
+	}
+	return b.String()
+}
+
+// linkPlaceholder marks an internal link in the rendered text until every
+// anchor is known; links can point forward.
+var linkPlaceholder = regexp.MustCompile("\x00([^\x00]*)\x00")
+
+// linkHref returns href, or a placeholder for a link to an id of the book.
+func (r *markdownRenderer) linkHref(href string) string {
+	if id, ok := strings.CutPrefix(href, "#"); ok && r.linkIDs[id] {
+		return "\x00" + id + "\x00"
+	}
+	return href
+}
+
+// resolveLinks replaces link placeholders with the fragment of their
+// target, prefixed with its note when pageFiles maps the pages of a split
+// book to files and the target is in another note.
+func (r *markdownRenderer) resolveLinks(text string, pageFiles map[int]string) string {
+	return linkPlaceholder.ReplaceAllStringFunc(text, func(m string) string {
+		id := strings.Trim(m, "\x00")
+		target, ok := r.anchors[id]
+		if !ok {
+			return "#" + id
+		}
+		if file := pageFiles[target.page]; file != "" && target.page != r.page {
+			return file + "#" + target.fragment
+		}
+		return "#" + target.fragment
+	})
+}
+
+// anchor returns an inline anchor for id, so links to the source's ids
+// keep working: a Pandoc empty span or an HTML anchor. Markua takes ids in
+// attribute lists instead.
+func (r *markdownRenderer) anchor(id string) string {
+	switch {
+	case id == "" || r.dialect.attrLists:
+		return ""
+	case r.dialect.headerIDs:
+		return "[]{#" + id + "}"
+	}
+	return fmt.Sprintf("<a id=\"%s\"></a>", html.EscapeString(id))
+}
+
+// writeProse writes inlines after prefix, reflowed at --wrap columns with
+// rest starting the continuation lines.
+func (r *markdownRenderer) writeProse(prefix, rest string, inlines []Inline) {
+	if r.ctx.opts.Wrap <= 0 {
+		r.out.WriteString(prefix)
+		r.writeInlines(inlines)
+		return
+	}
+	r.out.WriteString(wrapText(r.inlineString(inlines), r.ctx.opts.Wrap, prefix, rest))
+}
+
+// inlineString renders inlines to a string instead of the output.
+func (r *markdownRenderer) inlineString(inlines []Inline) string {
+	var buf strings.Builder
+	old := r.out
+	r.out = &buf
+	r.writeInlines(inlines)
+	r.out = old
+	return buf.String()
+}
+
+// binary returns the embedded binary with the given id.
+func (r *markdownRenderer) binary(id string) (Binary, bool) {
+	for _, bin := range r.book.Binaries {
+		if bin.ID == id {
+			return bin, true
+		}
+	}
+	return Binary{}, false
+}
+
+// writeImageAttrs writes the Markua attribute list of a block image.
+func (r *markdownRenderer) writeImageAttrs(img *Image) {
+	if _, ok := r.imageSrc(img); !ok || img.Media != "" {
+		return
+	}
+	if alt := img.altText(); alt != "" {
+		r.out.WriteString(fmt.Sprintf("{alt: %s}\n", yamlQuote(alt)))
+	}
+}
+
+// imageSrc returns the link of an image: the external file, the extracted
+// binary or, with --images inline, a data URI.
+func (r *markdownRenderer) imageSrc(img *Image) (string, bool) {
+	if img.ID == "" {
+		return img.Href, true
+	}
+	if link, ok := r.ctx.imageLink(img.ID); ok {
+		return link, true
+	}
+	if bin, ok := r.binary(img.ID); ok && r.ctx.opts.InlineImages {
+		return dataURI(bin), true
+	}
+	return "", false
+}
+
+func (r *markdownRenderer) writeImage(img *Image) {
+	if img.Media != "" {
+		r.writeMedia(img)
+		return
+	}
+	src, ok := r.imageSrc(img)
+	if !ok {
+		r.out.WriteString("![" + escapeLinkText(img.placeholder()) + "]")
+		return
+	}
+	if _, linked := r.ctx.imageLink(img.ID); linked && r.dialect.wikiImages {
+		r.out.WriteString("![[" + src + "]]")
+		return
+	}
+	title := ""
+	if img.Title != "" && img.Title != img.altText() {
+		title = fmt.Sprintf(" \"%s\"", strings.ReplaceAll(img.Title, `"`, `\"`))
+	}
+	r.out.WriteString(fmt.Sprintf("![%s](%s%s)", escapeLinkText(img.altText()), src, title))
+}
+
+// writeMedia writes the placeholder of a media file, [audio: file.mp3],
+// linked to the file when it is extracted or outside the book.
+func (r *markdownRenderer) writeMedia(img *Image) {
+	src := img.Href
+	if img.ID != "" {
+		src, _ = r.ctx.imageLink(img.ID)
+	}
+	if src == "" {
+		r.out.WriteString("[" + img.mediaLabel() + "]")
+		return
+	}
+	r.out.WriteString(fmt.Sprintf("[%s](%s)", escapeLinkText(img.mediaLabel()), src))
+}
+
+// writeFigure writes a block image with a caption as a figure: the caption
+// is the link text, which Pandoc and Markua show below the image.
+func (r *markdownRenderer) writeFigure(img *Image) {
+	src, ok := r.imageSrc(img)
+	if !ok || img.Title == "" || img.Media != "" {
+		r.writeImage(img)
+		return
+	}
+	r.out.WriteString(fmt.Sprintf("![%s](%s)", escapeLinkText(img.Title), src))
+	// Markua gives the alt text in its attribute list instead.
+	if !r.dialect.imageAttrs && img.Alt != "" {
+		r.out.WriteString(fmt.Sprintf("{fig-alt=\"%s\"}", strings.ReplaceAll(img.Alt, `"`, `\"`)))
+	}
+}
+
+// escapeLinkText escapes the brackets that would end link text early.
+func escapeLinkText(s string) string {
+	s = strings.ReplaceAll(s, "[", `\[`)
+	return strings.ReplaceAll(s, "]", `\]`)
+}
+
+// codeFence returns a backtick fence longer than any run of backticks in text.
+func codeFence(text string) string {
+	longest, run := 0, 0
+	for _, c := range text {
+		if c == '`' {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+	return strings.Repeat("`", max(3, longest+1))
+}
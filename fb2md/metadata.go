@@ -0,0 +1,77 @@
+package fb2md
+
+import (
+	"archive/zip"
+	"bytes"
+
+	"github.com/beevik/etree"
+)
+
+// ReadMetadata reads the description of a book in the given format from
+// data without converting it, or returns nil when the format carries none
+// or it cannot be read.
+func ReadMetadata(data []byte, format string, opts Options) *Metadata {
+	switch format {
+	case "fb2":
+		return fb2Metadata(data, opts)
+	case "fb2.zip", "zip":
+		fb2, err := readZippedFB2(bytes.NewReader(data))
+		if err != nil {
+			return nil
+		}
+		return fb2Metadata(fb2, opts)
+	case "fb3":
+		reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil
+		}
+		f := NewFb3Converter()
+		f.open(reader)
+		doc, err := f.buildFictionBook()
+		if err != nil {
+			return nil
+		}
+		return fb2DocMetadata(doc)
+	case "epub":
+		reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil
+		}
+		return epubMetadata(reader)
+	}
+	return nil
+}
+
+func fb2Metadata(data []byte, opts Options) *Metadata {
+	data, _, err := convertEncoding(data, opts)
+	if err != nil {
+		return nil
+	}
+	doc, _, err := parseFB2(data, opts.Lenient, opts.guard)
+	if err != nil {
+		return nil
+	}
+	return fb2DocMetadata(doc)
+}
+
+func fb2DocMetadata(doc *etree.Document) *Metadata {
+	desc := doc.FindElement("./FictionBook/description")
+	if desc == nil {
+		return nil
+	}
+	return NewConverter().buildMetadata(desc)
+}
+
+// epubMetadata reads the description in the OPF package of an EPUB, or
+// returns nil when it cannot be read.
+func epubMetadata(reader *zip.Reader) *Metadata {
+	e := NewEpubConverter()
+	for _, f := range reader.File {
+		e.files[f.Name] = f
+	}
+	rootFile, err := e.findRootFile()
+	if err != nil {
+		return nil
+	}
+	return e.readMetadata(rootFile)
+}
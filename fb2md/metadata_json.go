@@ -0,0 +1,169 @@
+package fb2md
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// metaJSON is the sidecar written by --metadata-json: the full book
+// description, for catalog tools that should not have to parse Markdown.
+type metaJSON struct {
+	TitleInfo    metaTitleInfo     `json:"title_info"`
+	SrcTitleInfo *metaTitleInfo    `json:"src_title_info,omitempty"`
+	DocumentInfo *metaDocumentInfo `json:"document_info,omitempty"`
+	PublishInfo  *metaPublishInfo  `json:"publish_info,omitempty"`
+	CustomInfo   []metaCustomInfo  `json:"custom_info,omitempty"`
+	Cover        *jsonImage        `json:"cover,omitempty"`
+}
+
+type metaTitleInfo struct {
+	Title       string         `json:"title,omitempty"`
+	Authors     []jsonPerson   `json:"authors,omitempty"`
+	Translators []jsonPerson   `json:"translators,omitempty"`
+	Genres      []string       `json:"genres,omitempty"`
+	Keywords    []string       `json:"keywords,omitempty"`
+	Annotation  string         `json:"annotation,omitempty"`
+	Date        string         `json:"date,omitempty"`
+	DateValue   string         `json:"date_value,omitempty"`
+	DateISO     string         `json:"date_iso,omitempty"`
+	Lang        string         `json:"lang,omitempty"`
+	SrcLang     string         `json:"src_lang,omitempty"`
+	Sequences   []jsonSequence `json:"sequences,omitempty"`
+}
+
+type metaDocumentInfo struct {
+	Authors     []jsonPerson `json:"authors,omitempty"`
+	ProgramUsed string       `json:"program_used,omitempty"`
+	Date        string       `json:"date,omitempty"`
+	DateValue   string       `json:"date_value,omitempty"`
+	SrcURLs     []string     `json:"src_urls,omitempty"`
+	SrcOCR      string       `json:"src_ocr,omitempty"`
+	ID          string       `json:"id,omitempty"`
+	Version     string       `json:"version,omitempty"`
+	History     string       `json:"history,omitempty"`
+	Publishers  []string     `json:"publishers,omitempty"`
+}
+
+type metaPublishInfo struct {
+	BookName  string         `json:"book_name,omitempty"`
+	Publisher string         `json:"publisher,omitempty"`
+	City      string         `json:"city,omitempty"`
+	Year      string         `json:"year,omitempty"`
+	ISBN      string         `json:"isbn,omitempty"`
+	Sequences []jsonSequence `json:"sequences,omitempty"`
+}
+
+type metaCustomInfo struct {
+	Type  string `json:"type,omitempty"`
+	Value string `json:"value"`
+}
+
+// metadataJSONPath returns the sidecar path for outputFile: its extension
+// replaced by .meta.json.
+func metadataJSONPath(outputFile string) string {
+	return strings.TrimSuffix(outputFile, filepath.Ext(outputFile)) + ".meta.json"
+}
+
+// writeMetadataJSON writes the book description next to outputFile.
+func writeMetadataJSON(book *Book, ctx *renderContext) error {
+	meta := book.Meta
+	if meta == nil {
+		meta = &Metadata{}
+	}
+
+	out := metaJSON{TitleInfo: jsonTitleInfo(meta)}
+	if meta.Source != nil {
+		src := jsonTitleInfo(meta.Source)
+		out.SrcTitleInfo = &src
+	}
+	if doc := meta.Document; doc != nil {
+		out.DocumentInfo = &metaDocumentInfo{
+			Authors:     jsonPersons(doc.Authors),
+			ProgramUsed: doc.ProgramUsed,
+			Date:        doc.Date,
+			DateValue:   doc.DateValue,
+			SrcURLs:     doc.SrcURLs,
+			SrcOCR:      doc.SrcOCR,
+			ID:          doc.ID,
+			Version:     doc.Version,
+			History:     blocksText(doc.History),
+			Publishers:  doc.Publishers,
+		}
+	}
+	if pub := meta.Publish; pub != nil {
+		out.PublishInfo = &metaPublishInfo{
+			BookName:  pub.BookName,
+			Publisher: pub.Publisher,
+			City:      pub.City,
+			Year:      pub.Year,
+			ISBN:      pub.ISBN,
+			Sequences: jsonSequences(pub.Sequences),
+		}
+	}
+	for _, info := range meta.CustomInfo {
+		out.CustomInfo = append(out.CustomInfo, metaCustomInfo{Type: info.Type, Value: info.Value})
+	}
+	if meta.Cover != "" {
+		cover := &jsonImage{ID: meta.Cover}
+		for _, bin := range book.Binaries {
+			if bin.ID == meta.Cover {
+				cover.ContentType = bin.ContentType
+			}
+		}
+		if link, ok := ctx.imageLink(meta.Cover); ok {
+			cover.File = link
+		}
+		out.Cover = cover
+	}
+
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	path := metadataJSONPath(ctx.outputFile)
+	if err := writeOutput(path, append(data, '\n'), ctx.opts); err != nil {
+		return fmt.Errorf("failed to write metadata file: %w", err)
+	}
+	return nil
+}
+
+func jsonTitleInfo(meta *Metadata) metaTitleInfo {
+	return metaTitleInfo{
+		Title:       strings.TrimSpace(meta.Title),
+		Authors:     jsonPersons(meta.Authors),
+		Translators: jsonPersons(meta.Translators),
+		Genres:      meta.Genres,
+		Keywords:    meta.keywordList(),
+		Annotation:  meta.annotationText(),
+		Date:        meta.Date,
+		DateValue:   meta.DateValue,
+		DateISO:     meta.ISODate(),
+		Lang:        meta.Lang,
+		SrcLang:     meta.SrcLang,
+		Sequences:   jsonSequences(meta.Sequences),
+	}
+}
+
+func jsonPersons(people []Person) []jsonPerson {
+	var out []jsonPerson
+	for _, p := range people {
+		out = append(out, jsonPerson{
+			Name:       p.Name(),
+			FirstName:  p.FirstName,
+			MiddleName: p.MiddleName,
+			LastName:   p.LastName,
+			Nickname:   p.Nickname,
+		})
+	}
+	return out
+}
+
+func jsonSequences(sequences []Sequence) []jsonSequence {
+	var out []jsonSequence
+	for _, seq := range sequences {
+		out = append(out, jsonSequence{Name: seq.Name, Number: seq.Number, Sub: jsonSequences(seq.Sub)})
+	}
+	return out
+}
@@ -0,0 +1,123 @@
+package fb2md
+
+import "strings"
+
+// normalizeBlocks drops sections and chapters with nothing in them, blank
+// paragraphs, and empty lines at the edges of a section or next to another
+// empty line. A section counts as empty whatever its title, but is kept
+// when its id is in linked, the targets of the book's internal links.
+func normalizeBlocks(blocks []Block, linked map[string]bool) []Block {
+	var kept []Block
+	for _, b := range blocks {
+		switch n := b.(type) {
+		case *Section:
+			n.Blocks = normalizeBlocks(n.Blocks, linked)
+			if len(n.Epigraphs) == 0 && len(n.Annotation) == 0 && len(n.Blocks) == 0 && !linked[n.ID] {
+				continue
+			}
+		case *Chapter:
+			n.Blocks = normalizeBlocks(n.Blocks, linked)
+			if len(n.Blocks) == 0 {
+				continue
+			}
+		case *Paragraph:
+			if n.ID == "" && blankInlines(n.Inlines) {
+				continue
+			}
+		case *EmptyLine:
+			if len(kept) == 0 {
+				continue
+			}
+			if _, ok := kept[len(kept)-1].(*EmptyLine); ok {
+				continue
+			}
+		}
+		kept = append(kept, b)
+	}
+	if len(kept) > 0 {
+		if _, ok := kept[len(kept)-1].(*EmptyLine); ok {
+			kept = kept[:len(kept)-1]
+		}
+	}
+	return kept
+}
+
+// linkTargets returns the ids the internal links of book point at, in the
+// body, notes and annotation.
+func linkTargets(book *Book) map[string]bool {
+	ids := make(map[string]bool)
+	collect := func(node any) {
+		if link, ok := node.(*Link); ok {
+			if id, ok := strings.CutPrefix(link.Href, "#"); ok && id != "" {
+				ids[id] = true
+			}
+		}
+	}
+	if book.Meta != nil {
+		WalkBlocks(book.Meta.Annotation, collect)
+	}
+	WalkBlocks(book.Body, collect)
+	for _, note := range book.Footnotes {
+		WalkInlines(note.Content, collect)
+	}
+	return ids
+}
+
+// blankInlines reports whether inlines hold only whitespace text.
+func blankInlines(inlines []Inline) bool {
+	for _, in := range inlines {
+		text, ok := in.(*Text)
+		if !ok || strings.TrimSpace(text.Value) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// collapseBlankLines turns runs of blank lines in Markdown, and of empty
+// quote lines, into one and drops blank lines at the start, leaving fenced
+// code as it is.
+func collapseBlankLines(text string) string {
+	lines := strings.Split(text, "\n")
+	out := lines[:0]
+	fence := ""
+	blank := true
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if fence != "" {
+			if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+				fence = ""
+			}
+			out = append(out, line)
+			continue
+		}
+		if trimmed == "" {
+			if !blank {
+				out = append(out, "")
+			}
+			blank = true
+			continue
+		}
+		if trimmed == ">" && len(out) > 0 && strings.TrimSpace(out[len(out)-1]) == ">" {
+			continue
+		}
+		if marker := fenceMarker(trimmed); marker != "" {
+			fence = marker
+		}
+		out = append(out, line)
+		blank = false
+	}
+	return strings.TrimRight(strings.Join(out, "\n"), "\n") + "\n"
+}
+
+// fenceMarker returns the run of backticks or tildes that opens a fenced
+// code block on line, or "" when the line opens none.
+func fenceMarker(line string) string {
+	for _, c := range "`~" {
+		run := len(line) - len(strings.TrimLeft(line, string(c)))
+		if run >= 3 {
+			return line[:run]
+		}
+	}
+	return ""
+}
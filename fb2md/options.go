@@ -0,0 +1,244 @@
+package fb2md
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+// Options controls how a book is converted. The zero value converts with
+// default settings.
+type Options struct {
+	// ExtractImages writes embedded images to ImagesDir and links them.
+	ExtractImages bool
+	ImagesDir     string
+	// Images, when set, receives the extracted images in place of the
+	// files in ImagesDir, which is then only where links point.
+	Images ImageFS
+	// ImageMaxSize downscales extracted images whose longest edge is larger;
+	// ImageQuality is the JPEG quality they are re-encoded with. Zero
+	// leaves images as they are.
+	ImageMaxSize int
+	ImageQuality int
+	// AllBinaries extracts, or packs into EPUB output, every embedded
+	// binary, including those no image in the book refers to.
+	AllBinaries bool
+	// RasterizeSVG replaces SVG images with PNG renderings.
+	RasterizeSVG bool
+	// ZipMaxSize and ZipMaxEntries cap the unpacked size and number of
+	// entries of an EPUB; zero selects DefaultZipMaxSize and
+	// DefaultZipMaxEntries.
+	ZipMaxSize    int64
+	ZipMaxEntries int
+	// MaxFileSize, when set, refuses books larger than it in bytes, and
+	// TimeoutPerFile gives up on a book that takes longer to convert. A
+	// book given up on stops at its next read, or between the parts it
+	// parses and renders; a read in progress then may still return, so
+	// the reader is not to be shared with what the caller does next.
+	MaxFileSize    int64
+	TimeoutPerFile time.Duration
+	// InlineImages embeds images in Markdown as base64 data URIs.
+	InlineImages bool
+	// StripGutenberg removes Project Gutenberg license boilerplate.
+	StripGutenberg bool
+	// To is the output format: "markdown" (the default when empty), "html",
+	// "json", "epub", "bbcode" or "pandoc-json".
+	To string
+	// SplitChapters writes each chapter to its own file next to the output.
+	SplitChapters bool
+	// MetadataJSON writes the full book description to <output>.meta.json.
+	MetadataJSON bool
+	// HeaderTemplate, when set, writes the Markdown metadata header instead
+	// of the built-in block.
+	HeaderTemplate *template.Template
+	// Wrap reflows Markdown paragraphs at this many columns; 0 leaves
+	// each paragraph on one line.
+	Wrap int
+	// NoNormalize keeps runs of blank lines and empty sections as the
+	// source has them.
+	NoNormalize bool
+	// RenumberFootnotes replaces the note ids with 1, 2, 3, ... in reading
+	// order.
+	RenumberFootnotes bool
+	// NumberHeadings prefixes section headings with hierarchical numbers.
+	NumberHeadings bool
+	// LangSpans wraps text marked with another language in Markdown
+	// <span lang> elements, or [text]{lang=xx} spans for Pandoc.
+	LangSpans bool
+	// Typography normalizes quotes, dashes and spaces in the text.
+	Typography Typography
+	// Dialect selects the Markdown flavor, e.g. "hugo"; empty is the default.
+	Dialect string
+	// MetadataLevel is how much of the description Markdown writes: "basic"
+	// (the default when empty), "full" for the publisher, translators,
+	// original and file history as well, or "none".
+	MetadataLevel string
+	// GenreNames is the language FB2 genre codes are named in: "en", "ru",
+	// or "raw" (also when empty) to keep the codes.
+	GenreNames string
+	// ExtraMetadata adds the FB2 keywords to the tags and writes the
+	// custom-info entries as metadata fields.
+	ExtraMetadata bool
+	// MetadataFormat is how book metadata is written: "header" (the default
+	// when empty) or "mmd" for a MultiMarkdown metadata block.
+	MetadataFormat string
+	// NoTables, NoFootnoteSyntax and NoStrikethrough write those constructs
+	// as HTML for renderers without the Markdown extension.
+	NoTables         bool
+	NoFootnoteSyntax bool
+	NoStrikethrough  bool
+	// PoemStyle is how Markdown writes verse: "linebreaks" (the default
+	// when empty), "blockquote" or "codeblock".
+	PoemStyle string
+	// EpigraphStyle is how epigraphs are written: "quote" (the default when
+	// empty), "html" for a right-aligned italic div, "callout" for an
+	// Obsidian/GitHub "> [!quote]" callout, or "none" to leave them out.
+	EpigraphStyle string
+	// Annotation is how Markdown writes the book annotation: "section" (the
+	// default when empty) under an "Annotation" heading, "blockquote",
+	// "front-matter" as a description field, or "skip" to leave it out of
+	// every format.
+	Annotation string
+	// Cover is where the cover image goes: "meta" (the default when empty)
+	// keeps it to front matter and the EPUB cover, "image" also shows it
+	// at the start of the text, extracted even without ExtractImages, and
+	// "none" leaves it out.
+	Cover string
+	// Lenient repairs FB2 files that are not well-formed XML, such as
+	// unescaped ampersands and unclosed tags, instead of failing.
+	Lenient bool
+	// AssumeEncoding is the encoding of books whose declared encoding is
+	// missing or wrong, when detection cannot tell; empty takes the best
+	// guess.
+	AssumeEncoding string
+	// Encoding, when set, is the encoding text books are read in, whatever
+	// they declare; no detection is done.
+	Encoding string
+	// NotesBodies names the FB2 bodies whose sections are footnotes; nil
+	// means notes, footnotes and comments.
+	NotesBodies []string
+	// IncludeBodies names the other FB2 bodies converted into the text,
+	// "main" standing for the unnamed one; nil includes them all.
+	IncludeBodies []string
+	// Diff prints a unified diff of each output against the file already
+	// there to DiffOutput, or to stdout when it is nil, instead of writing
+	// it. Images are not extracted.
+	Diff       bool
+	DiffOutput io.Writer
+	// Timestamped writes the conversion time into outputs that carry one,
+	// the EPUB modified date. By default they get a date from the book, so
+	// that the same input always converts to the same bytes.
+	Timestamped bool
+	// Stats adds word, character, chapter, footnote and image counts and
+	// the reading time to Markdown front matter.
+	Stats bool
+	// Permalink is the permalink pattern written to Jekyll front matter.
+	Permalink string
+	// ImageLinkBase, when set, replaces the output file's directory in image
+	// links, e.g. "https://cdn.example.com/books".
+	ImageLinkBase string
+	// AbsoluteImageLinks links images by absolute file path.
+	AbsoluteImageLinks bool
+	// ImagesURL, when set, is the site-absolute URL path of ImagesDir, used
+	// in place of any other link.
+	ImagesURL string
+	// Logger, when set, receives the warnings, details and events of the
+	// conversion, as LogWarning and LogEvent log them.
+	Logger *slog.Logger
+	// OnBook, when set, is called with each book rendered and its
+	// statistics, before it is written.
+	OnBook func(book *Book, stats BookStats)
+	// OnCover, when set, is called with the path each book's cover image
+	// is extracted to.
+	OnCover func(path string)
+
+	// collect, set by Read, receives each book read in place of
+	// rendering it.
+	collect func(book *Book)
+	// out, set by ConvertStream and Render, receives the output in place
+	// of the output file.
+	out io.Writer
+	// guard, set while a book is converted under MaxFileSize or
+	// TimeoutPerFile, stops its reads, loops and writes once abandoned.
+	guard *guard
+	// started, set when a book's conversion begins, times its steps at
+	// LevelDebug.
+	started time.Time
+}
+
+// diffOutput returns where Diff prints.
+func (o Options) diffOutput() io.Writer {
+	if o.DiffOutput != nil {
+		return o.DiffOutput
+	}
+	return os.Stdout
+}
+
+// imageFS returns where extracted images are written.
+func (o Options) imageFS() ImageFS {
+	if o.Images != nil {
+		return o.Images
+	}
+	return DirFS(o.ImagesDir)
+}
+
+// OutputExt returns the file extension for the selected output format.
+func (o Options) OutputExt() string {
+	if ext, ok := outputFormats[o.To]; ok {
+		return ext
+	}
+	return ".md"
+}
+
+// OutputName returns the output path for a book converted to base. Dialects
+// that write page bundles put the book in base/index.md.
+func (o Options) OutputName(base string) string {
+	if o.PageBundle() {
+		return filepath.Join(base, "index.md")
+	}
+	return base + o.OutputExt()
+}
+
+// PageBundle reports whether books are written as page bundles, each to
+// an index.md in a directory of its own with its images.
+func (o Options) PageBundle() bool {
+	return dialects[o.Dialect].bundle && o.OutputExt() == ".md"
+}
+
+// IsOutputFormat reports whether to names an output format Options.To
+// accepts.
+func IsOutputFormat(to string) bool {
+	_, ok := outputFormats[to]
+	return ok
+}
+
+// IsDialect reports whether name is a Markdown dialect Options.Dialect
+// accepts.
+func IsDialect(name string) bool {
+	_, ok := dialects[name]
+	return ok
+}
+
+// DialectFrontMatter reports whether the dialect name writes the book
+// metadata as front matter instead of a header block.
+func DialectFrontMatter(name string) bool {
+	return dialects[name].frontMatter != nil
+}
+
+// FormatByteSize writes n bytes in the largest unit that divides it, e.g.
+// 512M for 1<<29.
+func FormatByteSize(n int64) string {
+	for _, u := range []struct {
+		suffix string
+		size   int64
+	}{{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if n >= u.size && n%u.size == 0 {
+			return strconv.FormatInt(n/u.size, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
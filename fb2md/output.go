@@ -0,0 +1,29 @@
+package fb2md
+
+import "os"
+
+// StdoutPath is the output path that selects standard output.
+const StdoutPath = "-"
+
+// writeOutput writes the converted document to outputFile, to stdout when
+// outputFile is "-", or to the writer of a stream conversion. With --diff it
+// prints how data differs from the file instead.
+func writeOutput(outputFile string, data []byte, opts Options) error {
+	return opts.guard.run(func() error {
+		var err error
+		switch {
+		case opts.out != nil:
+			_, err = opts.out.Write(data)
+		case outputFile == StdoutPath:
+			_, err = os.Stdout.Write(data)
+		case opts.Diff:
+			err = diffOutput(opts.diffOutput(), outputFile, data)
+		default:
+			err = os.WriteFile(outputFile, data, 0644)
+		}
+		if err != nil {
+			return &OutputError{err}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,397 @@
+package fb2md
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// pandocAPIVersion is the pandoc-types version of the AST written by
+// --to pandoc-json, as read by Pandoc 3.
+var pandocAPIVersion = []int{1, 23, 1}
+
+// pandocRenderer writes a Book as a Pandoc JSON AST for `pandoc -f json`.
+type pandocRenderer struct {
+	ctx      *renderContext
+	book     *Book
+	binaries map[string]Binary
+	// noteOpen guards against notes that reference themselves.
+	noteOpen map[string]bool
+}
+
+// pandocNode is an AST element: a constructor tag and its arguments.
+type pandocNode struct {
+	T string `json:"t"`
+	C any    `json:"c,omitempty"`
+}
+
+func (r *pandocRenderer) render(book *Book) []byte {
+	r.book = book
+	r.noteOpen = make(map[string]bool)
+	r.binaries = make(map[string]Binary)
+	for _, b := range book.Binaries {
+		r.binaries[b.ID] = b
+	}
+
+	doc := map[string]any{
+		"pandoc-api-version": pandocAPIVersion,
+		"meta":               r.meta(book),
+		"blocks":             r.blocks(book.Body, 0),
+	}
+	data, _ := json.Marshal(doc)
+	return append(data, '\n')
+}
+
+func (r *pandocRenderer) meta(book *Book) map[string]any {
+	meta := make(map[string]any)
+	str := func(s string) pandocNode { return pandocNode{"MetaInlines", r.text(s)} }
+	list := func(items []string) pandocNode {
+		values := make([]any, len(items))
+		for i, item := range items {
+			values[i] = str(item)
+		}
+		return pandocNode{"MetaList", values}
+	}
+
+	for _, field := range book.FrontMatter {
+		switch v := field.Value.(type) {
+		case []string:
+			meta[field.Key] = list(v)
+		case int:
+			meta[field.Key] = pandocNode{"MetaString", strconv.Itoa(v)}
+		default:
+			meta[field.Key] = str(v.(string))
+		}
+	}
+
+	m := book.Meta
+	if m == nil {
+		return meta
+	}
+	if title := strings.TrimSpace(m.Title); title != "" {
+		meta["title"] = str(title)
+	}
+	if len(m.Authors) > 0 {
+		meta["author"] = list(m.AuthorNames())
+	}
+	if date := strings.TrimSpace(m.Date); date != "" {
+		meta["date"] = str(date)
+	}
+	if m.Lang != "" {
+		meta["lang"] = pandocNode{"MetaString", m.Lang}
+	}
+	if len(m.Genres) > 0 {
+		meta["keywords"] = list(m.Genres)
+	}
+	if len(m.Sequences) > 0 {
+		meta["series"] = str(m.Sequences[0].Name)
+	}
+	if len(m.Annotation) > 0 {
+		meta["abstract"] = pandocNode{"MetaBlocks", r.blocks(m.Annotation, 0)}
+	}
+	if m.Identifier != "" {
+		meta["identifier"] = pandocNode{"MetaString", m.Identifier}
+	}
+	return meta
+}
+
+// attr returns a Pandoc attribute triple: id, classes and key/value pairs.
+func attr(id string, classes ...string) []any {
+	if classes == nil {
+		classes = []string{}
+	}
+	return []any{id, classes, [][]string{}}
+}
+
+func (r *pandocRenderer) blocks(blocks []Block, level int) []pandocNode {
+	nodes := []pandocNode{}
+	for _, b := range blocks {
+		if r.ctx.opts.guard.err() != nil {
+			break
+		}
+		nodes = append(nodes, r.block(b, level)...)
+	}
+	return nodes
+}
+
+// block converts a block; level is the nesting depth of the enclosing section.
+func (r *pandocRenderer) block(b Block, level int) []pandocNode {
+	switch n := b.(type) {
+	case *Section:
+		var nodes []pandocNode
+		if n.Title != "" {
+			nodes = append(nodes, header(min(level+1, 6), n.ID, r.text(n.Title)))
+		}
+		for _, epigraph := range n.Epigraphs {
+			nodes = append(nodes, r.block(epigraph, level+1)...)
+		}
+		nodes = append(nodes, r.blocks(n.Annotation, level+1)...)
+		return append(nodes, r.blocks(n.Blocks, level+1)...)
+	case *Heading:
+		return []pandocNode{header(n.Level, "", r.text(n.Text))}
+	case *BodyTitle:
+		return []pandocNode{header(1, "", r.text(n.Text))}
+	case *Chapter:
+		return r.blocks(n.Blocks, level)
+	case *Paragraph:
+		inlines := r.inlines(n.Inlines)
+		if n.ID != "" {
+			inlines = append([]pandocNode{{"Span", []any{attr(n.ID), []pandocNode{}}}}, inlines...)
+		}
+		return []pandocNode{{"Para", inlines}}
+	case *Subtitle:
+		return []pandocNode{{"Para", []pandocNode{{"Strong", r.inlines(n.Inlines)}}}}
+	case *Plain:
+		if inlines := r.inlines(n.Inlines); len(inlines) > 0 {
+			return []pandocNode{{"Plain", inlines}}
+		}
+	case *TextAuthor:
+		return []pandocNode{{"Div", []any{attr("", "text-author"), []pandocNode{{"Para", r.inlines(n.Inlines)}}}}}
+	case *HorizontalRule:
+		return []pandocNode{{T: "HorizontalRule"}}
+	case *CodeBlock:
+		return []pandocNode{{"CodeBlock", []any{attr(""), n.Text}}}
+	case *Image:
+		if n.Title != "" {
+			caption := []any{nil, []pandocNode{{"Plain", r.text(n.Title)}}}
+			return []pandocNode{{"Figure", []any{attr(""), caption, []pandocNode{{"Plain", []pandocNode{r.image(n)}}}}}}
+		}
+		return []pandocNode{{"Para", []pandocNode{r.image(n)}}}
+	case *Epigraph:
+		return []pandocNode{{"Div", []any{attr("", "epigraph"), r.blocks(n.Blocks, level)}}}
+	case *Cite:
+		return []pandocNode{{"BlockQuote", r.blocks(n.Blocks, level)}}
+	case *Quote:
+		lines := []any{}
+		for _, line := range n.Lines {
+			lines = append(lines, r.inlines(line))
+		}
+		return []pandocNode{{"BlockQuote", []pandocNode{{"LineBlock", lines}}}}
+	case *Poem:
+		return []pandocNode{r.poem(n, level)}
+	case *Stanza:
+		return r.stanza(n)
+	case *List:
+		items := make([]any, len(n.Items))
+		for i, item := range n.Items {
+			items[i] = []pandocNode{{"Plain", r.inlines(item)}}
+		}
+		if n.Ordered {
+			style := []any{1, pandocNode{T: "Decimal"}, pandocNode{T: "Period"}}
+			return []pandocNode{{"OrderedList", []any{style, items}}}
+		}
+		return []pandocNode{{"BulletList", items}}
+	case *Table:
+		if table := r.table(n); table != nil {
+			return []pandocNode{*table}
+		}
+	}
+	return nil
+}
+
+func header(level int, id string, inlines []pandocNode) pandocNode {
+	return pandocNode{"Header", []any{level, attr(id), inlines}}
+}
+
+func (r *pandocRenderer) poem(poem *Poem, level int) pandocNode {
+	blocks := []pandocNode{}
+	if poem.Title != "" {
+		blocks = append(blocks, pandocNode{"Para", []pandocNode{{"Strong", r.text(poem.Title)}}})
+	}
+	for _, epigraph := range poem.Epigraphs {
+		blocks = append(blocks, r.block(epigraph, level)...)
+	}
+	blocks = append(blocks, r.blocks(poem.Blocks, level)...)
+	for _, author := range poem.Authors {
+		blocks = append(blocks, pandocNode{"Para", []pandocNode{{"Emph", r.inlines(author)}}})
+	}
+	if poem.Date != "" {
+		blocks = append(blocks, pandocNode{"Para", []pandocNode{{"Emph", r.text(poem.Date)}}})
+	}
+	return pandocNode{"Div", []any{attr("", "poem"), blocks}}
+}
+
+func (r *pandocRenderer) stanza(stanza *Stanza) []pandocNode {
+	var nodes []pandocNode
+	if stanza.Title != "" {
+		nodes = append(nodes, pandocNode{"Para", []pandocNode{{"Strong", r.text(stanza.Title)}}})
+	}
+	if stanza.Subtitle != nil {
+		nodes = append(nodes, pandocNode{"Para", []pandocNode{{"Strong", r.inlines(stanza.Subtitle)}}})
+	}
+	var lines []any
+	for _, line := range stanza.Lines {
+		lines = append(lines, r.inlines(line))
+	}
+	if len(lines) > 0 {
+		nodes = append(nodes, pandocNode{"LineBlock", lines})
+	}
+	return nodes
+}
+
+// table builds a pandoc-types 1.23 Table: attributes, caption, column specs,
+// head, bodies and foot.
+func (r *pandocRenderer) table(table *Table) *pandocNode {
+	if table.Columns == 0 {
+		return nil
+	}
+	row := func(cells []TableCell) []any {
+		var out []any
+		for _, cell := range cells {
+			blocks := []pandocNode{{"Plain", r.inlines(cell.Inlines)}}
+			out = append(out, []any{attr(""), pandocAlign(cell.Align), 1, 1, blocks})
+		}
+		// Pad short rows so every row spans all columns.
+		for i := len(cells); i < table.Columns; i++ {
+			out = append(out, []any{attr(""), pandocNode{T: "AlignDefault"}, 1, 1, []pandocNode{}})
+		}
+		return []any{attr(""), out}
+	}
+
+	rows := table.Rows
+	headRows := []any{}
+	if table.Header {
+		headRows = append(headRows, row(rows[0]))
+		rows = rows[1:]
+	}
+	bodyRows := []any{}
+	for _, cells := range rows {
+		bodyRows = append(bodyRows, row(cells))
+	}
+
+	colSpecs := make([]any, table.Columns)
+	for i := range colSpecs {
+		colSpecs[i] = []any{pandocAlign(table.columnAlign(i)), pandocNode{T: "ColWidthDefault"}}
+	}
+	return &pandocNode{"Table", []any{
+		attr(""),
+		[]any{nil, []pandocNode{}},
+		colSpecs,
+		[]any{attr(""), headRows},
+		[]any{[]any{attr(""), 0, []any{}, bodyRows}},
+		[]any{attr(""), []any{}},
+	}}
+}
+
+// pandocAlign maps a cell alignment to a Pandoc Alignment.
+func pandocAlign(align string) pandocNode {
+	switch align {
+	case "left":
+		return pandocNode{T: "AlignLeft"}
+	case "center":
+		return pandocNode{T: "AlignCenter"}
+	case "right":
+		return pandocNode{T: "AlignRight"}
+	}
+	return pandocNode{T: "AlignDefault"}
+}
+
+// text splits s into Str, Space and SoftBreak nodes.
+func (r *pandocRenderer) text(s string) []pandocNode {
+	nodes := []pandocNode{}
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			nodes = append(nodes, pandocNode{"Str", word.String()})
+			word.Reset()
+		}
+	}
+	space := func(t string) {
+		flush()
+		if len(nodes) > 0 && (nodes[len(nodes)-1].T == "Space" || nodes[len(nodes)-1].T == "SoftBreak") {
+			if t == "SoftBreak" {
+				nodes[len(nodes)-1].T = t
+			}
+			return
+		}
+		nodes = append(nodes, pandocNode{T: t})
+	}
+	for _, c := range s {
+		switch {
+		case c == '\n':
+			space("SoftBreak")
+		case c == ' ' || c == '\t' || c == '\r':
+			space("Space")
+		default:
+			word.WriteRune(c)
+		}
+	}
+	flush()
+	return nodes
+}
+
+func (r *pandocRenderer) inlines(inlines []Inline) []pandocNode {
+	nodes := []pandocNode{}
+	for _, in := range inlines {
+		switch n := in.(type) {
+		case *Text:
+			nodes = append(nodes, r.text(n.Value)...)
+		case *Emphasis:
+			nodes = append(nodes, pandocNode{"Emph", r.inlines(n.Children)})
+		case *Strong:
+			nodes = append(nodes, pandocNode{"Strong", r.inlines(n.Children)})
+		case *Strikethrough:
+			nodes = append(nodes, pandocNode{"Strikeout", r.inlines(n.Children)})
+		case *Code:
+			nodes = append(nodes, pandocNode{"Code", []any{attr(""), plainText(n.Children)}})
+		case *Superscript:
+			nodes = append(nodes, pandocNode{"Superscript", r.inlines(n.Children)})
+		case *Subscript:
+			nodes = append(nodes, pandocNode{"Subscript", r.inlines(n.Children)})
+		case *Span:
+			if n.Class == "" && n.Lang == "" {
+				nodes = append(nodes, r.inlines(n.Children)...)
+				continue
+			}
+			spanAttr := attr("")
+			if n.Class != "" {
+				spanAttr = attr("", n.Class)
+			}
+			if n.Lang != "" {
+				spanAttr[2] = [][]string{{"lang", n.Lang}}
+			}
+			nodes = append(nodes, pandocNode{"Span", []any{spanAttr, r.inlines(n.Children)}})
+		case *Link:
+			nodes = append(nodes, pandocNode{"Link", []any{attr(""), r.inlines(n.Children), []string{n.Href, ""}}})
+		case *NoteRef:
+			note, ok := r.book.Footnotes[n.ID]
+			if !ok || r.noteOpen[n.ID] {
+				continue
+			}
+			r.noteOpen[n.ID] = true
+			nodes = append(nodes, pandocNode{"Note", []pandocNode{{"Para", r.inlines(note.Content)}}})
+			delete(r.noteOpen, n.ID)
+		case *LineBreak:
+			nodes = append(nodes, pandocNode{T: "LineBreak"})
+		case *Image:
+			nodes = append(nodes, r.image(n))
+		}
+	}
+	return nodes
+}
+
+// image links an extracted image, or embeds it as a data URI.
+func (r *pandocRenderer) image(img *Image) pandocNode {
+	if img.Media != "" {
+		src := img.Href
+		if img.ID != "" {
+			src, _ = r.ctx.imageLink(img.ID)
+		}
+		label := "[" + img.mediaLabel() + "]"
+		if src == "" {
+			return pandocNode{"Str", label}
+		}
+		return pandocNode{"Link", []any{attr(""), r.text(label), []string{src, img.Title}}}
+	}
+	src := img.Href
+	if img.ID != "" {
+		if link, ok := r.ctx.imageLink(img.ID); ok {
+			src = link
+		} else if binary, found := r.binaries[img.ID]; found {
+			src = "data:" + binary.ContentType + ";base64," + stripBase64Whitespace(strings.TrimSpace(binary.Data))
+		} else {
+			return pandocNode{"Str", "[" + img.placeholder() + "]"}
+		}
+	}
+	return pandocNode{"Image", []any{attr(""), r.text(img.altText()), []string{src, img.Title}}}
+}
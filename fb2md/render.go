@@ -0,0 +1,404 @@
+package fb2md
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// renderer turns a Book into a document in some output format.
+type renderer interface {
+	render(book *Book) []byte
+}
+
+// splitRenderer renders a book as an index file followed by one file per
+// chapter, for --split-chapters.
+type splitRenderer interface {
+	renderSplit(book *Book) [][]byte
+}
+
+// outputFormats lists the accepted --to values and their file extensions.
+var outputFormats = map[string]string{
+	"markdown": ".md",
+	"md":       ".md",
+	"html":     ".html",
+	"json":     ".json",
+	"epub":     ".epub",
+	"bbcode":   ".bbcode",
+	// Pandoc reads it with -f json.
+	"pandoc-json": ".json",
+}
+
+// renderContext carries what renderers need besides the Book itself.
+type renderContext struct {
+	outputFile string
+	opts       Options
+	// imageFiles maps binary ids to file names in opts.ImagesDir.
+	imageFiles map[string]string
+	// cover is the id of the cover binary when it is extracted on its own,
+	// for --cover image without -i.
+	cover string
+}
+
+func newRenderer(ctx *renderContext) (renderer, error) {
+	switch ctx.opts.To {
+	case "", "markdown", "md":
+		return &markdownRenderer{ctx: ctx}, nil
+	case "html":
+		return &htmlRenderer{ctx: ctx}, nil
+	case "json":
+		return &jsonRenderer{ctx: ctx}, nil
+	case "epub":
+		return &epubRenderer{ctx: ctx}, nil
+	case "bbcode":
+		return &bbcodeRenderer{ctx: ctx}, nil
+	case "pandoc-json":
+		return &pandocRenderer{ctx: ctx}, nil
+	default:
+		return nil, fmt.Errorf("unsupported output format: %s", ctx.opts.To)
+	}
+}
+
+// imageLink returns the link to an extracted binary image relative to the
+// output file, or false when images are not being extracted.
+func (ctx *renderContext) imageLink(id string) (string, bool) {
+	if !ctx.opts.ExtractImages && (id == "" || id != ctx.cover) {
+		return "", false
+	}
+	filename := id
+	if v, ok := ctx.imageFiles[id]; ok && v != "" {
+		filename = v
+	} else if safe := sanitizeFilename(id); safe != "" {
+		filename = safe
+	}
+	path := filepath.Join(ctx.opts.ImagesDir, filename)
+	switch {
+	case ctx.opts.ImagesURL != "":
+		return strings.TrimSuffix(ctx.opts.ImagesURL, "/") + "/" + filename, true
+	case ctx.opts.ImageLinkBase != "":
+		return strings.TrimSuffix(ctx.opts.ImageLinkBase, "/") + "/" + relativeMarkdownPath(ctx.outputFile, path), true
+	case ctx.opts.AbsoluteImageLinks:
+		if abs, err := filepath.Abs(path); err == nil {
+			return filepath.ToSlash(abs), true
+		}
+	}
+	return relativeMarkdownPath(ctx.outputFile, path), true
+}
+
+// dataURI returns an embedded binary as a base64 data URI.
+func dataURI(bin Binary) string {
+	return "data:" + bin.ContentType + ";base64," + stripBase64Whitespace(strings.TrimSpace(bin.Data))
+}
+
+// chapterFile returns the path of the n-th chapter file of a split output.
+func (ctx *renderContext) chapterFile(n int) string {
+	ext := filepath.Ext(ctx.outputFile)
+	return fmt.Sprintf("%s-%02d%s", strings.TrimSuffix(ctx.outputFile, ext), n, ext)
+}
+
+// writeBook renders book in the format selected by opts.To, extracting
+// embedded images when requested, and writes it to outputFile.
+func writeBook(book *Book, outputFile string, opts Options) error {
+	if opts.collect != nil {
+		opts.collect(book)
+		return nil
+	}
+	if !opts.started.IsZero() {
+		LogTiming(opts.Logger, "read the book", opts.started)
+		defer LogTiming(opts.Logger, "rendered "+outputFile, time.Now())
+	}
+	if opts.Annotation == "skip" && book.Meta != nil {
+		book.Meta.Annotation = nil
+	}
+	switch opts.Cover {
+	case "image":
+		placeCover(book)
+	case "none":
+		if book.Meta != nil {
+			book.Meta.Cover = ""
+		}
+	}
+	if opts.RasterizeSVG {
+		rasterizeSVGs(book, opts.Logger)
+	}
+	ctx := &renderContext{
+		outputFile: outputFile,
+		opts:       opts,
+		imageFiles: make(map[string]string),
+	}
+	// HTML and EPUB embed their images; other formats link the cover.
+	embeds := opts.To == "html" || opts.To == "epub"
+	if opts.Cover == "image" && !opts.ExtractImages && !opts.InlineImages && !embeds && book.Meta != nil && book.Meta.Cover != "" {
+		ctx.cover = book.Meta.Cover
+		if ctx.opts.ImagesDir == "" && opts.out == nil {
+			ctx.opts.ImagesDir = strings.TrimSuffix(outputFile, filepath.Ext(outputFile)) + "_images"
+		}
+	}
+	r, err := newRenderer(ctx)
+	if err != nil {
+		return err
+	}
+	if err := opts.guard.err(); err != nil {
+		return err
+	}
+
+	nameGenres(book.Meta, opts.GenreNames)
+	if opts.EpigraphStyle == "none" {
+		book.Body = dropEpigraphs(book.Body)
+	}
+	if !opts.NoNormalize {
+		book.Body = normalizeBlocks(book.Body, linkTargets(book))
+	}
+	if opts.RenumberFootnotes {
+		renumberFootnotes(book)
+	}
+	if opts.NumberHeadings {
+		numberHeadings(book.Body)
+	}
+	if opts.Typography.enabled() {
+		(&typographer{rules: opts.Typography}).applyBook(book)
+	}
+	if opts.OnBook != nil {
+		stats := CollectStats(book)
+		opts.guard.run(func() error {
+			opts.OnBook(book, stats)
+			return nil
+		})
+	}
+
+	if opts.ExtractImages || ctx.cover != "" {
+		if ctx.opts.ImagesDir != "" && opts.Images == nil && !opts.Diff {
+			if err := os.MkdirAll(ctx.opts.ImagesDir, 0755); err != nil {
+				return &OutputError{fmt.Errorf("failed to create images directory: %w", err)}
+			}
+		}
+		// Name image files before rendering so links match written files.
+		ctx.imageFiles = binaryImageFilenames(book.Binaries)
+	}
+
+	var files [][]byte
+	if opts.SplitChapters {
+		sr, ok := r.(splitRenderer)
+		if !ok {
+			return fmt.Errorf("--split-chapters is not supported for %s output", opts.To)
+		}
+		files = sr.renderSplit(book)
+	} else {
+		files = [][]byte{r.render(book)}
+	}
+	if err := opts.guard.err(); err != nil {
+		return err
+	}
+
+	if opts.ExtractImages && !opts.Diff {
+		binaries := book.Binaries
+		if !opts.AllBinaries {
+			binaries = nil
+			used := referencedImages(book)
+			for _, bin := range book.Binaries {
+				if used[bin.ID] {
+					binaries = append(binaries, bin)
+				}
+			}
+		}
+		extractBinaryImages(binaries, opts, ctx.imageFiles)
+	} else if ctx.cover != "" && !opts.Diff {
+		for _, bin := range book.Binaries {
+			if bin.ID == ctx.cover {
+				extractBinaryImages([]Binary{bin}, ctx.opts, ctx.imageFiles)
+			}
+		}
+	}
+	if (opts.ExtractImages || ctx.cover != "") && !opts.Diff && opts.OnCover != nil && book.Meta != nil {
+		if name := ctx.imageFiles[book.Meta.Cover]; name != "" {
+			opts.guard.run(func() error {
+				opts.OnCover(filepath.Join(ctx.opts.ImagesDir, name))
+				return nil
+			})
+		}
+	}
+
+	if opts.MetadataJSON {
+		if outputFile == StdoutPath || opts.out != nil {
+			LogWarning(opts.Logger, "--metadata-json needs an output file, skipping")
+		} else if err := writeMetadataJSON(book, ctx); err != nil {
+			return err
+		}
+	}
+
+	if outputFile == StdoutPath || opts.out != nil {
+		if err := writeOutput(outputFile, bytes.Join(files, []byte("\n")), opts); err != nil {
+			return fmt.Errorf("failed to write output file: %w", err)
+		}
+		return nil
+	}
+	for i, data := range files {
+		path := outputFile
+		if i > 0 {
+			path = ctx.chapterFile(i)
+		}
+		if err := writeOutput(path, data, opts); err != nil {
+			return fmt.Errorf("failed to write output file: %w", err)
+		}
+	}
+	return nil
+}
+
+func imageExt(contentType string) string {
+	switch {
+	case strings.Contains(contentType, "png"):
+		return ".png"
+	case strings.Contains(contentType, "gif"):
+		return ".gif"
+	case strings.Contains(contentType, "svg"):
+		return ".svg"
+	case strings.Contains(contentType, "webp"):
+		return ".webp"
+	default:
+		return ".jpg"
+	}
+}
+
+// binaryExt returns the file extension of a binary: the one its image type
+// calls for, or for media files, which have no type imageExt knows, the one
+// of the file it came from.
+func binaryExt(binary Binary) string {
+	if !strings.HasPrefix(binary.ContentType, "image/") && binary.ContentType != "" {
+		if ext := filepath.Ext(binary.ID); ext != "" {
+			return ext
+		}
+	}
+	return imageExt(binary.ContentType)
+}
+
+func extractBinaryImages(binaries []Binary, opts Options, imageFiles map[string]string) {
+	for _, binary := range binaries {
+		if binary.ID == "" {
+			continue
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(stripBase64Whitespace(strings.TrimSpace(binary.Data)))
+		if err != nil {
+			LogWarning(opts.Logger, "failed to decode image %s: %v", binary.ID, err)
+			continue
+		}
+
+		if decoded, err = shrinkImage(decoded, opts); err != nil {
+			LogWarning(opts.Logger, "failed to resize image %s: %v", binary.ID, err)
+			continue
+		}
+
+		filename := imageFiles[binary.ID]
+		if filename == "" {
+			ext := binaryExt(binary)
+			filename = binary.ID
+			if !strings.HasSuffix(filename, ext) {
+				filename = filename + ext
+			}
+		}
+
+		imagePath := filepath.Join(opts.ImagesDir, filename)
+		err = opts.guard.run(func() error { return opts.imageFS().WriteFile(filename, decoded) })
+		if errors.Is(err, ErrTimedOut) {
+			return
+		}
+		if err != nil {
+			LogWarning(opts.Logger, "failed to write image %s: %v", binary.ID, err)
+			continue
+		}
+		LogEvent(opts.Logger, "image_written", "path", imagePath, "bytes", len(decoded))
+	}
+}
+
+func binaryImageFilenames(binaries []Binary) map[string]string {
+	files := make(map[string]string)
+	used := make(map[string]bool)
+	for _, binary := range binaries {
+		if binary.ID == "" {
+			continue
+		}
+
+		ext := binaryExt(binary)
+
+		base := sanitizeFilename(binary.ID)
+		if base == "" {
+			base = "image"
+		}
+
+		filename := base
+		if !strings.HasSuffix(strings.ToLower(filename), ext) {
+			filename += ext
+		}
+
+		if used[filename] {
+			for n := 2; ; n++ {
+				alt := fmt.Sprintf("%s_%d%s", base, n, ext)
+				if !used[alt] {
+					filename = alt
+					break
+				}
+			}
+		}
+
+		used[filename] = true
+		files[binary.ID] = filename
+	}
+	return files
+}
+
+// bookPage is a chapter-sized part of the body.
+type bookPage struct {
+	title  string
+	blocks []Block
+}
+
+// splitPages splits the body into pages: each top-level section or source
+// chapter starts a page, and other blocks join the page before them.
+func splitPages(body []Block, bookTitle string) []bookPage {
+	var pages []bookPage
+	newPage := func(title string) *bookPage {
+		pages = append(pages, bookPage{title: title})
+		return &pages[len(pages)-1]
+	}
+
+	var cur *bookPage
+	for _, b := range body {
+		switch n := b.(type) {
+		case *Section:
+			cur = newPage(n.Title)
+		case *Chapter:
+			cur = newPage(chapterTitle(n))
+		default:
+			if cur == nil {
+				title := bookTitle
+				if bt, ok := b.(*BodyTitle); ok && bt.Text != "" {
+					title = bt.Text
+				}
+				cur = newPage(title)
+			}
+		}
+		cur.blocks = append(cur.blocks, b)
+	}
+
+	for i := range pages {
+		if pages[i].title == "" {
+			pages[i].title = fmt.Sprintf("Chapter %d", i+1)
+		}
+	}
+	return pages
+}
+
+// chapterTitle returns the text of the first heading in a chapter.
+func chapterTitle(ch *Chapter) string {
+	for _, b := range ch.Blocks {
+		if h, ok := b.(*Heading); ok && h.Text != "" {
+			return h.Text
+		}
+	}
+	return ""
+}
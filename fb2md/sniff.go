@@ -0,0 +1,114 @@
+package fb2md
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// readableFormats lists the formats Convert reads.
+var readableFormats = map[string]bool{
+	"fb2":     true,
+	"fb2.zip": true,
+	"zip":     true,
+	"fb3":     true,
+	"epub":    true,
+	"txt":     true,
+	"tei":     true,
+	"cbz":     true,
+}
+
+// Readable reports whether Convert reads books in format.
+func Readable(format string) bool {
+	return readableFormats[format]
+}
+
+// errMOBI explains the format fb2md recognizes but does not read.
+var errMOBI = fmt.Errorf("%w: MOBI (convert it to EPUB first, e.g. with calibre's ebook-convert)", ErrUnsupportedFormat)
+
+// sniffLen is how much of a file SniffFormat looks at for an XML root.
+const sniffLen = 4096
+
+// SniffFormat works out the format of the book in r, size bytes long, from
+// its content: a FictionBook or TEI root element, a zip archive holding an
+// EPUB, an FB3, FB2 files or comic pages, or a MOBI. It returns "" when the
+// content does not tell, as for plain text.
+func SniffFormat(r io.ReaderAt, size int64) string {
+	head := make([]byte, sniffLen)
+	n, _ := r.ReadAt(head, 0)
+	head = head[:n]
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		if zr, err := zip.NewReader(r, size); err == nil {
+			return sniffZip(zr)
+		}
+		return ""
+	// A MOBI is a Palm database of type BOOK and creator MOBI.
+	case len(head) >= 68 && string(head[60:68]) == "BOOKMOBI":
+		return "mobi"
+	}
+	text := string(bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")), " \t\r\n"))
+	if !strings.HasPrefix(text, "<") {
+		return ""
+	}
+	switch {
+	case strings.Contains(text, "<FictionBook"):
+		return "fb2"
+	case strings.Contains(text, "<TEI ") || strings.Contains(text, "<TEI>"):
+		return "tei"
+	}
+	return ""
+}
+
+// sniffZip tells the zip formats apart by the entries that mark them.
+func sniffZip(zr *zip.Reader) string {
+	for _, f := range zr.File {
+		switch f.Name {
+		case "mimetype":
+			if data, err := readZipPrefix(f, 64); err == nil && strings.TrimSpace(string(data)) == "application/epub+zip" {
+				return "epub"
+			}
+		case "_rels/.rels":
+			if data, err := readZipPrefix(f, sniffLen); err == nil && strings.Contains(string(data), "FictionBook3") {
+				return "fb3"
+			}
+		}
+	}
+	// An archive of FB2 files alone is a zipped FB2; one with other books
+	// in it is a library, whose format is its own.
+	var fb2, others int
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		switch ext := strings.ToLower(path.Ext(f.Name)); {
+		case ext == ".fb2":
+			fb2++
+		case ext != ".xml" && formatsByExt[ext] != "":
+			others++
+		}
+	}
+	switch {
+	case others > 0:
+		return ""
+	case fb2 > 0:
+		return "fb2.zip"
+	}
+	if _, _, err := cbzPages(zr); err == nil {
+		return "cbz"
+	}
+	return ""
+}
+
+// readZipPrefix reads at most n bytes of a zip entry.
+func readZipPrefix(f *zip.File, n int64) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(io.LimitReader(rc, n))
+}
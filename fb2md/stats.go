@@ -0,0 +1,111 @@
+package fb2md
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// wordsPerMinute is the reading speed the reading time is estimated at.
+const wordsPerMinute = 230
+
+// BookStats are the figures CollectStats counts in a book.
+type BookStats struct {
+	Words      int
+	Characters int
+	Chapters   int
+	Footnotes  int
+	Images     int
+}
+
+// CollectStats counts the words and characters in the body of the book,
+// headings included, its chapters (the titled sections with no titled sections
+// below them, or the EPUB spine documents), its footnotes and the images it shows.
+func CollectStats(book *Book) BookStats {
+	s := BookStats{
+		Chapters:  countChapters(book.Body),
+		Footnotes: len(book.Footnotes),
+		Images:    len(referencedImages(book)),
+	}
+	count := func(text string) {
+		words := strings.Fields(text)
+		s.Words += len(words)
+		s.Characters += utf8.RuneCountInString(strings.Join(words, " "))
+	}
+	WalkBlocks(book.Body, func(node any) {
+		switch v := node.(type) {
+		case *Text:
+			count(v.Value)
+		case *Section:
+			count(v.Title)
+		case *Heading:
+			count(v.Text)
+		case *BodyTitle:
+			count(v.Text)
+		case *CodeBlock:
+			count(v.Text)
+		}
+	})
+	return s
+}
+
+func countChapters(blocks []Block) int {
+	var n int
+	for _, b := range blocks {
+		var inner []Block
+		var titled bool
+		switch v := b.(type) {
+		case *Section:
+			inner, titled = v.Blocks, v.Title != ""
+		case *Chapter:
+			// EPUB chapters are the spine documents.
+			inner, titled = v.Blocks, true
+		default:
+			continue
+		}
+		sub := countChapters(inner)
+		if sub == 0 && titled {
+			sub = 1
+		}
+		n += sub
+	}
+	return n
+}
+
+// readingMinutes estimates the time to read the book, rounded up.
+func (s BookStats) readingMinutes() int {
+	return (s.Words + wordsPerMinute - 1) / wordsPerMinute
+}
+
+func (s BookStats) String() string {
+	return fmt.Sprintf("%d words, %d characters, %s reading, %d chapters, %d footnotes, %d images",
+		s.Words, s.Characters, formatMinutes(s.readingMinutes()), s.Chapters, s.Footnotes, s.Images)
+}
+
+// fields returns the statistics as front matter fields.
+func (s BookStats) fields() []MetaField {
+	return []MetaField{
+		{Key: "words", Value: s.Words},
+		{Key: "characters", Value: s.Characters},
+		{Key: "reading_time", Value: s.readingMinutes()},
+		{Key: "chapters", Value: s.Chapters},
+		{Key: "footnotes", Value: s.Footnotes},
+		{Key: "images", Value: s.Images},
+	}
+}
+
+// Add adds the statistics of another book, for the totals of several.
+func (s *BookStats) Add(o BookStats) {
+	s.Words += o.Words
+	s.Characters += o.Characters
+	s.Chapters += o.Chapters
+	s.Footnotes += o.Footnotes
+	s.Images += o.Images
+}
+
+func formatMinutes(minutes int) string {
+	if minutes < 60 {
+		return fmt.Sprintf("%d min", minutes)
+	}
+	return fmt.Sprintf("%d h %02d min", minutes/60, minutes%60)
+}
@@ -0,0 +1,84 @@
+package fb2md
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// SVGRasterizer is the program Options.RasterizeSVG renders SVG images
+// with, from librsvg; it must be on the PATH.
+const SVGRasterizer = "rsvg-convert"
+
+// rasterizeSVGs replaces the SVG binaries of book with PNG renderings and
+// renames them, and the images showing them, from .svg to .png. An SVG that
+// fails to render is kept with a warning.
+func rasterizeSVGs(book *Book, logger *slog.Logger) {
+	taken := make(map[string]bool, len(book.Binaries))
+	for _, bin := range book.Binaries {
+		taken[bin.ID] = true
+	}
+	renamed := make(map[string]string)
+	for i := range book.Binaries {
+		bin := &book.Binaries[i]
+		if !strings.Contains(bin.ContentType, "svg") {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(stripBase64Whitespace(strings.TrimSpace(bin.Data)))
+		if err == nil {
+			data, err = rasterizeSVG(data)
+		}
+		if err != nil {
+			LogWarning(logger, "failed to rasterize %s: %v", bin.ID, err)
+			continue
+		}
+		id := strings.TrimSuffix(bin.ID, path.Ext(bin.ID)) + ".png"
+		if taken[id] {
+			id = bin.ID + ".png"
+		}
+		taken[id] = true
+		renamed[bin.ID] = id
+		bin.ID, bin.ContentType, bin.Data = id, "image/png", base64.StdEncoding.EncodeToString(data)
+	}
+	if len(renamed) == 0 {
+		return
+	}
+
+	rename := func(node any) {
+		if img, ok := node.(*Image); ok {
+			if id, ok := renamed[img.ID]; ok {
+				img.ID = id
+			}
+		}
+	}
+	if book.Meta != nil {
+		if id, ok := renamed[book.Meta.Cover]; ok {
+			book.Meta.Cover = id
+		}
+		WalkBlocks(book.Meta.Annotation, rename)
+	}
+	WalkBlocks(book.Body, rename)
+	for _, note := range book.Footnotes {
+		WalkInlines(note.Content, rename)
+	}
+}
+
+// rasterizeSVG renders an SVG image as PNG.
+func rasterizeSVG(data []byte) ([]byte, error) {
+	cmd := exec.Command(SVGRasterizer, "--format", "png")
+	cmd.Stdin = bytes.NewReader(data)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %s", SVGRasterizer, msg)
+		}
+		return nil, fmt.Errorf("%s: %w", SVGRasterizer, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,455 @@
+package fb2md
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+// TeiConverter maps TEI XML onto a FictionBook tree (divs to sections, line
+// groups to poems, notes to footnotes) and renders it through the FB2
+// converter.
+type TeiConverter struct {
+	notes     *etree.Element
+	noteCount int
+}
+
+func NewTeiConverter() *TeiConverter {
+	return &TeiConverter{}
+}
+
+// Convert converts a TEI document read from r and writes it to w, as
+// ConvertStream does.
+func (t *TeiConverter) Convert(r io.Reader, w io.Writer, opts Options) error {
+	opts.out = w
+	return t.ConvertReader(r, "", opts)
+}
+
+// ConvertReader converts a TEI document read from r.
+func (t *TeiConverter) ConvertReader(r io.Reader, outputFile string, opts Options) error {
+	decoded, ok, err := decodeStream(r, opts)
+	if err != nil {
+		return fmt.Errorf("failed to read TEI file: %w", err)
+	}
+	var src *etree.Document
+	if ok {
+		if src, err = readXMLStream(decoded); err != nil {
+			return fmt.Errorf("failed to parse TEI file: %w", err)
+		}
+	} else {
+		data, err := io.ReadAll(decoded)
+		if err != nil {
+			return fmt.Errorf("failed to read TEI file: %w", err)
+		}
+		if data, err = detectAndConvertEncoding(data, opts); err != nil {
+			return fmt.Errorf("encoding conversion failed: %w", err)
+		}
+		src = etree.NewDocument()
+		if err := src.ReadFromBytes(data); err != nil {
+			return fmt.Errorf("failed to parse TEI file: %w", err)
+		}
+	}
+
+	doc, err := t.buildFictionBook(src)
+	if err != nil {
+		return err
+	}
+
+	converter := NewConverter()
+	return converter.ConvertDocument(doc, outputFile, opts)
+}
+
+func (t *TeiConverter) buildFictionBook(src *etree.Document) (*etree.Document, error) {
+	tei := src.Root()
+	if tei == nil || (tei.Tag != "TEI" && tei.Tag != "TEI.2") {
+		return nil, fmt.Errorf("invalid TEI file: TEI element not found")
+	}
+
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="utf-8"`)
+	root := doc.CreateElement("FictionBook")
+	root.CreateAttr("xmlns", "http://www.gribuser.ru/xml/fictionbook/2.0")
+	root.CreateAttr("xmlns:l", "http://www.w3.org/1999/xlink")
+
+	if header := tei.SelectElement("teiHeader"); header != nil {
+		t.convertHeader(header, root.CreateElement("description").CreateElement("title-info"))
+	}
+
+	body := root.CreateElement("body")
+	t.noteCount = 0
+	t.notes = etree.NewElement("body")
+	t.notes.CreateAttr("name", "notes")
+
+	text := tei.SelectElement("text")
+	if text == nil {
+		return nil, fmt.Errorf("invalid TEI file: text element not found")
+	}
+	for _, part := range text.ChildElements() {
+		switch part.Tag {
+		case "front", "body", "back":
+			t.convertBlocks(part, body)
+		case "group":
+			for _, inner := range part.SelectElements("text") {
+				for _, p := range inner.ChildElements() {
+					t.convertBlocks(p, body)
+				}
+			}
+		}
+	}
+
+	if t.noteCount > 0 {
+		root.AddChild(t.notes)
+	}
+	return doc, nil
+}
+
+func (t *TeiConverter) convertHeader(header, titleInfo *etree.Element) {
+	fileDesc := header.SelectElement("fileDesc")
+	if fileDesc == nil {
+		return
+	}
+
+	if terms := header.FindElements(".//textClass//term"); len(terms) > 0 {
+		for _, term := range terms {
+			if text := collapseWhitespace(term.Text()); text != "" {
+				titleInfo.CreateElement("genre").SetText(text)
+			}
+		}
+	}
+
+	if stmt := fileDesc.SelectElement("titleStmt"); stmt != nil {
+		for _, author := range stmt.SelectElements("author") {
+			dst := titleInfo.CreateElement("author")
+			forename := author.FindElement(".//forename")
+			surname := author.FindElement(".//surname")
+			if forename != nil || surname != nil {
+				if forename != nil {
+					dst.CreateElement("first-name").SetText(collapseWhitespace(teiText(forename)))
+				}
+				if surname != nil {
+					dst.CreateElement("last-name").SetText(collapseWhitespace(teiText(surname)))
+				}
+				continue
+			}
+			dst.CreateElement("nickname").SetText(collapseWhitespace(teiText(author)))
+		}
+
+		var title *etree.Element
+		for _, candidate := range stmt.SelectElements("title") {
+			if title == nil || candidate.SelectAttrValue("type", "") == "main" {
+				title = candidate
+			}
+		}
+		if title != nil {
+			titleInfo.CreateElement("book-title").SetText(collapseWhitespace(teiText(title)))
+		}
+	}
+
+	if pub := fileDesc.SelectElement("publicationStmt"); pub != nil {
+		if date := pub.SelectElement("date"); date != nil {
+			dst := titleInfo.CreateElement("date")
+			dst.SetText(collapseWhitespace(teiText(date)))
+			if when := date.SelectAttrValue("when", ""); when != "" {
+				dst.CreateAttr("value", when)
+			}
+		}
+	}
+
+	if lang := header.FindElement(".//langUsage/language"); lang != nil {
+		if ident := lang.SelectAttrValue("ident", ""); ident != "" {
+			titleInfo.CreateElement("lang").SetText(ident)
+		}
+	}
+}
+
+// convertBlocks converts the block-level children of src into parent.
+func (t *TeiConverter) convertBlocks(src, parent *etree.Element) {
+	for _, child := range src.ChildElements() {
+		t.convertBlock(child, parent)
+	}
+}
+
+func (t *TeiConverter) convertBlock(src, parent *etree.Element) {
+	switch src.Tag {
+	case "div", "div1", "div2", "div3", "div4", "div5", "div6", "div7":
+		section := parent.CreateElement("section")
+		if id := src.SelectAttrValue("xml:id", ""); id != "" {
+			section.CreateAttr("id", id)
+		}
+		titled := false
+		for _, child := range src.ChildElements() {
+			if child.Tag == "head" && !titled {
+				t.convertInline(child, section.CreateElement("title").CreateElement("p"))
+				titled = true
+				continue
+			}
+			t.convertBlock(child, section)
+		}
+	case "head":
+		t.convertInline(src, parent.CreateElement("subtitle"))
+	case "p", "ab":
+		p := parent.CreateElement("p")
+		if id := src.SelectAttrValue("xml:id", ""); id != "" {
+			p.CreateAttr("id", id)
+		}
+		t.convertInline(src, p)
+	case "lg":
+		t.convertPoem(src, parent)
+	case "l":
+		t.convertInline(src, parent.CreateElement("p"))
+	case "quote", "cit":
+		cite := parent.CreateElement("cite")
+		t.convertCitation(src, cite)
+	case "epigraph":
+		epigraph := parent.CreateElement("epigraph")
+		t.convertCitation(src, epigraph)
+	case "list":
+		for _, item := range src.SelectElements("item") {
+			p := parent.CreateElement("p")
+			p.SetText("- ")
+			t.convertInline(item, p)
+		}
+	case "table":
+		table := parent.CreateElement("table")
+		for _, row := range src.SelectElements("row") {
+			tr := table.CreateElement("tr")
+			for _, cell := range row.SelectElements("cell") {
+				tag := "td"
+				if cell.SelectAttrValue("role", "") == "label" || row.SelectAttrValue("role", "") == "label" {
+					tag = "th"
+				}
+				t.convertInline(cell, tr.CreateElement(tag))
+			}
+		}
+	case "figure":
+		graphics := src.SelectElements("graphic")
+		head := src.SelectElement("head")
+		for _, graphic := range graphics {
+			image := parent.CreateElement("image")
+			image.CreateAttr("l:href", graphic.SelectAttrValue("url", ""))
+			if desc := graphic.SelectElement("desc"); desc != nil {
+				image.CreateAttr("alt", extractAllText(desc))
+			}
+			if head != nil && len(graphics) == 1 {
+				// The heading of a single graphic is its caption.
+				image.CreateAttr("title", extractAllText(head))
+			}
+		}
+		if head != nil && len(graphics) != 1 {
+			t.convertInline(head, parent.CreateElement("p").CreateElement("emphasis"))
+		}
+	case "note":
+		t.convertInline(src, parent.CreateElement("p"))
+	case "pb", "milestone", "fw":
+		// Page breaks and printed furniture carry no content
+	case "titlePage", "docTitle", "byline", "docAuthor", "docImprint", "trailer", "closer", "opener", "salute", "signed", "dateline":
+		t.convertInline(src, parent.CreateElement("p"))
+	default:
+		if len(src.ChildElements()) > 0 && isTeiContainer(src) {
+			t.convertBlocks(src, parent)
+			return
+		}
+		t.convertInline(src, parent.CreateElement("p"))
+	}
+}
+
+// isTeiContainer reports whether elem holds only block children and no text
+// of its own.
+func isTeiContainer(elem *etree.Element) bool {
+	if strings.TrimSpace(elem.Text()) != "" {
+		return false
+	}
+	for _, child := range elem.ChildElements() {
+		if strings.TrimSpace(child.Tail()) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// convertPoem maps <lg> onto <poem>. Nested line groups become stanzas.
+func (t *TeiConverter) convertPoem(lg, parent *etree.Element) {
+	poem := parent.CreateElement("poem")
+	if head := lg.SelectElement("head"); head != nil {
+		t.convertInline(head, poem.CreateElement("title").CreateElement("p"))
+	}
+
+	if len(lg.SelectElements("lg")) == 0 {
+		t.convertStanza(lg, poem.CreateElement("stanza"))
+		return
+	}
+	for _, inner := range lg.SelectElements("lg") {
+		t.convertStanza(inner, poem.CreateElement("stanza"))
+	}
+}
+
+func (t *TeiConverter) convertStanza(lg, stanza *etree.Element) {
+	for _, line := range lg.SelectElements("l") {
+		t.convertInline(line, stanza.CreateElement("v"))
+	}
+}
+
+// convertCitation fills a cite or epigraph with quoted paragraphs and the
+// bibliographic source as text-author.
+func (t *TeiConverter) convertCitation(src, dst *etree.Element) {
+	if len(src.ChildElements()) == 0 || !isTeiContainer(src) {
+		t.convertInline(src, dst.CreateElement("p"))
+		return
+	}
+	for _, child := range src.ChildElements() {
+		switch child.Tag {
+		case "bibl":
+			t.convertInline(child, dst.CreateElement("text-author"))
+		case "quote", "cit":
+			t.convertCitation(child, dst)
+		case "lg":
+			t.convertPoem(child, dst)
+		default:
+			t.convertBlock(child, dst)
+		}
+	}
+}
+
+// convertInline copies text and inline markup of src into dst, collapsing
+// the source indentation.
+func (t *TeiConverter) convertInline(src, dst *etree.Element) {
+	t.convertInlineContent(src, dst)
+	dst.SetText(strings.TrimLeft(dst.Text(), " "))
+	if children := dst.ChildElements(); len(children) > 0 {
+		last := children[len(children)-1]
+		last.SetTail(strings.TrimRight(last.Tail(), " "))
+	} else {
+		dst.SetText(strings.TrimRight(dst.Text(), " "))
+	}
+}
+
+func (t *TeiConverter) convertInlineContent(src, dst *etree.Element) {
+	dst.SetText(dst.Text() + normalizeInlineWhitespace(src.Text(), true, true))
+	for _, child := range src.ChildElements() {
+		out := t.convertInlineChild(child, dst)
+		tail := normalizeInlineWhitespace(child.Tail(), true, true)
+		if out != nil {
+			out.SetTail(out.Tail() + tail)
+		} else if last := lastChildElement(dst); last != nil {
+			last.SetTail(last.Tail() + tail)
+		} else {
+			dst.SetText(dst.Text() + tail)
+		}
+	}
+}
+
+func (t *TeiConverter) convertInlineChild(child, dst *etree.Element) *etree.Element {
+	var out *etree.Element
+	switch child.Tag {
+	case "hi":
+		rend := child.SelectAttrValue("rend", "italic")
+		switch {
+		case strings.Contains(rend, "bold"):
+			out = dst.CreateElement("strong")
+		case strings.Contains(rend, "strike"):
+			out = dst.CreateElement("strikethrough")
+		case strings.Contains(rend, "sup"):
+			out = dst.CreateElement("sup")
+		case strings.Contains(rend, "sub"):
+			out = dst.CreateElement("sub")
+		default:
+			out = dst.CreateElement("emphasis")
+		}
+		t.convertInlineContent(child, out)
+	case "emph", "foreign", "term", "title", "mentioned", "soCalled":
+		out = dst.CreateElement("emphasis")
+		t.convertInlineContent(child, out)
+	case "ref", "ptr":
+		out = dst.CreateElement("a")
+		out.CreateAttr("l:href", child.SelectAttrValue("target", ""))
+		t.convertInlineContent(child, out)
+	case "note":
+		out = t.addNote(child, dst)
+	case "q", "quote", "said":
+		out = dst.CreateElement("style")
+		out.SetText("“")
+		t.convertInlineContent(child, out)
+		out.SetText(strings.TrimSpace(out.Text()))
+		if last := lastChildElement(out); last != nil {
+			last.SetTail(strings.TrimRight(last.Tail(), " ") + "”")
+		} else {
+			out.SetText(out.Text() + "”")
+		}
+	case "lb":
+		out = dst.CreateElement("style")
+		out.SetText(" ")
+	case "pb", "milestone", "fw", "figure", "gap":
+		return nil
+	case "choice":
+		// Prefer the regularised or corrected reading
+		for _, tag := range []string{"reg", "corr", "expan"} {
+			if alt := child.SelectElement(tag); alt != nil {
+				out = dst.CreateElement("style")
+				t.convertInlineContent(alt, out)
+				return out
+			}
+		}
+		return nil
+	default:
+		out = dst.CreateElement("style")
+		t.convertInlineContent(child, out)
+	}
+	return out
+}
+
+// addNote moves an inline <note> into the notes body and leaves a footnote
+// reference in its place.
+func (t *TeiConverter) addNote(note, dst *etree.Element) *etree.Element {
+	t.noteCount++
+	id := note.SelectAttrValue("xml:id", "")
+	if id == "" {
+		id = fmt.Sprintf("note_%d", t.noteCount)
+	}
+
+	label := note.SelectAttrValue("n", "")
+	if label == "" {
+		label = fmt.Sprintf("%d", t.noteCount)
+	}
+
+	ref := dst.CreateElement("a")
+	ref.CreateAttr("l:href", "#"+id)
+	ref.CreateAttr("type", "note")
+	ref.SetText(label)
+
+	section := t.notes.CreateElement("section")
+	section.CreateAttr("id", id)
+	if len(note.SelectElements("p")) > 0 {
+		for _, p := range note.SelectElements("p") {
+			t.convertInline(p, section.CreateElement("p"))
+		}
+	} else {
+		t.convertInline(note, section.CreateElement("p"))
+	}
+	return ref
+}
+
+func lastChildElement(elem *etree.Element) *etree.Element {
+	children := elem.ChildElements()
+	if len(children) == 0 {
+		return nil
+	}
+	return children[len(children)-1]
+}
+
+// teiText returns the whitespace-collapsed text of an element and its
+// descendants.
+func teiText(elem *etree.Element) string {
+	var b strings.Builder
+	b.WriteString(elem.Text())
+	for _, child := range elem.ChildElements() {
+		b.WriteString(teiText(child))
+		b.WriteString(child.Tail())
+	}
+	return b.String()
+}
+
+func collapseWhitespace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
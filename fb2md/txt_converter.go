@@ -0,0 +1,245 @@
+package fb2md
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/beevik/etree"
+)
+
+var (
+	txtPartRe     = regexp.MustCompile(`(?i)^(part|book|volume|часть|книга|том)\s+([0-9]+|[ivxlc]+|[a-zа-яё]+)\b`)
+	txtChapterRe  = regexp.MustCompile(`(?i)^(chapter|глава|prologue|epilogue|пролог|эпилог|introduction|afterword|предисловие|послесловие)\b`)
+	txtNumberedRe = regexp.MustCompile(`^(\d+(?:\.\d+)*)\.?\s+\S`)
+	txtRomanRe    = regexp.MustCompile(`^[IVXLC]+\.?$`)
+)
+
+// maxTxtHeadingLen bounds the length of a line that may be treated as a heading.
+const maxTxtHeadingLen = 80
+
+// TxtConverter turns plain text into a FictionBook tree, guessing chapter
+// boundaries from the layout, and renders it through the FB2 converter.
+type TxtConverter struct{}
+
+func NewTxtConverter() *TxtConverter {
+	return &TxtConverter{}
+}
+
+// Convert converts plain text read from r and writes it to w, as
+// ConvertStream does.
+func (t *TxtConverter) Convert(r io.Reader, w io.Writer, opts Options) error {
+	opts.out = w
+	return t.ConvertReader(r, "", opts)
+}
+
+// ConvertReader converts plain text read from r.
+func (t *TxtConverter) ConvertReader(r io.Reader, outputFile string, opts Options) error {
+	decoded, ok, err := decodeStream(r, opts)
+	if err != nil {
+		return fmt.Errorf("failed to read text file: %w", err)
+	}
+	data, err := io.ReadAll(decoded)
+	if err != nil {
+		return fmt.Errorf("failed to read text file: %w", err)
+	}
+	if !ok {
+		if data, err = detectAndConvertEncoding(data, opts); err != nil {
+			return fmt.Errorf("encoding conversion failed: %w", err)
+		}
+	}
+
+	text := string(data)
+	var meta gutenbergMeta
+	if opts.StripGutenberg {
+		text, meta = stripGutenberg(text)
+	}
+
+	converter := NewConverter()
+	return converter.ConvertDocument(t.buildFictionBook(text, meta), outputFile, opts)
+}
+
+// txtBlock is a run of non-blank lines together with the number of blank
+// lines that preceded it.
+type txtBlock struct {
+	lines       []string
+	blankBefore int
+}
+
+func splitTxtBlocks(text string) []txtBlock {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	lines := strings.Split(text, "\n")
+
+	nonBlank, blank := 0, 0
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			blank++
+		} else {
+			nonBlank++
+		}
+	}
+	// Texts without blank lines between paragraphs use one line per paragraph.
+	linePerParagraph := nonBlank > 0 && blank*20 < nonBlank
+
+	var blocks []txtBlock
+	var cur *txtBlock
+	pending := 0
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			cur = nil
+			pending++
+			continue
+		}
+		if cur == nil || linePerParagraph {
+			blocks = append(blocks, txtBlock{blankBefore: pending})
+			cur = &blocks[len(blocks)-1]
+			pending = 0
+		}
+		cur.lines = append(cur.lines, trimmed)
+	}
+	return blocks
+}
+
+// txtHeadingLevel reports whether a block looks like a heading and at which
+// nesting level (1 for parts and top-level chapters).
+func txtHeadingLevel(b txtBlock, first bool) (int, bool) {
+	if len(b.lines) != 1 {
+		return 0, false
+	}
+	line := b.lines[0]
+	if utf8.RuneCountInString(line) > maxTxtHeadingLen {
+		return 0, false
+	}
+
+	switch {
+	case txtPartRe.MatchString(line):
+		return 1, true
+	case txtChapterRe.MatchString(line):
+		return 2, true
+	case txtRomanRe.MatchString(line):
+		return 2, true
+	}
+
+	if m := txtNumberedRe.FindStringSubmatch(line); m != nil && !endsSentence(line) {
+		return strings.Count(m[1], ".") + 2, true
+	}
+
+	if isAllCaps(line) {
+		return 2, true
+	}
+
+	// A short line set apart by a run of blank lines
+	if (b.blankBefore >= 3 || first) && !endsSentence(line) && utf8.RuneCountInString(line) <= 60 {
+		return 2, true
+	}
+
+	return 0, false
+}
+
+func endsSentence(line string) bool {
+	r, _ := utf8.DecodeLastRuneInString(line)
+	return strings.ContainsRune(".,;:!?…»\"", r)
+}
+
+func isAllCaps(line string) bool {
+	letters := 0
+	for _, r := range line {
+		if unicode.IsLetter(r) {
+			if !unicode.IsUpper(r) {
+				return false
+			}
+			letters++
+		}
+	}
+	return letters >= 2
+}
+
+func (t *TxtConverter) buildFictionBook(text string, meta gutenbergMeta) *etree.Document {
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="utf-8"`)
+	root := doc.CreateElement("FictionBook")
+	root.CreateAttr("xmlns", "http://www.gribuser.ru/xml/fictionbook/2.0")
+	if meta.title != "" || len(meta.authors) > 0 {
+		writeGutenbergTitleInfo(root.CreateElement("description").CreateElement("title-info"), meta)
+	}
+	body := root.CreateElement("body")
+
+	blocks := splitTxtBlocks(text)
+
+	// Chapters nest under parts only when the text actually has parts.
+	hasParts := false
+	for i, b := range blocks {
+		if level, ok := txtHeadingLevel(b, i == 0); ok && level == 1 {
+			hasParts = true
+			break
+		}
+	}
+
+	// stack[i] is the open section at nesting level i+1
+	var stack []*etree.Element
+	for i, b := range blocks {
+		level, ok := txtHeadingLevel(b, i == 0)
+		if !ok {
+			parent := body
+			if len(stack) > 0 {
+				parent = stack[len(stack)-1]
+			}
+			parent.CreateElement("p").SetText(strings.Join(b.lines, " "))
+			continue
+		}
+
+		if !hasParts && level > 1 {
+			level--
+		}
+		if level > len(stack)+1 {
+			level = len(stack) + 1
+		}
+		stack = stack[:level-1]
+
+		parent := body
+		if len(stack) > 0 {
+			parent = stack[len(stack)-1]
+		}
+		section := parent.CreateElement("section")
+		section.CreateElement("title").CreateElement("p").SetText(b.lines[0])
+		stack = append(stack, section)
+	}
+
+	return doc
+}
+
+// writeGutenbergTitleInfo fills an FB2 title-info from Gutenberg header data.
+func writeGutenbergTitleInfo(titleInfo *etree.Element, meta gutenbergMeta) {
+	for _, name := range meta.authors {
+		writePersonName(titleInfo.CreateElement("author"), name)
+	}
+	if meta.title != "" {
+		titleInfo.CreateElement("book-title").SetText(meta.title)
+	}
+	if meta.date != "" {
+		titleInfo.CreateElement("date").SetText(meta.date)
+	}
+	if meta.language != "" {
+		titleInfo.CreateElement("lang").SetText(meta.language)
+	}
+	for _, name := range meta.translators {
+		writePersonName(titleInfo.CreateElement("translator"), name)
+	}
+}
+
+// writePersonName splits a full name into FB2 first-name/last-name parts.
+func writePersonName(person *etree.Element, name string) {
+	parts := strings.Fields(name)
+	switch len(parts) {
+	case 0:
+	case 1:
+		person.CreateElement("nickname").SetText(parts[0])
+	default:
+		person.CreateElement("first-name").SetText(strings.Join(parts[:len(parts)-1], " "))
+		person.CreateElement("last-name").SetText(parts[len(parts)-1])
+	}
+}
@@ -0,0 +1,243 @@
+package fb2md
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Typography selects the punctuation rules applied to the text. The zero value leaves the text as it is.
+type Typography struct {
+	// Quotes is "straight", "curly" or empty to keep the source quotes.
+	Quotes string
+	// Dashes turns free-standing hyphens, en dashes and "--" into em dashes.
+	Dashes bool
+	// SoftHyphens removes U+00AD soft hyphens.
+	SoftHyphens bool
+	// Spaces collapses runs of spaces and tabs into one space.
+	Spaces bool
+}
+
+func (t Typography) enabled() bool {
+	return t != Typography{}
+}
+
+// ParseTypography parses a comma-separated rule list such as
+// "quotes=curly,dashes". "all" turns on every rule with curly quotes, and a
+// "no-" prefix turns a rule off again, e.g. "all,no-quotes".
+func ParseTypography(s string) (Typography, error) {
+	var t Typography
+	for _, rule := range strings.Split(s, ",") {
+		rule = strings.TrimSpace(strings.ToLower(rule))
+		switch rule {
+		case "":
+		case "all":
+			t = Typography{Quotes: "curly", Dashes: true, SoftHyphens: true, Spaces: true}
+		case "quotes", "quotes=curly":
+			t.Quotes = "curly"
+		case "quotes=straight":
+			t.Quotes = "straight"
+		case "no-quotes":
+			t.Quotes = ""
+		case "dashes", "no-dashes":
+			t.Dashes = rule == "dashes"
+		case "soft-hyphens", "no-soft-hyphens":
+			t.SoftHyphens = rule == "soft-hyphens"
+		case "spaces", "no-spaces":
+			t.Spaces = rule == "spaces"
+		default:
+			return t, fmt.Errorf("unknown typography rule: %s", rule)
+		}
+	}
+	return t, nil
+}
+
+// typographer rewrites the text of a book in place. It carries the last
+// written rune across inline nodes so quotes and spaces are judged in the
+// context of the whole paragraph.
+type typographer struct {
+	rules Typography
+	prev  rune
+}
+
+func (t *typographer) applyBook(book *Book) {
+	if meta := book.Meta; meta != nil {
+		meta.Title = t.line(meta.Title)
+		t.blocks(meta.Annotation)
+	}
+	t.blocks(book.Body)
+	for _, note := range book.Footnotes {
+		t.paragraph(note.Content)
+	}
+}
+
+func (t *typographer) blocks(blocks []Block) {
+	for _, b := range blocks {
+		switch n := b.(type) {
+		case *Section:
+			n.Title = t.line(n.Title)
+			for _, epigraph := range n.Epigraphs {
+				t.blocks(epigraph.Blocks)
+			}
+			t.blocks(n.Annotation)
+			t.blocks(n.Blocks)
+		case *Heading:
+			n.Text = t.line(n.Text)
+		case *BodyTitle:
+			n.Text = t.line(n.Text)
+		case *Chapter:
+			t.blocks(n.Blocks)
+		case *Paragraph:
+			t.paragraph(n.Inlines)
+		case *Subtitle:
+			t.paragraph(n.Inlines)
+		case *Plain:
+			t.paragraph(n.Inlines)
+		case *TextAuthor:
+			t.paragraph(n.Inlines)
+		case *Epigraph:
+			t.blocks(n.Blocks)
+		case *Cite:
+			t.blocks(n.Blocks)
+		case *Quote:
+			for _, line := range n.Lines {
+				t.paragraph(line)
+			}
+		case *Poem:
+			n.Title = t.line(n.Title)
+			for _, epigraph := range n.Epigraphs {
+				t.blocks(epigraph.Blocks)
+			}
+			t.blocks(n.Blocks)
+			for _, author := range n.Authors {
+				t.paragraph(author)
+			}
+		case *Stanza:
+			n.Title = t.line(n.Title)
+			t.paragraph(n.Subtitle)
+			for _, line := range n.Lines {
+				t.paragraph(line)
+			}
+		case *List:
+			for _, item := range n.Items {
+				t.paragraph(item)
+			}
+		case *Table:
+			for _, row := range n.Rows {
+				for _, cell := range row {
+					t.paragraph(cell.Inlines)
+				}
+			}
+		}
+	}
+}
+
+// paragraph rewrites a run of inlines that starts a new line of text.
+func (t *typographer) paragraph(inlines []Inline) {
+	t.prev = 0
+	t.inlines(inlines)
+}
+
+func (t *typographer) inlines(inlines []Inline) {
+	for _, in := range inlines {
+		switch n := in.(type) {
+		case *Text:
+			n.Value = t.text(n.Value)
+		case *Emphasis:
+			t.inlines(n.Children)
+		case *Strong:
+			t.inlines(n.Children)
+		case *Strikethrough:
+			t.inlines(n.Children)
+		case *Superscript:
+			t.inlines(n.Children)
+		case *Subscript:
+			t.inlines(n.Children)
+		case *Span:
+			t.inlines(n.Children)
+		case *Link:
+			t.inlines(n.Children)
+		case *Code:
+			// Code is left exactly as written.
+			t.prev = 'x'
+		case *LineBreak:
+			t.prev = 0
+		}
+	}
+}
+
+// line rewrites a standalone string such as a title.
+func (t *typographer) line(s string) string {
+	t.prev = 0
+	return t.text(s)
+}
+
+func (t *typographer) text(s string) string {
+	if s == "" {
+		return s
+	}
+	runes := []rune(s)
+	var b strings.Builder
+	dashRun := false
+	for i, c := range runes {
+		next := rune(0)
+		if i+1 < len(runes) {
+			next = runes[i+1]
+		}
+		switch {
+		case c == '\u00ad' && t.rules.SoftHyphens:
+			continue
+		case (c == ' ' || c == '\t') && t.rules.Spaces:
+			if t.prev == ' ' {
+				continue
+			}
+			c = ' '
+		case c == '-' && next == '-' && t.rules.Dashes:
+			// "--" and "---" become a single em dash.
+			dashRun = true
+			continue
+		case t.rules.Dashes && (dashRun && c == '-' || isFreeDash(c, t.prev, next)):
+			dashRun = false
+			c = '—'
+		case isDoubleQuote(c) && t.rules.Quotes != "":
+			c = t.quote('"', '“', '”')
+		case isSingleQuote(c) && t.rules.Quotes != "":
+			c = t.quote('\'', '‘', '’')
+		}
+		b.WriteRune(c)
+		t.prev = c
+	}
+	return b.String()
+}
+
+// quote returns the straight quote, or the opening or closing curly quote
+// depending on the rune before it.
+func (t *typographer) quote(straight, open, close rune) rune {
+	if t.rules.Quotes == "straight" {
+		return straight
+	}
+	if t.prev == 0 || unicode.IsSpace(t.prev) || strings.ContainsRune("([{—–-/“‘", t.prev) {
+		return open
+	}
+	return close
+}
+
+// isFreeDash reports whether c is a hyphen-like dash standing between
+// spaces or at the start of a line, as in dialogue, rather than joining
+// words or numbers.
+func isFreeDash(c, prev, next rune) bool {
+	if c != '-' && c != '–' {
+		return false
+	}
+	before := prev == 0 || unicode.IsSpace(prev) || prev == '-'
+	after := next == 0 || unicode.IsSpace(next)
+	return before && after
+}
+
+func isDoubleQuote(c rune) bool {
+	return strings.ContainsRune("\"«»„“”", c)
+}
+
+func isSingleQuote(c rune) bool {
+	return strings.ContainsRune("'‹›‚‘’", c)
+}
@@ -0,0 +1,324 @@
+package fb2md
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+// fb2Namespace is the namespace of FictionBook 2.0 and 2.1 documents.
+const fb2Namespace = "http://www.gribuser.ru/xml/fictionbook/2.0"
+
+// ValidationIssue is one problem ValidateFile found in a book.
+type ValidationIssue struct {
+	// Severity is "error" for what breaks conversion or the FB2 schema,
+	// "warning" for what the converter works around.
+	Severity string `json:"severity"`
+	Where    string `json:"where,omitempty"`
+	Message  string `json:"message"`
+}
+
+// ValidationReport is the result of validating one file.
+type ValidationReport struct {
+	File   string            `json:"file"`
+	Issues []ValidationIssue `json:"issues"`
+}
+
+func (r *ValidationReport) add(severity, where, format string, args ...any) {
+	r.Issues = append(r.Issues, ValidationIssue{Severity: severity, Where: where, Message: fmt.Sprintf(format, args...)})
+}
+
+// Count returns the number of issues of the given severity.
+func (r *ValidationReport) Count(severity string) int {
+	var n int
+	for _, issue := range r.Issues {
+		if issue.Severity == severity {
+			n++
+		}
+	}
+	return n
+}
+
+// ValidateFile reads an FB2 or zipped FB2 file and checks it against the
+// parts of the FB2 2.0/2.1 schema the converter relies on. The error is
+// set only when the file cannot be read at all.
+func ValidateFile(file string) (*ValidationReport, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	format := SniffFormat(bytes.NewReader(data), int64(len(data)))
+	if format == "" {
+		format = FormatFromExt(file)
+	}
+	if format == "fb2.zip" {
+		if data, err = readZippedFB2(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	} else if format != "fb2" {
+		return nil, fmt.Errorf("not an FB2 file")
+	}
+	report := &ValidationReport{File: file, Issues: []ValidationIssue{}}
+	validateFB2(data, report)
+	return report, nil
+}
+
+// validateFB2 checks the parts of the FB2 2.0/2.1 schema the converter
+// relies on.
+func validateFB2(data []byte, r *ValidationReport) {
+	data, note, err := convertEncoding(data, Options{})
+	if err != nil {
+		r.add("error", "", "cannot decode text: %v", err)
+		return
+	}
+	if note != "" {
+		r.add("warning", "", "%s", note)
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		r.add("error", "", "not well-formed XML: %v (--lenient may recover it)", err)
+		return
+	}
+	root := doc.SelectElement("FictionBook")
+	if root == nil {
+		r.add("error", "", "root element is not <FictionBook>")
+		return
+	}
+	if ns := root.SelectAttrValue("xmlns", ""); ns != fb2Namespace {
+		r.add("warning", "FictionBook", "namespace is %q, not %q", ns, fb2Namespace)
+	}
+
+	validateDescription(root.SelectElement("description"), r)
+
+	ids := make(map[string]string)
+	binaries := make(map[string]bool)
+	for _, bin := range root.SelectElements("binary") {
+		id := bin.SelectAttrValue("id", "")
+		binaries[id] = true
+		validateBinary(bin, r)
+	}
+	walkElements(root, func(elem *etree.Element, where string) {
+		id := elem.SelectAttrValue("id", "")
+		if id == "" || elem.Tag == "binary" {
+			return
+		}
+		if _, dup := ids[id]; dup {
+			r.add("warning", where, "id %q is used more than once", id)
+		}
+		ids[id] = where
+	}, "")
+
+	var main int
+	for _, body := range root.SelectElements("body") {
+		if !isNotesBody(body, defaultNotesBodies) {
+			main++
+		}
+		validateBody(body, bodyLabel(body), r)
+	}
+	if main == 0 {
+		r.add("error", "", "no main <body>")
+	}
+
+	used := make(map[string]bool)
+	walkElements(root, func(elem *etree.Element, where string) {
+		href := fb2Href(elem)
+		if !strings.HasPrefix(href, "#") {
+			return
+		}
+		target := strings.TrimPrefix(href, "#")
+		switch elem.Tag {
+		case "image":
+			used[target] = true
+			if !binaries[target] {
+				r.add("error", where, "image refers to missing binary %q", target)
+			}
+		case "a":
+			if _, ok := ids[target]; !ok {
+				r.add("error", where, "link to missing #%s", target)
+			}
+		}
+	}, "")
+	for _, bin := range root.SelectElements("binary") {
+		if id := bin.SelectAttrValue("id", ""); id != "" && !used[id] {
+			r.add("warning", "binary "+id, "no image refers to it")
+		}
+	}
+}
+
+func validateDescription(desc *etree.Element, r *ValidationReport) {
+	if desc == nil {
+		r.add("error", "", "missing <description>")
+		return
+	}
+	titleInfo := desc.SelectElement("title-info")
+	if titleInfo == nil {
+		r.add("error", "description", "missing <title-info>")
+	} else {
+		genres := titleInfo.SelectElements("genre")
+		if len(genres) == 0 {
+			r.add("error", "title-info", "missing <genre>")
+		}
+		for _, genre := range genres {
+			code := strings.TrimSpace(genre.Text())
+			if _, ok := fb2Genres[strings.ToLower(code)]; !ok {
+				r.add("warning", "title-info", "unknown genre %q", code)
+			}
+		}
+		authors := titleInfo.SelectElements("author")
+		if len(authors) == 0 {
+			r.add("error", "title-info", "missing <author>")
+		}
+		for _, author := range authors {
+			if strings.TrimSpace(extractAllText(author)) == "" {
+				r.add("error", "title-info", "<author> has no name")
+			} else if author.SelectElement("nickname") == nil && (author.SelectElement("first-name") == nil || author.SelectElement("last-name") == nil) {
+				r.add("warning", "title-info", "<author> needs <first-name> and <last-name>, or <nickname>")
+			}
+		}
+		for _, field := range []string{"book-title", "lang"} {
+			if elem := titleInfo.SelectElement(field); elem == nil || strings.TrimSpace(elem.Text()) == "" {
+				r.add("error", "title-info", "missing <%s>", field)
+			}
+		}
+		if cover := titleInfo.SelectElement("coverpage"); cover != nil && cover.SelectElement("image") == nil {
+			r.add("warning", "title-info", "<coverpage> holds no <image>")
+		}
+	}
+
+	docInfo := desc.SelectElement("document-info")
+	if docInfo == nil {
+		r.add("warning", "description", "missing <document-info>")
+		return
+	}
+	for _, field := range []string{"author", "date", "id", "version"} {
+		if docInfo.SelectElement(field) == nil {
+			r.add("warning", "document-info", "missing <%s>", field)
+		}
+	}
+}
+
+// validateBody checks that sections hold either sections or content, not
+// both, and that the body and its sections are not empty.
+func validateBody(body *etree.Element, where string, r *ValidationReport) {
+	if len(body.ChildElements()) == 0 {
+		r.add("warning", where, "empty body")
+		return
+	}
+	var check func(section *etree.Element, where string)
+	check = func(section *etree.Element, where string) {
+		var sections, content int
+		for _, child := range section.ChildElements() {
+			switch child.Tag {
+			case "title", "epigraph", "annotation", "image":
+			case "section":
+				sections++
+				check(child, where+" > "+sectionLabel(child))
+			default:
+				content++
+			}
+		}
+		switch {
+		case sections > 0 && content > 0:
+			// Against the schema, but the converter reads it fine.
+			r.add("warning", where, "section mixes nested sections with paragraphs")
+		case sections == 0 && content == 0 && section.SelectElement("title") == nil:
+			r.add("warning", where, "empty section")
+		}
+	}
+	for _, child := range body.ChildElements() {
+		switch child.Tag {
+		case "section":
+			check(child, where+" > "+sectionLabel(child))
+		case "image", "title", "epigraph":
+		default:
+			r.add("error", where, "<%s> directly in <body>; content belongs in a <section>", child.Tag)
+		}
+	}
+}
+
+func validateBinary(bin *etree.Element, r *ValidationReport) {
+	id := bin.SelectAttrValue("id", "")
+	if id == "" {
+		r.add("error", "binary", "missing id")
+		return
+	}
+	where := "binary " + id
+	contentType := bin.SelectAttrValue("content-type", "")
+	if contentType == "" {
+		r.add("warning", where, "missing content-type")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(stripBase64Whitespace(strings.TrimSpace(bin.Text())))
+	if err != nil {
+		r.add("error", where, "undecodable base64: %v", err)
+		return
+	}
+	if len(decoded) == 0 {
+		r.add("error", where, "no data")
+		return
+	}
+	sniffed := http.DetectContentType(decoded)
+	if strings.HasPrefix(contentType, "image/") && sniffed != contentType {
+		if !strings.HasPrefix(sniffed, "image/") {
+			r.add("error", where, "content-type %s, but the data is not an image (%s)", contentType, sniffed)
+		} else {
+			r.add("warning", where, "content-type %s, but the data is %s", contentType, sniffed)
+		}
+	}
+}
+
+// walkElements calls fn for elem and each element below it, with a label
+// naming the section it is in.
+func walkElements(elem *etree.Element, fn func(elem *etree.Element, where string), where string) {
+	switch elem.Tag {
+	case "body":
+		where = bodyLabel(elem)
+	case "section":
+		where += " > " + sectionLabel(elem)
+	case "description":
+		where = "description"
+	}
+	fn(elem, where)
+	for _, child := range elem.ChildElements() {
+		walkElements(child, fn, where)
+	}
+}
+
+// bodyLabel names a body by its name attribute.
+func bodyLabel(body *etree.Element) string {
+	if name := body.SelectAttrValue("name", ""); name != "" {
+		return fmt.Sprintf("body %q", name)
+	}
+	return "body"
+}
+
+// sectionLabel names a section by its title or id.
+func sectionLabel(section *etree.Element) string {
+	if title := section.SelectElement("title"); title != nil {
+		if text := strings.Join(strings.Fields(extractAllText(title)), " "); text != "" {
+			if runes := []rune(text); len(runes) > 40 {
+				text = string(runes[:40]) + "…"
+			}
+			return fmt.Sprintf("section %q", text)
+		}
+	}
+	if id := section.SelectAttrValue("id", ""); id != "" {
+		return "section #" + id
+	}
+	return "section"
+}
+
+// fb2Href returns the href of a link or image, whatever prefix its xlink
+// namespace is bound to.
+func fb2Href(elem *etree.Element) string {
+	for _, attr := range elem.Attr {
+		if attr.Key == "href" {
+			return attr.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,66 @@
+package fb2md
+
+import (
+	"regexp"
+	"strings"
+)
+
+// orderedMarkerRe matches a word that would open an ordered list item.
+var orderedMarkerRe = regexp.MustCompile(`^\d{1,9}[.)]$`)
+
+// wrapText reflows text to lines of at most width columns. The first line
+// starts with first and the following ones with rest. Hard line breaks
+// ("  \n") are kept, and a word that would turn a continuation line into a
+// heading, list item, quote or other block is kept on the line before.
+// Words longer than the width get a line of their own.
+func wrapText(text string, width int, first, rest string) string {
+	if width <= 0 {
+		return first + strings.ReplaceAll(text, "\n", "\n"+rest)
+	}
+
+	var b strings.Builder
+	prefix := first
+	for i, line := range strings.Split(text, "\n") {
+		hardBreak := strings.HasSuffix(line, "  ")
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		col := 0
+		for j, word := range strings.Fields(line) {
+			wordLen := len([]rune(word))
+			switch {
+			case j == 0:
+				b.WriteString(prefix)
+				col = len([]rune(prefix))
+			case col+1+wordLen > width && canStartLine(word):
+				b.WriteString("\n")
+				b.WriteString(rest)
+				col = len([]rune(rest))
+			default:
+				b.WriteString(" ")
+				col++
+			}
+			b.WriteString(word)
+			col += wordLen
+			prefix = rest
+		}
+		if hardBreak {
+			b.WriteString("  ")
+		}
+	}
+	return b.String()
+}
+
+// canStartLine reports whether word can begin a continuation line without
+// being read as Markdown block syntax.
+func canStartLine(word string) bool {
+	if strings.Trim(word, "-=*_+") == "" || orderedMarkerRe.MatchString(word) {
+		return false
+	}
+	for _, marker := range []string{"#", ">", "<", "|", "```", "~~~", ":::", "{", "[^"} {
+		if strings.HasPrefix(word, marker) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,286 @@
+package fb2md
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+// parseFB2 parses FB2 XML. With lenient set, a document that fails to parse
+// is repaired with repairXML and read again, permissively; recovered then
+// says what was wrong and what was fixed. The parse stops once g is
+// abandoned.
+func parseFB2(data []byte, lenient bool, g *guard) (doc *etree.Document, recovered string, err error) {
+	doc = etree.NewDocument()
+	_, err = doc.ReadFrom(g.reader(bytes.NewReader(data)))
+	if err == nil || !lenient {
+		return doc, "", err
+	}
+	fixed, repairs := repairXML(data)
+	doc = etree.NewDocument()
+	doc.ReadSettings.Permissive = true
+	if _, err := doc.ReadFrom(g.reader(bytes.NewReader(fixed))); err != nil {
+		return nil, "", err
+	}
+	recovered = fmt.Sprintf("recovered malformed XML (%v)", err)
+	if len(repairs) > 0 {
+		recovered += ": repaired " + repairs.String()
+	}
+	return doc, recovered, nil
+}
+
+// xmlRepairs counts the fixes repairXML made, by kind.
+type xmlRepairs map[string]int
+
+func (r xmlRepairs) String() string {
+	var kinds []string
+	for kind, n := range r {
+		kinds = append(kinds, fmt.Sprintf("%d %s", n, kind))
+	}
+	sort.Strings(kinds)
+	return strings.Join(kinds, ", ")
+}
+
+// xmlEntities are the entities XML defines; other names are looked up as
+// HTML entities and written as character references.
+var xmlEntities = map[string]bool{"amp": true, "lt": true, "gt": true, "quot": true, "apos": true}
+
+// fb2BlockTags are the FB2 elements that cannot appear inside a paragraph,
+// and fb2TextTags the paragraphs and inline elements they close.
+var (
+	fb2BlockTags = map[string]bool{
+		"p": true, "v": true, "subtitle": true, "text-author": true, "empty-line": true,
+		"section": true, "title": true, "epigraph": true, "annotation": true, "cite": true,
+		"poem": true, "stanza": true, "table": true, "tr": true, "td": true, "th": true,
+		"body": true, "binary": true,
+	}
+	fb2TextTags = map[string]bool{
+		"p": true, "v": true, "subtitle": true, "text-author": true, "td": true, "th": true,
+		"emphasis": true, "strong": true, "strikethrough": true, "sub": true, "sup": true,
+		"code": true, "a": true, "style": true,
+	}
+)
+
+// repairXML fixes the mistakes hand-made FB2 files commonly have, so that
+// a document that fails to parse can still be read: "&" that starts no
+// entity is escaped, HTML entities such as &nbsp; become character
+// references, a "<" that starts no tag is escaped, end tags that close no
+// open element are dropped, and elements left open are closed where their
+// parent ends, where a paragraph or section starts that they cannot hold,
+// or at the end of the file.
+func repairXML(data []byte) ([]byte, xmlRepairs) {
+	repairs := make(xmlRepairs)
+	var out bytes.Buffer
+	out.Grow(len(data) + len(data)/64)
+	var open []string
+
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == '&':
+			n := writeEntity(&out, data[i:], repairs)
+			i += n
+		case c == '<':
+			n, ok := tagLength(data[i:])
+			if !ok {
+				out.WriteString("&lt;")
+				repairs[`stray "<"`]++
+				i++
+				continue
+			}
+			tag := data[i : i+n]
+			i += n
+			switch {
+			case bytes.HasPrefix(tag, []byte("</")):
+				name := tagName(tag[2:])
+				depth := -1
+				for j := len(open) - 1; j >= 0; j-- {
+					if open[j] == name {
+						depth = j
+						break
+					}
+				}
+				if depth < 0 {
+					repairs["unmatched end tag(s)"]++
+					continue
+				}
+				for len(open) > depth+1 {
+					closeElement(&out, open[len(open)-1])
+					open = open[:len(open)-1]
+					repairs["unclosed element(s)"]++
+				}
+				open = open[:depth]
+				out.Write(tag)
+			case tag[1] == '!' || tag[1] == '?':
+				out.Write(tag)
+			default:
+				name := tagName(tag[1:])
+				if fb2BlockTags[localName(name)] {
+					for len(open) > 0 && fb2TextTags[localName(open[len(open)-1])] {
+						closeElement(&out, open[len(open)-1])
+						open = open[:len(open)-1]
+						repairs["unclosed element(s)"]++
+					}
+				}
+				out.Write(repairTag(tag, repairs))
+				if !bytes.HasSuffix(tag, []byte("/>")) {
+					open = append(open, name)
+				}
+			}
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	for len(open) > 0 {
+		closeElement(&out, open[len(open)-1])
+		open = open[:len(open)-1]
+		repairs["unclosed element(s)"]++
+	}
+	return out.Bytes(), repairs
+}
+
+// closeElement writes the end tag of an element left open, before the
+// whitespace that follows its content.
+func closeElement(out *bytes.Buffer, name string) {
+	text := out.Bytes()
+	space := append([]byte(nil), text[len(bytes.TrimRight(text, " \t\r\n")):]...)
+	out.Truncate(len(text) - len(space))
+	out.WriteString("</" + name + ">")
+	out.Write(space)
+}
+
+// writeEntity writes the entity reference starting at the "&" of data, or
+// an escaped "&" when it starts none, and returns how many bytes it read.
+func writeEntity(out *bytes.Buffer, data []byte, repairs xmlRepairs) int {
+	end := bytes.IndexByte(data[:min(len(data), 40)], ';')
+	if end > 1 && isEntityName(data[1:end]) {
+		name := string(data[1:end])
+		switch {
+		case xmlEntities[name]:
+			out.Write(data[:end+1])
+			return end + 1
+		case name[0] == '#':
+			if decoded := html.UnescapeString(string(data[:end+1])); decoded != string(data[:end+1]) {
+				out.Write(data[:end+1])
+				return end + 1
+			}
+		default:
+			if decoded := html.UnescapeString(string(data[:end+1])); decoded != string(data[:end+1]) {
+				for _, r := range decoded {
+					fmt.Fprintf(out, "&#%d;", r)
+				}
+				repairs["HTML entities"]++
+				return end + 1
+			}
+		}
+	}
+	out.WriteString("&amp;")
+	repairs[`unescaped "&"`]++
+	return 1
+}
+
+// isEntityName reports whether name can sit between "&" and ";": a name of
+// letters and digits, or a "#" character number.
+func isEntityName(name []byte) bool {
+	for i, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || i == 0 && c == '#') {
+			return false
+		}
+	}
+	return true
+}
+
+// tagLength returns the length of the markup starting at the "<" of data:
+// a start or end tag, comment, CDATA section, doctype or processing
+// instruction. It reports false when the "<" starts none of them.
+func tagLength(data []byte) (int, bool) {
+	if len(data) < 2 {
+		return 0, false
+	}
+	for _, m := range [][2]string{{"<!--", "-->"}, {"<![CDATA[", "]]>"}, {"<?", "?>"}} {
+		if bytes.HasPrefix(data, []byte(m[0])) {
+			end := bytes.Index(data[len(m[0]):], []byte(m[1]))
+			if end < 0 {
+				return 0, false
+			}
+			return len(m[0]) + end + len(m[1]), true
+		}
+	}
+	start := 1
+	if data[1] == '/' || data[1] == '!' {
+		start = 2
+	}
+	if start >= len(data) || !isNameStart(data[start]) {
+		return 0, false
+	}
+	var quote byte
+	for i := start; i < len(data); i++ {
+		switch c := data[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i + 1, true
+		case c == '<':
+			// A tag never holds "<" outside its attribute values.
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// repairTag escapes "&" and "<" inside the attribute values of a start tag.
+func repairTag(tag []byte, repairs xmlRepairs) []byte {
+	if !bytes.ContainsAny(tag, "&") && bytes.Count(tag, []byte("<")) == 1 {
+		return tag
+	}
+	var out bytes.Buffer
+	var quote byte
+	for i := 0; i < len(tag); i++ {
+		c := tag[i]
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+			out.WriteByte(c)
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+			out.WriteByte(c)
+		case quote != 0 && c == '&':
+			i += writeEntity(&out, tag[i:], repairs) - 1
+		case quote != 0 && c == '<':
+			out.WriteString("&lt;")
+			repairs[`stray "<"`]++
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.Bytes()
+}
+
+// tagName returns the element name at the start of data.
+func tagName(data []byte) string {
+	end := bytes.IndexFunc(data, func(r rune) bool {
+		return r == '>' || r == '/' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	if end < 0 {
+		end = len(data)
+	}
+	return string(data[:end])
+}
+
+// localName strips the namespace prefix from an element name.
+func localName(name string) string {
+	return name[strings.LastIndexByte(name, ':')+1:]
+}
+
+func isNameStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == ':' || c >= 0x80
+}
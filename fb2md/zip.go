@@ -0,0 +1,118 @@
+package fb2md
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// openZipReader reads a zip archive from a stream. Zip needs random access,
+// so the whole archive is buffered in memory.
+func openZipReader(r io.Reader) (*zip.Reader, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return zip.NewReader(bytes.NewReader(data), int64(len(data)))
+}
+
+// Default limits on the unpacked size and number of entries of an EPUB,
+// against zip bombs.
+const (
+	DefaultZipMaxSize    = 1 << 30
+	DefaultZipMaxEntries = 10000
+)
+
+// ErrArchiveTooLarge and ErrTooManyEntries are returned for an EPUB over
+// Options.ZipMaxSize or Options.ZipMaxEntries.
+var (
+	ErrArchiveTooLarge = errors.New("archive unpacks too large")
+	ErrTooManyEntries  = errors.New("archive has too many entries")
+)
+
+// checkZipArchive rejects an archive with an entry whose path would point
+// outside it, or that unpacks to more than opts allows in size or number
+// of entries. The sizes are those the archive declares; archive/zip fails
+// reading an entry that turns out larger.
+func checkZipArchive(reader *zip.Reader, opts Options) error {
+	maxSize, maxEntries := opts.ZipMaxSize, opts.ZipMaxEntries
+	if maxSize <= 0 {
+		maxSize = DefaultZipMaxSize
+	}
+	if maxEntries <= 0 {
+		maxEntries = DefaultZipMaxEntries
+	}
+	if len(reader.File) > maxEntries {
+		return fmt.Errorf("%w: %d, over the limit of %d", ErrTooManyEntries, len(reader.File), maxEntries)
+	}
+	var total uint64
+	for _, f := range reader.File {
+		if !safeZipPath(f.Name) {
+			return fmt.Errorf("archive entry %q points outside the archive", f.Name)
+		}
+		total += f.UncompressedSize64
+		if total > uint64(maxSize) {
+			return fmt.Errorf("%w: more than %s", ErrArchiveTooLarge, FormatByteSize(maxSize))
+		}
+	}
+	return nil
+}
+
+// safeZipPath reports whether an entry name stays inside the archive: it
+// is relative and has no ".." element, with either slash.
+func safeZipPath(name string) bool {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if name == "" || strings.HasPrefix(name, "/") || filepath.VolumeName(name) != "" || len(name) > 1 && name[1] == ':' {
+		return false
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// readZippedFB2 returns the contents of the single FB2 book stored in a zip
+// archive (the common .fb2.zip distribution format).
+func readZippedFB2(r io.Reader) ([]byte, error) {
+	reader, err := openZipReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open zip archive: %w", err)
+	}
+
+	var fb2Files []*zip.File
+	for _, f := range reader.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if strings.ToLower(path.Ext(f.Name)) == ".fb2" {
+			fb2Files = append(fb2Files, f)
+		}
+	}
+
+	switch len(fb2Files) {
+	case 0:
+		return nil, fmt.Errorf("no .fb2 file found in zip archive")
+	case 1:
+	default:
+		return nil, fmt.Errorf("zip archive contains %d .fb2 files, expected one", len(fb2Files))
+	}
+
+	rc, err := fb2Files[0].Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", fb2Files[0].Name, err)
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", fb2Files[0].Name, err)
+	}
+	return data, nil
+}
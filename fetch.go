@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lexoprom/fb2md-cli/fb2md"
+)
+
+// formatsByContentType maps MIME types served for ebooks to input formats.
+var formatsByContentType = map[string]string{
+	"application/x-fictionbook+xml": "fb2",
+	"application/x-fictionbook":     "fb2",
+	"text/fb2+xml":                  "fb2",
+	"application/fb2":               "fb2",
+	"application/fb3":               "fb3",
+	"application/epub+zip":          "epub",
+	"application/zip":               "fb2.zip",
+	"application/x-zip-compressed":  "fb2.zip",
+	"application/vnd.comicbook+zip": "cbz",
+	"application/x-cbz":             "cbz",
+	"application/tei+xml":           "tei",
+	"text/plain":                    "txt",
+}
+
+func isURL(input string) bool {
+	return strings.HasPrefix(input, "http://") || strings.HasPrefix(input, "https://")
+}
+
+// download is a book fetched over HTTP.
+type download struct {
+	data     []byte
+	format   string
+	filename string
+}
+
+// fetchURL downloads a book and works out its format from its content, then
+// from the file name (Content-Disposition, falling back to the URL path),
+// then from Content-Type.
+// An empty proxy uses the standard proxy environment variables.
+func fetchURL(rawURL string, timeout time.Duration, proxy string) (*download, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	client := &http.Client{Timeout: timeout, Transport: transport}
+
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("download failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download failed: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("download failed: %w", err)
+	}
+
+	d := &download{data: data}
+
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		d.filename = path.Base(params["filename"])
+	}
+	if d.filename == "" || d.filename == "." || d.filename == "/" {
+		d.filename = path.Base(resp.Request.URL.Path)
+	}
+
+	if format := fb2md.SniffFormat(bytes.NewReader(d.data), int64(len(d.data))); format != "" {
+		d.format = format
+	} else if format := fb2md.FormatFromExt(d.filename); fb2md.Readable(format) {
+		d.format = format
+	} else if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil && formatsByContentType[mediaType] != "" {
+		d.format = formatsByContentType[mediaType]
+	} else {
+		d.format = "fb2"
+	}
+
+	return d, nil
+}
+
+// bookTitle extracts the book title from raw book data, or returns "" when
+// the format carries no title or it cannot be read.
+func bookTitle(data []byte, format string, opts Options) string {
+	if meta := fb2md.ReadMetadata(data, format, opts.Options); meta != nil {
+		return meta.Title
+	}
+	return ""
+}
+
+// titleToFilename turns a book title into a file name, keeping letters of any
+// script but dropping characters that are unsafe in paths.
+func titleToFilename(title string) string {
+	var b strings.Builder
+	for _, r := range title {
+		switch {
+		case strings.ContainsRune(`<>:"/\|?*`, r), unicode.IsControl(r):
+			b.WriteByte('_')
+		case unicode.IsSpace(r):
+			b.WriteByte(' ')
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	name := strings.Join(strings.Fields(b.String()), " ")
+	name = strings.Trim(name, ". ")
+	if runes := []rune(name); len(runes) > 100 {
+		name = strings.TrimSpace(string(runes[:100]))
+	}
+	return name
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/fs"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// isGlob reports whether s is a shell-style pattern rather than a path.
+func isGlob(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+// expandGlob returns the files pattern matches, in name order, and root,
+// the directory before its first wildcard, which names are made relative
+// to. Besides the wildcards of path.Match, a "**" component matches any
+// number of directories, so "books/**/*.fb2" finds FB2 files at any depth.
+func expandGlob(pattern string) (root string, matches []string, err error) {
+	parts := strings.Split(filepath.ToSlash(pattern), "/")
+	i := 0
+	for i < len(parts) && !isGlob(parts[i]) {
+		i++
+	}
+	root = strings.Join(parts[:i], "/")
+	switch {
+	case root == "" && i > 0:
+		root = "/"
+	case root == "":
+		root = "."
+	}
+	root = filepath.FromSlash(root)
+	rest := parts[i:]
+
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// What cannot be read matches nothing.
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			// Without "**" a pattern only reaches as deep as it has
+			// components.
+			if rel != "." && !slices.Contains(rest, "**") && strings.Count(filepath.ToSlash(rel), "/")+1 >= len(rest) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if matchGlob(rest, strings.Split(filepath.ToSlash(rel), "/")) {
+			matches = append(matches, p)
+		}
+		return nil
+	})
+	return root, matches, err
+}
+
+// matchGlob reports whether the path components name match the pattern
+// components, "**" matching any number of them.
+func matchGlob(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchGlob(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// excluded reports whether the book at rel, a path relative to the
+// directory, archive or pattern it was found by, or a directory on that
+// path, matches one of the --exclude patterns.
+func excluded(rel string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i := 1; i <= len(parts); i++ {
+		if excludedEntry(parts[:i], i < len(parts), patterns) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedEntry reports whether the file or directory at the path parts
+// matches one of patterns. A pattern without a slash matches the name, so
+// "_trash" leaves out every _trash directory; one with a slash matches the
+// whole path, "**" standing for any number of directories. A trailing
+// slash matches directories only.
+func excludedEntry(parts []string, isDir bool, patterns []string) bool {
+	for _, pattern := range patterns {
+		dirOnly := strings.HasSuffix(pattern, "/")
+		pattern = strings.TrimSuffix(pattern, "/")
+		if dirOnly && !isDir {
+			continue
+		}
+		if strings.Contains(pattern, "/") {
+			if matchGlob(strings.Split(pattern, "/"), parts) {
+				return true
+			}
+		} else if ok, _ := path.Match(pattern, parts[len(parts)-1]); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lexoprom/fb2md-cli/fb2md"
+)
+
+// imagesBook is a book "fb2md images" extracts the images of, with the name
+// they are written under.
+type imagesBook struct {
+	path string
+	name string
+}
+
+// runImages runs "fb2md images [-o dir] [--cover-only] book...", which
+// writes the images embedded in books without converting them, and returns
+// the exit status. A directory stands for the books in it.
+func runImages(args []string) int {
+	flags := flag.NewFlagSet("images", flag.ContinueOnError)
+	outputDir := flags.String("output-dir", "", "directory to write the images to (default: <book>_images for one book, the current directory for several)")
+	flags.StringVar(outputDir, "o", "", "directory to write the images to (shorthand)")
+	coverOnly := flags.Bool("cover-only", false, "write only the cover of each book, named after the book, e.g. <book>.jpg")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: fb2md images [-o dir] [--cover-only] book.fb2 [books/ ...]
+
+Writes the images embedded in FB2, FB3 and EPUB books and the pages of CBZ
+comics without converting them: the images of one book to dir, those of
+several books, or of the books in a directory, to dir/<book>_images. With
+--cover-only each book's cover is written to dir/<book>.jpg (or .png, ...),
+the first page of a comic standing for its cover.
+
+Examples:
+  fb2md images book.fb2           images to book_images/
+  fb2md images --cover-only -o covers/ library/
+                                  a cover gallery of a library
+
+Flags:
+`)
+		flags.PrintDefaults()
+	}
+	files := parseArgs(flags, args, nil)
+	if len(files) == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	var books []imagesBook
+	several := len(files) > 1
+	var walkErrs int
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil && info.IsDir() {
+			several = true
+			err := walkBooks(file, Options{}, true, func(path, rel string) error {
+				name := strings.ReplaceAll(trimBookExt(rel), string(filepath.Separator), "_")
+				books = append(books, imagesBook{path: path, name: name})
+				return nil
+			})
+			if err != nil {
+				log.Printf("warning: %s: %v", file, err)
+				walkErrs++
+			}
+			continue
+		}
+		books = append(books, imagesBook{path: file, name: trimBookExt(filepath.Base(file))})
+	}
+
+	dir := *outputDir
+	if dir == "" && (several || *coverOnly) {
+		dir = "."
+	}
+	var written, failed, noCover int
+	var lastErr error
+	for _, book := range books {
+		bookDir := dir
+		if !*coverOnly && (several || dir == "") {
+			bookDir = filepath.Join(dir, book.name+"_images")
+		}
+		paths, err := extractImages(book, bookDir, *coverOnly)
+		switch {
+		case errors.Is(err, fb2md.ErrNoCover):
+			noCover++
+			log.Printf("warning: %s", colorize(os.Stderr, ansiYellow, fmt.Sprintf("%s: %v", book.path, err)))
+			continue
+		case err != nil:
+			failed++
+			lastErr = err
+			log.Printf("warning: %s", colorize(os.Stderr, ansiRed, fmt.Sprintf("%s: %v", book.path, err)))
+			continue
+		}
+		written += len(paths)
+		if *coverOnly {
+			fmt.Println(colorize(os.Stdout, ansiGreen, book.path+" -> "+paths[0]))
+		} else {
+			fmt.Println(colorize(os.Stdout, ansiGreen, fmt.Sprintf("%s -> %s (%d image(s))", book.path, bookDir, len(paths))))
+		}
+	}
+
+	line := fmt.Sprintf("wrote %d image(s) from %d book(s)", written, len(books)-failed-noCover)
+	if noCover > 0 {
+		line += fmt.Sprintf(", %d without a cover", noCover)
+	}
+	if failed > 0 {
+		line += fmt.Sprintf(", %d failed", failed)
+	}
+	fmt.Println(line)
+	switch {
+	case len(books) == 1 && failed == 1:
+		return exitStatus(lastErr)
+	case failed > 0 && failed == len(books):
+		return exitAllFailed
+	case failed > 0 || walkErrs > 0:
+		return exitSomeFailed
+	}
+	return 0
+}
+
+// extractImages writes the images of book to dir, or only its cover named
+// after the book, and returns the paths written.
+func extractImages(book imagesBook, dir string, coverOnly bool) ([]string, error) {
+	if pathFormat(book.path) == "cbz" {
+		cover := ""
+		if coverOnly {
+			cover = book.name
+		}
+		return fb2md.WritePages(book.path, dir, cover)
+	}
+	b, err := readBook(book.path, Options{})
+	if err != nil {
+		return nil, err
+	}
+	if !coverOnly {
+		return fb2md.WriteImages(b, dir, logger)
+	}
+	path, err := fb2md.WriteCover(b, dir, book.name, logger)
+	if err != nil {
+		return nil, err
+	}
+	return []string{path}, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lexoprom/fb2md-cli/fb2md"
+)
+
+// Index files --index writes to the output directory of a batch.
+const (
+	indexMarkdown = "INDEX.md"
+	indexJSON     = "index.json"
+)
+
+// libraryIndex is the catalog of a batch conversion: the converted books
+// grouped by author and series.
+type libraryIndex struct {
+	Books   int           `json:"books"`
+	Authors []indexAuthor `json:"authors"`
+	// UpToDate lists the outputs left as they were, whose books were not
+	// read again.
+	UpToDate []string `json:"up_to_date,omitempty"`
+}
+
+// indexAuthor holds the books of one author, or of several writing
+// together; Name is "" for the books that name none.
+type indexAuthor struct {
+	Name   string        `json:"name"`
+	Series []indexSeries `json:"series,omitempty"`
+	// Books are the books outside any series.
+	Books []indexBook `json:"books,omitempty"`
+}
+
+type indexSeries struct {
+	Name  string      `json:"name"`
+	Books []indexBook `json:"books"`
+}
+
+// indexBook is a converted book; Output and Cover are relative to the
+// output directory.
+type indexBook struct {
+	Title  string `json:"title"`
+	Number string `json:"number,omitempty"`
+	Output string `json:"output"`
+	Cover  string `json:"cover,omitempty"`
+	Source string `json:"source"`
+	Words  int    `json:"words"`
+}
+
+// writeIndex writes INDEX.md and index.json to outputDir, cataloging the
+// books recorded in m.
+func writeIndex(outputDir string, m *manifest) error {
+	index := buildIndex(outputDir, m)
+	mdPath := filepath.Join(outputDir, indexMarkdown)
+	jsonPath := filepath.Join(outputDir, indexJSON)
+	for _, e := range m.entries {
+		if e.Output != "" && (sameFile(e.Output, mdPath) || sameFile(e.Output, jsonPath)) {
+			return fmt.Errorf("failed to write index: %s would overwrite the book converted from %s", e.Output, e.Source)
+		}
+	}
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode index: %w", err)
+	}
+	if err := os.WriteFile(jsonPath, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	if err := os.WriteFile(mdPath, []byte(index.markdown()), 0644); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	return nil
+}
+
+// buildIndex groups the converted books of m by author and series. Authors
+// and series are sorted by name, the books of a series by number, and the
+// other books by title.
+func buildIndex(outputDir string, m *manifest) libraryIndex {
+	rel := func(path string) string {
+		if r, err := filepath.Rel(outputDir, path); err == nil {
+			return filepath.ToSlash(r)
+		}
+		return filepath.ToSlash(path)
+	}
+	index := libraryIndex{Authors: []indexAuthor{}}
+	authors := make(map[string]*indexAuthor)
+	var names []string
+	// Under --on-conflict overwrite the last book written to an output is
+	// the one it holds.
+	last := make(map[string]int)
+	for i, e := range m.entries {
+		last[e.Output] = i
+	}
+	for i, e := range m.entries {
+		switch {
+		case last[e.Output] != i:
+			continue
+		case e.Status == "up-to-date":
+			index.UpToDate = append(index.UpToDate, rel(e.Output))
+			continue
+		case e.Status != "converted" || e.Output == fb2md.StdoutPath:
+			continue
+		}
+		book := indexBook{
+			Title:  e.Title,
+			Output: rel(e.Output),
+			Source: e.Source,
+			Words:  e.Words,
+		}
+		if book.Title == "" {
+			book.Title = trimBookExt(filepath.Base(e.Source))
+		}
+		if e.cover != "" {
+			book.Cover = rel(e.cover)
+		}
+		name := strings.Join(e.Authors, ", ")
+		author := authors[name]
+		if author == nil {
+			author = &indexAuthor{Name: name}
+			authors[name] = author
+			names = append(names, name)
+		}
+		index.Books++
+		if len(e.series) == 0 || e.series[0].Name == "" {
+			author.Books = append(author.Books, book)
+			continue
+		}
+		book.Number = e.series[0].Number
+		i := 0
+		for i < len(author.Series) && author.Series[i].Name != e.series[0].Name {
+			i++
+		}
+		if i == len(author.Series) {
+			author.Series = append(author.Series, indexSeries{Name: e.series[0].Name})
+		}
+		author.Series[i].Books = append(author.Series[i].Books, book)
+	}
+
+	// The books that name no author come last.
+	sort.Slice(names, func(i, j int) bool {
+		if (names[i] == "") != (names[j] == "") {
+			return names[j] == ""
+		}
+		return strings.ToLower(names[i]) < strings.ToLower(names[j])
+	})
+	byTitle := func(books []indexBook) {
+		sort.SliceStable(books, func(i, j int) bool {
+			return strings.ToLower(books[i].Title) < strings.ToLower(books[j].Title)
+		})
+	}
+	for _, name := range names {
+		author := authors[name]
+		byTitle(author.Books)
+		sort.SliceStable(author.Series, func(i, j int) bool {
+			return strings.ToLower(author.Series[i].Name) < strings.ToLower(author.Series[j].Name)
+		})
+		for _, series := range author.Series {
+			byTitle(series.Books)
+			sort.SliceStable(series.Books, func(i, j int) bool {
+				return seriesOrder(series.Books[i].Number) < seriesOrder(series.Books[j].Number)
+			})
+		}
+		index.Authors = append(index.Authors, *author)
+	}
+	return index
+}
+
+// seriesOrder returns the place of a book numbered number in its series;
+// unnumbered books go last.
+func seriesOrder(number string) float64 {
+	if n, err := strconv.ParseFloat(number, 64); err == nil {
+		return n
+	}
+	return 1e9
+}
+
+// markdown returns the index as INDEX.md: a heading per author and series
+// and a list item per book linking its output and cover.
+func (index libraryIndex) markdown() string {
+	var b strings.Builder
+	b.WriteString("# Library\n\n")
+	fmt.Fprintf(&b, "%d book(s) by %d author(s).\n", index.Books, len(index.Authors))
+	item := func(book indexBook) {
+		b.WriteString("- ")
+		if book.Number != "" {
+			b.WriteString("#" + book.Number + " ")
+		}
+		fmt.Fprintf(&b, "[%s](%s)", linkText.Replace(book.Title), linkDestination(book.Output))
+		if book.Cover != "" {
+			fmt.Fprintf(&b, " · [cover](%s)", linkDestination(book.Cover))
+		}
+		b.WriteString("\n")
+	}
+	for _, author := range index.Authors {
+		name := author.Name
+		if name == "" {
+			name = "Unknown author"
+		}
+		fmt.Fprintf(&b, "\n## %s\n", name)
+		if len(author.Books) > 0 {
+			b.WriteString("\n")
+		}
+		for _, book := range author.Books {
+			item(book)
+		}
+		for _, series := range author.Series {
+			fmt.Fprintf(&b, "\n### %s\n\n", series.Name)
+			for _, book := range series.Books {
+				item(book)
+			}
+		}
+	}
+	if len(index.UpToDate) > 0 {
+		b.WriteString("\n## Up to date\n\nConverted by an earlier run and not read again:\n\n")
+		for _, output := range index.UpToDate {
+			fmt.Fprintf(&b, "- [%s](%s)\n", linkText.Replace(output), linkDestination(output))
+		}
+	}
+	return b.String()
+}
+
+// linkText escapes the brackets that would end link text early.
+var linkText = strings.NewReplacer("[", `\[`, "]", `\]`)
+
+// linkDestination returns path as a Markdown link destination, in angle
+// brackets when it has spaces or parentheses.
+func linkDestination(path string) string {
+	if strings.ContainsAny(path, " ()") {
+		return "<" + path + ">"
+	}
+	return path
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/lexoprom/fb2md-cli/fb2md"
+)
+
+// Verbosity levels of the messages the command shows.
+const (
+	levelQuiet = iota - 1
+	levelNormal
+	levelVerbose
+	levelDebug
+)
+
+// verbosity is the level --quiet, --verbose and --debug select.
+var verbosity = levelNormal
+
+// logger receives the messages and events of the conversion, the
+// command's own and those of the fb2md package, for the log format and
+// verbosity chosen; setLogger builds it once they are known.
+var logger = slog.New(logHandler{Handler: textLogHandler{}, level: slog.LevelWarn})
+
+// setLogger builds logger for the verbosity and log format chosen: the
+// details show with --verbose, the diagnostics with --debug, and the events
+// only in the JSON log.
+func setLogger() {
+	level := slog.LevelWarn
+	switch {
+	case verbosity >= levelDebug:
+		level = slog.LevelDebug
+	case verbosity >= levelVerbose:
+		level = slog.LevelInfo
+	}
+	if jsonLog != nil {
+		logger = slog.New(logHandler{Handler: jsonLog.Handler(), level: level, events: true})
+		return
+	}
+	logger = slog.New(logHandler{Handler: textLogHandler{}, level: level})
+}
+
+// logHandler passes on the messages at level or above, and the events of
+// a conversion when events is set.
+type logHandler struct {
+	slog.Handler
+	level  slog.Level
+	events bool
+}
+
+func (h logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	if level == fb2md.LevelEvent {
+		return h.events
+	}
+	return level >= h.level
+}
+
+func (h logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h.Handler = h.Handler.WithAttrs(attrs)
+	return h
+}
+
+func (h logHandler) WithGroup(name string) slog.Handler {
+	h.Handler = h.Handler.WithGroup(name)
+	return h
+}
+
+// textLogHandler writes messages to the standard logger, prefixed with
+// their level as the command's own are, e.g. "warning: ".
+type textLogHandler struct{}
+
+func (textLogHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (textLogHandler) Handle(_ context.Context, r slog.Record) error {
+	prefix := ""
+	for _, l := range jsonLogLevels {
+		if l.level == r.Level {
+			prefix = l.prefix
+			break
+		}
+	}
+	log.Print(prefix + r.Message)
+	return nil
+}
+
+func (h textLogHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h textLogHandler) WithGroup(string) slog.Handler      { return h }
+
+// jsonLog is the logger of --log-format json, which writes the messages and
+// the events of a conversion to stderr as JSON objects, one a line; nil
+// for the text log.
+var jsonLog *slog.Logger
+
+// setLogFormat switches logging to format: "text" or "json".
+func setLogFormat(format string) error {
+	switch format {
+	case "text":
+	case "json":
+		jsonLog = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug, ReplaceAttr: eventLevel}))
+		log.SetOutput(jsonLogWriter{})
+	default:
+		return fmt.Errorf("unsupported log format: %s", format)
+	}
+	return nil
+}
+
+// eventLevel shows fb2md.LevelEvent in the JSON log as INFO, the level of
+// the other events.
+func eventLevel(_ []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey && a.Value.Any() == fb2md.LevelEvent {
+		a.Value = slog.StringValue(slog.LevelInfo.String())
+	}
+	return a
+}
+
+// jsonLogLevels maps the prefixes of logged messages to their JSON log
+// events and levels.
+var jsonLogLevels = []struct {
+	prefix string
+	event  string
+	level  slog.Level
+}{
+	{"error: ", "error", slog.LevelError},
+	{"warning: ", "warning", slog.LevelWarn},
+	{"info: ", "info", slog.LevelInfo},
+	{"debug: ", "debug", slog.LevelDebug},
+}
+
+// jsonLogWriter writes the messages of the standard logger to the JSON
+// log, the event and level taken from their prefix.
+type jsonLogWriter struct{}
+
+func (jsonLogWriter) Write(b []byte) (int, error) {
+	msg := strings.TrimSuffix(string(b), "\n")
+	event, level := "message", slog.LevelInfo
+	for _, l := range jsonLogLevels {
+		if rest, ok := strings.CutPrefix(msg, l.prefix); ok {
+			msg, event, level = rest, l.event, l.level
+			break
+		}
+	}
+	jsonLog.Log(context.Background(), level, msg, "event", event)
+	return len(b), nil
+}
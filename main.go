@@ -1,81 +1,617 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
-	"io/fs"
+	"io"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/lexoprom/fb2md-cli/fb2md"
 )
 
 var version = "dev"
 
+// supportedExts lists the input extensions picked up by directory conversion.
+var supportedExts = map[string]bool{
+	".fb2":  true,
+	".fb3":  true,
+	".zip":  true,
+	".epub": true,
+	".txt":  true,
+	".tei":  true,
+	".cbz":  true,
+}
+
 func main() {
 	log.SetFlags(0)
 
-	images := flag.Bool("images", false, "extract embedded images")
-	flag.BoolVar(images, "i", false, "extract embedded images (shorthand)")
+	// "fb2md validate book.fb2" checks a book instead of converting it,
+	// unless a file of that name is what is being converted.
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		if _, err := os.Stat(os.Args[1]); err != nil {
+			os.Exit(runValidate(os.Args[2:]))
+		}
+	}
+	// Likewise "fb2md images book.fb2" only extracts the book's images,
+	// and "fb2md toc book.fb2" prints its outline.
+	if len(os.Args) > 1 && os.Args[1] == "images" {
+		if _, err := os.Stat(os.Args[1]); err != nil {
+			os.Exit(runImages(os.Args[2:]))
+		}
+	}
+	if len(os.Args) > 1 && os.Args[1] == "toc" {
+		if _, err := os.Stat(os.Args[1]); err != nil {
+			os.Exit(runTOC(os.Args[2:]))
+		}
+	}
+
+	var images imagesMode
+	flag.Var(&images, "images", "extract embedded images; \"--images inline\" embeds them in the Markdown as data URIs")
+	flag.Var(&images, "i", "extract embedded images (shorthand)")
 
 	imagesDir := flag.String("images-dir", "", "directory for extracted images (default: <output>_images)")
 
+	imageMaxSize := flag.Int("image-max-size", 0, "downscale extracted images to at most `N` pixels on the longest edge")
+	imageQuality := flag.Int("image-quality", 0, "re-encode extracted JPEG images at this quality, 1-100 (default 85 when resizing)")
+
+	allBinaries := flag.Bool("all-binaries", false, "with -i, also extract embedded binaries that no image in the book refers to")
+	zipMaxSize := byteSize(fb2md.DefaultZipMaxSize)
+	flag.Var(&zipMaxSize, "zip-max-size", "refuse EPUBs that unpack to more than this `size`, e.g. 512M or 2G")
+	zipMaxEntries := flag.Int("zip-max-entries", fb2md.DefaultZipMaxEntries, "refuse EPUBs with more than `N` files")
+	var maxFileSize byteSize
+	flag.Var(&maxFileSize, "max-file-size", "skip books larger than this `size`, e.g. 200M or 1G, with a warning (default: no limit)")
+	timeoutPerFile := flag.Duration("timeout-per-file", 0, "give up on a book that takes longer than this `duration` to convert, e.g. 30s or 2m, with a warning (default: no limit)")
+	rasterizeSVG := flag.Bool("rasterize-svg", false, "convert SVG images to PNG, for readers and sites that cannot show SVG (needs rsvg-convert)")
+	imageLinks := flag.String("image-links", "relative", "how image links are written: relative (to the output file), absolute")
+	imageLinkBase := flag.String("image-link-base", "", "URL prefix for image links in place of the output directory, e.g. https://cdn.example.com/books")
+
 	outputDir := flag.String("output-dir", "", "output directory for batch conversion")
+	recursive := flag.Bool("recursive", true, "convert the books in subdirectories of a directory too (--recursive=false or --no-recursive: only the books directly in it)")
+	noRecursive := flag.Bool("no-recursive", false, "convert only the books directly in a directory (same as --max-depth 1)")
+	followSymlinks := flag.Bool("follow-symlinks", false, "in batch conversion, walk the directories symlinks point to, each directory once")
+	skipHidden := flag.Bool("skip-hidden", false, "in batch conversion, leave out the files and directories whose names start with a dot, such as .calibre")
+	maxDepth := flag.Int("max-depth", 0, "look for books at most `N` directory levels deep, 1 being the directory itself (0: no limit)")
+	var exclude patternList
+	flag.Var(&exclude, "exclude", "leave out the books and directories matching this glob `pattern` in batch conversion, e.g. _trash/ or '*sample*' (repeatable)")
+	skipExisting := flag.Bool("skip-existing", false, "in batch conversion, leave out the books whose output already exists")
+	newerOnly := flag.Bool("newer-only", false, "in batch conversion, convert only the books modified since their output was written")
+	index := flag.Bool("index", false, "in batch conversion, also write INDEX.md and index.json to the output directory, the converted books by author and series")
+	resume := flag.Bool("resume", false, "in batch conversion, leave out the books an interrupted run into the same output directory finished")
+	manifestPath := flag.String("manifest", "", "after batch conversion, write each book's source, output, title, authors, word and image counts and status to this JSON `file` (CSV if it ends in .csv)")
+	reportPath := flag.String("report", "", "after batch conversion, write a JSON `file` with each book's status, error, output and duration and the totals, for automated pipelines")
+	onConflict := flag.String("on-conflict", "overwrite", "what batch conversion does when two books get the same output name: overwrite, skip, rename (book_2.md, ...), error")
+	merge := flag.String("merge", "", "convert all the input files into this one `file`, each book under a top-level heading, e.g. the volumes of a series")
+	annotation := flag.String("annotation", "section", "how Markdown writes the book annotation: section (under an Annotation heading), blockquote, front-matter (description field), skip")
+	cover := flag.String("cover", "meta", "where the cover image goes: meta (front matter and EPUB cover), image (also first in the text, extracted even without -i), none")
+	nameTemplate := flag.String("name-template", "", "name output files from the book's metadata, e.g. \"{author} - {title}\"; fields: author, authors, title, series, series_number, year, lang, source")
 	flag.StringVar(outputDir, "o", "", "output directory for batch conversion (shorthand)")
 
+	readStdin := flag.Bool("stdin", false, "read the book from standard input (same as input \"-\")")
+	format := flag.String("format", "", "input format when reading from stdin: fb2, fb2.zip, fb3, epub, txt, tei, cbz (default: told by the content, else fb2)")
+
+	timeout := flag.Duration("timeout", 60*time.Second, "timeout for downloading http(s) inputs")
+	proxy := flag.String("proxy", "", "proxy URL for downloads (default: from HTTP_PROXY/HTTPS_PROXY)")
+
+	to := flag.String("to", "markdown", "output format: markdown, html, json, epub, bbcode, pandoc-json")
+	splitChapters := flag.Bool("split-chapters", false, "write each chapter to its own file, <output>-01, <output>-02, ... (markdown, bbcode)")
+	metadataJSON := flag.Bool("metadata-json", false, "also write the full book description to <output>.meta.json")
+	wrap := flag.Int("wrap", 0, "reflow Markdown paragraphs at `N` columns (0: one line per paragraph)")
+	noNormalize := flag.Bool("no-normalize", false, "keep runs of blank lines and empty sections instead of collapsing and dropping them")
+	renumberFootnotes := flag.Bool("renumber-footnotes", false, "number footnotes 1, 2, 3, ... in reading order instead of keeping the source ids")
+	encodingFlag := flag.String("encoding", "", "read FB2, TEI and text books in this encoding whatever they declare, e.g. cp1251 (default: the declared or detected one)")
+	assumeEncoding := flag.String("assume-encoding", "", "encoding of books that declare none or a wrong one, when detection cannot tell, e.g. windows-1251 (default: the best guess)")
+	lenient := flag.Bool("lenient", false, "repair malformed FB2 XML (unescaped &, stray <, unclosed or mismatched tags) instead of failing")
+	notesBodies := flag.String("notes-bodies", "notes,footnotes,comments", "comma-separated names of the FB2 bodies whose sections become footnotes, or none")
+	includeBodies := flag.String("include-bodies", "all", "comma-separated names of the other FB2 bodies to convert, \"main\" for the unnamed one; all converts every body")
+	diff := flag.Bool("diff", false, "convert in memory and print a unified diff against the existing output instead of overwriting it")
+	stats := flag.Bool("stats", false, "print word, character, chapter, footnote and image counts and the reading time of each book, with batch totals; also adds them to front matter")
+	numberHeadings := flag.Bool("number-headings", false, "prefix section headings with hierarchical numbers: 1, 1.1, 1.2, ...")
+	langSpans := flag.Bool("lang-spans", false, "wrap text marked with xml:lang in <span lang=\"...\"> (Pandoc: [text]{lang=...}) in Markdown")
+	typography := flag.String("typography", "", "punctuation rules, comma-separated: quotes=curly|straight, dashes, soft-hyphens, spaces, all (no-RULE turns one off)")
+	headerTemplate := flag.String("header-template", "", "Go text/template `file` for the Markdown metadata header")
+	dialectName := flag.String("dialect", "", "Markdown dialect: gfm (default), hugo (page bundle with front matter), jekyll, obsidian, pandoc, markua, commonmark")
+	metadataLevel := flag.String("metadata", "basic", "how much metadata Markdown writes: basic, full (adds translators, original, publisher, ISBN, file history), none")
+	genreNames := flag.String("genre-names", "en", "name FB2 genre codes such as sf_fantasy in: en, ru, raw (keep the codes)")
+	extraMetadata := flag.Bool("extra-metadata", false, "add FB2 keywords to the tags and write custom-info entries as metadata fields")
+	metadataFormat := flag.String("metadata-format", "header", "how Markdown shows book metadata: header, mmd (MultiMarkdown metadata block)")
+	noTables := flag.Bool("no-tables", false, "write tables as HTML")
+	noFootnoteSyntax := flag.Bool("no-footnote-syntax", false, "write footnotes as superscript links and a numbered list instead of [^id]")
+	noStrikethrough := flag.Bool("no-strikethrough", false, "write strikethrough as <del> instead of ~~")
+	poemStyle := flag.String("poem-style", "linebreaks", "how Markdown writes verse: linebreaks (trailing double spaces), blockquote (backslash breaks), codeblock (keeps indentation)")
+	epigraphStyle := flag.String("epigraph-style", "quote", "how epigraphs are written: quote, html (right-aligned italic div), callout (> [!quote]), none (left out)")
+	callouts := flag.Bool("callouts", false, "render epigraphs as > [!quote] callouts (same as --epigraph-style callout)")
+	permalink := flag.String("permalink", "", "permalink pattern for --dialect jekyll, e.g. /books/:slug/")
+
+	deterministic := flag.Bool("deterministic", true, "give the same input byte-identical output: no conversion timestamps (--deterministic=false writes them)")
+
+	stripGutenberg := flag.Bool("strip-gutenberg", false, "remove Project Gutenberg license boilerplate and take title/author from its header")
+
+	noProgress := flag.Bool("no-progress", false, "print a line for each book of a batch instead of a progress bar on a terminal")
+	quiet := flag.Bool("quiet", false, "do not print a line for each converted book; warnings and errors are still shown")
+	flag.BoolVar(quiet, "q", false, "do not print a line for each converted book (shorthand)")
+	verbose := flag.Bool("verbose", false, "also tell which parts of the books and which files were left out")
+	debug := flag.Bool("debug", false, "like --verbose, and also time reading and rendering each book")
+	flag.BoolVar(&noColor, "no-color", false, "do not color the per-book lines and the batch summary on a terminal (also set by the NO_COLOR environment variable)")
+	logFormat := flag.String("log-format", "text", "how messages are written to stderr: text, json (one JSON object a line for each message and each book started, image written and book done)")
+
 	showVersion := flag.Bool("version", false, "print version and exit")
 	flag.BoolVar(showVersion, "v", false, "print version (shorthand)")
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, `fb2md — convert FB2/EPUB ebooks to Markdown
+		fmt.Fprintf(os.Stderr, `fb2md — convert FB2/FB3/EPUB/TEI/TXT ebooks and CBZ comics to Markdown or HTML
 
 Usage:
   fb2md book.fb2                  convert to book.md in current directory
   fb2md book.fb2 output.md        convert to explicit output path
-  fb2md books/                    convert all fb2/epub files in directory
+  fb2md book.fb2.zip              convert a zipped FB2 without unpacking
+  fb2md books/                    convert all supported files in directory
   fb2md -o out/ books/            batch convert to specified directory
+  fb2md --no-recursive -o out/ library/
+                                  only the books directly in library/, not its subfolders
+  fb2md --max-depth 2 -o out/ library/
+                                  library/ and one level of subfolders
+  fb2md --exclude _trash/ --exclude '*sample*' -o out/ library/
+                                  skip the _trash folders and sample files
+  fb2md --follow-symlinks --skip-hidden -o out/ library/
+                                  walk symlinked folders once each, leave out .calibre and the like
+  fb2md --newer-only -o out/ library/
+                                  convert only the books added or changed since the last run
+  fb2md --resume -o out/ library/
+                                  go on with a batch that was interrupted
+  fb2md -o out/ '**/*.fb2' extra.epub
+                                  convert several inputs and patterns as one batch
+  fb2md -o out/ library.zip       batch convert every book inside a zip
+  fb2md -o out/ dump.tar.gz       batch convert books from a tar/tgz stream
+  fb2md --lenient broken.fb2      repair unescaped &, stray < and unclosed tags
+  fb2md --assume-encoding koi8-r old.fb2
+                                  read a file that declares no encoding as KOI8-R
+  fb2md --encoding cp1251 mislabeled.fb2
+                                  read a file as windows-1251 whatever it declares
+  fb2md -q -o out/ books/         batch convert without a line per book
+  fb2md --debug book.epub         show what was left out and how long each step took
+  fb2md --log-format json -o out/ books/ 2> events.ndjson
+                                  one JSON object a line for each message and book event
+  fb2md --include-bodies main --notes-bodies notes,comments book.fb2
+                                  main text only; notes and comments as footnotes
+  fb2md validate book.fb2         check the FB2 structure; exit 0 valid, 1 warnings, 2 errors
+  fb2md images --cover-only -o covers/ books/
+                                  write only the covers, covers/<book>.jpg, no Markdown
+  fb2md toc --json book.epub      print the chapter outline with word counts
   fb2md -i book.fb2               convert and extract images
+  fb2md -i --image-max-size 1200 comic.cbz
+                                  extract pages downscaled to 1200px
+  fb2md -i --image-link-base https://cdn.example.com/books -o out/ books/
+                                  link images as https://cdn.example.com/books/<book>_images/...
+  fb2md -i --rasterize-svg book.epub
+                                  extract SVG drawings as PNG (needs rsvg-convert)
+  fb2md --cover image book.fb2    show the cover first, in book_images/ even without -i
+  fb2md --images inline book.fb2  embed images as data URIs in book.md
+  fb2md book.fb2 -                write Markdown to stdout
+  fb2md - < book.fb2 > book.md    read from stdin, the format told by the content
+  fb2md https://host/book.fb2.zip download, convert, name after the title
+  fb2md --format epub - book.md   read an EPUB from stdin
+  fb2md --to html book.fb2        convert to a standalone book.html
+  fb2md --to json book.fb2 -      print the parsed document tree as JSON
+  fb2md --to epub book.fb2        build book.epub
+  fb2md --to pandoc-json book.fb2 - | pandoc -f json -o book.docx
+  fb2md --to bbcode --split-chapters book.fb2
+                                  forum posts: book.bbcode, book-01.bbcode, ...
+  fb2md --diff -o out/ books/     show what a reconversion would change in out/
+  fb2md --wrap 72 book.fb2        hard-wrap paragraphs at 72 columns
+  fb2md --number-headings book.fb2
+                                  numbered headings: 1 Chapter, 1.1 Section, ...
+  fb2md --renumber-footnotes book.fb2
+                                  notes as [^1], [^2], ... instead of [^n_142]
+  fb2md --stats -o out/ books/    word counts and reading time per book, totals at the end
+  fb2md --typography quotes=curly,dashes book.fb2
+                                  curly quotes and em dashes in the text
+  fb2md --poem-style codeblock book.fb2
+                                  verse in code blocks, indentation kept
+  fb2md --epigraph-style none --to epub book.fb2
+                                  leave the epigraphs out
+  fb2md --header-template head.tmpl book.fb2
+                                  write the metadata header from a Go template
+  fb2md --annotation front-matter book.fb2
+                                  annotation as a description field, no Annotation heading
+  fb2md --metadata full book.fb2  add publisher, ISBN, translators and file history
+  fb2md --genre-names ru book.fb2 genres as Russian names: Фэнтези, ...
+  fb2md --dialect hugo --extra-metadata -o content/ book.fb2
+                                  keywords as tags, custom-info as front matter
+  fb2md --name-template "{author}/{series} {series_number} - {title}" -o library/ books/
+                                  library/Author/Series 1 - Title.md
+  fb2md --on-conflict rename -o out/ books/
+                                  book.fb2 and book.epub -> book.md, book_2.md
+  fb2md --manifest out/manifest.json -o out/ books/
+                                  record source, output, title, author, words, images, status
+  fb2md --index -i -o library/ books/
+                                  library/INDEX.md: the books by author and series, with covers
+  fb2md --report report.json -o out/ inbox/
+                                  per-book status, errors and durations and the totals as JSON
+  fb2md --max-file-size 200M --timeout-per-file 2m -o out/ library/
+                                  skip huge books and give up on any taking over 2 minutes
+  fb2md --merge trilogy.md vol1.fb2 vol2.fb2 vol3.fb2
+                                  one file, a heading per volume, images in trilogy_images/
+  fb2md --metadata-json -o out/ books/
+                                  add out/<book>.meta.json for catalog tools
+  fb2md --dialect hugo -o content/books/ book.fb2
+                                  write a Hugo page bundle book/index.md
+  fb2md --dialect jekyll -o _posts/ book.fb2
+                                  Jekyll post with images in assets/img/book/
+  fb2md --dialect obsidian --callouts -o vault/Books/ books/
+                                  Obsidian notes with properties and ![[embeds]]
+  fb2md --split-chapters -o notes/ book.fb2
+                                  linked notes: book.md index, book-01.md, ...
+  fb2md --dialect gfm --no-tables book.fb2
+                                  GitHub Markdown with HTML tables
+  FB2MD_OUTPUT_DIR=out/ FB2MD_DIALECT=hugo fb2md books/
+                                  defaults from the environment, as in a container
+
+Flags may come before or after the file arguments; "--" ends them, for a
+file whose name starts with "-".
+
+Exit status: 0 success, 1 usage error, 2 some books of a batch failed,
+3 the book or every book failed, 4 unsupported format, 5 output not written,
+6 the book is DRM-protected.
 
-Flags must come before file arguments.
+Every flag takes its default from an FB2MD_ environment variable, named
+after its long form: FB2MD_OUTPUT_DIR for --output-dir, FB2MD_DIALECT for
+--dialect, FB2MD_QUIET=true for --quiet. A flag on the command line wins.
 
 Flags:
 `)
 		flag.PrintDefaults()
 	}
 
-	flag.Parse()
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err := applyEnv(flag.CommandLine); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	args := parseArgs(flag.CommandLine, os.Args[1:], &images)
+	if err := setLogFormat(strings.ToLower(*logFormat)); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	warnUnknownEnv(flag.CommandLine)
+	if os.Getenv("NO_COLOR") != "" {
+		noColor = true
+	}
 
 	if *showVersion {
 		fmt.Println("fb2md", version)
 		return
 	}
 
-	args := flag.Args()
+	switch {
+	case *quiet && (*verbose || *debug):
+		log.Fatalf("error: --quiet cannot be combined with --verbose or --debug")
+	case *quiet:
+		verbosity = levelQuiet
+	case *debug:
+		verbosity = levelDebug
+	case *verbose:
+		verbosity = levelVerbose
+	}
+	setLogger()
+
+	if *readStdin {
+		args = append([]string{"-"}, args...)
+	}
 	if len(args) == 0 {
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
 
 	input := args[0]
 
-	info, err := os.Stat(input)
+	opts := Options{
+		Options: fb2md.Options{
+			Logger:            logger,
+			ExtractImages:     images == "extract",
+			InlineImages:      images == "inline",
+			ImageMaxSize:      *imageMaxSize,
+			ImageQuality:      *imageQuality,
+			ImageLinkBase:     *imageLinkBase,
+			AllBinaries:       *allBinaries,
+			RasterizeSVG:      *rasterizeSVG,
+			ZipMaxSize:        int64(zipMaxSize),
+			MaxFileSize:       int64(maxFileSize),
+			TimeoutPerFile:    *timeoutPerFile,
+			ZipMaxEntries:     *zipMaxEntries,
+			ImagesDir:         *imagesDir,
+			StripGutenberg:    *stripGutenberg,
+			To:                strings.ToLower(*to),
+			SplitChapters:     *splitChapters,
+			MetadataJSON:      *metadataJSON,
+			Wrap:              *wrap,
+			NumberHeadings:    *numberHeadings,
+			RenumberFootnotes: *renumberFootnotes,
+			LangSpans:         *langSpans,
+			NoNormalize:       *noNormalize,
+			Dialect:           strings.ToLower(*dialectName),
+			EpigraphStyle:     strings.ToLower(*epigraphStyle),
+			PoemStyle:         strings.ToLower(*poemStyle),
+			MetadataLevel:     strings.ToLower(*metadataLevel),
+			MetadataFormat:    strings.ToLower(*metadataFormat),
+			GenreNames:        strings.ToLower(*genreNames),
+			ExtraMetadata:     *extraMetadata,
+			NoTables:          *noTables,
+			NoFootnoteSyntax:  *noFootnoteSyntax,
+			NoStrikethrough:   *noStrikethrough,
+			Permalink:         *permalink,
+			Timestamped:       !*deterministic,
+			Stats:             *stats,
+			NotesBodies:       bodyNames(*notesBodies),
+			Annotation:        strings.ToLower(*annotation),
+			Cover:             strings.ToLower(*cover),
+			Diff:              *diff,
+			Lenient:           *lenient,
+			AssumeEncoding:    *assumeEncoding,
+			Encoding:          *encodingFlag,
+		},
+		NameTemplate:   *nameTemplate,
+		NoProgress:     *noProgress,
+		MaxDepth:       *maxDepth,
+		FollowSymlinks: *followSymlinks,
+		SkipHidden:     *skipHidden,
+		Exclude:        exclude,
+		SkipExisting:   *skipExisting,
+		NewerOnly:      *newerOnly,
+		Resume:         *resume,
+		Index:          *index,
+	}
+	if opts.Stats {
+		opts.stats = &statsTotals{}
+	}
+	if !fb2md.IsOutputFormat(opts.To) {
+		log.Fatalf("error: unsupported output format: %s", *to)
+	}
+	if !fb2md.IsDialect(opts.Dialect) {
+		log.Fatalf("error: unsupported dialect: %s", *dialectName)
+	}
+	if opts.Dialect != "" && opts.OutputExt() != ".md" {
+		log.Fatalf("error: --dialect applies to Markdown output only")
+	}
+	if *headerTemplate != "" {
+		tmpl, err := fb2md.LoadHeaderTemplate(*headerTemplate)
+		if err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		opts.HeaderTemplate = tmpl
+	}
+	rules, err := fb2md.ParseTypography(*typography)
 	if err != nil {
-		log.Fatalf("error: %s: %v", input, err)
+		log.Fatalf("error: %v", err)
+	}
+	opts.Typography = rules
+	switch strings.ToLower(*imageLinks) {
+	case "relative":
+	case "absolute":
+		opts.AbsoluteImageLinks = true
+	default:
+		log.Fatalf("error: unsupported image link style: %s", *imageLinks)
+	}
+	if opts.ImageMaxSize < 0 {
+		log.Fatalf("error: --image-max-size must not be negative")
+	}
+	if opts.ImageQuality < 0 || opts.ImageQuality > 100 {
+		log.Fatalf("error: --image-quality must be between 1 and 100")
+	}
+	if opts.AssumeEncoding != "" {
+		if _, err := fb2md.LookupEncoding(opts.AssumeEncoding); err != nil {
+			log.Fatalf("error: --assume-encoding: %v", err)
+		}
+	}
+	if opts.Encoding != "" {
+		if _, err := fb2md.LookupEncoding(opts.Encoding); err != nil {
+			log.Fatalf("error: --encoding: %v", err)
+		}
+	}
+	if opts.RasterizeSVG {
+		if _, err := exec.LookPath(fb2md.SVGRasterizer); err != nil {
+			log.Fatalf("error: --rasterize-svg needs %s (librsvg) on the PATH", fb2md.SVGRasterizer)
+		}
+	}
+	if opts.InlineImages && opts.OutputExt() != ".md" {
+		log.Fatalf("error: --images inline applies to Markdown output only")
+	}
+	if opts.MaxDepth < 0 {
+		log.Fatalf("error: --max-depth must not be negative")
+	}
+	if !*recursive || *noRecursive {
+		if opts.MaxDepth > 1 {
+			log.Fatalf("error: --no-recursive cannot be combined with --max-depth %d", opts.MaxDepth)
+		}
+		opts.MaxDepth = 1
+	}
+	if opts.Wrap < 0 {
+		log.Fatalf("error: --wrap must not be negative")
+	}
+	if opts.Wrap > 0 && opts.OutputExt() != ".md" {
+		log.Fatalf("error: --wrap applies to Markdown output only")
+	}
+	if *callouts {
+		opts.EpigraphStyle = "callout"
+	}
+	switch opts.EpigraphStyle {
+	case "quote", "none":
+	case "html", "callout":
+		if opts.OutputExt() != ".md" {
+			log.Fatalf("error: --epigraph-style %s applies to Markdown output only", opts.EpigraphStyle)
+		}
+	default:
+		log.Fatalf("error: unsupported epigraph style: %s", *epigraphStyle)
+	}
+	switch opts.PoemStyle {
+	case "linebreaks":
+	case "blockquote", "codeblock":
+		if opts.OutputExt() != ".md" {
+			log.Fatalf("error: --poem-style applies to Markdown output only")
+		}
+	default:
+		log.Fatalf("error: unsupported poem style: %s", *poemStyle)
+	}
+	switch opts.MetadataLevel {
+	case "basic":
+	case "full", "none":
+		if opts.OutputExt() != ".md" {
+			log.Fatalf("error: --metadata applies to Markdown output only")
+		}
+	default:
+		log.Fatalf("error: unsupported metadata level: %s", *metadataLevel)
+	}
+	switch opts.GenreNames {
+	case "en", "ru", "raw":
+	default:
+		log.Fatalf("error: unsupported genre name language: %s", *genreNames)
+	}
+	if opts.Diff && len(args) == 2 && args[1] == fb2md.StdoutPath {
+		log.Fatalf("error: --diff needs an output file to compare with, not stdout")
+	}
+	switch opts.Annotation {
+	case "section", "skip":
+	case "blockquote", "front-matter":
+		if opts.OutputExt() != ".md" {
+			log.Fatalf("error: --annotation %s applies to Markdown output only", opts.Annotation)
+		}
+	default:
+		log.Fatalf("error: unsupported annotation style: %s", *annotation)
+	}
+	switch opts.Cover {
+	case "meta", "image", "none":
+	default:
+		log.Fatalf("error: unsupported cover placement: %s", *cover)
+	}
+	if !strings.EqualFold(*includeBodies, "all") {
+		opts.IncludeBodies = bodyNames(*includeBodies)
+	}
+	conflictMode := strings.ToLower(*onConflict)
+	switch conflictMode {
+	case "overwrite", "skip", "rename", "error":
+	default:
+		log.Fatalf("error: unsupported conflict strategy: %s", *onConflict)
+	}
+	// Several inputs, or an input where the output path would go, are
+	// converted together as one batch.
+	batchInputs := len(args) > 2 || len(args) == 2 && isBatchInput(args[1], opts)
+	if opts.NameTemplate != "" {
+		if err := checkNameTemplate(opts.NameTemplate); err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		if len(args) >= 2 && !batchInputs {
+			// An explicit output path wins over the template.
+			opts.NameTemplate = ""
+		}
+	}
+	switch opts.MetadataFormat {
+	case "header":
+	case "mmd":
+		if fb2md.DialectFrontMatter(opts.Dialect) {
+			log.Fatalf("error: --dialect %s writes front matter; it cannot be combined with --metadata-format mmd", opts.Dialect)
+		}
+	default:
+		log.Fatalf("error: unsupported metadata format: %s", *metadataFormat)
+	}
+
+	if *merge != "" {
+		if err := mergeBooks(args, *merge, opts); err != nil {
+			fatalConversion(err)
+		}
+		reportConverted(fmt.Sprintf("%d books", len(args)), *merge, opts)
+		return
+	}
+
+	if batchInputs {
+		runBatch(args, *outputDir, *manifestPath, *reportPath, conflictMode, opts)
+		return
 	}
 
-	if info.IsDir() {
-		dir := *outputDir
-		if dir == "" {
-			dir = "."
+	if input == "-" {
+		output := fb2md.StdoutPath
+		if len(args) >= 2 {
+			output = args[1]
 		}
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			log.Fatalf("error: cannot create output directory: %v", err)
+		if output == fb2md.StdoutPath && opts.ImagesDir == "" {
+			opts.ImagesDir = "stdin_images"
 		}
-		n, err := convertDirectory(input, dir, *images, *imagesDir)
+		var r io.Reader = os.Stdin
+		inputFormat := strings.ToLower(*format)
+		if inputFormat == "" {
+			r, inputFormat = stdinFormat(os.Stdin, opts.MaxFileSize)
+		}
+		started := beginBook("stdin", opts)
+		err := flagError(fb2md.Convert(r, inputFormat, output, opts.book()))
+		finishBook("stdin", output, started, err, opts)
 		if err != nil {
-			log.Fatalf("error: %v", err)
+			fatalConversion(err)
+		}
+		if output != fb2md.StdoutPath || opts.stats != nil {
+			reportConverted("stdin", output, opts)
+		}
+		return
+	}
+
+	if isURL(input) {
+		d, err := fetchURL(input, *timeout, *proxy)
+		if err != nil {
+			fatalConversion(fmt.Errorf("%s: %w", input, err))
+		}
+
+		output := ""
+		if len(args) >= 2 {
+			output = args[1]
+		} else {
+			base := titleToFilename(bookTitle(d.data, d.format, opts))
+			if base == "" {
+				base = trimBookExt(d.filename)
+			}
+			if *outputDir != "" {
+				if err := os.MkdirAll(*outputDir, 0755); err != nil {
+					fatalf(exitOutputError, "error: cannot create output directory: %v", err)
+				}
+				base = filepath.Join(*outputDir, base)
+			}
+			output = opts.OutputName(base)
+			if output, err = templatedOutput(d.data, d.format, output, opts); err != nil {
+				fatalConversion(err)
+			}
+		}
+
+		started := beginBook(input, opts)
+		err = flagError(fb2md.Convert(bytes.NewReader(d.data), d.format, output, opts.book()))
+		finishBook(input, output, started, err, opts)
+		if err != nil {
+			fatalConversion(err)
+		}
+		reportConverted(input, output, opts)
+		return
+	}
+
+	info, err := os.Stat(input)
+	if err != nil && isGlob(input) {
+		runBatch(args[:1], *outputDir, *manifestPath, *reportPath, conflictMode, opts)
+		return
+	}
+	if err != nil {
+		fatalConversion(fmt.Errorf("%s: %w", input, err))
+	}
+
+	zipLibrary := false
+	if !info.IsDir() && pathFormat(input) == "fb2.zip" && len(args) < 2 {
+		zipLibrary, err = isZipLibrary(input)
+		if err != nil {
+			fatalConversion(fmt.Errorf("%s: %w", input, err))
 		}
-		fmt.Printf("converted %d file(s)\n", n)
+	}
+
+	tarArchive := !info.IsDir() && isTarArchive(input)
+
+	if info.IsDir() || zipLibrary || tarArchive {
+		runBatch(args[:1], *outputDir, *manifestPath, *reportPath, conflictMode, opts)
 		return
 	}
 
@@ -84,87 +620,159 @@ Flags:
 	if len(args) >= 2 {
 		output = args[1]
 	} else {
-		base := strings.TrimSuffix(filepath.Base(input), filepath.Ext(input))
+		base := trimBookExt(filepath.Base(input))
 		if *outputDir != "" {
 			if err := os.MkdirAll(*outputDir, 0755); err != nil {
-				log.Fatalf("error: cannot create output directory: %v", err)
+				fatalf(exitOutputError, "error: cannot create output directory: %v", err)
 			}
-			output = filepath.Join(*outputDir, base+".md")
+			output = filepath.Join(*outputDir, opts.OutputName(base))
 		} else {
-			output = base + ".md"
+			output = opts.OutputName(base)
 		}
 	}
 
-	if err := convertFile(input, output, *images, *imagesDir); err != nil {
-		log.Fatalf("error: %v", err)
+	if output == fb2md.StdoutPath && opts.ImagesDir == "" {
+		opts.ImagesDir = trimBookExt(filepath.Base(input)) + "_images"
+	}
+
+	started := beginBook(input, opts)
+	output, err = convertFile(input, output, opts)
+	finishBook(input, output, started, err, opts)
+	if err != nil {
+		fatalConversion(err)
 	}
-	fmt.Printf("%s -> %s\n", input, output)
+	reportConverted(input, output, opts)
 }
 
-func convertFile(input, output string, extractImages bool, imagesDir string) error {
-	ext := strings.ToLower(filepath.Ext(input))
+// fatalConversion reports the error a conversion failed with and exits
+// with its exitStatus.
+func fatalConversion(err error) {
+	fatalf(exitStatus(err), "error: %v", err)
+}
 
-	outDir := filepath.Dir(output)
-	if outDir != "." {
-		info, err := os.Stat(outDir)
-		if err != nil {
-			if os.IsNotExist(err) {
-				return fmt.Errorf("output directory does not exist: %s", outDir)
-			}
-			return fmt.Errorf("cannot access output directory %s: %w", outDir, err)
+// parseArgs parses the flags of fs wherever they are among the file
+// arguments in args, and returns the file arguments: "fb2md book.fb2 -i"
+// extracts images as "fb2md -i book.fb2" does. Everything after "--" is a
+// file argument. images is the --images flag of fs, if it has one.
+func parseArgs(fs *flag.FlagSet, args []string, images *imagesMode) []string {
+	var files []string
+	for {
+		parseFlags(fs, args)
+		rest := fs.Args()
+		parsed := args[:len(args)-len(rest)]
+		last := ""
+		if len(parsed) > 0 {
+			last = parsed[len(parsed)-1]
+		}
+		if last == "--" {
+			return append(files, rest...)
+		}
+		if len(rest) == 0 {
+			return files
 		}
-		if !info.IsDir() {
-			return fmt.Errorf("output directory is not a directory: %s", outDir)
+		// --images is a boolean-style flag, so "--images inline" leaves the
+		// mode as an argument of its own.
+		name := strings.TrimLeft(last, "-")
+		if images != nil && rest[0] == "inline" && *images == "extract" && (name == "images" || name == "i") {
+			if _, err := os.Stat(rest[0]); err != nil {
+				*images = "inline"
+				args = rest[1:]
+				continue
+			}
 		}
+		files = append(files, rest[0])
+		args = rest[1:]
 	}
+}
 
-	switch ext {
-	case ".fb2":
-		converter := NewConverter()
-		if extractImages && imagesDir == "" {
-			imagesDir = strings.TrimSuffix(output, filepath.Ext(output)) + "_images"
-		}
-		return converter.Convert(input, output, extractImages, imagesDir)
-	case ".epub":
-		converter := NewEpubConverter()
-		return converter.Convert(input, output)
-	default:
-		return fmt.Errorf("unsupported format: %s", ext)
+// parseFlags parses the flags of fs in args, exiting with exitUsage on a
+// bad one rather than the flag package's 2.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	switch err := fs.Parse(args); {
+	case err == flag.ErrHelp:
+		os.Exit(0)
+	case err != nil:
+		os.Exit(exitUsage)
 	}
 }
 
-func convertDirectory(dir, outputDir string, extractImages bool, imagesDir string) (int, error) {
-	var count int
+// readBook reads the book at input into the document tree without
+// rendering it, for the subcommands that look into books.
+func readBook(input string, opts Options) (*fb2md.Book, error) {
+	f, err := os.Open(input)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
-	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if d.IsDir() {
-			return nil
-		}
+	// --diff keeps the pages of a comic from being written.
+	opts.Diff = true
+	opts.Logger = logger
+	book, err := fb2md.Read(f, fileFormat(f), fb2md.StdoutPath, opts.Options)
+	return book, flagError(err)
+}
 
-		ext := strings.ToLower(filepath.Ext(path))
-		if ext != ".fb2" && ext != ".epub" {
-			return nil
+// convertFile converts the book at input and returns the path it was
+// written to, which --name-template may have changed from output.
+func convertFile(input, output string, opts Options) (string, error) {
+	f, err := os.Open(input)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil {
+		if err := fb2md.CheckSize(info.Size(), opts.Options); err != nil {
+			return "", flagError(err)
 		}
+	}
 
-		rel, err := filepath.Rel(dir, path)
-		if err != nil {
-			rel = filepath.Base(path)
+	format := fileFormat(f)
+	r, output, err := nameFromTemplate(f, format, output, opts)
+	if err != nil {
+		return "", err
+	}
+	if output, err = opts.outputs.claim(output, opts); err != nil {
+		return "", err
+	}
+	if info, err := f.Stat(); err == nil {
+		if err := opts.outputs.current(input, output, info.ModTime()); err != nil {
+			return output, err
 		}
-		base := strings.TrimSuffix(rel, filepath.Ext(rel))
-		safeName := strings.ReplaceAll(base, string(filepath.Separator), "_")
-		outPath := filepath.Join(outputDir, safeName+".md")
+	}
+	if sameFile(input, output) {
+		return "", &fb2md.OutputError{Err: fmt.Errorf("output %s would overwrite the input", output)}
+	}
+	return output, flagError(fb2md.Convert(r, format, output, opts.book()))
+}
+
+func sameFile(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+// tooDeep reports whether the books in the subdirectory path of root are
+// below maxDepth levels, counting root's own files as level 1; 0 means no
+// limit.
+func tooDeep(root, path string, maxDepth int) bool {
+	if maxDepth <= 0 || path == root {
+		return false
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return strings.Count(rel, string(filepath.Separator))+1 >= maxDepth
+}
 
-		if err := convertFile(path, outPath, extractImages, imagesDir); err != nil {
-			log.Printf("warning: %s: %v", path, err)
-			return nil
+func convertDirectory(dir, outputDir string, opts Options) (int, error) {
+	var count int
+	err := walkBooks(dir, opts, true, func(path, rel string) error {
+		ok, err := convertBatchFile(path, batchOutput(rel, outputDir, opts), opts)
+		if ok {
+			count++
 		}
-		fmt.Printf("%s -> %s\n", path, outPath)
-		count++
-		return nil
+		return err
 	})
-
 	return count, err
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lexoprom/fb2md-cli/fb2md"
+)
+
+// manifest records the books of a batch conversion for --manifest,
+// --report and --index: where each came from, where it went and what it
+// holds.
+type manifest struct {
+	path    string
+	entries []manifestEntry
+}
+
+type manifestEntry struct {
+	Source  string   `json:"source"`
+	Output  string   `json:"output,omitempty"`
+	Title   string   `json:"title,omitempty"`
+	Authors []string `json:"authors,omitempty"`
+	Words   int      `json:"words"`
+	Images  int      `json:"images"`
+	// Status is "converted", "up-to-date", "skipped", "drm-protected",
+	// "too-large", "timed-out" or "failed".
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	started  time.Time
+	duration time.Duration
+	// series and cover, the path of the extracted cover image, are kept
+	// for --index.
+	series []fb2md.Sequence
+	cover  string
+}
+
+// newManifest returns a manifest written to path, or only kept for the
+// report when path is "".
+func newManifest(path string) *manifest {
+	return &manifest{path: path}
+}
+
+// begin starts the entry for the book read from source. A nil manifest
+// records nothing.
+func (m *manifest) begin(source string) {
+	if m != nil {
+		m.entries = append(m.entries, manifestEntry{Source: source, started: time.Now()})
+	}
+}
+
+// describe fills the current entry in from the converted book.
+func (m *manifest) describe(book *fb2md.Book, stats fb2md.BookStats) {
+	if m == nil || len(m.entries) == 0 {
+		return
+	}
+	e := &m.entries[len(m.entries)-1]
+	if book.Meta != nil {
+		e.Title = book.Meta.Title
+		e.Authors = book.Meta.AuthorNames()
+		e.series = book.Meta.Sequences
+	}
+	e.Words = stats.Words
+	e.Images = stats.Images
+}
+
+// coverAt records path as where the cover of the current book was
+// extracted.
+func (m *manifest) coverAt(path string) {
+	if m != nil && len(m.entries) > 0 {
+		m.entries[len(m.entries)-1].cover = path
+	}
+}
+
+// finish records the outcome of converting the current book.
+func (m *manifest) finish(output string, err error) {
+	if m == nil || len(m.entries) == 0 {
+		return
+	}
+	e := &m.entries[len(m.entries)-1]
+	e.duration = time.Since(e.started)
+	e.Status = bookStatus(err)
+	switch {
+	case err == nil, errors.Is(err, errUpToDate):
+		e.Output = output
+	default:
+		e.Error = err.Error()
+	}
+}
+
+// bookStatus returns the manifest status of a book converted with err.
+func bookStatus(err error) string {
+	switch {
+	case err == nil:
+		return "converted"
+	case errors.Is(err, errUpToDate):
+		return "up-to-date"
+	case errors.Is(err, errOutputConflict):
+		return "skipped"
+	case errors.Is(err, fb2md.ErrDRMProtected):
+		return "drm-protected"
+	case errors.Is(err, fb2md.ErrTooLarge):
+		return "too-large"
+	case errors.Is(err, fb2md.ErrTimedOut):
+		return "timed-out"
+	default:
+		return "failed"
+	}
+}
+
+// write saves the manifest as CSV when its path ends in .csv, and as JSON
+// otherwise.
+func (m *manifest) write() error {
+	if m == nil || m.path == "" {
+		return nil
+	}
+	var data []byte
+	if strings.HasSuffix(strings.ToLower(m.path), ".csv") {
+		var b strings.Builder
+		w := csv.NewWriter(&b)
+		w.Write([]string{"source", "output", "title", "authors", "words", "images", "status", "error"})
+		for _, e := range m.entries {
+			w.Write([]string{e.Source, e.Output, e.Title, strings.Join(e.Authors, "; "),
+				strconv.Itoa(e.Words), strconv.Itoa(e.Images), e.Status, e.Error})
+		}
+		w.Flush()
+		data = []byte(b.String())
+	} else {
+		entries := m.entries
+		if entries == nil {
+			entries = []manifestEntry{}
+		}
+		var err error
+		data, err = json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode manifest: %w", err)
+		}
+		data = append(data, '\n')
+	}
+	if err := os.WriteFile(m.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
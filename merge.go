@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/lexoprom/fb2md-cli/fb2md"
+)
+
+// mergeBooks converts each of inputs and writes them to output as one
+// book, each under a top-level heading of its own title. Images of all the
+// books share output's images directory.
+func mergeBooks(inputs []string, output string, opts Options) error {
+	var books []*fb2md.Book
+	var titles []string
+	for i, input := range inputs {
+		if input == "-" || isURL(input) {
+			return fmt.Errorf("--merge reads local files only: %s", input)
+		}
+		format := pathFormat(input)
+		if !fb2md.Readable(format) {
+			return fmt.Errorf("%s: %w", input, fb2md.ErrUnsupportedFormat)
+		}
+		bookOpts := opts.Options
+		if format == "cbz" {
+			// Comic pages are written while reading; keep each book's
+			// pages apart so their names cannot collide.
+			bookOpts.ImagesDir = filepath.Join(mergeImagesDir(output, opts), fmt.Sprintf("%02d", i+1))
+		}
+		f, err := os.Open(input)
+		if err != nil {
+			return fmt.Errorf("failed to open input file: %w", err)
+		}
+		book, err := fb2md.Read(f, format, output, bookOpts)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", input, flagError(err))
+		}
+		books = append(books, book)
+		titles = append(titles, trimBookExt(filepath.Base(input)))
+	}
+
+	book := mergedBook(books, titles)
+	if output == fb2md.StdoutPath {
+		opts.ImagesDir = mergeImagesDir(output, opts)
+	}
+	return fb2md.Write(book, output, opts.book())
+}
+
+// mergeImagesDir returns the images directory of the merged book.
+func mergeImagesDir(output string, opts Options) string {
+	switch {
+	case opts.ImagesDir != "":
+		return opts.ImagesDir
+	case output == fb2md.StdoutPath:
+		return "merged_images"
+	}
+	return strings.TrimSuffix(output, filepath.Ext(output)) + "_images"
+}
+
+// mergedBook joins books into one. Each book becomes a section titled by
+// its own title, or by fallback when it has none; ids a later book shares
+// with an earlier one are given a "-N" suffix, N being the book's number.
+func mergedBook(books []*fb2md.Book, fallbacks []string) *fb2md.Book {
+	merged := &fb2md.Book{Footnotes: make(map[string]*fb2md.Footnote)}
+	taken := make(map[string]bool)
+	var meta []*fb2md.Metadata
+	var titles []string
+	for i, book := range books {
+		renameBookIDs(book, i+1, taken)
+
+		title := fallbacks[i]
+		section := &fb2md.Section{Blocks: nestBlocks(book.Body)}
+		meta = append(meta, book.Meta)
+		if book.Meta != nil {
+			if book.Meta.Title != "" {
+				title = book.Meta.Title
+			}
+			section.Annotation = book.Meta.Annotation
+		}
+		section.Title = title
+		titles = append(titles, title)
+		merged.Body = append(merged.Body, section)
+		for id, note := range book.Footnotes {
+			merged.Footnotes[id] = note
+		}
+		merged.Binaries = append(merged.Binaries, book.Binaries...)
+	}
+	merged.Meta = mergedMetadata(meta, titles)
+	return merged
+}
+
+// nestBlocks moves the body of a book one level down, below the heading
+// it gets in the merged book: headings with an explicit level are
+// demoted to start at level 3 and body titles become subtitles.
+func nestBlocks(blocks []fb2md.Block) []fb2md.Block {
+	var headings []*fb2md.Heading
+	top := 6
+	fb2md.WalkBlocks(blocks, func(node any) {
+		if h, ok := node.(*fb2md.Heading); ok {
+			headings = append(headings, h)
+			top = min(top, h.Level)
+		}
+	})
+	for _, h := range headings {
+		h.Level = min(h.Level+max(3-top, 0), 6)
+	}
+	for i, b := range blocks {
+		if bt, ok := b.(*fb2md.BodyTitle); ok {
+			blocks[i] = &fb2md.Subtitle{Inlines: []fb2md.Inline{&fb2md.Text{Value: bt.Text}}}
+		}
+	}
+	return blocks
+}
+
+// mergedMetadata describes the merged book: titled by the series all the
+// books belong to, else by titles joined, with the authors and
+// genres of all of them and the cover and language of the first. books
+// has a nil entry for each book without a description.
+func mergedMetadata(books []*fb2md.Metadata, titles []string) *fb2md.Metadata {
+	first := books[0]
+	if first == nil {
+		first = &fb2md.Metadata{}
+	}
+	meta := &fb2md.Metadata{Lang: first.Lang, Cover: first.Cover}
+	series := ""
+	if len(first.Sequences) > 0 {
+		series = first.Sequences[0].Name
+	}
+	for _, m := range books {
+		if m == nil {
+			series = ""
+			continue
+		}
+		if len(m.Sequences) == 0 || m.Sequences[0].Name != series {
+			series = ""
+		}
+		for _, author := range m.Authors {
+			if !slices.Contains(meta.AuthorNames(), author.Name()) {
+				meta.Authors = append(meta.Authors, author)
+			}
+		}
+		for _, genre := range m.Genres {
+			if !slices.Contains(meta.Genres, genre) {
+				meta.Genres = append(meta.Genres, genre)
+			}
+		}
+	}
+	if series != "" {
+		meta.Title = series
+		meta.Sequences = []fb2md.Sequence{{Name: series}}
+	} else {
+		meta.Title = strings.Join(titles, " / ")
+	}
+	return meta
+}
+
+// renameBookIDs gives the footnotes, binaries and anchors of book that
+// clash with taken ids new ones suffixed "-n", updates every reference to
+// them, and adds the book's ids to taken.
+func renameBookIDs(book *fb2md.Book, n int, taken map[string]bool) {
+	var ids []string
+	defined := func(node any) {
+		switch node := node.(type) {
+		case *fb2md.Section:
+			ids = append(ids, node.ID)
+		case *fb2md.Paragraph:
+			ids = append(ids, node.ID)
+		}
+	}
+	if book.Meta != nil {
+		fb2md.WalkBlocks(book.Meta.Annotation, defined)
+	}
+	fb2md.WalkBlocks(book.Body, defined)
+	for id := range book.Footnotes {
+		ids = append(ids, id)
+	}
+	for _, bin := range book.Binaries {
+		ids = append(ids, bin.ID)
+	}
+
+	// The ids that clash are renamed once the others are taken, so that a
+	// new id cannot be one the book defines itself.
+	renamed := make(map[string]string)
+	var clashing []string
+	for _, id := range ids {
+		if _, done := renamed[id]; done || id == "" {
+			continue
+		}
+		renamed[id] = id
+		if taken[id] {
+			clashing = append(clashing, id)
+		}
+	}
+	for id := range renamed {
+		if !slices.Contains(clashing, id) {
+			taken[id] = true
+		}
+	}
+	for _, id := range clashing {
+		// The suffix goes before an extension, keeping image names usable.
+		ext := filepath.Ext(id)
+		newID := id
+		for suffix := n; taken[newID]; suffix++ {
+			newID = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(id, ext), suffix, ext)
+		}
+		renamed[id] = newID
+		taken[newID] = true
+	}
+
+	rename := func(id string) string {
+		if newID, ok := renamed[id]; ok {
+			return newID
+		}
+		return id
+	}
+	refs := func(node any) {
+		switch node := node.(type) {
+		case *fb2md.Section:
+			node.ID = rename(node.ID)
+		case *fb2md.Paragraph:
+			node.ID = rename(node.ID)
+		case *fb2md.Image:
+			node.ID = rename(node.ID)
+		case *fb2md.NoteRef:
+			node.ID = rename(node.ID)
+		case *fb2md.Link:
+			if id, ok := strings.CutPrefix(node.Href, "#"); ok {
+				node.Href = "#" + rename(id)
+			}
+		}
+	}
+	if book.Meta != nil {
+		book.Meta.Cover = rename(book.Meta.Cover)
+		fb2md.WalkBlocks(book.Meta.Annotation, refs)
+	}
+	fb2md.WalkBlocks(book.Body, refs)
+	notes := make(map[string]*fb2md.Footnote, len(book.Footnotes))
+	for id, note := range book.Footnotes {
+		fb2md.WalkInlines(note.Content, refs)
+		note.ID = rename(note.ID)
+		notes[rename(id)] = note
+	}
+	book.Footnotes = notes
+	for i := range book.Binaries {
+		book.Binaries[i].ID = rename(book.Binaries[i].ID)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/lexoprom/fb2md-cli/fb2md"
+)
+
+var (
+	nameFieldRe = regexp.MustCompile(`\{(\w+)\}`)
+	yearRe      = regexp.MustCompile(`^\d{4}`)
+)
+
+// nameFields lists the --name-template fields.
+var nameFields = map[string]bool{
+	"author":        true,
+	"authors":       true,
+	"title":         true,
+	"series":        true,
+	"series_number": true,
+	"year":          true,
+	"lang":          true,
+	"source":        true,
+}
+
+// checkNameTemplate reports a --name-template that uses unknown fields.
+func checkNameTemplate(tmpl string) error {
+	for _, m := range nameFieldRe.FindAllStringSubmatch(tmpl, -1) {
+		if !nameFields[m[1]] {
+			return fmt.Errorf("unknown --name-template field {%s}", m[1])
+		}
+	}
+	if strings.TrimSpace(tmpl) == "" || filepath.IsAbs(tmpl) {
+		return fmt.Errorf("--name-template must be a relative file name")
+	}
+	return nil
+}
+
+// expandNameTemplate fills in tmpl from meta. Field values are made safe
+// for file names; a "/" in the template itself starts a subdirectory. It
+// returns "" when the template yields no name.
+func expandNameTemplate(tmpl string, meta *fb2md.Metadata, source string) string {
+	if meta == nil {
+		meta = &fb2md.Metadata{}
+	}
+	values := map[string]string{
+		"title":  meta.Title,
+		"lang":   meta.Lang,
+		"source": source,
+	}
+	if len(meta.Authors) > 0 {
+		values["author"] = meta.Authors[0].Name()
+		values["authors"] = strings.Join(meta.AuthorNames(), ", ")
+	}
+	if len(meta.Sequences) > 0 {
+		values["series"] = meta.Sequences[0].Name
+		values["series_number"] = meta.Sequences[0].Number
+	}
+	values["year"] = bookYear(meta)
+
+	var filled bool
+	name := nameFieldRe.ReplaceAllStringFunc(tmpl, func(field string) string {
+		value := titleToFilename(values[field[1:len(field)-1]])
+		filled = filled || value != "" && field != "{source}"
+		return value
+	})
+	if !filled && strings.Contains(tmpl, "{") {
+		return ""
+	}
+
+	var parts []string
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		// Brackets and separators around fields the book has no value
+		// for are dropped.
+		part = strings.NewReplacer("()", "", "[]", "").Replace(part)
+		part = strings.Trim(strings.Join(strings.Fields(part), " "), " -_.,")
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return filepath.Join(parts...)
+}
+
+// bookYear returns the year the book was written or, failing that, printed.
+func bookYear(meta *fb2md.Metadata) string {
+	if m := yearRe.FindString(meta.ISODate()); m != "" {
+		return m
+	}
+	if m := yearRe.FindString(strings.TrimSpace(meta.Date)); m != "" {
+		return m
+	}
+	if meta.Publish != nil {
+		return yearRe.FindString(strings.TrimSpace(meta.Publish.Year))
+	}
+	return ""
+}
+
+// templatedOutput returns the output path --name-template gives a book read
+// from data: output with its base name replaced by the expanded template.
+// output is returned unchanged when no template is set or the book has no
+// metadata to fill it.
+func templatedOutput(data []byte, format, output string, opts Options) (string, error) {
+	if opts.NameTemplate == "" || output == fb2md.StdoutPath {
+		return output, nil
+	}
+	dir := filepath.Dir(output)
+	source := strings.TrimSuffix(filepath.Base(output), filepath.Ext(output))
+	if opts.PageBundle() {
+		// Page bundles are named by their directory.
+		source = filepath.Base(dir)
+		dir = filepath.Dir(dir)
+	}
+	name := expandNameTemplate(opts.NameTemplate, fb2md.ReadMetadata(data, format, opts.Options), source)
+	if name == "" {
+		return output, nil
+	}
+	output = filepath.Join(dir, opts.OutputName(name))
+	if opts.Diff {
+		return output, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		return "", &fb2md.OutputError{Err: fmt.Errorf("cannot create output directory: %w", err)}
+	}
+	return output, nil
+}
+
+// nameFromTemplate reads the book from r when --name-template is set and
+// returns a reader over the same data along with the templated output path.
+func nameFromTemplate(r io.Reader, format, output string, opts Options) (io.Reader, string, error) {
+	if opts.NameTemplate == "" || output == fb2md.StdoutPath {
+		return r, output, nil
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+	output, err = templatedOutput(data, format, output, opts)
+	return bytes.NewReader(data), output, err
+}
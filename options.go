@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/lexoprom/fb2md-cli/fb2md"
+)
+
+// Options controls a conversion of the command line: the conversion of
+// each book, which fb2md.Options holds, and how batches find their books
+// and name their outputs.
+type Options struct {
+	fb2md.Options
+	// NameTemplate, when set, names output files from the book's metadata,
+	// e.g. "{author} - {title}"; see expandNameTemplate.
+	NameTemplate string
+	// MaxDepth limits how deep batch conversion looks for books in a
+	// directory: 1 converts only the books directly in it; 0 means no
+	// limit.
+	MaxDepth int
+	// FollowSymlinks walks the directories symlinks point to in batch
+	// conversion; SkipHidden leaves out the files and directories whose
+	// names start with a dot.
+	FollowSymlinks bool
+	SkipHidden     bool
+	// SkipExisting leaves out of batch conversion the books whose output
+	// already exists; NewerOnly only those whose output is no older than
+	// the book.
+	SkipExisting bool
+	NewerOnly    bool
+	// Index writes INDEX.md and index.json, a catalog of the books of a
+	// batch conversion, to the output directory.
+	Index bool
+	// Resume leaves out of batch conversion the books an interrupted run
+	// into the same output directory finished; see resumeFile.
+	Resume bool
+	// Exclude lists the patterns of books and directories batch
+	// conversion leaves out; see excluded.
+	Exclude []string
+	// NoProgress prints a line for each book of a batch conversion on a
+	// terminal instead of a progress bar.
+	NoProgress bool
+	// stats, set with --stats, collects the statistics of converted books.
+	stats *statsTotals
+	// outputs, set for batch conversions, resolves books that are given
+	// the same output path.
+	outputs *outputSet
+	// manifest, set for batch conversions with --manifest, records each
+	// book converted.
+	manifest *manifest
+	// progress, set for batch conversions on a terminal, shows how far
+	// the batch is.
+	progress *progress
+	// resume, set for batch conversions, records the books finished for
+	// --resume.
+	resume *resumeState
+}
+
+// book returns the options a book of the conversion is converted with,
+// which report its statistics and cover to --stats and the manifest.
+func (o Options) book() fb2md.Options {
+	opts := o.Options
+	if o.stats != nil || o.manifest != nil {
+		opts.OnBook = func(book *fb2md.Book, stats fb2md.BookStats) {
+			o.stats.record(stats)
+			o.manifest.describe(book, stats)
+		}
+	}
+	if o.manifest != nil {
+		opts.OnCover = o.manifest.coverAt
+	}
+	return opts
+}
+
+// bodyNames parses a comma-separated --notes-bodies or --include-bodies
+// list; "none" gives an empty list.
+func bodyNames(list string) []string {
+	names := []string{}
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" && !strings.EqualFold(name, "none") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// imagesMode is the value of --images. The bare flag extracts images to
+// files; "inline" embeds them as data URIs.
+type imagesMode string
+
+func (m *imagesMode) String() string {
+	if m == nil {
+		return ""
+	}
+	return string(*m)
+}
+
+func (m *imagesMode) Set(s string) error {
+	switch strings.ToLower(s) {
+	case "true", "extract":
+		*m = "extract"
+	case "false", "none":
+		*m = ""
+	case "inline":
+		*m = "inline"
+	default:
+		return fmt.Errorf("unsupported images mode: %s", s)
+	}
+	return nil
+}
+
+func (m *imagesMode) IsBoolFlag() bool { return true }
+
+// patternList is the value of a repeatable pattern flag such as --exclude.
+type patternList []string
+
+func (l *patternList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *patternList) Set(s string) error {
+	for _, part := range strings.Split(strings.Trim(s, "/"), "/") {
+		if _, err := path.Match(part, ""); err != nil {
+			return fmt.Errorf("invalid pattern: %s", s)
+		}
+	}
+	*l = append(*l, s)
+	return nil
+}
+
+// byteSize is the value of a size flag: a number of bytes with an optional
+// K, M or G suffix (KB, MB, GB and KiB, ... are read the same, as powers of
+// 1024).
+type byteSize int64
+
+func (b *byteSize) String() string {
+	if b == nil {
+		return ""
+	}
+	return fb2md.FormatByteSize(int64(*b))
+}
+
+func (b *byteSize) Set(s string) error {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+	unit := int64(1)
+	if value != "" {
+		switch value[len(value)-1] {
+		case 'K':
+			unit = 1 << 10
+		case 'M':
+			unit = 1 << 20
+		case 'G':
+			unit = 1 << 30
+		}
+		if unit > 1 {
+			value = value[:len(value)-1]
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size: %s", s)
+	}
+	*b = byteSize(n * unit)
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lexoprom/fb2md-cli/fb2md"
+)
+
+// errOutputConflict is returned for a book whose output another book in the
+// same batch has already been written to, under --on-conflict skip or error.
+var errOutputConflict = errors.New("output already written by another book")
+
+// errUpToDate is returned for a book whose output is left as it is under
+// --skip-existing or --newer-only.
+var errUpToDate = errors.New("output is up to date")
+
+// outputSet tracks the outputs a batch conversion has written, so that two
+// books given the same output name are handled as --on-conflict says:
+// "overwrite", "skip", "rename" or "error". With --skip-existing or
+// --newer-only it also leaves out the books converted by an earlier run,
+// and with --resume those an interrupted run finished.
+type outputSet struct {
+	mode         string
+	seen         map[string]bool
+	collisions   int
+	skipExisting bool
+	newerOnly    bool
+	upToDate     int
+	// resumed holds the sources an interrupted run finished, under
+	// --resume.
+	resumed map[string]bool
+	// failures lists the books that could not be converted, with why.
+	failures []string
+}
+
+func newOutputSet(mode string) *outputSet {
+	return &outputSet{mode: mode, seen: make(map[string]bool)}
+}
+
+// claim returns the path to write a book bound for output to. Under
+// "rename" a taken path gets a numeric suffix, book_2.md, book_3.md, ...;
+// "skip" and "error" return errOutputConflict instead. A nil set claims
+// every path as is.
+func (s *outputSet) claim(output string, opts Options) (string, error) {
+	if s == nil || output == fb2md.StdoutPath {
+		return output, nil
+	}
+	if !s.seen[filepath.Clean(output)] {
+		s.seen[filepath.Clean(output)] = true
+		return output, nil
+	}
+	s.collisions++
+	switch s.mode {
+	case "skip", "error":
+		return "", fmt.Errorf("%s: %w", output, errOutputConflict)
+	case "rename":
+		dir, base := filepath.Split(output)
+		if opts.PageBundle() {
+			// Page bundles are named by their directory.
+			dir, base = filepath.Split(filepath.Clean(dir))
+		} else {
+			base = strings.TrimSuffix(base, opts.OutputExt())
+		}
+		for n := 2; ; n++ {
+			renamed := filepath.Join(dir, opts.OutputName(base+"_"+strconv.Itoa(n)))
+			if !s.seen[renamed] {
+				s.seen[renamed] = true
+				return renamed, nil
+			}
+		}
+	}
+	return output, nil
+}
+
+// current returns errUpToDate when the book read from source, last
+// modified at modified, need not be converted to output again: with
+// --resume when an interrupted run finished it, with --skip-existing when
+// output exists, with --newer-only when it is no older than the book.
+func (s *outputSet) current(source, output string, modified time.Time) error {
+	if s == nil || output == fb2md.StdoutPath {
+		return nil
+	}
+	if s.resumed[source] {
+		s.upToDate++
+		return fmt.Errorf("%s: %w", output, errUpToDate)
+	}
+	if !s.skipExisting && !s.newerOnly {
+		return nil
+	}
+	info, err := os.Stat(output)
+	if err != nil {
+		return nil
+	}
+	if !s.skipExisting && info.ModTime().Before(modified) {
+		return nil
+	}
+	s.upToDate++
+	return fmt.Errorf("%s: %w", output, errUpToDate)
+}
+
+// stops reports whether err, from one book of a batch, stops the whole
+// batch, as an output conflict does under --on-conflict error.
+func (s *outputSet) stops(err error) bool {
+	return s != nil && s.mode == "error" && errors.Is(err, errOutputConflict)
+}
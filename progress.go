@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// progressBarWidth is the number of cells in the progress bar.
+const progressBarWidth = 24
+
+// progress draws a progress bar for a batch conversion on the terminal in
+// place of the "source -> output" lines: the books done out of the total,
+// the failures, the time left and the book being converted. Messages
+// logged meanwhile are printed above the bar. A nil progress draws
+// nothing.
+//
+// mu guards the bar: messages are logged from the goroutines of books
+// abandoned by --timeout-per-file while the batch goes on.
+type progress struct {
+	mu      sync.Mutex
+	out     *os.File
+	width   int
+	total   int
+	done    int
+	failed  int
+	current string
+	started time.Time
+	shown   bool
+}
+
+// newProgress returns a progress bar for a batch conversion, or nil when
+// stdout or stderr is not a terminal, or with --no-progress, --quiet,
+// --diff or --log-format json, which print lines instead. The bar is drawn on stderr and takes
+// over the standard logger until finished.
+func newProgress(opts Options) *progress {
+	if opts.NoProgress || opts.Diff || verbosity < levelNormal || jsonLog != nil || !isTerminal(os.Stdout) || !isTerminal(os.Stderr) {
+		return nil
+	}
+	width, err := strconv.Atoi(os.Getenv("COLUMNS"))
+	if err != nil || width <= 0 {
+		width = 80
+	}
+	p := &progress{out: os.Stderr, width: width, started: time.Now()}
+	log.SetOutput(p)
+	return p
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// setTotal sets the number of books the batch converts; 0 means unknown,
+// as for a tar stream.
+func (p *progress) setTotal(total int) {
+	if p != nil {
+		p.mu.Lock()
+		p.total = total
+		p.mu.Unlock()
+	}
+}
+
+// begin shows the book read from source as the one being converted.
+func (p *progress) begin(source string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current = source
+	p.draw()
+}
+
+// finish counts the current book as done, and as failed if err is set
+// other than for a book skipped by --on-conflict, --skip-existing or
+// --newer-only.
+func (p *progress) finish(err error) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if err != nil && !errors.Is(err, errOutputConflict) && !errors.Is(err, errUpToDate) {
+		p.failed++
+	}
+	p.current = ""
+	p.draw()
+}
+
+// close removes the bar and gives the standard logger back its output.
+func (p *progress) close() {
+	if p == nil {
+		return
+	}
+	// The logger is given back first: it holds its own lock while
+	// writing to p.
+	log.SetOutput(os.Stderr)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+}
+
+// Write prints a logged message above the bar.
+func (p *progress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	n, err := p.out.Write(b)
+	p.draw()
+	return n, err
+}
+
+// clear and draw are called with p.mu held.
+func (p *progress) clear() {
+	if p.shown {
+		fmt.Fprint(p.out, "\r\033[K")
+		p.shown = false
+	}
+}
+
+func (p *progress) draw() {
+	var line strings.Builder
+	if p.total > 0 {
+		filled := min(p.done*progressBarWidth/p.total, progressBarWidth)
+		fmt.Fprintf(&line, "[%s%s] %d/%d", strings.Repeat("#", filled), strings.Repeat("-", progressBarWidth-filled), p.done, p.total)
+	} else {
+		fmt.Fprintf(&line, "%d done", p.done)
+	}
+	if p.failed > 0 {
+		fmt.Fprintf(&line, ", %d failed", p.failed)
+	}
+	if p.total > 0 && p.done > 0 && p.done < p.total {
+		left := time.Since(p.started) / time.Duration(p.done) * time.Duration(p.total-p.done)
+		fmt.Fprintf(&line, ", ETA %s", left.Round(time.Second))
+	}
+	if p.current != "" {
+		fmt.Fprintf(&line, "  %s", p.current)
+	}
+
+	text := line.String()
+	if utf8.RuneCountInString(text) >= p.width {
+		text = string([]rune(text)[:p.width-1])
+	}
+	fmt.Fprint(p.out, "\r\033[K"+text)
+	p.shown = true
+}
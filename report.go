@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"time"
+)
+
+// batchReport is what --report writes for the pipelines that run fb2md:
+// the outcome of a batch conversion, each book's with its duration, and
+// the totals.
+type batchReport struct {
+	Started time.Time `json:"started"`
+	Seconds float64   `json:"seconds"`
+	// Error is why the batch stopped early, as --on-conflict error does.
+	Error      string       `json:"error,omitempty"`
+	Counts     reportCounts `json:"counts"`
+	Collisions int          `json:"collisions"`
+	Files      []reportFile `json:"files"`
+}
+
+// reportCounts counts the books of a batch by manifest status.
+type reportCounts struct {
+	Total        int `json:"total"`
+	Converted    int `json:"converted"`
+	UpToDate     int `json:"up_to_date"`
+	Skipped      int `json:"skipped"`
+	DRMProtected int `json:"drm_protected"`
+	TooLarge     int `json:"too_large"`
+	TimedOut     int `json:"timed_out"`
+	Failed       int `json:"failed"`
+}
+
+type reportFile struct {
+	manifestEntry
+	Seconds float64 `json:"seconds"`
+}
+
+// writeReport writes the report of a batch started at started, recorded in
+// m, to path as JSON; batchErr is the error that stopped the batch, if any.
+func writeReport(path string, m *manifest, outputs *outputSet, started time.Time, batchErr error) error {
+	report := batchReport{
+		Started: started,
+		Seconds: roundSeconds(time.Since(started)),
+		Files:   []reportFile{},
+	}
+	if batchErr != nil {
+		report.Error = batchErr.Error()
+	}
+	if outputs != nil {
+		report.Collisions = outputs.collisions
+	}
+	for _, e := range m.entries {
+		report.Files = append(report.Files, reportFile{e, roundSeconds(e.duration)})
+		report.Counts.Total++
+		switch e.Status {
+		case "converted":
+			report.Counts.Converted++
+		case "up-to-date":
+			report.Counts.UpToDate++
+		case "skipped":
+			report.Counts.Skipped++
+		case "drm-protected":
+			report.Counts.DRMProtected++
+		case "too-large":
+			report.Counts.TooLarge++
+		case "timed-out":
+			report.Counts.TimedOut++
+		default:
+			report.Counts.Failed++
+		}
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
+
+// roundSeconds returns d in seconds to the millisecond.
+func roundSeconds(d time.Duration) float64 {
+	return math.Round(d.Seconds()*1000) / 1000
+}
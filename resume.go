@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/lexoprom/fb2md-cli/fb2md"
+)
+
+// resumeFile is the file in the output directory where a batch records
+// the books it has finished, so that --resume can go on from where an
+// interrupted run stopped. A batch that runs to the end removes it.
+const resumeFile = ".fb2md-resume"
+
+// resumeState appends the source of each finished book to the resume file,
+// one quoted source a line.
+type resumeState struct {
+	path string
+	f    *os.File
+	// failed is set once a write has failed, so that it is reported once.
+	failed bool
+}
+
+// openResume starts the resume file of a batch into outputDir. With resume
+// set it returns the sources an earlier run finished and adds to its file;
+// otherwise the file starts empty.
+func openResume(outputDir string, resume bool) (*resumeState, map[string]bool, error) {
+	path := filepath.Join(outputDir, resumeFile)
+	done := make(map[string]bool)
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if resume {
+		var err error
+		if done, err = readResume(path); err != nil {
+			return nil, nil, err
+		}
+		fb2md.LogInfo(logger, "resuming: %d book(s) finished before", len(done))
+	} else {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, nil, &fb2md.OutputError{Err: fmt.Errorf("failed to open resume file: %w", err)}
+	}
+	return &resumeState{path: path, f: f}, done, nil
+}
+
+// readResume returns the sources listed in the resume file at path, none
+// when there is no file. A line cut short by an interruption is left out.
+func readResume(path string) (map[string]bool, error) {
+	done := make(map[string]bool)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("warning: --resume: no %s in the output directory; starting from the beginning", resumeFile)
+		return done, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read resume file: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if source, err := strconv.Unquote(scanner.Text()); err == nil {
+			done[source] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read resume file: %w", err)
+	}
+	return done, nil
+}
+
+// finish records the book read from source as finished when it was
+// converted or left as up to date; a failed book is tried again on resume.
+// A nil resumeState records nothing.
+func (r *resumeState) finish(source string, err error) {
+	if r == nil || err != nil && !errors.Is(err, errUpToDate) {
+		return
+	}
+	if _, werr := fmt.Fprintln(r.f, strconv.Quote(source)); werr != nil && !r.failed {
+		r.failed = true
+		log.Printf("warning: failed to write resume file: %v", werr)
+	}
+}
+
+// close closes the resume file, and removes it when the batch ran to the
+// end and there is nothing left to resume.
+func (r *resumeState) close(complete bool) {
+	if r == nil {
+		return
+	}
+	r.f.Close()
+	if complete {
+		os.Remove(r.path)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lexoprom/fb2md-cli/fb2md"
+)
+
+// fileFormat returns the format of the open book f: what its content
+// shows, so that a misnamed book or one without an extension is still
+// read, or else what the extension of its name says, in any case.
+func fileFormat(f *os.File) string {
+	if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+		if format := fb2md.SniffFormat(f, info.Size()); format != "" {
+			return format
+		}
+	}
+	return fb2md.FormatFromExt(f.Name())
+}
+
+// pathFormat is fileFormat for the book at path.
+func pathFormat(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return fb2md.FormatFromExt(path)
+	}
+	defer f.Close()
+	return fileFormat(f)
+}
+
+// stdinPeek is how much of stdin stdinFormat looks at for an XML root.
+const stdinPeek = 4096
+
+// stdinFormat is fileFormat for the book read from r, a stream: it peeks at
+// the start, reading a zip archive whole since its entries tell the format
+// apart, and returns the reader to convert the book from in place of r.
+// A book whose content does not tell is read as FB2. limit, when set, is
+// --max-file-size: an archive over it is left for the conversion to refuse.
+func stdinFormat(r io.Reader, limit int64) (io.Reader, string) {
+	br := bufio.NewReaderSize(r, stdinPeek)
+	head, _ := br.Peek(stdinPeek)
+	if !bytes.HasPrefix(head, []byte("PK\x03\x04")) {
+		if format := fb2md.SniffFormat(bytes.NewReader(head), int64(len(head))); format != "" {
+			return br, format
+		}
+		return br, "fb2"
+	}
+	var data []byte
+	var err error
+	if limit > 0 {
+		data, err = io.ReadAll(io.LimitReader(br, limit+1))
+	} else {
+		data, err = io.ReadAll(br)
+	}
+	rest := io.MultiReader(bytes.NewReader(data), br)
+	if err != nil || limit > 0 && int64(len(data)) > limit {
+		return rest, "zip"
+	}
+	if format := fb2md.SniffFormat(bytes.NewReader(data), int64(len(data))); format != "" {
+		return rest, format
+	}
+	return rest, "zip"
+}
+
+// isBook reports whether the file at path is a book batch conversion
+// picks up: one with a supported extension, or one whose content shows
+// a readable format when the extension is not a book's.
+func isBook(path string) bool {
+	if supportedExts[strings.ToLower(filepath.Ext(path))] {
+		return true
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	return err == nil && info.Mode().IsRegular() && fb2md.Readable(fb2md.SniffFormat(f, info.Size()))
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/lexoprom/fb2md-cli/fb2md"
+)
+
+// statsTotals collects the statistics of the books converted with --stats:
+// the last book's, for the line printed after it, and the running totals
+// for the batch summary.
+type statsTotals struct {
+	last  fb2md.BookStats
+	total fb2md.BookStats
+	books int
+}
+
+// record adds the statistics of a converted book. A nil collector records
+// nothing.
+func (t *statsTotals) record(s fb2md.BookStats) {
+	if t == nil {
+		return
+	}
+	t.last = s
+	t.total.Add(s)
+	t.books++
+}
+
+// reportConverted prints the "source -> output" line for a converted book,
+// followed by its statistics with --stats, unless --quiet is set or a
+// progress bar shows the batch. Books
+// written to stdout, and all books under --diff, are reported on stderr.
+func reportConverted(source, output string, opts Options) {
+	if verbosity < levelNormal || opts.progress != nil {
+		return
+	}
+	w := os.Stdout
+	if output == fb2md.StdoutPath {
+		w, output = os.Stderr, "stdout"
+	} else if opts.Diff {
+		// Keep stdout for the diff itself.
+		w = os.Stderr
+	}
+	fmt.Fprintln(w, colorize(w, ansiGreen, source+" -> "+output))
+	if opts.stats != nil {
+		fmt.Fprintf(w, "  %s\n", opts.stats.last)
+	}
+}
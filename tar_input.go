@@ -0,0 +1,101 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/lexoprom/fb2md-cli/fb2md"
+)
+
+// isTarArchive reports whether input names a tar or gzip-compressed tar archive.
+func isTarArchive(input string) bool {
+	name := strings.ToLower(input)
+	return strings.HasSuffix(name, ".tar") || strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// convertTarArchive converts every supported book in a tar archive as its
+// entry is read, so the archive is never held in memory or unpacked.
+func convertTarArchive(inputFile, outputDir string, opts Options) (int, error) {
+	f, err := os.Open(inputFile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	name := strings.ToLower(inputFile)
+	if strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return 0, fmt.Errorf("failed to open gzip stream: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var count int
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, fmt.Errorf("failed to read tar archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if !supportedExts[strings.ToLower(path.Ext(hdr.Name))] {
+			fb2md.LogInfo(logger, "skipped %s:%s: not a supported book format", inputFile, hdr.Name)
+			continue
+		}
+
+		entry := strings.TrimPrefix(path.Clean(hdr.Name), "./")
+		if excluded(entry, opts.Exclude) {
+			fb2md.LogInfo(logger, "skipped %s:%s: matches --exclude", inputFile, entry)
+			continue
+		}
+		safeName := strings.ReplaceAll(trimBookExt(entry), "/", "_")
+		outPath := filepath.Join(outputDir, opts.OutputName(safeName))
+		source := inputFile + ":" + entry
+		started := beginBook(source, opts)
+
+		format := fb2md.FormatFromExt(entry)
+		r, outPath, err := nameFromTemplate(tr, format, outPath, opts)
+		if err == nil {
+			outPath, err = opts.outputs.claim(outPath, opts)
+		}
+		if err == nil {
+			err = opts.outputs.current(source, outPath, hdr.ModTime)
+		}
+		if err == nil {
+			err = fb2md.CheckSize(hdr.Size, opts.Options)
+		}
+		if err == nil {
+			r, err = detach(r, opts)
+		}
+		if err == nil {
+			err = fb2md.Convert(r, format, outPath, opts.book())
+		}
+		err = flagError(err)
+		finishBook(source, outPath, started, err, opts)
+		if opts.outputs.stops(err) {
+			return count, fmt.Errorf("%s: %w", source, err)
+		}
+		if err != nil {
+			reportFailed(source, err, opts)
+			continue
+		}
+		reportConverted(source, outPath, opts)
+		count++
+	}
+
+	return count, nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/lexoprom/fb2md-cli/fb2md"
+)
+
+// tocItem is an entry of the outline "fb2md toc" prints: a titled section
+// or heading, and the entries below it.
+type tocItem struct {
+	Title string `json:"title"`
+	// Level is 1 for top-level entries, 2 for the entries under them, ...
+	Level int `json:"level"`
+	// Words counts the words of the entry, those below it included.
+	Words    int        `json:"words"`
+	Children []*tocItem `json:"children,omitempty"`
+}
+
+// bookTOC is the outline of one book.
+type bookTOC struct {
+	File  string     `json:"file"`
+	Title string     `json:"title,omitempty"`
+	Words int        `json:"words"`
+	TOC   []*tocItem `json:"toc"`
+}
+
+// runTOC runs "fb2md toc [--json] book...", printing the outline of each
+// book, and returns the exit status.
+func runTOC(args []string) int {
+	flags := flag.NewFlagSet("toc", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the outlines as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: fb2md toc [--json] book.fb2 [book.epub ...]
+
+Prints the sections and chapters of books as an indented outline, with the
+words in each, without converting them.
+
+Flags:
+`)
+		flags.PrintDefaults()
+	}
+	files := parseArgs(flags, args, nil)
+	if len(files) == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	var tocs []*bookTOC
+	var failed int
+	var lastErr error
+	for _, file := range files {
+		book, err := readBook(file, Options{})
+		if err != nil {
+			log.Printf("warning: %s: %v", file, err)
+			failed++
+			lastErr = err
+			continue
+		}
+		toc := &bookTOC{File: file, Words: fb2md.CollectStats(book).Words, TOC: outline(book.Body)}
+		if book.Meta != nil {
+			toc.Title = book.Meta.Title
+		}
+		tocs = append(tocs, toc)
+		if !*asJSON {
+			printTOC(toc)
+		}
+	}
+	if *asJSON {
+		if tocs == nil {
+			tocs = []*bookTOC{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		enc.Encode(tocs)
+	}
+	switch {
+	case len(files) == 1 && failed == 1:
+		return exitStatus(lastErr)
+	case failed > 0 && failed == len(files):
+		return exitAllFailed
+	case failed > 0:
+		return exitSomeFailed
+	}
+	return 0
+}
+
+func printTOC(toc *bookTOC) {
+	title := toc.Title
+	if title == "" {
+		title = toc.File
+	}
+	fmt.Printf("%s (%d words)\n", title, toc.Words)
+	var print func(items []*tocItem)
+	print = func(items []*tocItem) {
+		for _, item := range items {
+			fmt.Printf("%s%s (%d words)\n", strings.Repeat("  ", item.Level), item.Title, item.Words)
+			print(item.Children)
+		}
+	}
+	print(toc.TOC)
+}
+
+// outline returns the titled sections and headings of blocks as a tree.
+// Sections nest by structure, FB2 style, and headings by their level, as
+// in EPUB chapters.
+func outline(blocks []fb2md.Block) []*tocItem {
+	var o outliner
+	o.walk(blocks, 0)
+	for _, item := range o.items {
+		settle(item, 1)
+	}
+	return o.items
+}
+
+// outliner builds an outline from the blocks it walks, counting the words
+// of each entry until the next one.
+type outliner struct {
+	items []*tocItem
+	// open are the entries the text walked belongs to, innermost last.
+	open []*tocItem
+}
+
+// begin adds an entry at level, closing the open entries at that level or
+// deeper.
+func (o *outliner) begin(title string, level int) *tocItem {
+	for len(o.open) > 0 && o.open[len(o.open)-1].Level >= level {
+		o.open = o.open[:len(o.open)-1]
+	}
+	item := &tocItem{Title: title, Level: level}
+	if len(o.open) == 0 {
+		o.items = append(o.items, item)
+	} else {
+		parent := o.open[len(o.open)-1]
+		parent.Children = append(parent.Children, item)
+	}
+	o.open = append(o.open, item)
+	o.count(title)
+	return item
+}
+
+// end closes item and the entries opened after it.
+func (o *outliner) end(item *tocItem) {
+	for i := len(o.open) - 1; i >= 0; i-- {
+		if o.open[i] == item {
+			o.open = o.open[:i]
+			return
+		}
+	}
+}
+
+func (o *outliner) count(text string) {
+	if len(o.open) > 0 {
+		o.open[len(o.open)-1].Words += len(strings.Fields(text))
+	}
+}
+
+// walk adds the entries of blocks, nested depth levels deep.
+func (o *outliner) walk(blocks []fb2md.Block, depth int) {
+	for _, b := range blocks {
+		switch v := b.(type) {
+		case *fb2md.Section:
+			if v.Title == "" {
+				o.walkSection(v, depth)
+				continue
+			}
+			item := o.begin(v.Title, depth+1)
+			o.walkSection(v, depth+1)
+			o.end(item)
+		case *fb2md.Heading:
+			o.begin(v.Text, depth+v.Level)
+		case *fb2md.Chapter:
+			o.walk(v.Blocks, depth)
+		default:
+			fb2md.WalkBlocks([]fb2md.Block{b}, func(node any) {
+				switch n := node.(type) {
+				case *fb2md.Text:
+					o.count(n.Value)
+				case *fb2md.CodeBlock:
+					o.count(n.Text)
+				}
+			})
+		}
+	}
+}
+
+func (o *outliner) walkSection(s *fb2md.Section, depth int) {
+	for _, epigraph := range s.Epigraphs {
+		o.walk([]fb2md.Block{epigraph}, depth)
+	}
+	o.walk(s.Annotation, depth)
+	o.walk(s.Blocks, depth)
+}
+
+// settle renumbers the levels of item and the entries below it from level,
+// so that the outline starts at 1 whatever heading the book starts at, and
+// adds the words of those entries to item's own.
+func settle(item *tocItem, level int) int {
+	item.Level = level
+	for _, child := range item.Children {
+		item.Words += settle(child, level+1)
+	}
+	return item.Words
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/lexoprom/fb2md-cli/fb2md"
+)
+
+// Exit codes of fb2md validate, by the worst problem found.
+const (
+	validOK       = 0
+	validWarnings = 1
+	validErrors   = 2
+	validFailed   = 3
+)
+
+// validationStatus returns the exit status report r calls for.
+func validationStatus(r *fb2md.ValidationReport) int {
+	switch {
+	case r.Count("error") > 0:
+		return validErrors
+	case r.Count("warning") > 0:
+		return validWarnings
+	}
+	return validOK
+}
+
+// runValidate runs "fb2md validate [--json] book.fb2...", printing a report
+// for each book, and returns the exit status: 0 when every book is valid, 1
+// when the worst problems are warnings, 2 for errors and 3 when a file
+// cannot be read.
+func runValidate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the reports as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: fb2md validate [--json] book.fb2 [book.fb2.zip ...]
+
+Checks FB2 files for missing description fields, misplaced body content,
+broken internal links and undecodable binaries. Exits with 0 when the books
+are valid, 1 for warnings, 2 for errors and 3 when a file cannot be read.
+
+Flags:
+`)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return validFailed
+	}
+
+	code := validOK
+	var reports []*fb2md.ValidationReport
+	for _, file := range flags.Args() {
+		report, err := fb2md.ValidateFile(file)
+		if err != nil {
+			report = &fb2md.ValidationReport{File: file, Issues: []fb2md.ValidationIssue{{Severity: "error", Message: err.Error()}}}
+			code = max(code, validFailed)
+		} else {
+			code = max(code, validationStatus(report))
+		}
+		reports = append(reports, report)
+		if !*asJSON {
+			printValidationReport(report)
+		}
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		enc.Encode(reports)
+	}
+	return code
+}
+
+func printValidationReport(r *fb2md.ValidationReport) {
+	if len(r.Issues) == 0 {
+		fmt.Printf("%s: valid\n", r.File)
+		return
+	}
+	fmt.Printf("%s: %d error(s), %d warning(s)\n", r.File, r.Count("error"), r.Count("warning"))
+	for _, issue := range r.Issues {
+		if issue.Where != "" {
+			fmt.Printf("  %-8s %s: %s\n", issue.Severity, issue.Where, issue.Message)
+		} else {
+			fmt.Printf("  %-8s %s\n", issue.Severity, issue.Message)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/lexoprom/fb2md-cli/fb2md"
+)
+
+// trimBookExt strips the book extension from a path, treating compound
+// extensions such as .fb2.zip as a single extension.
+func trimBookExt(p string) string {
+	ext := filepath.Ext(p)
+	p = strings.TrimSuffix(p, ext)
+	if strings.EqualFold(ext, ".zip") && strings.EqualFold(filepath.Ext(p), ".fb2") {
+		p = strings.TrimSuffix(p, filepath.Ext(p))
+	}
+	return p
+}
+
+// zipBookEntries lists the archive entries that batch conversion picks up.
+func zipBookEntries(reader *zip.Reader) []*zip.File {
+	var entries []*zip.File
+	for _, f := range reader.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if supportedExts[strings.ToLower(path.Ext(f.Name))] {
+			entries = append(entries, f)
+		}
+	}
+	// Books are converted in name order, as directories are, so that the
+	// result does not depend on how the archive was packed.
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// isZipLibrary reports whether a zip archive is a collection of books rather
+// than a single zipped FB2.
+func isZipLibrary(inputFile string) (bool, error) {
+	reader, err := zip.OpenReader(inputFile)
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+
+	entries := zipBookEntries(&reader.Reader)
+	if len(entries) == 1 && strings.EqualFold(path.Ext(entries[0].Name), ".fb2") {
+		return false, nil
+	}
+	return len(entries) > 0, nil
+}
+
+// convertZipArchive converts every supported book inside a zip archive,
+// reading entries in memory without extracting the archive to disk.
+func convertZipArchive(inputFile, outputDir string, opts Options) (int, error) {
+	reader, err := zip.OpenReader(inputFile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open zip archive: %w", err)
+	}
+	defer reader.Close()
+
+	var count int
+	for _, f := range zipBookEntries(&reader.Reader) {
+		if excluded(f.Name, opts.Exclude) {
+			fb2md.LogInfo(logger, "skipped %s:%s: matches --exclude", inputFile, f.Name)
+			continue
+		}
+		safeName := strings.ReplaceAll(trimBookExt(f.Name), "/", "_")
+		outPath := filepath.Join(outputDir, opts.OutputName(safeName))
+		source := inputFile + ":" + f.Name
+		started := beginBook(source, opts)
+
+		rc, err := f.Open()
+		if err != nil {
+			finishBook(source, outPath, started, err, opts)
+			reportFailed(source, err, opts)
+			continue
+		}
+		format := fb2md.FormatFromExt(f.Name)
+		r, outPath, err := nameFromTemplate(rc, format, outPath, opts)
+		if err == nil {
+			outPath, err = opts.outputs.claim(outPath, opts)
+		}
+		if err == nil {
+			err = opts.outputs.current(source, outPath, f.Modified)
+		}
+		if err == nil {
+			err = fb2md.CheckSize(int64(f.UncompressedSize64), opts.Options)
+		}
+		if err == nil {
+			r, err = detach(r, opts)
+		}
+		if err == nil {
+			err = fb2md.Convert(r, format, outPath, opts.book())
+		}
+		err = flagError(err)
+		rc.Close()
+		finishBook(source, outPath, started, err, opts)
+		if opts.outputs.stops(err) {
+			return count, fmt.Errorf("%s: %w", source, err)
+		}
+		if err != nil {
+			reportFailed(source, err, opts)
+			continue
+		}
+		reportConverted(source, outPath, opts)
+		count++
+	}
+
+	return count, nil
+}